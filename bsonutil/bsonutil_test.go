@@ -84,3 +84,70 @@ func TestFindDeepValue(t *testing.T) {
 		})
 	})
 }
+
+func TestShape(t *testing.T) {
+	Convey("Normalize the shape of a filter", t, func() {
+		filter := bson.D{
+			{"a", 1},
+			{"b", bson.D{{"$gt", 5}, {"$lt", "z"}}},
+			{"$or", []interface{}{bson.D{{"c", true}}, bson.M{"d": bson.M{"$in": []interface{}{1, 2}}}}},
+		}
+		So(Shape(filter), ShouldEqual, "{ a: ?, b: { $gt: ?, $lt: ? }, $or: [ { c: ? }, { d: { $in: ? } } ] }")
+		So(Shape(bson.D{}), ShouldEqual, "{}")
+		So(Shape([]bson.D{{{"$match", bson.D{{"status", "A"}}}}}), ShouldEqual, "[ { $match: { status: ? } } ]")
+	})
+}
+
+func TestRewriteDeepValue(t *testing.T) {
+	doc := bson.D{
+		{"name", "ann"},
+		{"ssn", "123-45-6789"},
+		{"address", bson.D{{"street", "1 Main St"}, {"zip", "10001"}}},
+		{"cards", []interface{}{
+			bson.M{"number": "4111", "type": "visa"},
+			bson.D{{"number", "5500"}},
+			"none",
+		}},
+	}
+	stars := func(v interface{}) (interface{}, bool) {
+		return "***", true
+	}
+	remove := func(v interface{}) (interface{}, bool) {
+		return nil, false
+	}
+
+	Convey("Rewrite a value in a document", t, func() {
+		Convey("at the top level", func() {
+			out := RewriteDeepValue("ssn", doc, stars).(bson.D)
+			So(FindValueByKey("ssn", out), ShouldEqual, "***")
+			So(FindValueByKey("ssn", doc), ShouldEqual, "123-45-6789")
+		})
+
+		Convey("in an embedded document", func() {
+			out := RewriteDeepValue("address.zip", doc, remove).(bson.D)
+			So(FindValueByKey("address", out), ShouldResemble, bson.D{{"street", "1 Main St"}})
+			So(len(out), ShouldEqual, len(doc))
+		})
+
+		Convey("in every document of an array", func() {
+			out := RewriteDeepValue("cards.number", doc, stars).(bson.D)
+			So(FindValueByKey("cards", out), ShouldResemble, []interface{}{
+				bson.M{"number": "***", "type": "visa"},
+				bson.D{{"number", "***"}},
+				"none",
+			})
+		})
+
+		Convey("in one element of an array", func() {
+			out := RewriteDeepValue("cards.1.number", doc, remove).(bson.D)
+			cards := FindValueByKey("cards", out).([]interface{})
+			So(cards[0], ShouldResemble, bson.M{"number": "4111", "type": "visa"})
+			So(cards[1], ShouldResemble, bson.D{})
+		})
+
+		Convey("that doesn't exist", func() {
+			So(RewriteDeepValue("phone.number", doc, stars), ShouldResemble, doc)
+			So(RewriteDeepValue("name.first", doc, stars), ShouldResemble, doc)
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package bsonutil
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+)
+
+// A RewriteFunc returns the value that replaces a field's value, and false if the
+// field should be removed instead.
+type RewriteFunc func(value interface{}) (interface{}, bool)
+
+// RewriteDeepValue rewrites the value of a dot-notation-separated keyName in a
+// document with f. Arrays along the path are descended into, so "a.b" rewrites b
+// in every document of an array a, and a numeric key rewrites one element of an
+// array, which is set to nil if f removes it. Documents can be bson.D or bson.M,
+// and the path is left alone where it doesn't exist. The document isn't changed: a
+// copy is returned, which shares the parts of the document that aren't on the path.
+func RewriteDeepValue(keyName string, doc interface{}, f RewriteFunc) interface{} {
+	return rewrite(strings.Split(keyName, "."), doc, f)
+}
+
+func rewrite(keyChain []string, v interface{}, f RewriteFunc) interface{} {
+	key := keyChain[0]
+	switch doc := v.(type) {
+	case bson.D:
+		out := make(bson.D, 0, len(doc))
+		for i := 0; i < len(doc); i++ {
+			if doc[i].Name != key {
+				out = append(out, doc[i])
+				continue
+			}
+			value, ok := rewriteField(keyChain, doc[i].Value, f)
+			if ok {
+				out = append(out, bson.DocElem{Name: key, Value: value})
+			}
+		}
+		return out
+	case bson.M:
+		return bson.M(rewriteMap(keyChain, doc, f))
+	case map[string]interface{}:
+		return rewriteMap(keyChain, doc, f)
+	case []interface{}:
+		index, err := strconv.Atoi(key)
+		out := make([]interface{}, len(doc))
+		copy(out, doc)
+		if err == nil {
+			if index >= 0 && index < len(out) {
+				value, ok := rewriteField(keyChain, out[index], f)
+				if !ok {
+					value = nil
+				}
+				out[index] = value
+			}
+			return out
+		}
+		for i := 0; i < len(out); i++ {
+			out[i] = rewrite(keyChain, out[i], f)
+		}
+		return out
+	}
+	return v
+}
+
+func rewriteMap(keyChain []string, doc map[string]interface{}, f RewriteFunc) map[string]interface{} {
+	key := keyChain[0]
+	value, found := doc[key]
+	if !found {
+		return doc
+	}
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	value, ok := rewriteField(keyChain, value, f)
+	if ok {
+		out[key] = value
+	} else {
+		delete(out, key)
+	}
+	return out
+}
+
+// rewriteField rewrites the value of the first key in keyChain: with f if it is the
+// last key, and by rewriting the rest of the path in the value otherwise.
+func rewriteField(keyChain []string, value interface{}, f RewriteFunc) (interface{}, bool) {
+	if len(keyChain) == 1 {
+		return f(value)
+	}
+	return rewrite(keyChain[1:], value, f), true
+}
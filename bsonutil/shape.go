@@ -0,0 +1,95 @@
+package bsonutil
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+)
+
+/*
+Shape returns the normalized shape of a value, such as a filter. Documents keep their
+keys, arrays of documents keep their documents, and every other value is replaced by
+"?", such as:
+
+	{ a: ?, b: { $gt: ? }, $or: [ { c: ? }, { d: { $in: ? } } ] }
+
+The keys of a bson.M are sorted, so that the shape doesn't depend on the order of
+a map.
+*/
+func Shape(v interface{}) string {
+	var buf bytes.Buffer
+	writeShape(&buf, v)
+	return buf.String()
+}
+
+func writeShape(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case bson.D:
+		if len(value) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteString("{ ")
+		for i := 0; i < len(value); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(value[i].Name)
+			buf.WriteString(": ")
+			writeShape(buf, value[i].Value)
+		}
+		buf.WriteString(" }")
+	case bson.M:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		doc := make(bson.D, len(keys))
+		for i := 0; i < len(keys); i++ {
+			doc[i] = bson.DocElem{keys[i], value[keys[i]]}
+		}
+		writeShape(buf, doc)
+	case map[string]interface{}:
+		writeShape(buf, bson.M(value))
+	case []bson.D:
+		docs := make([]interface{}, len(value))
+		for i := 0; i < len(value); i++ {
+			docs[i] = value[i]
+		}
+		writeShape(buf, docs)
+	case []bson.M:
+		docs := make([]interface{}, len(value))
+		for i := 0; i < len(value); i++ {
+			docs[i] = value[i]
+		}
+		writeShape(buf, docs)
+	case []interface{}:
+		if len(value) == 0 || !allDocuments(value) {
+			buf.WriteString("?")
+			return
+		}
+		buf.WriteString("[ ")
+		for i := 0; i < len(value); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeShape(buf, value[i])
+		}
+		buf.WriteString(" ]")
+	default:
+		buf.WriteString("?")
+	}
+}
+
+// allDocuments returns true if every value in the array is a document.
+func allDocuments(values []interface{}) bool {
+	for i := 0; i < len(values); i++ {
+		switch values[i].(type) {
+		case bson.D, bson.M, map[string]interface{}:
+		default:
+			return false
+		}
+	}
+	return true
+}
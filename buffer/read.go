@@ -55,8 +55,8 @@ func ReadDocument(reader io.Reader) (docSize int32, document bson.D, err error)
 func ReadInt32LE(reader io.Reader) (int32, error) {
 	// Read the first 4 bytes from the connection
 	buffer := make([]byte, 4)
-	n, err := reader.Read(buffer)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return 0, fmt.Errorf("error reading from connection: %v", err)
 	}
 	if n != 4 {
@@ -69,8 +69,8 @@ func ReadInt32LE(reader io.Reader) (int32, error) {
 func ReadInt64LE(reader io.Reader) (int64, error) {
 	// Read the first 4 bytes from the connection
 	buffer := make([]byte, 8)
-	n, err := reader.Read(buffer)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return 0, fmt.Errorf("error reading from connection: %v", err)
 	}
 	if n != 8 {
@@ -0,0 +1,152 @@
+// Package connection contains the configuration and health checks shared by modules
+// that connect to MongoDB servers.
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// the timeout used when a connection doesn't specify one.
+const defaultTimeout = time.Second * 10
+
+/*
+ParseDialInfo creates the dial information for mgo from a connection configuration,
+which has the following structure:
+
+	{
+		addresses: []string,
+		direct: boolean,
+		timeout: integer,
+		auth: {
+			username: string,
+			password: string,
+			database: string
+		},
+		tls: {
+			caFile: string,
+			certFile: string,
+			keyFile: string,
+			serverName: string,
+			insecureSkipVerify: boolean
+		}
+	}
+*/
+func ParseDialInfo(conf bson.M) (mgo.DialInfo, error) {
+	if conf == nil {
+		return mgo.DialInfo{}, fmt.Errorf("No connection data")
+	}
+
+	addrs, err := convert.ConvertToStringSlice(conf["addresses"])
+	if err != nil {
+		return mgo.DialInfo{}, fmt.Errorf("Invalid addresses: %v", err)
+	}
+
+	timeout := time.Duration(convert.ToInt64(conf["timeout"], -1))
+	if timeout == -1 {
+		timeout = defaultTimeout
+	}
+
+	dialInfo := mgo.DialInfo{
+		Addrs:   addrs,
+		Direct:  convert.ToBool(conf["direct"]),
+		Timeout: timeout,
+	}
+
+	auth := convert.ToBSONMap(conf["auth"])
+	if auth != nil {
+		username, ok := auth["username"].(string)
+		if ok {
+			dialInfo.Username = username
+		}
+		password, ok := auth["password"].(string)
+		if ok {
+			dialInfo.Password = password
+		}
+		database, ok := auth["database"].(string)
+		if ok {
+			dialInfo.Database = database
+		}
+	}
+
+	tlsConf := convert.ToBSONMap(conf["tls"])
+	if tlsConf != nil {
+		config, err := ParseTLSConfig(tlsConf)
+		if err != nil {
+			return mgo.DialInfo{}, err
+		}
+		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: timeout}
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), config)
+		}
+	}
+
+	return dialInfo, nil
+}
+
+// ParseTLSConfig creates the TLS configuration for connecting to a server from the
+// tls field of a connection configuration. Without a CA file, the server's
+// certificate is verified with the system's certificate authorities.
+func ParseTLSConfig(conf bson.M) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         convert.ToString(conf["serverName"]),
+		InsecureSkipVerify: convert.ToBool(conf["insecureSkipVerify"]),
+	}
+
+	caFile := convert.ToString(conf["caFile"])
+	if len(caFile) > 0 {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %v", caFile)
+		}
+	}
+
+	certFile := convert.ToString(conf["certFile"])
+	keyFile := convert.ToString(conf["keyFile"])
+	if len(certFile) > 0 {
+		if len(keyFile) == 0 {
+			// the key can be in the same file as the certificate
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if len(keyFile) > 0 {
+		return nil, fmt.Errorf("A key file was given without a certificate file")
+	}
+
+	return config, nil
+}
+
+// Health pings the servers of a session, and reports them as down if they can't be
+// reached. A nil session, which hasn't connected yet, is also down.
+func Health(session *mgo.Session, dialInfo mgo.DialInfo) server.Health {
+	details := bson.M{"addresses": dialInfo.Addrs}
+	if session == nil {
+		details["error"] = "not connected"
+		return server.Health{Status: server.HealthDown, Details: details}
+	}
+
+	s := session.Copy()
+	defer s.Close()
+	err := s.Ping()
+	if err != nil {
+		details["error"] = err.Error()
+		return server.Health{Status: server.HealthDown, Details: details}
+	}
+	return server.Health{Status: server.HealthOK, Details: details}
+}
@@ -0,0 +1,83 @@
+package connection
+
+import (
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestParseDialInfo(t *testing.T) {
+	SetLogLevel(DEBUG)
+
+	Convey("Parse a connection configuration", t, func() {
+		Convey("with only addresses", func() {
+			dialInfo, err := ParseDialInfo(bson.M{
+				"addresses": []interface{}{"localhost:27017", "localhost:27018"},
+			})
+			So(err, ShouldBeNil)
+			So(dialInfo.Addrs, ShouldResemble, []string{"localhost:27017", "localhost:27018"})
+			So(dialInfo.Direct, ShouldBeFalse)
+			So(dialInfo.Timeout, ShouldEqual, time.Second*10)
+			So(dialInfo.DialServer, ShouldBeNil)
+		})
+		Convey("with all fields", func() {
+			dialInfo, err := ParseDialInfo(bson.M{
+				"addresses": []string{"localhost"},
+				"direct":    true,
+				"timeout":   int64(time.Second),
+				"auth": bson.M{
+					"username": "user",
+					"password": "pass",
+					"database": "admin",
+				},
+				"tls": bson.M{
+					"serverName":         "mongodb.example.com",
+					"insecureSkipVerify": true,
+				},
+			})
+			So(err, ShouldBeNil)
+			So(dialInfo.Direct, ShouldBeTrue)
+			So(dialInfo.Timeout, ShouldEqual, time.Second)
+			So(dialInfo.Username, ShouldEqual, "user")
+			So(dialInfo.Password, ShouldEqual, "pass")
+			So(dialInfo.Database, ShouldEqual, "admin")
+			So(dialInfo.DialServer, ShouldNotBeNil)
+		})
+		Convey("without connection data", func() {
+			_, err := ParseDialInfo(nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("with invalid addresses", func() {
+			_, err := ParseDialInfo(bson.M{"addresses": "localhost"})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("with a missing CA file", func() {
+			_, err := ParseDialInfo(bson.M{
+				"addresses": []string{"localhost"},
+				"tls":       bson.M{"caFile": "/nonexistent/ca.pem"},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestParseTLSConfig(t *testing.T) {
+	SetLogLevel(DEBUG)
+
+	Convey("Parse a TLS configuration", t, func() {
+		Convey("with a server name", func() {
+			config, err := ParseTLSConfig(bson.M{"serverName": "mongodb.example.com"})
+			So(err, ShouldBeNil)
+			So(config.ServerName, ShouldEqual, "mongodb.example.com")
+			So(config.InsecureSkipVerify, ShouldBeFalse)
+			So(config.RootCAs, ShouldBeNil)
+			So(len(config.Certificates), ShouldEqual, 0)
+		})
+		Convey("with a key file but no certificate file", func() {
+			_, err := ParseTLSConfig(bson.M{"keyFile": "client.key"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
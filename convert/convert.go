@@ -314,3 +314,31 @@ func ConvertToStringSlice(input interface{}) ([]string, error) {
 
 	return nil, fmt.Errorf("Unsupported input for a string slice: %#v", input)
 }
+
+// ConvertToInt64Slice converts an []interface{} of integers to an []int64 slice.
+func ConvertToInt64Slice(input interface{}) ([]int64, error) {
+	inputInt64s, ok := input.([]int64)
+	if ok {
+		return inputInt64s, nil
+	}
+
+	inputInterface, ok := input.([]interface{})
+	if ok {
+		d := make([]int64, len(inputInterface))
+		for i := 0; i < len(inputInterface); i++ {
+			switch n := inputInterface[i].(type) {
+			case int64:
+				d[i] = n
+			case int32:
+				d[i] = int64(n)
+			case int:
+				d[i] = int64(n)
+			default:
+				return nil, fmt.Errorf("Slice contents aren't integers")
+			}
+		}
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported input for an int64 slice: %#v", input)
+}
@@ -0,0 +1,125 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A RotatingFile is a log file that is rotated once it reaches its maximum size. The
+// file is renamed with the suffix ".1", older files are renamed with the next
+// suffix up, and the oldest file is removed once there are too many.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile opens the log file at the path, appending to it if it exists. The
+// file is rotated when a write would make it larger than maxSize bytes, and
+// maxBackups rotated files are kept. At least one backup has to be kept, so that
+// rotating doesn't throw the lines of the file away.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("The maximum size of a log file must be positive")
+	}
+	if maxBackups < 1 {
+		return nil, fmt.Errorf("The number of log file backups must be at least 1")
+	}
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	err := f.open(os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the log file with the flag, which either appends to or truncates it.
+func (f *RotatingFile) open(flag int) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Error opening log file: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes to the log file, rotating it first if the write would make it too
+// large. A write that is larger than the maximum size is written to an empty file.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("The log file is closed")
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file and its backups, and opens a new log file. If a file
+// can't be renamed, the log file is opened again to append to, so that later writes
+// can still be written and try to rotate it again.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(backupPath(f.path, i), backupPath(f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return f.reopen(err)
+		}
+	}
+	err := os.Rename(f.path, backupPath(f.path, 1))
+	if err != nil && !os.IsNotExist(err) {
+		return f.reopen(err)
+	}
+	return f.open(os.O_TRUNC)
+}
+
+// reopen opens the log file again after it couldn't be rotated, and returns the
+// error of the rotation.
+func (f *RotatingFile) reopen(rotateErr error) error {
+	err := f.open(os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("Error rotating log file: %v, and then %v", rotateErr, err)
+	}
+	return fmt.Errorf("Error rotating log file: %v", rotateErr)
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%v.%v", path, i)
+}
+
+// Close closes the log file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
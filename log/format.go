@@ -0,0 +1,118 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An entry is a single log line.
+type entry struct {
+	time    time.Time
+	level   int
+	module  string
+	message string
+	fields  Fields
+}
+
+// the terminal colors of the levels, indexed by level.
+var levelColors = []int{35, 31, 33, 32, 37, 36}
+
+// formatText formats an entry as a line of text, with the fields as key=value pairs
+// after the message. Colored lines are meant for a terminal, and lines without color
+// start with the time instead.
+func formatText(e entry, color bool) []byte {
+	var buf bytes.Buffer
+	if color {
+		fmt.Fprintf(&buf, "\033[%dm %.4s ▶ \033[0m %v", levelColors[e.level], levelNames[e.level],
+			e.message)
+	} else {
+		fmt.Fprintf(&buf, "%v %.4s ▶ %v", e.time.Format(time.RFC3339Nano), levelNames[e.level],
+			e.message)
+	}
+
+	if e.module != CoreModule {
+		buf.WriteString(" module=")
+		buf.WriteString(textValue(e.module))
+	}
+	keys := sortedKeys(e.fields)
+	for i := 0; i < len(keys); i++ {
+		buf.WriteByte(' ')
+		buf.WriteString(keys[i])
+		buf.WriteByte('=')
+		buf.WriteString(textValue(fieldValue(e.fields[keys[i]])))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// textValue formats a field's value for a text line, quoting it if it has spaces.
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if len(s) == 0 || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatJSON formats an entry as a JSON object on a single line, with the time, level,
+// module and message followed by the fields.
+func formatJSON(e entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, e.time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, levelNames[e.level])
+	buf.WriteString(`,"module":`)
+	writeJSON(&buf, e.module)
+	buf.WriteString(`,"message":`)
+	writeJSON(&buf, e.message)
+
+	keys := sortedKeys(e.fields)
+	for i := 0; i < len(keys); i++ {
+		switch keys[i] {
+		case "time", "level", "module", "message":
+			// fields can't replace the standard keys
+			continue
+		}
+		buf.WriteByte(',')
+		writeJSON(&buf, keys[i])
+		buf.WriteByte(':')
+		writeJSON(&buf, fieldValue(e.fields[keys[i]]))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// writeJSON writes a value as JSON, or as a JSON string if it can't be marshaled.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// fieldValue converts errors and other values that describe themselves to strings.
+func fieldValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return v
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
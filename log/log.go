@@ -2,8 +2,13 @@
 package log
 
 import (
-	"github.com/op/go-logging"
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,62 +20,201 @@ const (
 	DEBUG        = 5
 )
 
-// set up the global logger
-var log = logging.MustGetLogger("global")
+// the names of the levels, indexed by level.
+var levelNames = []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
 
-var format = logging.MustStringFormatter(
-	"%{color} %{level:.4s} ▶ %{color:reset} %{message}",
+// CoreModule is the module name of log lines from the proxy itself, rather than
+// from one of its modules.
+const CoreModule = "core"
+
+// the formats that log lines can be written in.
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// the logging configuration, which is guarded by mu.
+var (
+	mu           sync.RWMutex
+	defaultLevel = NOTICE
+	moduleLevels = make(map[string]int)
+	logFormat    = TextFormat
+	output       = io.Writer(os.Stderr)
 )
 
-var backend = logging.NewLogBackend(os.Stderr, "", 0)
-var backendFormatted = logging.NewBackendFormatter(backend, format)
-var backendLeveled = logging.AddModuleLevel(backendFormatted)
+// guards writes to the output, so that lines aren't interleaved.
+var writeMu sync.Mutex
+
+// Fields are structured data that are added to a log line, such as the ID of the
+// client connection that a request came from.
+type Fields map[string]interface{}
+
+// A Logger writes log lines for a module, with fields that are added to every line.
+// The zero Logger writes log lines for the core.
+type Logger struct {
+	module string
+	fields Fields
+}
+
+// NewLogger creates a logger for the module, whose log level can be set with
+// SetModuleLogLevel.
+func NewLogger(module string) Logger {
+	return Logger{module: module}
+}
+
+// Module returns the name of the module that the logger writes log lines for.
+func (l Logger) Module() string {
+	if len(l.module) == 0 {
+		return CoreModule
+	}
+	return l.module
+}
+
+// ForModule returns a copy of the logger that writes log lines for another module,
+// with the same fields.
+func (l Logger) ForModule(module string) Logger {
+	return Logger{module: module, fields: l.fields}
+}
+
+// With returns a copy of the logger that adds the fields to every line, along with
+// the fields that the logger already had.
+func (l Logger) With(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return Logger{module: l.module, fields: merged}
+}
+
+// Enabled returns true if lines with the level are written for the logger's module.
+func (l Logger) Enabled(level int) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	moduleLevel, ok := moduleLevels[l.Module()]
+	if !ok {
+		moduleLevel = defaultLevel
+	}
+	return level <= moduleLevel
+}
+
+// Log logs a formatted message with the specified integer verbosity level, along with
+// the logger's fields.
+func (l Logger) Log(level int, format string, args ...interface{}) {
+	if level < CRITICAL || level > DEBUG {
+		level = ERROR
+	}
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(entry{
+		time:    time.Now(),
+		level:   level,
+		module:  l.Module(),
+		message: fmt.Sprintf(format, args...),
+		fields:  l.fields,
+	})
+}
+
+// write formats an entry and writes it to the output.
+func (l Logger) write(e entry) {
+	mu.RLock()
+	f := logFormat
+	w := output
+	mu.RUnlock()
 
-func init() {
-	logging.SetBackend(backendLeveled)
-	SetLogLevel(NOTICE)
+	var line []byte
+	if f == JSONFormat {
+		line = formatJSON(e)
+	} else {
+		line = formatText(e, w == os.Stderr)
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	w.Write(line)
 }
 
 // Log logs a formatted message with the specified integer verbosity level.
 // The lower the level, the more critical the message.
 func Log(level int, format string, args ...interface{}) {
-	switch level {
-	case CRITICAL:
-		log.Critical(format, args...)
-	case ERROR:
-		log.Error(format, args...)
-	case WARNING:
-		log.Warning(format, args...)
-	case NOTICE:
-		log.Notice(format, args...)
-	case INFO:
-		log.Info(format, args...)
-	case DEBUG:
-		log.Debug(format, args...)
-	default:
-		log.Error(format, args...)
-	}
+	Logger{}.Log(level, format, args...)
+}
+
+// the key for the Logger stored in a context.
+type loggerKey struct{}
+
+// WithLogger returns a copy of the context that holds the logger. The proxy stores a
+// logger with the IDs of the connection and request in the context of each request.
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the logger in the context, or a logger for the core
+// without fields if the context doesn't have one.
+func LoggerFromContext(ctx context.Context) Logger {
+	l, _ := ctx.Value(loggerKey{}).(Logger)
+	return l
+}
+
+// LogContext logs a formatted message with the logger in the context, so that it has
+// the fields of the request that the context belongs to.
+func LogContext(ctx context.Context, level int, format string, args ...interface{}) {
+	LoggerFromContext(ctx).Log(level, format, args...)
 }
 
 // SetLogLevel sets the verbosity level of the logger, with 0 being least verbose,
-// and 5 being the most verbose. By default, the verbosity level is 1, which
-// logs critical and error messages.
+// and 5 being the most verbose. By default, the verbosity level is 3, which
+// logs critical, error, warning and notice messages. Modules with their own level
+// aren't affected.
 func SetLogLevel(level int) {
-	switch level {
-	case CRITICAL:
-		backendLeveled.SetLevel(logging.CRITICAL, "global")
-	case ERROR:
-		backendLeveled.SetLevel(logging.ERROR, "global")
-	case WARNING:
-		backendLeveled.SetLevel(logging.WARNING, "global")
-	case NOTICE:
-		backendLeveled.SetLevel(logging.NOTICE, "global")
-	case INFO:
-		backendLeveled.SetLevel(logging.INFO, "global")
-	case DEBUG:
-		backendLeveled.SetLevel(logging.DEBUG, "global")
-	default:
-		backendLeveled.SetLevel(logging.ERROR, "global")
+	if level < CRITICAL || level > DEBUG {
+		level = ERROR
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLevel = level
+}
+
+// SetModuleLogLevel sets the verbosity level of a module's log lines, such as "mongod",
+// or "core" for the proxy itself.
+func SetModuleLogLevel(module string, level int) {
+	if level < CRITICAL || level > DEBUG {
+		level = ERROR
 	}
+	mu.Lock()
+	defer mu.Unlock()
+	moduleLevels[module] = level
+}
+
+// ParseLogLevel parses a verbosity level from its name, such as "warning", or
+// its number.
+func ParseLogLevel(s string) (int, error) {
+	for i := 0; i < len(levelNames); i++ {
+		if strings.EqualFold(s, levelNames[i]) || s == fmt.Sprint(i) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level: %v", s)
+}
+
+// SetLogFormat sets the format of log lines, which is either "text" or "json".
+func SetLogFormat(f string) error {
+	if f != TextFormat && f != JSONFormat {
+		return fmt.Errorf("Unknown log format: %v", f)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	logFormat = f
+	return nil
+}
 
+// SetLogOutput sets where log lines are written to, which is stderr by default. Text
+// lines are only colored when they are written to stderr.
+func SetLogOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
 }
@@ -0,0 +1,193 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureLogs writes log lines to a buffer in the format until the test is done.
+func captureLogs(f string) *bytes.Buffer {
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	SetLogFormat(f)
+	SetLogLevel(NOTICE)
+	Reset(func() {
+		SetLogOutput(os.Stderr)
+		SetLogFormat(TextFormat)
+		mu.Lock()
+		moduleLevels = make(map[string]int)
+		mu.Unlock()
+	})
+	return &buf
+}
+
+func TestLogFormats(t *testing.T) {
+	Convey("Write log lines", t, func() {
+		Convey("as JSON", func() {
+			buf := captureLogs(JSONFormat)
+			NewLogger("mongod").With(Fields{"connectionId": 3, "requestId": int32(12)}).
+				Log(WARNING, "Error running command %v", "find")
+			bi := NewLogger("bi").With(Fields{"error": fmt.Errorf("no backend"), "message": "ignored"})
+			bi.Log(ERROR, "Error updating database")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			So(len(lines), ShouldEqual, 2)
+
+			line := map[string]interface{}{}
+			So(json.Unmarshal([]byte(lines[0]), &line), ShouldBeNil)
+			So(line["level"], ShouldEqual, "WARNING")
+			So(line["module"], ShouldEqual, "mongod")
+			So(line["message"], ShouldEqual, "Error running command find")
+			So(line["connectionId"], ShouldEqual, 3)
+			So(line["requestId"], ShouldEqual, 12)
+			So(line["time"], ShouldNotBeEmpty)
+
+			line = map[string]interface{}{}
+			So(json.Unmarshal([]byte(lines[1]), &line), ShouldBeNil)
+			So(line["error"], ShouldEqual, "no backend")
+			So(line["message"], ShouldEqual, "Error updating database")
+		})
+
+		Convey("as text", func() {
+			buf := captureLogs(TextFormat)
+			NewLogger("mongod").With(Fields{"connectionId": 3, "namespace": "test.foo bar"}).
+				Log(NOTICE, "Request")
+			Log(NOTICE, "Server running")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			So(len(lines), ShouldEqual, 2)
+			So(lines[0], ShouldEndWith, ` NOTI ▶ Request module=mongod connectionId=3 namespace="test.foo bar"`)
+			So(lines[1], ShouldEndWith, ` NOTI ▶ Server running`)
+		})
+	})
+}
+
+func TestLogLevels(t *testing.T) {
+	Convey("Filter log lines by level", t, func() {
+		buf := captureLogs(TextFormat)
+
+		Convey("with the default level", func() {
+			Log(INFO, "hidden")
+			Log(NOTICE, "shown")
+			So(buf.String(), ShouldNotContainSubstring, "hidden")
+			So(buf.String(), ShouldContainSubstring, "shown")
+		})
+
+		Convey("with a level for a module", func() {
+			SetModuleLogLevel("mongod", DEBUG)
+			SetModuleLogLevel(CoreModule, ERROR)
+
+			NewLogger("mongod").Log(DEBUG, "mongod debug")
+			NewLogger("bi").Log(DEBUG, "bi debug")
+			Log(WARNING, "core warning")
+			So(buf.String(), ShouldContainSubstring, "mongod debug")
+			So(buf.String(), ShouldNotContainSubstring, "bi debug")
+			So(buf.String(), ShouldNotContainSubstring, "core warning")
+		})
+
+		Convey("by name", func() {
+			level, err := ParseLogLevel("warning")
+			So(err, ShouldBeNil)
+			So(level, ShouldEqual, WARNING)
+			level, err = ParseLogLevel("5")
+			So(err, ShouldBeNil)
+			So(level, ShouldEqual, DEBUG)
+			_, err = ParseLogLevel("verbose")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestLogContext(t *testing.T) {
+	Convey("Log with the logger of a context", t, func() {
+		buf := captureLogs(JSONFormat)
+
+		ctx := WithLogger(context.Background(), NewLogger(CoreModule).With(Fields{"connectionId": 7}))
+		LogContext(ctx, NOTICE, "first")
+		LogContext(context.Background(), NOTICE, "second")
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		So(lines[0], ShouldContainSubstring, `"connectionId":7`)
+		So(lines[1], ShouldNotContainSubstring, "connectionId")
+		So(lines[1], ShouldContainSubstring, `"module":"core"`)
+	})
+}
+
+func TestRotatingFile(t *testing.T) {
+	Convey("Write to a rotating log file", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-log")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		path := filepath.Join(dir, "proxy.log")
+
+		f, err := NewRotatingFile(path, 10, 2)
+		So(err, ShouldBeNil)
+		for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+			_, err = f.Write([]byte(line))
+			So(err, ShouldBeNil)
+		}
+		So(f.Close(), ShouldBeNil)
+
+		contents := func(path string) string {
+			b, _ := ioutil.ReadFile(path)
+			return string(b)
+		}
+		So(contents(path), ShouldEqual, "fourth\n")
+		So(contents(path+".1"), ShouldEqual, "third\n")
+		So(contents(path+".2"), ShouldEqual, "second\n")
+		_, err = os.Stat(path + ".3")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		Convey("and append to it when it is opened again", func() {
+			f, err := NewRotatingFile(path, 100, 2)
+			So(err, ShouldBeNil)
+			f.Write([]byte("fifth\n"))
+			f.Close()
+			So(contents(path), ShouldEqual, "fourth\nfifth\n")
+		})
+	})
+
+	Convey("Keep writing to a log file that can't be rotated", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-log")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		path := filepath.Join(dir, "proxy.log")
+
+		// the backup can't be replaced by the log file
+		So(os.MkdirAll(filepath.Join(path+".1", "taken"), 0755), ShouldBeNil)
+
+		f, err := NewRotatingFile(path, 10, 1)
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte("first\n"))
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte("second\n"))
+		So(err, ShouldNotBeNil)
+
+		So(os.RemoveAll(path+".1"), ShouldBeNil)
+		_, err = f.Write([]byte("third\n"))
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		b, _ := ioutil.ReadFile(path)
+		So(string(b), ShouldEqual, "third\n")
+		b, _ = ioutil.ReadFile(path + ".1")
+		So(string(b), ShouldEqual, "first\n")
+	})
+
+	Convey("Don't rotate a log file without backups", t, func() {
+		_, err := NewRotatingFile(filepath.Join(os.TempDir(), "proxy.log"), 10, 0)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,93 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the size and number of rotated log files, if the configuration doesn't set them.
+const (
+	defaultLogFileMaxSizeMB  = 100
+	defaultLogFileMaxBackups = 5
+)
+
+/*
+ConfigureLogging sets up logging from the logging field of a configuration, which has
+the following structure:
+
+	{
+		level: integer or string,
+		format: "text" or "json",
+		file: {
+			path: string,
+			maxSizeMB: integer,
+			maxBackups: integer
+		},
+		modules: {
+			<module name>: integer or string
+		}
+	}
+
+Levels are either numbers from 0 (critical) to 5 (debug), or their names. The modules
+field sets the level of each module's log lines, with "core" for the proxy itself.
+Log lines are written to stderr unless a file is given, which is rotated once it
+reaches its maximum size.
+*/
+func ConfigureLogging(conf bson.M) error {
+	levelRaw, ok := conf["level"]
+	if ok {
+		level, err := parseLevel(levelRaw)
+		if err != nil {
+			return err
+		}
+		SetLogLevel(level)
+	}
+
+	modules := convert.ToBSONMap(conf["modules"])
+	for module, levelRaw := range modules {
+		level, err := parseLevel(levelRaw)
+		if err != nil {
+			return fmt.Errorf("Invalid level for module %v: %v", module, err)
+		}
+		SetModuleLogLevel(module, level)
+	}
+
+	format := convert.ToString(conf["format"])
+	if len(format) > 0 {
+		err := SetLogFormat(format)
+		if err != nil {
+			return err
+		}
+	}
+
+	file := convert.ToBSONMap(conf["file"])
+	if file != nil {
+		path := convert.ToString(file["path"])
+		if len(path) == 0 {
+			return fmt.Errorf("The log file doesn't have a path")
+		}
+		maxSize := convert.ToInt64(file["maxSizeMB"], defaultLogFileMaxSizeMB) * 1024 * 1024
+		maxBackups := convert.ToInt(file["maxBackups"], defaultLogFileMaxBackups)
+		f, err := NewRotatingFile(path, maxSize, maxBackups)
+		if err != nil {
+			return err
+		}
+		SetLogOutput(f)
+	}
+	return nil
+}
+
+// parseLevel parses a log level that is either a number or a name.
+func parseLevel(in interface{}) (int, error) {
+	name, ok := in.(string)
+	if ok {
+		return ParseLogLevel(name)
+	}
+	level := convert.ToInt(in, -1)
+	if level < CRITICAL || level > DEBUG {
+		return 0, fmt.Errorf("Invalid log level: %v", in)
+	}
+	return level, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/modules/audit"
+	"os"
+)
+
+var (
+	logFilename string
+	format      string
+	keyFilename string
+	lastHash    string
+)
+
+func parseFlags() {
+	flag.StringVar(&logFilename, "f", "", "audit log to verify.")
+	flag.StringVar(&format, "format", audit.JSONLinesFormat,
+		"format of the audit log: json or bson.")
+	flag.StringVar(&keyFilename, "keyFile", "",
+		"file with the key that the audit log was written with, if any.")
+	flag.StringVar(&lastHash, "lastHash", "",
+		"hash of a record that the audit log must still have, such as the last hash of an earlier verification.")
+	flag.Parse()
+}
+
+func main() {
+
+	parseFlags()
+	if len(logFilename) == 0 {
+		fmt.Fprintln(os.Stderr, "An audit log is required: -f <path>")
+		os.Exit(2)
+	}
+
+	var key []byte
+	if len(keyFilename) > 0 {
+		var err error
+		key, err = audit.ReadKeyFile(keyFilename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	count, lastHash, err := audit.VerifyFileThrough(logFilename, format, key, lastHash)
+	if err != nil {
+		fmt.Printf("%v: FAILED after %v valid records: %v\n", logFilename, count, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v: OK, %v records, last hash %v\n", logFilename, count, lastHash)
+}
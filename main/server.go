@@ -3,8 +3,13 @@ package main
 import (
 	"flag"
 	"github.com/mongodbinc-interns/mongoproxy"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"gopkg.in/mgo.v2/bson"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -13,6 +18,15 @@ var (
 	mongoURI        string
 	configNamespace string
 	configFilename  string
+
+	configPollInterval time.Duration
+
+	tlsCertFile           string
+	tlsKeyFile            string
+	tlsCAFile             string
+	tlsMinVersion         string
+	tlsCipherSuites       string
+	tlsClientCertificates string
 )
 
 func parseFlags() {
@@ -24,26 +38,86 @@ func parseFlags() {
 		"Namespace to query for configuration.")
 	flag.StringVar(&configFilename, "f", "",
 		"JSON config filename. If set, will be used instead of mongoDB configuration.")
+	flag.DurationVar(&configPollInterval, "configPollInterval", 5*time.Second,
+		"How often to check the configuration for changes to the modules, which are reloaded. 0 disables reloading.")
+	flag.StringVar(&tlsCertFile, "tlsCertFile", "",
+		"PEM file with the certificate for TLS connections. If set, only TLS connections are accepted.")
+	flag.StringVar(&tlsKeyFile, "tlsKeyFile", "",
+		"PEM file with the private key for TLS connections, if it isn't in the certificate file.")
+	flag.StringVar(&tlsCAFile, "tlsCAFile", "",
+		"PEM file with the certificate authorities used to verify client certificates.")
+	flag.StringVar(&tlsMinVersion, "tlsMinVersion", "",
+		"Minimum TLS version (1.0, 1.1, 1.2 or 1.3). Defaults to 1.2.")
+	flag.StringVar(&tlsCipherSuites, "tlsCipherSuites", "",
+		"Comma-separated list of allowed TLS cipher suites.")
+	flag.StringVar(&tlsClientCertificates, "tlsClientCertificates", "",
+		"Whether clients must present a certificate: none, optional or required.")
 	flag.Parse()
 }
 
+// applyTLSFlags overrides the tls field of the configuration with the TLS
+// options that were set on the command line.
+func applyTLSFlags(config bson.M) {
+	tlsConfig := convert.ToBSONMap(config["tls"])
+	if tlsConfig == nil {
+		tlsConfig = bson.M{}
+	}
+
+	flags := map[string]string{
+		"certFile":           tlsCertFile,
+		"keyFile":            tlsKeyFile,
+		"caFile":             tlsCAFile,
+		"minVersion":         tlsMinVersion,
+		"clientCertificates": tlsClientCertificates,
+	}
+	for option, value := range flags {
+		if len(value) > 0 {
+			tlsConfig[option] = value
+		}
+	}
+	if len(tlsCipherSuites) > 0 {
+		tlsConfig["cipherSuites"] = strings.Split(tlsCipherSuites, ",")
+	}
+
+	if len(tlsConfig) > 0 {
+		config["tls"] = tlsConfig
+	}
+}
+
 func main() {
 
 	parseFlags()
 	SetLogLevel(logLevel)
 
 	// grab config file
-	var result bson.M
-	var err error
+	var load mongoproxy.ConfigLoader
 	if len(configFilename) == 0 {
-		result, err = mongoproxy.ParseConfigFromDB(mongoURI, configNamespace)
+		load = mongoproxy.DBConfigLoader(mongoURI, configNamespace)
 	} else {
-		result, err = mongoproxy.ParseConfigFromFile(configFilename)
+		load = mongoproxy.FileConfigLoader(configFilename)
 	}
 
+	result, err := load()
 	if err != nil {
 		Log(WARNING, "%v", err)
 	}
+	if result == nil {
+		result = bson.M{}
+	}
+	applyTLSFlags(result)
+
+	s, err := mongoproxy.NewServerWithConfig(port, result)
+	if err != nil {
+		Log(ERROR, "%v", err)
+		return
+	}
+	if configPollInterval > 0 {
+		s.WatchConfig(load, configPollInterval, result)
+	}
+	s.ShutdownOnSignal(os.Interrupt, syscall.SIGTERM)
 
-	mongoproxy.StartWithConfig(port, result)
+	err = s.ListenAndServe()
+	if err != mongoproxy.ErrServerClosed {
+		Log(ERROR, "%v", err)
+	}
 }
@@ -0,0 +1,224 @@
+package messages
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mongodbinc-interns/mongoproxy/buffer"
+	"io"
+	"io/ioutil"
+)
+
+// constants representing the names of the supported compressors.
+const (
+	NoopCompressor   string = "noop"
+	SnappyCompressor        = "snappy"
+	ZlibCompressor          = "zlib"
+	ZstdCompressor          = "zstd"
+)
+
+// the compressor IDs used in OP_COMPRESSED messages.
+var compressorIDs = map[string]uint8{
+	NoopCompressor:   0,
+	SnappyCompressor: 1,
+	ZlibCompressor:   2,
+	ZstdCompressor:   3,
+}
+
+// SupportedCompressors is the list of compressors that can be negotiated
+// with clients, in the order of preference.
+var SupportedCompressors = []string{SnappyCompressor, ZstdCompressor, ZlibCompressor}
+
+// maxMessageSize is the largest uncompressed message that will be accepted,
+// matching the maxMessageSizeBytes reported by mongod.
+const maxMessageSize = 48000000
+
+// zstd encoders and decoders are safe for concurrent use, so we only need one of each.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxMessageSize))
+
+// IsSupportedCompressor returns true if the named compressor can be used to
+// compress and decompress messages.
+func IsSupportedCompressor(name string) bool {
+	_, ok := compressorIDs[name]
+	return ok
+}
+
+func compressorName(id uint8) (string, error) {
+	for name, i := range compressorIDs {
+		if i == id {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compressor ID: %v", id)
+}
+
+// NegotiateCompressors takes the compressors requested by a client in the handshake and
+// the compressors the proxy is willing to use, and returns the compressors that both
+// support, in the client's order of preference.
+func NegotiateCompressors(requested []string, allowed []string) []string {
+	negotiated := make([]string, 0)
+	for i := 0; i < len(requested); i++ {
+		for j := 0; j < len(allowed); j++ {
+			if requested[i] == allowed[j] && IsSupportedCompressor(requested[i]) {
+				negotiated = append(negotiated, requested[i])
+				break
+			}
+		}
+	}
+	return negotiated
+}
+
+func compress(compressor string, data []byte) ([]byte, error) {
+	switch compressor {
+	case NoopCompressor:
+		return data, nil
+	case SnappyCompressor:
+		return snappy.Encode(nil, data), nil
+	case ZlibCompressor:
+		buf := bytes.NewBuffer([]byte{})
+		w := zlib.NewWriter(buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ZstdCompressor:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported compressor: %v", compressor)
+	}
+}
+
+func decompress(compressor string, data []byte, uncompressedSize int32) ([]byte, error) {
+	switch compressor {
+	case NoopCompressor:
+		return data, nil
+	case SnappyCompressor:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n != int(uncompressedSize) {
+			return nil, fmt.Errorf("uncompressed size mismatch: %v instead of %v", n,
+				uncompressedSize)
+		}
+		return snappy.Decode(nil, data)
+	case ZlibCompressor:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		// read one more byte than expected so that we can tell if the message is too long
+		return ioutil.ReadAll(io.LimitReader(r, int64(uncompressedSize)+1))
+	case ZstdCompressor:
+		return zstdDecoder.DecodeAll(data, make([]byte, 0, uncompressedSize))
+	default:
+		return nil, fmt.Errorf("unsupported compressor: %v", compressor)
+	}
+}
+
+// OpCode 2012. The compressed message is decompressed and returned as a header and a reader
+// for the rest of the original message, along with the name of the compressor used.
+func processOpCompressed(reader io.Reader, header MsgHeader) (MsgHeader, io.Reader, string, error) {
+	// originalOpcode
+	opCode, err := buffer.ReadInt32LE(reader)
+	if err != nil {
+		return MsgHeader{}, nil, "", fmt.Errorf("error reading original opcode: %v", err)
+	}
+
+	// uncompressedSize
+	uncompressedSize, err := buffer.ReadInt32LE(reader)
+	if err != nil {
+		return MsgHeader{}, nil, "", fmt.Errorf("error reading uncompressed size: %v", err)
+	}
+	if uncompressedSize < 0 || uncompressedSize > maxMessageSize-16 {
+		return MsgHeader{}, nil, "", fmt.Errorf("invalid uncompressed size: %v", uncompressedSize)
+	}
+
+	// compressorId
+	id := make([]byte, 1)
+	_, err = io.ReadFull(reader, id)
+	if err != nil {
+		return MsgHeader{}, nil, "", fmt.Errorf("error reading compressor ID: %v", err)
+	}
+	compressor, err := compressorName(id[0])
+	if err != nil {
+		return MsgHeader{}, nil, "", err
+	}
+
+	compressedSize := header.MessageLength -
+		16 - // bytes representing the header
+		4 - // bytes representing the original opcode
+		4 - // bytes representing the uncompressed size
+		1 // the compressor ID
+	if compressedSize < 0 {
+		return MsgHeader{}, nil, "", fmt.Errorf("Message length not long enough for OP_COMPRESSED")
+	}
+	if compressedSize > maxMessageSize {
+		return MsgHeader{}, nil, "", fmt.Errorf("invalid compressed size: %v", compressedSize)
+	}
+	compressed := make([]byte, compressedSize)
+	_, err = io.ReadFull(reader, compressed)
+	if err != nil {
+		return MsgHeader{}, nil, "", fmt.Errorf("error reading compressed message: %v", err)
+	}
+
+	uncompressed, err := decompress(compressor, compressed, uncompressedSize)
+	if err != nil {
+		return MsgHeader{}, nil, "", fmt.Errorf("error decompressing message with %v: %v",
+			compressor, err)
+	}
+	if int32(len(uncompressed)) != uncompressedSize {
+		return MsgHeader{}, nil, "", fmt.Errorf("uncompressed size mismatch: %v instead of %v",
+			len(uncompressed), uncompressedSize)
+	}
+
+	originalHeader := MsgHeader{
+		MessageLength: 16 + uncompressedSize,
+		RequestID:     header.RequestID,
+		ResponseTo:    header.ResponseTo,
+		OpCode:        opCode,
+	}
+	return originalHeader, bytes.NewReader(uncompressed), compressor, nil
+}
+
+// Compress wraps an encoded wire protocol message in an OP_COMPRESSED message, using
+// the named compressor.
+// https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+func Compress(message []byte, compressor string) ([]byte, error) {
+	if len(message) < 16 {
+		return nil, fmt.Errorf("Message length not long enough for header")
+	}
+	id, ok := compressorIDs[compressor]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compressor: %v", compressor)
+	}
+
+	compressed, err := compress(compressor, message[16:])
+	if err != nil {
+		return nil, fmt.Errorf("error compressing message with %v: %v", compressor, err)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	err = buffer.WriteToBuf(buf,
+		message[0:12], // messageLength (overwritten below), requestID, and responseTo
+		int32(OP_COMPRESSED),
+		message[12:16], // the original opcode
+		int32(len(message)-16),
+		id,
+		compressed)
+	if err != nil {
+		return nil, fmt.Errorf("error writing compressed message: %v", err)
+	}
+
+	return setMessageSize(buf.Bytes()), nil
+}
@@ -8,10 +8,14 @@ import (
 	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
 	"io"
 	"strings"
 )
 
+// the table for the CRC-32C checksums of OP_MSG messages.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 func splitCommandOpQuery(q bson.D) (string, bson.M) {
 	commandName := q[0].Name
 
@@ -27,6 +31,72 @@ func splitCommandOpQuery(q bson.D) (string, bson.M) {
 	return commandName, args
 }
 
+// the names of the legacy OP_QUERY query modifiers, and the find command arguments
+// that they correspond to.
+var queryModifiers = map[string]string{
+	"$orderby":        "sort",
+	"orderby":         "sort",
+	"$hint":           "hint",
+	"$max":            "max",
+	"$min":            "min",
+	"$maxTimeMS":      "maxTimeMS",
+	"$comment":        "comment",
+	"$readPreference": "$readPreference",
+	"$explain":        "explain",
+	"$snapshot":       "snapshot",
+	"$showDiskLoc":    "showRecordId",
+	"$returnKey":      "returnKey",
+}
+
+// unwrapQuery takes the query document of an OP_QUERY message and, if it wraps the
+// actual query in a $query (or query) field, returns the wrapped query along with
+// the query modifiers converted to find command arguments. Other queries are returned
+// unchanged.
+func unwrapQuery(q bson.D) (bson.D, bson.M) {
+	args := bson.M{}
+	if !isWrappedQuery(q) {
+		return q, args
+	}
+
+	var query bson.D
+	for i := 0; i < len(q); i++ {
+		switch q[i].Name {
+		case "$query", "query":
+			query = convert.ToBSONDoc(q[i].Value)
+		default:
+			arg, ok := queryModifiers[q[i].Name]
+			if ok {
+				args[arg] = q[i].Value
+			} else {
+				Log(WARNING, "Unsupported query modifier: %v", q[i].Name)
+			}
+		}
+	}
+
+	return query, args
+}
+
+// isWrappedQuery returns true if a query document wraps the actual query. A $query
+// field always wraps it, but query is also the name of an ordinary field, so it only
+// wraps the query if it comes first, is a document, and every other field is a query
+// modifier.
+func isWrappedQuery(q bson.D) bool {
+	for i := 0; i < len(q); i++ {
+		if q[i].Name == "$query" {
+			return true
+		}
+	}
+	if len(q) == 0 || q[0].Name != "query" || convert.ToBSONDoc(q[0].Value) == nil {
+		return false
+	}
+	for i := 1; i < len(q); i++ {
+		if _, ok := queryModifiers[q[i].Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // ParseNamespace splits a namespace string into the database and collection.
 // The first return value is the database, the second, the collection. An error
 // is returned if either the database or the collection doesn't exist.
@@ -80,7 +150,23 @@ func createFind(header MsgHeader, database string, args bson.M) (Find, error) {
 		OplogReplay:     convert.ToBool(args["oplogReplay"]),
 		NoCursorTimeout: convert.ToBool(args["noCursorTimeout"]),
 		AwaitData:       convert.ToBool(args["awaitData"]),
-		Partial:         convert.ToBool(args["partial"]),
+		Partial:         convert.ToBool(args["allowPartialResults"]),
+		Sort:            convert.ToBSONDoc(args["sort"]),
+		Hint:            args["hint"],
+		Max:             convert.ToBSONDoc(args["max"]),
+		Min:             convert.ToBSONDoc(args["min"]),
+		MaxTimeMS:       convert.ToInt64(args["maxTimeMS"]),
+		Comment:         convert.ToString(args["comment"]),
+		ReadPreference:  convert.ToBSONDoc(args["$readPreference"]),
+		Explain:         convert.ToBool(args["explain"]),
+		Snapshot:        convert.ToBool(args["snapshot"]),
+		ShowRecordId:    convert.ToBool(args["showRecordId"]),
+		ReturnKey:       convert.ToBool(args["returnKey"]),
+		BatchSize:       convert.ToInt32(args["batchSize"], -1),
+		SingleBatch:     convert.ToBool(args["singleBatch"]),
+		ReadConcern:     convert.ToBSONDoc(args["readConcern"]),
+		Collation:       convert.ToBSONDoc(args["collation"]),
+		Exhaust:         convert.ToBool(args["exhaust"]),
 	}
 
 	return f, nil
@@ -219,23 +305,277 @@ func createGetMore(header MsgHeader, database string, args bson.M) (GetMore, err
 
 }
 
+func createKillCursors(header MsgHeader, database string, args bson.M) (KillCursors, error) {
+	c := args["killCursors"]
+	collection, ok := c.(string)
+	if !ok {
+		// we have issues
+		return KillCursors{}, fmt.Errorf("KillCursors command has no collection.")
+	}
+
+	cursorIDs, err := convert.ConvertToInt64Slice(args["cursors"])
+	if err != nil {
+		return KillCursors{}, fmt.Errorf("KillCursors command has no cursors.")
+	}
+
+	k := KillCursors{
+		RequestID:  header.RequestID,
+		Database:   database,
+		Collection: collection,
+		CursorIDs:  cursorIDs,
+	}
+	return k, nil
+}
+
+func createAggregate(header MsgHeader, database string, args bson.M) (Aggregate, error) {
+	c := args["aggregate"]
+	collection, ok := c.(string)
+	if !ok && convert.ToInt(c) != 1 {
+		// aggregations that aren't on a collection have to use 1
+		return Aggregate{}, fmt.Errorf("Aggregate command has no collection.")
+	}
+
+	pipeline, err := convert.ConvertToBSONDocSlice(args["pipeline"])
+	if err != nil {
+		return Aggregate{}, fmt.Errorf("Aggregate command has no pipeline.")
+	}
+
+	a := Aggregate{
+		RequestID:    header.RequestID,
+		Database:     database,
+		Collection:   collection,
+		Pipeline:     pipeline,
+		BatchSize:    -1,
+		AllowDiskUse: convert.ToBool(args["allowDiskUse"]),
+		MaxTimeMS:    convert.ToInt64(args["maxTimeMS"]),
+		Collation:    convert.ToBSONDoc(args["collation"]),
+		Hint:         args["hint"],
+	}
+
+	cursor := convert.ToBSONMap(args["cursor"])
+	batchSize, ok := cursor["batchSize"]
+	if ok {
+		a.BatchSize = convert.ToInt32(batchSize)
+	}
+
+	return a, nil
+}
+
+func createFindAndModify(header MsgHeader, database string, args bson.M) (FindAndModify, error) {
+	c, ok := args["findAndModify"]
+	if !ok {
+		// the legacy lowercase spelling of the command
+		c = args["findandmodify"]
+	}
+	collection, ok := c.(string)
+	if !ok {
+		// we have issues
+		return FindAndModify{}, fmt.Errorf("FindAndModify command has no collection.")
+	}
+
+	f := FindAndModify{
+		RequestID:  header.RequestID,
+		Database:   database,
+		Collection: collection,
+		Query:      convert.ToBSONDoc(args["query"]),
+		Sort:       convert.ToBSONDoc(args["sort"]),
+		Remove:     convert.ToBool(args["remove"]),
+		New:        convert.ToBool(args["new"]),
+		Fields:     convert.ToBSONDoc(args["fields"]),
+		Upsert:     convert.ToBool(args["upsert"]),
+		Collation:  convert.ToBSONDoc(args["collation"]),
+		MaxTimeMS:  convert.ToInt64(args["maxTimeMS"]),
+	}
+
+	update, hasUpdate := args["update"]
+	if f.Remove == hasUpdate {
+		return FindAndModify{}, fmt.Errorf("FindAndModify command must have exactly one of remove and update.")
+	}
+	if hasUpdate {
+		// updates with an aggregation pipeline are arrays
+		pipeline, err := convert.ConvertToBSONDocSlice(update)
+		if err == nil {
+			f.Update = pipeline
+		} else {
+			f.Update = convert.ToBSONDoc(update)
+		}
+	}
+
+	arrayFilters, err := convert.ConvertToBSONDocSlice(args["arrayFilters"])
+	if err == nil {
+		f.ArrayFilters = arrayFilters
+	}
+
+	writeConcern := convert.ToBSONMap(args["writeConcern"])
+	if writeConcern != nil {
+		f.WriteConcern = &writeConcern
+	}
+
+	return f, nil
+}
+
+func createCount(header MsgHeader, database string, args bson.M) (Count, error) {
+	c := args["count"]
+	collection, ok := c.(string)
+	if !ok {
+		// we have issues
+		return Count{}, fmt.Errorf("Count command has no collection.")
+	}
+
+	count := Count{
+		RequestID:  header.RequestID,
+		Database:   database,
+		Collection: collection,
+		Query:      convert.ToBSONDoc(args["query"]),
+		Limit:      convert.ToInt64(args["limit"]),
+		Skip:       convert.ToInt64(args["skip"]),
+		Hint:       args["hint"],
+		MaxTimeMS:  convert.ToInt64(args["maxTimeMS"]),
+		Collation:  convert.ToBSONDoc(args["collation"]),
+	}
+	return count, nil
+}
+
+func createDistinct(header MsgHeader, database string, args bson.M) (Distinct, error) {
+	c := args["distinct"]
+	collection, ok := c.(string)
+	if !ok {
+		// we have issues
+		return Distinct{}, fmt.Errorf("Distinct command has no collection.")
+	}
+
+	key, ok := args["key"].(string)
+	if !ok {
+		return Distinct{}, fmt.Errorf("Distinct command has no key.")
+	}
+
+	d := Distinct{
+		RequestID:  header.RequestID,
+		Database:   database,
+		Collection: collection,
+		Key:        key,
+		Query:      convert.ToBSONDoc(args["query"]),
+		MaxTimeMS:  convert.ToInt64(args["maxTimeMS"]),
+		Collation:  convert.ToBSONDoc(args["collation"]),
+	}
+	return d, nil
+}
+
+func createListCollections(header MsgHeader, database string, args bson.M) (ListCollections, error) {
+	l := ListCollections{
+		RequestID:             header.RequestID,
+		Database:              database,
+		Filter:                convert.ToBSONDoc(args["filter"]),
+		NameOnly:              convert.ToBool(args["nameOnly"]),
+		AuthorizedCollections: convert.ToBool(args["authorizedCollections"]),
+		BatchSize:             -1,
+	}
+
+	cursor := convert.ToBSONMap(args["cursor"])
+	batchSize, ok := cursor["batchSize"]
+	if ok {
+		l.BatchSize = convert.ToInt32(batchSize)
+	}
+
+	return l, nil
+}
+
+func createListIndexes(header MsgHeader, database string, args bson.M) (ListIndexes, error) {
+	c := args["listIndexes"]
+	collection, ok := c.(string)
+	if !ok {
+		// we have issues
+		return ListIndexes{}, fmt.Errorf("ListIndexes command has no collection.")
+	}
+
+	l := ListIndexes{
+		RequestID:  header.RequestID,
+		Database:   database,
+		Collection: collection,
+		BatchSize:  -1,
+	}
+
+	cursor := convert.ToBSONMap(args["cursor"])
+	batchSize, ok := cursor["batchSize"]
+	if ok {
+		l.BatchSize = convert.ToInt32(batchSize)
+	}
+
+	return l, nil
+}
+
+// createCommandRequest produces the Requester for a command, using the specialized
+// struct for the command if there is one, and a generic Command otherwise.
+func createCommandRequest(header MsgHeader, database string, commandName string,
+	args bson.M) (Requester, error) {
+
+	switch commandName {
+	case "insert":
+		// convert documents to an array of bson.D so that the struct
+		// knows what to do with them.
+		i, err := convert.ConvertToBSONDocSlice(args["documents"])
+		if err != nil {
+			i = make([]bson.D, 0)
+		}
+		args["documents"] = i
+		return createInsert(header, database, args)
+	case "update":
+		// convert updates to an array of bson.M so that the struct
+		// knows what to do with them.
+		u, err := convert.ConvertToBSONMapSlice(args["updates"])
+		if err != nil {
+			u = make([]bson.M, 0)
+		}
+		args["updates"] = u
+		return createUpdate(header, database, args)
+	case "delete":
+		d, err := convert.ConvertToBSONMapSlice(args["deletes"])
+		if err != nil {
+			d = make([]bson.M, 0)
+		}
+		args["deletes"] = d
+		return createDelete(header, database, args)
+	case "killCursors":
+		return createKillCursors(header, database, args)
+	case "find":
+		return createFind(header, database, args)
+	case "getMore":
+		return createGetMore(header, database, args)
+	case "aggregate":
+		return createAggregate(header, database, args)
+	case "findAndModify", "findandmodify":
+		return createFindAndModify(header, database, args)
+	case "count":
+		return createCount(header, database, args)
+	case "distinct":
+		return createDistinct(header, database, args)
+	case "listCollections":
+		return createListCollections(header, database, args)
+	case "listIndexes":
+		return createListIndexes(header, database, args)
+	default:
+		return createCommand(header, commandName, database, args), nil
+	}
+}
+
 // reads a header from the reader (16 bytes), consistent with wire protocol
 func processHeader(reader io.Reader) (MsgHeader, error) {
 	// read the message header
 	msgHeaderBytes := make([]byte, 16)
-	n, err := reader.Read(msgHeaderBytes)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(reader, msgHeaderBytes)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return MsgHeader{}, err
 	}
 	if n == 0 {
 		// EOF?
-		Log(INFO, "connection closed")
 		return MsgHeader{}, err
 	}
+	if n != 16 {
+		return MsgHeader{}, fmt.Errorf("insufficient bytes read for header: %v", n)
+	}
 	mHeader := MsgHeader{}
 	err = binary.Read(bytes.NewReader(msgHeaderBytes), binary.LittleEndian, &mHeader)
 	if err != nil {
-		Log(ERROR, "error decoding from reader: %v", err)
 		return MsgHeader{}, err
 	}
 
@@ -243,16 +583,21 @@ func processHeader(reader io.Reader) (MsgHeader, error) {
 	if mHeader.MessageLength <= 15 {
 		return MsgHeader{}, fmt.Errorf("Message length not long enough for header")
 	}
+	if mHeader.MessageLength > maxMessageSize {
+		return MsgHeader{}, fmt.Errorf("Message length %v is larger than the maximum of %v",
+			mHeader.MessageLength, maxMessageSize)
+	}
 
 	return mHeader, nil
 }
 
-// anything with OpCode 2004 goes here
-func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
+// anything with OpCode 2004 goes here. Along with the Requester, it returns true
+// if the query was a command on $cmd rather than a legacy find.
+func processOpQuery(reader io.Reader, header MsgHeader) (Requester, bool, error) {
 	// flags
 	flags, err := buffer.ReadInt32LE(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error reading flags: %v", err)
+		return nil, false, fmt.Errorf("error reading flags: %v", err)
 	}
 
 	// namespace
@@ -264,31 +609,31 @@ func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 		4 // bytes representing the flags
 	numNamespaceBytes, namespace, err := buffer.ReadNullTerminatedString(reader, maxStringBytes)
 	if err != nil {
-		return nil, fmt.Errorf("error reading null terminated string: %v", err)
+		return nil, false, fmt.Errorf("error reading null terminated string: %v", err)
 	}
 	database, collection, err := ParseNamespace(namespace)
 
 	if err != nil {
-		return nil, fmt.Errorf("error parsing namespace: %v", err)
+		return nil, false, fmt.Errorf("error parsing namespace: %v", err)
 	}
 
 	// numberToSkip
 	skip, err := buffer.ReadInt32LE(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error reading NumberToSkip: %v", err)
+		return nil, false, fmt.Errorf("error reading NumberToSkip: %v", err)
 	}
 
 	// numberToReturn
 	limit, err := buffer.ReadInt32LE(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error reading NumberToReturn: %v", err)
+		return nil, false, fmt.Errorf("error reading NumberToReturn: %v", err)
 	}
 
 	// query
 	var docSize int32
 	docSize, q, err := buffer.ReadDocument(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error reading query: %v", err)
+		return nil, false, fmt.Errorf("error reading query: %v", err)
 	}
 	totalBytesRead := 16 + // bytes representing the header
 		4 + // bytes representing flags
@@ -303,68 +648,27 @@ func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 		_, projection, err = buffer.ReadDocument(reader)
 		if err != nil {
 			if err != io.EOF {
-				return nil, fmt.Errorf("error reading projection: %v", err)
+				return nil, false, fmt.Errorf("error reading projection: %v", err)
 			}
 		}
 	}
 
+	// modifiers (like $readPreference on commands sent through mongos) may wrap
+	// the actual query.
+	q, modifiers := unwrapQuery(q)
+
 	// figure out what kind of struct to actually produce
 	switch collection {
 	case "$cmd":
-		cName, args := splitCommandOpQuery(q)
-		var c Requester
-		switch cName {
-		case "insert":
-			// convert documents to an array of bson.D so that the struct
-			// knows what to do with them.
-			i, err := convert.ConvertToBSONDocSlice(args["documents"])
-
-			if err != nil {
-				i = make([]bson.D, 0)
-			}
-
-			args["documents"] = i
-
-			c, err = createInsert(header, database, args)
-			if err != nil {
-				return nil, err
-			}
-		case "update":
-			// convert updates to an array of bson.M so that the struct
-			// knows what to do with them.
-			u, err := convert.ConvertToBSONMapSlice(args["updates"])
-
-			if err != nil {
-				u = make([]bson.M, 0)
-			}
-
-			args["updates"] = u
-
-			c, err = createUpdate(header, database, args)
-			if err != nil {
-				return nil, err
-			}
-		case "delete":
-
-			d, err := convert.ConvertToBSONMapSlice(args["deletes"])
-			if err != nil {
-				d = make([]bson.M, 0)
-			}
-
-			args["deletes"] = d
-
-			c, err = createDelete(header, database, args)
-			if err != nil {
-				return nil, err
-			}
-		default:
-			c = createCommand(header, cName, database, args)
+		if len(q) == 0 {
+			return nil, false, fmt.Errorf("empty command")
 		}
-
-		return c, nil
+		cName, args := splitCommandOpQuery(q)
+		r, err := createCommandRequest(header, database, cName, args)
+		return r, true, err
 	default:
 		// find command
-		args := bson.M{}
+		args := modifiers
 
 		// this is to more closely match the command spec
 		args["find"] = collection
@@ -374,10 +678,23 @@ func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 		args["oplogReplay"] = convert.ReadBit32LE(flags, 3)
 		args["noCursorTimeout"] = convert.ReadBit32LE(flags, 4)
 		args["awaitData"] = convert.ReadBit32LE(flags, 5)
-		args["partial"] = convert.ReadBit32LE(flags, 7)
+		args["exhaust"] = convert.ReadBit32LE(flags, 6)
+		args["allowPartialResults"] = convert.ReadBit32LE(flags, 7)
 
 		args["skip"] = skip
-		args["limit"] = limit
+
+		// numberToReturn is the size of the first batch if it is positive, and a limit
+		// that closes the cursor after the first batch if it is negative (or 1).
+		switch {
+		case limit < 0:
+			args["limit"] = -limit
+			args["singleBatch"] = true
+		case limit == 1:
+			args["limit"] = limit
+			args["singleBatch"] = true
+		case limit > 1:
+			args["batchSize"] = limit
+		}
 
 		// the actual query
 		args["filter"] = q
@@ -385,9 +702,9 @@ func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 
 		f, err := createFind(header, database, args)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return f, nil
+		return f, false, nil
 	}
 
 }
@@ -585,49 +902,234 @@ func processOpDelete(reader io.Reader, header MsgHeader) (Requester, error) {
 	return createDelete(header, database, args)
 }
 
+// OpCode 2007
+func processOpKillCursors(reader io.Reader, header MsgHeader) (Requester, error) {
+	buffer.ReadInt32LE(reader) // the zero (not used in wire protocol)
+
+	// numberOfCursorIDs
+	n, err := buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading number of cursor IDs: %v", err)
+	}
+	if n < 0 || 16+4+4+8*int64(n) != int64(header.MessageLength) {
+		return nil, fmt.Errorf("invalid number of cursor IDs: %v", n)
+	}
+
+	// cursorIDs
+	cursorIDs := make([]int64, n)
+	for i := int32(0); i < n; i++ {
+		cursorIDs[i], err = buffer.ReadInt64LE(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cursor ID: %v", err)
+		}
+	}
+
+	k := KillCursors{
+		RequestID: header.RequestID,
+		CursorIDs: cursorIDs,
+	}
+	return k, nil
+}
+
+// OpCode 2013
+func processOpMsg(reader io.Reader, header MsgHeader) (Requester, int32, error) {
+	// read in the rest of the message, as the checksum covers all of it
+	body := make([]byte, header.MessageLength-16)
+	_, err := io.ReadFull(reader, body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading message: %v", err)
+	}
+	if len(body) < 5 {
+		return nil, 0, fmt.Errorf("Message length not long enough for OP_MSG")
+	}
+
+	flags := convert.ConvertToInt32LE(body)
+
+	// bits 0-15 are required to be understood, and we only know about
+	// checksumPresent and moreToCome.
+	if flags&0xfffc != 0 {
+		return nil, 0, fmt.Errorf("unsupported required flag bits: %v", flags)
+	}
+
+	sectionsEnd := len(body)
+	if convert.ReadBit32LE(flags, 0) {
+		sectionsEnd -= 4
+		if sectionsEnd < 5 {
+			return nil, 0, fmt.Errorf("Message length not long enough for checksum")
+		}
+
+		headerBuf := bytes.NewBuffer([]byte{})
+		err = buffer.WriteToBuf(headerBuf, header)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error writing header for checksum: %v", err)
+		}
+		crc := crc32.Checksum(headerBuf.Bytes(), castagnoliTable)
+		crc = crc32.Update(crc, castagnoliTable, body[:sectionsEnd])
+		if crc != binary.LittleEndian.Uint32(body[sectionsEnd:]) {
+			return nil, 0, fmt.Errorf("checksum mismatch")
+		}
+	}
+
+	// sections
+	var doc bson.D
+	sequences := bson.D{}
+	sections := bytes.NewReader(body[4:sectionsEnd])
+	for sections.Len() > 0 {
+		kind, err := sections.ReadByte()
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading section kind: %v", err)
+		}
+
+		switch kind {
+		case 0:
+			// body
+			if doc != nil {
+				return nil, 0, fmt.Errorf("OP_MSG has more than one body section")
+			}
+			_, doc, err = buffer.ReadDocument(sections)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error reading body: %v", err)
+			}
+		case 1:
+			// document sequence
+			size, err := buffer.ReadInt32LE(sections)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error reading document sequence size: %v", err)
+			}
+			if size < 4 || int(size-4) > sections.Len() {
+				return nil, 0, fmt.Errorf("invalid document sequence size: %v", size)
+			}
+			n, identifier, err := buffer.ReadNullTerminatedString(sections, size-4)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error reading document sequence identifier: %v", err)
+			}
+
+			docs := make([]bson.D, 0)
+			remaining := size - 4 - n
+			for remaining > 0 {
+				docSize, d, err := buffer.ReadDocument(sections)
+				if err != nil {
+					return nil, 0, fmt.Errorf("error reading document sequence: %v", err)
+				}
+				docs = append(docs, d)
+				remaining -= docSize
+			}
+			if remaining != 0 {
+				return nil, 0, fmt.Errorf("document sequence %v overran its size", identifier)
+			}
+			sequences = append(sequences, bson.DocElem{identifier, docs})
+		default:
+			return nil, 0, fmt.Errorf("unknown section kind: %v", kind)
+		}
+	}
+
+	if len(doc) == 0 {
+		return nil, 0, fmt.Errorf("OP_MSG has no command")
+	}
+
+	// the database is in the $db field rather than the namespace. The field is removed,
+	// as it isn't allowed in commands that are sent to mongod over OP_QUERY.
+	database := ""
+	q := bson.D{}
+	for i := 0; i < len(doc); i++ {
+		if doc[i].Name == "$db" {
+			database = convert.ToString(doc[i].Value)
+			continue
+		}
+		q = append(q, doc[i])
+	}
+	if len(database) == 0 {
+		return nil, 0, fmt.Errorf("OP_MSG has no $db field")
+	}
+	if len(q) == 0 {
+		return nil, 0, fmt.Errorf("OP_MSG has no command")
+	}
+
+	// document sequences are equivalent to array fields in the body
+	q = append(q, sequences...)
+
+	cName, args := splitCommandOpQuery(q)
+	r, err := createCommandRequest(header, database, cName, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, flags, nil
+}
+
 // Decodes a wire protocol message from a connection into a Requester to pass
 // onto modules, a struct containing the header of the original message, and an error.
+// OP_COMPRESSED messages are decompressed and decoded as their original opcode.
 // It returns a non-nil error if reading from the connection
 // fails in any way
-func Decode(reader io.Reader) (Requester, MsgHeader, error) {
+func Decode(reader io.Reader) (Requester, RequestHeader, error) {
 	mHeader, err := processHeader(reader)
 
 	if err != nil {
-		return nil, MsgHeader{}, err
+		return nil, RequestHeader{}, err
+	}
+
+	if mHeader.OpCode == OP_COMPRESSED {
+		originalHeader, originalReader, compressor, err := processOpCompressed(reader, mHeader)
+		if err != nil {
+			return nil, RequestHeader{}, err
+		}
+		r, rHeader, err := decodeMessage(originalReader, originalHeader)
+		if err != nil {
+			return nil, RequestHeader{}, err
+		}
+		rHeader.Compressor = compressor
+		return r, rHeader, nil
 	}
 
+	return decodeMessage(reader, mHeader)
+}
+
+// decodeMessage decodes the rest of an uncompressed message with the given header.
+func decodeMessage(reader io.Reader, mHeader MsgHeader) (Requester, RequestHeader, error) {
 	switch mHeader.OpCode {
 	case OP_UPDATE:
 		opu, err := processOpUpdate(reader, mHeader)
 		if err != nil {
-			return nil, MsgHeader{}, err
+			return nil, RequestHeader{}, err
 		}
-		return opu, mHeader, nil
+		return opu, RequestHeader{MsgHeader: mHeader}, nil
 	case OP_INSERT:
 		opi, err := processOpInsert(reader, mHeader)
 		if err != nil {
-			return nil, MsgHeader{}, err
+			return nil, RequestHeader{}, err
 		}
-		return opi, mHeader, nil
+		return opi, RequestHeader{MsgHeader: mHeader}, nil
 	case OP_QUERY:
-		opq, err := processOpQuery(reader, mHeader)
+		opq, command, err := processOpQuery(reader, mHeader)
 		if err != nil {
-			return nil, MsgHeader{}, err
+			return nil, RequestHeader{}, err
 		}
-		return opq, mHeader, nil
+		return opq, RequestHeader{MsgHeader: mHeader, Command: command}, nil
 	case OP_GET_MORE:
 		opg, err := processOpGetMore(reader, mHeader)
 		if err != nil {
-			return nil, MsgHeader{}, err
+			return nil, RequestHeader{}, err
 		}
-		return opg, mHeader, nil
+		return opg, RequestHeader{MsgHeader: mHeader}, nil
 	case OP_DELETE:
 		opd, err := processOpDelete(reader, mHeader)
 		if err != nil {
-			return nil, MsgHeader{}, err
+			return nil, RequestHeader{}, err
+		}
+		return opd, RequestHeader{MsgHeader: mHeader}, nil
+	case OP_KILL_CURSORS:
+		opk, err := processOpKillCursors(reader, mHeader)
+		if err != nil {
+			return nil, RequestHeader{}, err
+		}
+		return opk, RequestHeader{MsgHeader: mHeader}, nil
+	case OP_MSG:
+		opm, flags, err := processOpMsg(reader, mHeader)
+		if err != nil {
+			return nil, RequestHeader{}, err
 		}
-		return opd, mHeader, nil
+		return opm, RequestHeader{MsgHeader: mHeader, FlagBits: flags, Command: true}, nil
 	default:
-		return nil, MsgHeader{}, fmt.Errorf("unimplemented operation: %#v", mHeader)
+		return nil, RequestHeader{}, fmt.Errorf("unimplemented operation: %#v", mHeader)
 	}
 }
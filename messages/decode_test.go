@@ -9,6 +9,7 @@ import (
 	"github.com/mongodbinc-interns/mongoproxy/mock"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
 	"testing"
 )
 
@@ -204,6 +205,75 @@ func createMockGetMore(id int32, namespace string, numToReturn int32, cursorID i
 	return input
 }
 
+// creates a valid OP_MSG with a body section and an optional document sequence. A
+// checksum is appended if the checksumPresent flag is set.
+func createMockMsg(id int32, flags int32, body interface{}, identifier string,
+	sequence []interface{}) []byte {
+	responseTo := int32(0)
+	opCode := int32(2013)
+
+	bodyBytes, err := bson.Marshal(body)
+	if err != nil {
+		fmt.Println("Error encoding BSON")
+	}
+
+	buf := new(bytes.Buffer)
+
+	buffer.WriteToBuf(buf, int32(0), id, responseTo, opCode, flags, byte(0), bodyBytes)
+
+	if len(identifier) > 0 {
+		sequenceBytes := append([]byte(identifier), byte('\x00'))
+		for i := 0; i < len(sequence); i++ {
+			d, err := bson.Marshal(sequence[i])
+			if err != nil {
+				fmt.Println("Error encoding BSON")
+			}
+			sequenceBytes = append(sequenceBytes, d...)
+		}
+		buffer.WriteToBuf(buf, byte(1), int32(len(sequenceBytes)+4), sequenceBytes)
+	}
+
+	if flags&1 != 0 {
+		// make room for the checksum
+		buffer.WriteToBuf(buf, uint32(0))
+	}
+
+	input := buf.Bytes()
+	respSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
+	input[0] = respSize[0]
+	input[1] = respSize[1]
+	input[2] = respSize[2]
+	input[3] = respSize[3]
+
+	if flags&1 != 0 {
+		checksum := crc32.Checksum(input[:len(input)-4], crc32.MakeTable(crc32.Castagnoli))
+		binary.LittleEndian.PutUint32(input[len(input)-4:], checksum)
+	}
+
+	return input
+}
+
+func createMockKillCursors(id int32, cursorIDs []int64) []byte {
+	responseTo := int32(0)
+	opCode := int32(2007)
+
+	buf := new(bytes.Buffer)
+
+	buffer.WriteToBuf(buf, int32(0), id, responseTo, opCode, int32(0), int32(len(cursorIDs)),
+		cursorIDs)
+
+	input := buf.Bytes()
+	respSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
+	input[0] = respSize[0]
+	input[1] = respSize[1]
+	input[2] = respSize[2]
+	input[3] = respSize[3]
+
+	return input
+}
+
 func TestProcessHeader(t *testing.T) {
 	Convey("Decode a header", t, func() {
 		Convey("which reads 0 bytes", func() {
@@ -231,6 +301,20 @@ func TestProcessHeader(t *testing.T) {
 
 			So(err, ShouldNotBeNil)
 		})
+
+		Convey("with a length that is larger than the maximum", func() {
+			input := make([]byte, 16)
+			binary.LittleEndian.PutUint32(input, 0x7fffffff)
+			binary.LittleEndian.PutUint32(input[12:], uint32(OP_MSG))
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, err := processHeader(&m)
+
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
@@ -578,3 +662,629 @@ func TestDecodeOpGetMore(t *testing.T) {
 		})
 	})
 }
+
+func TestDecodeOpMsg(t *testing.T) {
+	Convey("Decode a wire protocol OP_MSG message", t, func() {
+		Convey("that is a valid non-specialized command", func() {
+			body := bson.D{{"isMaster", 1}, {"$db", "admin"}}
+			input := createMockMsg(int32(0), int32(0), body, "", nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, err := Decode(&m)
+			So(err, ShouldBeNil)
+			So(header.OpCode, ShouldEqual, OP_MSG)
+			So(header.MoreToCome(), ShouldBeFalse)
+
+			command, err := ToCommandRequest(request)
+			So(err, ShouldBeNil)
+			So(command.Database, ShouldEqual, "admin")
+			So(command.GetArg("isMaster"), ShouldEqual, 1)
+			So(command.GetArg("$db"), ShouldBeNil)
+		})
+
+		Convey("that is an insert with a document sequence", func() {
+			body := bson.D{{"insert", "foo"}, {"ordered", false}, {"$db", "db"}}
+			docs := []interface{}{mockQuery, mockCommand}
+			input := createMockMsg(int32(0), int32(2), body, "documents", docs)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, err := Decode(&m)
+			So(err, ShouldBeNil)
+			So(header.MoreToCome(), ShouldBeTrue)
+
+			opi, err := ToInsertRequest(request)
+			So(err, ShouldBeNil)
+			So(opi.Database, ShouldEqual, "db")
+			So(opi.Collection, ShouldEqual, "foo")
+			So(opi.Ordered, ShouldBeFalse)
+			So(opi.Documents, ShouldResemble, []bson.D{mockQuery, mockCommand})
+		})
+
+		Convey("that is a find command with a checksum", func() {
+			body := bson.D{{"find", "foo"}, {"filter", mockQuery}, {"$db", "db"}}
+			input := createMockMsg(int32(0), int32(1+65536), body, "", nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, err := Decode(&m)
+			So(err, ShouldBeNil)
+			So(header.ChecksumPresent(), ShouldBeTrue)
+			So(header.ExhaustAllowed(), ShouldBeTrue)
+
+			f, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(f.Database, ShouldEqual, "db")
+			So(f.Collection, ShouldEqual, "foo")
+			So(f.Filter, ShouldResemble, mockQuery)
+		})
+
+		Convey("that has an invalid checksum", func() {
+			body := bson.D{{"isMaster", 1}, {"$db", "admin"}}
+			input := createMockMsg(int32(0), int32(1), body, "", nil)
+			input[len(input)-1] ^= 0xff
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+			So(request, ShouldBeNil)
+		})
+
+		Convey("that has no $db field", func() {
+			input := createMockMsg(int32(0), int32(0), mockCommand, "", nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDecodeOpCompressed(t *testing.T) {
+	Convey("Decode a wire protocol OP_COMPRESSED message", t, func() {
+		body := bson.D{{"insert", "foo"}, {"$db", "db"}}
+		docs := []interface{}{mockQuery, mockCommand}
+		original := createMockMsg(int32(7), int32(0), body, "documents", docs)
+
+		for _, compressor := range []string{"noop", "snappy", "zlib", "zstd"} {
+			compressor := compressor
+			Convey("that uses the "+compressor+" compressor", func() {
+				input, err := Compress(original, compressor)
+				So(err, ShouldBeNil)
+				m := mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, header, err := Decode(&m)
+				So(err, ShouldBeNil)
+				So(header.Compressor, ShouldEqual, compressor)
+				So(header.OpCode, ShouldEqual, OP_MSG)
+				So(header.RequestID, ShouldEqual, 7)
+				So(header.MessageLength, ShouldEqual, len(original))
+
+				opi, err := ToInsertRequest(request)
+				So(err, ShouldBeNil)
+				So(opi.Collection, ShouldEqual, "foo")
+				So(opi.Documents, ShouldResemble, []bson.D{mockQuery, mockCommand})
+			})
+		}
+
+		Convey("that has an unknown compressor", func() {
+			input, err := Compress(original, "snappy")
+			So(err, ShouldBeNil)
+			input[24] = 100
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+			So(request, ShouldBeNil)
+		})
+
+		Convey("that has a compressed size larger than the maximum", func() {
+			input, err := Compress(original, "snappy")
+			So(err, ShouldBeNil)
+			header := MsgHeader{MessageLength: 0x7fffffff, OpCode: OP_COMPRESSED}
+			_, _, _, err = processOpCompressed(bytes.NewReader(input[16:]), header)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestNegotiateCompressors(t *testing.T) {
+	Convey("Negotiate compressors with a client", t, func() {
+		allowed := []string{"zlib", "snappy"}
+		So(NegotiateCompressors([]string{"zstd", "snappy", "zlib"}, allowed),
+			ShouldResemble, []string{"snappy", "zlib"})
+		So(NegotiateCompressors([]string{"zstd"}, allowed), ShouldBeEmpty)
+		So(NegotiateCompressors([]string{"lz4", "zlib"}, []string{"lz4", "zlib"}),
+			ShouldResemble, []string{"zlib"})
+	})
+}
+
+func TestDecodeKillCursors(t *testing.T) {
+	Convey("Decode a request to kill cursors", t, func() {
+		Convey("that is a valid OP_KILL_CURSORS message", func() {
+			input := createMockKillCursors(int32(0), []int64{125, 126})
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			t := request.Type()
+			So(t, ShouldEqual, "killCursors")
+
+			opk, err := ToKillCursorsRequest(request)
+			So(err, ShouldBeNil)
+			So(opk.Database, ShouldEqual, "")
+			So(opk.CursorIDs, ShouldResemble, []int64{125, 126})
+		})
+
+		Convey("that is an OP_KILL_CURSORS message with the wrong number of cursors", func() {
+			input := createMockKillCursors(int32(0), []int64{125, 126})
+			input = input[:len(input)-8]
+			binary.LittleEndian.PutUint32(input, uint32(len(input)))
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("that is a valid killCursors command", func() {
+			mockKillCursors := bson.D{{"killCursors", "foo"},
+				{"cursors", []int64{125}}}
+			input := createMockQuery(int32(0), int32(0), "db.$cmd", int32(0), int32(0), mockKillCursors)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opk, err := ToKillCursorsRequest(request)
+			So(err, ShouldBeNil)
+			So(opk.Database, ShouldEqual, "db")
+			So(opk.Collection, ShouldEqual, "foo")
+			So(opk.CursorIDs, ShouldResemble, []int64{125})
+		})
+	})
+}
+
+func TestDecodeAggregate(t *testing.T) {
+	Convey("Decode an aggregate command", t, func() {
+		pipeline := []bson.D{
+			{{"$match", mockQuery}},
+			{{"$group", bson.D{{"_id", "$hello"}}}},
+		}
+
+		Convey("that is on a collection", func() {
+			mockAggregate := bson.D{{"aggregate", "foo"},
+				{"pipeline", pipeline},
+				{"cursor", bson.D{{"batchSize", 0}}},
+				{"allowDiskUse", true},
+				{"maxTimeMS", 500},
+				{"hint", "hello_1"}}
+			input := createMockQuery(int32(0), int32(0), "db.$cmd", int32(0), int32(0), mockAggregate)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			t := request.Type()
+			So(t, ShouldEqual, "aggregate")
+
+			opa, err := ToAggregateRequest(request)
+			So(err, ShouldBeNil)
+			So(opa.Database, ShouldEqual, "db")
+			So(opa.Collection, ShouldEqual, "foo")
+			So(opa.Pipeline, ShouldResemble, pipeline)
+			So(opa.BatchSize, ShouldEqual, 0)
+			So(opa.AllowDiskUse, ShouldBeTrue)
+			So(opa.MaxTimeMS, ShouldEqual, 500)
+			So(opa.Hint, ShouldEqual, "hello_1")
+		})
+
+		Convey("that is on a database", func() {
+			mockAggregate := bson.D{{"aggregate", 1},
+				{"pipeline", pipeline},
+				{"cursor", bson.D{}}}
+			input := createMockQuery(int32(0), int32(0), "db.$cmd", int32(0), int32(0), mockAggregate)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opa, err := ToAggregateRequest(request)
+			So(err, ShouldBeNil)
+			So(opa.Collection, ShouldEqual, "")
+			So(opa.BatchSize, ShouldEqual, -1)
+			So(opa.ToBSON()[0], ShouldResemble, bson.DocElem{"aggregate", 1})
+		})
+
+		Convey("that has no pipeline", func() {
+			mockAggregate := bson.D{{"aggregate", "foo"}, {"cursor", bson.D{}}}
+			input := createMockQuery(int32(0), int32(0), "db.$cmd", int32(0), int32(0), mockAggregate)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDecodeReadAndModifyCommands(t *testing.T) {
+	Convey("Decode a specialized command", t, func() {
+		decodeMsg := func(body bson.D) (Requester, error) {
+			input := createMockMsg(int32(0), int32(0), body, "", nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			return request, err
+		}
+
+		Convey("that is a findAndModify with an update", func() {
+			update := bson.D{{"$set", bson.D{{"a", 1}}}}
+			request, err := decodeMsg(bson.D{{"findAndModify", "foo"},
+				{"query", mockQuery},
+				{"update", update},
+				{"new", true},
+				{"upsert", true},
+				{"writeConcern", bson.D{{"w", 2}}},
+				{"$db", "db"}})
+			So(err, ShouldBeNil)
+			So(request.Type(), ShouldEqual, "findAndModify")
+
+			opf, err := ToFindAndModifyRequest(request)
+			So(err, ShouldBeNil)
+			So(opf.Database, ShouldEqual, "db")
+			So(opf.Collection, ShouldEqual, "foo")
+			So(opf.Query, ShouldResemble, mockQuery)
+			So(opf.Update, ShouldResemble, update)
+			So(opf.Remove, ShouldBeFalse)
+			So(opf.New, ShouldBeTrue)
+			So(opf.Upsert, ShouldBeTrue)
+			So(*opf.WriteConcern, ShouldResemble, bson.M{"w": 2})
+		})
+
+		Convey("that is a findandmodify with a remove", func() {
+			request, err := decodeMsg(bson.D{{"findandmodify", "foo"},
+				{"query", mockQuery},
+				{"remove", true},
+				{"$db", "db"}})
+			So(err, ShouldBeNil)
+
+			opf, err := ToFindAndModifyRequest(request)
+			So(err, ShouldBeNil)
+			So(opf.Collection, ShouldEqual, "foo")
+			So(opf.Remove, ShouldBeTrue)
+			So(opf.Update, ShouldBeNil)
+		})
+
+		Convey("that is a findAndModify without an update or remove", func() {
+			_, err := decodeMsg(bson.D{{"findAndModify", "foo"}, {"$db", "db"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("that is a count", func() {
+			request, err := decodeMsg(bson.D{{"count", "foo"},
+				{"query", mockQuery},
+				{"limit", 10},
+				{"skip", int64(5)},
+				{"$db", "db"}})
+			So(err, ShouldBeNil)
+			So(request.Type(), ShouldEqual, "count")
+
+			opc, err := ToCountRequest(request)
+			So(err, ShouldBeNil)
+			So(opc.Collection, ShouldEqual, "foo")
+			So(opc.Query, ShouldResemble, mockQuery)
+			So(opc.Limit, ShouldEqual, 10)
+			So(opc.Skip, ShouldEqual, 5)
+		})
+
+		Convey("that is a distinct", func() {
+			request, err := decodeMsg(bson.D{{"distinct", "foo"},
+				{"key", "hello"},
+				{"$db", "db"}})
+			So(err, ShouldBeNil)
+
+			opd, err := ToDistinctRequest(request)
+			So(err, ShouldBeNil)
+			So(opd.Collection, ShouldEqual, "foo")
+			So(opd.Key, ShouldEqual, "hello")
+			So(opd.Query, ShouldBeNil)
+		})
+
+		Convey("that is a distinct without a key", func() {
+			_, err := decodeMsg(bson.D{{"distinct", "foo"}, {"$db", "db"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("that is a listCollections", func() {
+			request, err := decodeMsg(bson.D{{"listCollections", 1},
+				{"filter", bson.D{{"name", "foo"}}},
+				{"nameOnly", true},
+				{"cursor", bson.D{{"batchSize", 2}}},
+				{"$db", "db"}})
+			So(err, ShouldBeNil)
+
+			opl, err := ToListCollectionsRequest(request)
+			So(err, ShouldBeNil)
+			So(opl.Database, ShouldEqual, "db")
+			So(opl.Filter, ShouldResemble, bson.D{{"name", "foo"}})
+			So(opl.NameOnly, ShouldBeTrue)
+			So(opl.BatchSize, ShouldEqual, 2)
+		})
+
+		Convey("that is a listIndexes", func() {
+			request, err := decodeMsg(bson.D{{"listIndexes", "foo"}, {"$db", "db"}})
+			So(err, ShouldBeNil)
+
+			opl, err := ToListIndexesRequest(request)
+			So(err, ShouldBeNil)
+			So(opl.Collection, ShouldEqual, "foo")
+			So(opl.BatchSize, ShouldEqual, -1)
+		})
+	})
+}
+
+func TestDecodeQueryModifiers(t *testing.T) {
+	Convey("Decode an OP_QUERY with query modifiers", t, func() {
+		Convey("that wraps the query in $query", func() {
+			q := bson.D{{"$query", mockQuery},
+				{"$orderby", bson.D{{"a", -1}}},
+				{"$hint", "a_1"},
+				{"$max", bson.D{{"a", 10}}},
+				{"$min", bson.D{{"a", 1}}},
+				{"$maxTimeMS", 100},
+				{"$comment", "hi"},
+				{"$readPreference", bson.D{{"mode", "secondary"}}},
+				{"$explain", true},
+				{"$snapshot", true},
+				{"$showDiskLoc", true},
+				{"$returnKey", true}}
+			input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), q)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.Filter, ShouldResemble, mockQuery)
+			So(opq.Sort, ShouldResemble, bson.D{{"a", -1}})
+			So(opq.Hint, ShouldEqual, "a_1")
+			So(opq.Max, ShouldResemble, bson.D{{"a", 10}})
+			So(opq.Min, ShouldResemble, bson.D{{"a", 1}})
+			So(opq.MaxTimeMS, ShouldEqual, 100)
+			So(opq.Comment, ShouldEqual, "hi")
+			So(opq.ReadPreference, ShouldResemble, bson.D{{"mode", "secondary"}})
+			So(opq.Explain, ShouldBeTrue)
+			So(opq.Snapshot, ShouldBeTrue)
+			So(opq.ShowRecordId, ShouldBeTrue)
+			So(opq.ReturnKey, ShouldBeTrue)
+		})
+
+		Convey("that wraps the query in query", func() {
+			q := bson.D{{"query", mockQuery}, {"orderby", bson.D{{"a", 1}}}}
+			input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), q)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.Filter, ShouldResemble, mockQuery)
+			So(opq.Sort, ShouldResemble, bson.D{{"a", 1}})
+		})
+
+		Convey("that doesn't wrap the query", func() {
+			input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), mockQuery)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.Filter, ShouldResemble, mockQuery)
+			So(opq.Sort, ShouldBeNil)
+			So(opq.Hint, ShouldBeNil)
+			So(opq.MaxTimeMS, ShouldEqual, 0)
+			So(opq.ReadPreference, ShouldBeNil)
+		})
+
+		Convey("that has a field named query", func() {
+			for _, q := range []bson.D{
+				{{"query", "abc"}, {"x", 1}},
+				{{"query", bson.D{{"a", 1}}}, {"x", 1}},
+			} {
+				input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), q)
+				m := mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, _, err := Decode(&m)
+				So(err, ShouldBeNil)
+
+				opq, err := ToFindRequest(request)
+				So(err, ShouldBeNil)
+				So(opq.Filter, ShouldResemble, q)
+				So(opq.Sort, ShouldBeNil)
+			}
+		})
+
+		Convey("that is a wrapped command", func() {
+			q := bson.D{{"$query", mockCommand},
+				{"$readPreference", bson.D{{"mode", "secondary"}}}}
+			input := createMockQuery(int32(0), int32(0), "admin.$cmd", int32(0), int32(0), q)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			command, err := ToCommandRequest(request)
+			So(err, ShouldBeNil)
+			So(command.CommandName, ShouldEqual, "isMaster")
+		})
+	})
+}
+
+func TestDecodeFindCommand(t *testing.T) {
+	Convey("Decode a find or getMore", t, func() {
+		Convey("that is a find command sent over OP_QUERY", func() {
+			q := bson.D{{"find", "foo"},
+				{"filter", mockQuery},
+				{"sort", bson.D{{"a", 1}}},
+				{"hint", bson.D{{"a", 1}}},
+				{"limit", 20},
+				{"batchSize", 5},
+				{"singleBatch", true},
+				{"maxTimeMS", 1000},
+				{"readConcern", bson.D{{"level", "majority"}}},
+				{"collation", bson.D{{"locale", "fr"}}}}
+			input := createMockQuery(int32(0), int32(0), "db.$cmd", int32(0), int32(-1), q)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, err := Decode(&m)
+			So(err, ShouldBeNil)
+			So(header.Command, ShouldBeTrue)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.Database, ShouldEqual, "db")
+			So(opq.Collection, ShouldEqual, "foo")
+			So(opq.Filter, ShouldResemble, mockQuery)
+			So(opq.Sort, ShouldResemble, bson.D{{"a", 1}})
+			So(opq.Hint, ShouldResemble, bson.D{{"a", 1}})
+			So(opq.Limit, ShouldEqual, 20)
+			So(opq.BatchSize, ShouldEqual, 5)
+			So(opq.SingleBatch, ShouldBeTrue)
+			So(opq.MaxTimeMS, ShouldEqual, 1000)
+			So(opq.ReadConcern, ShouldResemble, bson.D{{"level", "majority"}})
+			So(opq.Collation, ShouldResemble, bson.D{{"locale", "fr"}})
+			So(opq.ToBSON()[0], ShouldResemble, bson.DocElem{"find", "foo"})
+		})
+
+		Convey("that is a getMore command sent over OP_QUERY", func() {
+			q := bson.D{{"getMore", int64(125)}, {"collection", "foo"}, {"batchSize", 10}}
+			input := createMockQuery(int32(0), int32(0), "db.$cmd", int32(0), int32(-1), q)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, err := Decode(&m)
+			So(err, ShouldBeNil)
+			So(header.Command, ShouldBeTrue)
+
+			opg, err := ToGetMoreRequest(request)
+			So(err, ShouldBeNil)
+			So(opg.CursorID, ShouldEqual, 125)
+			So(opg.Collection, ShouldEqual, "foo")
+			So(opg.BatchSize, ShouldEqual, 10)
+		})
+
+		Convey("that is a legacy query with a positive numberToReturn", func() {
+			input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(10), mockQuery)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, err := Decode(&m)
+			So(err, ShouldBeNil)
+			So(header.Command, ShouldBeFalse)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.BatchSize, ShouldEqual, 10)
+			So(opq.Limit, ShouldEqual, 0)
+			So(opq.SingleBatch, ShouldBeFalse)
+		})
+
+		Convey("that is a legacy query with a negative numberToReturn", func() {
+			input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(-5), mockQuery)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.BatchSize, ShouldEqual, -1)
+			So(opq.Limit, ShouldEqual, 5)
+			So(opq.SingleBatch, ShouldBeTrue)
+		})
+
+		Convey("that is a legacy query with the exhaust flag", func() {
+			input := createMockQuery(int32(0), int32(64), "db.foo", int32(0), int32(0), mockQuery)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.Exhaust, ShouldBeTrue)
+		})
+	})
+}
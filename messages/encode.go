@@ -5,7 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy/buffer"
-	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -56,11 +56,15 @@ func setMessageSize(resp []byte) []byte {
 }
 
 // EncodeBSON encodes a BSON object in an OP_REPLY wire protocol message
-// as a response to the request with header reqHeader. Not to be used with
-// find or getMore command responses, as it disregards some flags that are important
-// to those two commands.
+// as a response to the request with header reqHeader, or in an OP_MSG message if
+// the request was an OP_MSG. Not to be used with legacy find or getMore responses,
+// as it disregards some flags that are important to those two operations.
 // http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/
 func EncodeBSON(reqHeader MsgHeader, b bson.M) ([]byte, error) {
+	if reqHeader.OpCode == OP_MSG {
+		return EncodeOpMsg(reqHeader, 0, b)
+	}
+
 	resHeader := createResponseHeader(reqHeader)
 
 	// we just return 1 object, which is b.
@@ -92,10 +96,34 @@ func EncodeBSON(reqHeader MsgHeader, b bson.M) ([]byte, error) {
 	return resp, nil
 }
 
-// Encodes a response into a byte slice that represents an OP_REPLY wire protocol message.
-func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
+// EncodeOpMsg encodes a BSON object as the body section of an OP_MSG wire protocol
+// message with the given flagBits, as a response to the request with header reqHeader.
+// https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst
+func EncodeOpMsg(reqHeader MsgHeader, flagBits int32, b bson.M) ([]byte, error) {
+	resHeader := createResponseHeader(reqHeader)
+	resHeader.OpCode = OP_MSG
+
+	buf := bytes.NewBuffer([]byte{})
+	err := buffer.WriteToBuf(buf, resHeader, flagBits,
+		byte(0)) // the section kind for a single body document
+	if err != nil {
+		return nil, fmt.Errorf("error writing prepared response %v", err)
+	}
+
+	docBytes, err := marshalReplyDocs(b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling documents")
+	}
+	resp := append(buf.Bytes(), docBytes...)
+
+	resp = setMessageSize(resp)
+
+	return resp, nil
+}
 
-	Log(DEBUG, "Response: %#v", res)
+// Encodes a response into a byte slice that represents an OP_REPLY wire protocol message,
+// or an OP_MSG wire protocol message if the request was an OP_MSG.
+func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 
 	// handle error
 	hasError := res.CommandError != nil
@@ -118,3 +146,41 @@ func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 	return res.Writer.ToBytes(reqHeader)
 
 }
+
+// a ResponseWriter whose reply to a command is different from its reply to the
+// legacy opcode for the same operation.
+type commandReplier interface {
+	commandReply() bson.M
+}
+
+// EncodeCommandReply encodes a response like Encode, but always in the command
+// reply format. It is used for requests that were sent as commands, such as find
+// and getMore commands sent over OP_QUERY, whose replies would otherwise be
+// encoded for the legacy opcodes.
+func EncodeCommandReply(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
+	if res.CommandError == nil {
+		r, ok := res.Writer.(commandReplier)
+		if ok {
+			return EncodeBSON(reqHeader, r.commandReply())
+		}
+	}
+	return Encode(reqHeader, res)
+}
+
+// SetRequestID sets the requestID in the header of an encoded wire protocol message.
+func SetRequestID(message []byte, requestID int32) []byte {
+	binary.LittleEndian.PutUint32(message[4:8], uint32(requestID))
+	return message
+}
+
+// SetMoreToCome sets the moreToCome flag of an encoded OP_MSG message, to show that
+// another reply follows it. Messages with other opcodes are returned unchanged.
+func SetMoreToCome(message []byte) []byte {
+	if len(message) < 20 || int32(binary.LittleEndian.Uint32(message[12:16])) != OP_MSG {
+		return message
+	}
+	flagBits := int32(binary.LittleEndian.Uint32(message[16:20]))
+	flagBits = convert.WriteBit32LE(flagBits, 1, true)
+	binary.LittleEndian.PutUint32(message[16:20], uint32(flagBits))
+	return message
+}
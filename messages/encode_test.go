@@ -2,6 +2,7 @@ package messages
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy/buffer"
 	. "github.com/smartystreets/goconvey/convey"
@@ -239,3 +240,392 @@ func TestEncodeInsertResponse(t *testing.T) {
 		So(actual, shouldHaveSameContents, expected)
 	})
 }
+
+func TestEncodeKillCursorsResponse(t *testing.T) {
+	Convey("Encode a KillCursorsResponse to send over the wire protocol", t, func() {
+
+		reqHeader := MsgHeader{
+			RequestID: int32(5),
+			OpCode:    int32(2004),
+		}
+
+		r := KillCursorsResponse{}
+		r.CursorsKilled = []int64{125}
+
+		res := ModuleResponse{}
+		res.Write(r)
+
+		resSlice := make([]interface{}, 1)
+		resSlice[0] = bson.M{
+			"cursorsKilled":   []int64{125},
+			"cursorsNotFound": []int64{},
+			"cursorsAlive":    []int64{},
+			"cursorsUnknown":  []int64{},
+			"ok":              1,
+		}
+
+		expected, err := createWireProtocolMessage(reqHeader.RequestID, int32(8), int64(0), int32(0), resSlice)
+		So(err, ShouldBeNil)
+		actual, err := Encode(reqHeader, res)
+		So(err, ShouldBeNil)
+		So(actual, shouldHaveSameContents, expected)
+	})
+}
+
+func TestEncodeAggregateResponse(t *testing.T) {
+	Convey("Encode an AggregateResponse to send over the wire protocol", t, func() {
+
+		reqHeader := MsgHeader{
+			RequestID: int32(5),
+			OpCode:    int32(2004),
+		}
+
+		r := AggregateResponse{}
+		r.CursorID = 125
+		r.Database = "db"
+		r.Collection = "foo"
+		r.Documents = []bson.D{mockQuery}
+
+		res := ModuleResponse{}
+		res.Write(r)
+
+		resSlice := make([]interface{}, 1)
+		resSlice[0] = bson.M{
+			"cursor": bson.M{
+				"id":         int64(125),
+				"ns":         "db.foo",
+				"firstBatch": []bson.D{mockQuery},
+			},
+			"ok": 1,
+		}
+
+		expected, err := createWireProtocolMessage(reqHeader.RequestID, int32(8), int64(0), int32(0), resSlice)
+		So(err, ShouldBeNil)
+		actual, err := Encode(reqHeader, res)
+		So(err, ShouldBeNil)
+		So(actual, shouldHaveSameContents, expected)
+	})
+}
+
+func TestEncodeFindAndModifyResponse(t *testing.T) {
+	Convey("Convert a FindAndModifyResponse to BSON", t, func() {
+		Convey("for an update that upserted", func() {
+			r := FindAndModifyResponse{
+				Value:    mockQuery,
+				N:        1,
+				Upserted: 5,
+			}
+			So(r.ToBSON(), ShouldResemble, bson.M{
+				"lastErrorObject": bson.M{
+					"n":               int32(1),
+					"updatedExisting": false,
+					"upserted":        5,
+				},
+				"value": mockQuery,
+			})
+		})
+
+		Convey("for a remove that didn't match a document", func() {
+			r := FindAndModifyResponse{Removed: true}
+			So(r.ToBSON(), ShouldResemble, bson.M{
+				"lastErrorObject": bson.M{
+					"n": int32(0),
+				},
+				"value": nil,
+			})
+		})
+	})
+}
+
+func TestEncodeListCollectionsResponse(t *testing.T) {
+	Convey("Encode a ListCollectionsResponse to send over the wire protocol", t, func() {
+
+		reqHeader := MsgHeader{
+			RequestID: int32(5),
+			OpCode:    int32(2004),
+		}
+
+		r := ListCollectionsResponse{}
+		r.Database = "db"
+
+		res := ModuleResponse{}
+		res.Write(r)
+
+		resSlice := make([]interface{}, 1)
+		resSlice[0] = bson.M{
+			"cursor": bson.M{
+				"id":         int64(0),
+				"ns":         "db.$cmd.listCollections",
+				"firstBatch": []bson.D{},
+			},
+			"ok": 1,
+		}
+
+		expected, err := createWireProtocolMessage(reqHeader.RequestID, int32(8), int64(0), int32(0), resSlice)
+		So(err, ShouldBeNil)
+		actual, err := Encode(reqHeader, res)
+		So(err, ShouldBeNil)
+		So(actual, shouldHaveSameContents, expected)
+	})
+}
+
+func TestEncodeCommandReply(t *testing.T) {
+	Convey("Encode a response to a command sent over OP_QUERY", t, func() {
+
+		reqHeader := MsgHeader{
+			RequestID: int32(5),
+			OpCode:    int32(2004),
+		}
+
+		Convey("that is a find", func() {
+			r := FindResponse{}
+			r.CursorID = 125
+			r.Database = "db"
+			r.Collection = "foo"
+			r.Documents = []bson.D{mockQuery}
+
+			res := ModuleResponse{}
+			res.Write(r)
+
+			resSlice := make([]interface{}, 1)
+			resSlice[0] = bson.M{
+				"cursor": bson.M{
+					"id":         int64(125),
+					"ns":         "db.foo",
+					"firstBatch": []bson.D{mockQuery},
+				},
+				"ok": 1,
+			}
+
+			expected, err := createWireProtocolMessage(reqHeader.RequestID, int32(8), int64(0), int32(0), resSlice)
+			So(err, ShouldBeNil)
+			actual, err := EncodeCommandReply(reqHeader, res)
+			So(err, ShouldBeNil)
+			So(actual, shouldHaveSameContents, expected)
+		})
+
+		Convey("that is a getMore with an invalid cursor", func() {
+			r := GetMoreResponse{}
+			r.CursorID = 125
+			r.InvalidCursor = true
+
+			res := ModuleResponse{}
+			res.Write(r)
+
+			resSlice := make([]interface{}, 1)
+			resSlice[0] = bson.M{
+				"ok":     0,
+				"errmsg": "cursor id 125 not found",
+				"code":   43,
+			}
+
+			expected, err := createWireProtocolMessage(reqHeader.RequestID, int32(8), int64(0), int32(0), resSlice)
+			So(err, ShouldBeNil)
+			actual, err := EncodeCommandReply(reqHeader, res)
+			So(err, ShouldBeNil)
+			So(actual, shouldHaveSameContents, expected)
+		})
+	})
+}
+
+func TestExhaustReplyHeaders(t *testing.T) {
+	Convey("Set the header fields of a reply in an exhaust stream", t, func() {
+		res := ModuleResponse{}
+		res.Write(GetMoreResponse{CursorID: 125, Database: "db", Collection: "foo"})
+
+		Convey("for an OP_MSG reply", func() {
+			reqHeader := MsgHeader{RequestID: int32(5), OpCode: OP_MSG}
+			bytes, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			bytes = SetMoreToCome(SetRequestID(bytes, 17))
+			So(binary.LittleEndian.Uint32(bytes[4:8]), ShouldEqual, 17)
+			So(binary.LittleEndian.Uint32(bytes[8:12]), ShouldEqual, 5)
+			So(binary.LittleEndian.Uint32(bytes[16:20]), ShouldEqual, 2)
+		})
+
+		Convey("for an OP_REPLY reply", func() {
+			reqHeader := MsgHeader{RequestID: int32(5), OpCode: OP_QUERY}
+			bytes, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+			original := append([]byte{}, bytes...)
+
+			bytes = SetMoreToCome(SetRequestID(bytes, 17))
+			So(binary.LittleEndian.Uint32(bytes[4:8]), ShouldEqual, 17)
+			So(bytes[12:], ShouldResemble, original[12:])
+		})
+	})
+}
+
+func TestLastErrorResponse(t *testing.T) {
+	Convey("Create a getLastError reply from the last legacy write", t, func() {
+		Convey("when there was no write", func() {
+			r := LastErrorResponse(nil)
+			So(r.Reply, ShouldResemble, bson.M{"n": 0, "err": nil})
+		})
+
+		Convey("when the write was an upsert", func() {
+			res := ModuleResponse{}
+			res.Write(UpdateResponse{
+				N:        1,
+				Upserted: []bson.D{{{"index", 0}, {"_id", 5}}},
+			})
+
+			r := LastErrorResponse(&res)
+			So(r.Reply["n"], ShouldEqual, 1)
+			So(r.Reply["upserted"], ShouldEqual, 5)
+			So(r.Reply["updatedExisting"], ShouldBeFalse)
+			So(r.Reply["err"], ShouldBeNil)
+		})
+
+		Convey("when the write had a write error", func() {
+			res := ModuleResponse{}
+			res.Write(InsertResponse{
+				N:           0,
+				WriteErrors: []bson.M{{"index": 0, "code": 11000, "errmsg": "duplicate key"}},
+			})
+
+			r := LastErrorResponse(&res)
+			So(r.Reply["n"], ShouldEqual, 0)
+			So(r.Reply["err"], ShouldEqual, "duplicate key")
+			So(r.Reply["code"], ShouldEqual, 11000)
+		})
+
+		Convey("when the write concern timed out", func() {
+			res := ModuleResponse{}
+			res.Write(DeleteResponse{
+				N: 2,
+				WriteConcernError: bson.M{"code": 64,
+					"errmsg": "waiting for replication timed out"},
+			})
+
+			r := LastErrorResponse(&res)
+			So(r.Reply["n"], ShouldEqual, 2)
+			So(r.Reply["code"], ShouldEqual, 64)
+			So(r.Reply["wtimeout"], ShouldBeTrue)
+		})
+
+		Convey("when the write failed", func() {
+			res := ModuleResponse{}
+			res.Error(13, "not authorized")
+
+			r := LastErrorResponse(&res)
+			So(r.Reply["err"], ShouldEqual, "not authorized")
+			So(r.Reply["code"], ShouldEqual, 13)
+		})
+	})
+
+	Convey("Report the write concern of a getLastError that the backend waited for", t, func() {
+		res := ModuleResponse{}
+		res.Write(InsertResponse{N: 1})
+
+		Convey("when it waits for replication", func() {
+			gle := Command{CommandName: "getLastError", Database: "test",
+				Args: bson.M{"getLastError": 1, "w": "majority", "wtimeout": 1000}}
+			writeConcern := GetLastErrorWriteConcern(gle)
+			So(writeConcern, ShouldResemble, bson.M{"w": "majority", "wtimeout": 1000})
+			So(WaitsForReplication(writeConcern), ShouldBeTrue)
+
+			backend := ModuleResponse{}
+			backend.Write(CommandResponse{Reply: bson.M{"err": "timeout", "code": 64,
+				"wtimeout": true, "writtenTo": []string{"a:27017"}, "ok": 1}})
+			r := WriteConcernResponse(LastErrorResponse(&res), &backend)
+			So(r.Reply["n"], ShouldEqual, 0)
+			So(r.Reply["err"], ShouldEqual, "timeout")
+			So(r.Reply["code"], ShouldEqual, 64)
+			So(r.Reply["wtimeout"], ShouldBeTrue)
+			So(r.Reply["writtenTo"], ShouldResemble, []string{"a:27017"})
+		})
+
+		Convey("when it waits for the journal", func() {
+			gle := Command{CommandName: "getLastError", Database: "test",
+				Args: bson.M{"getLastError": 1, "fsync": true}}
+			So(WaitsForReplication(GetLastErrorWriteConcern(gle)), ShouldBeTrue)
+		})
+
+		Convey("but not when it only waits for the primary", func() {
+			for _, args := range []bson.M{{"getLastError": 1}, {"getLastError": 1, "w": 1}} {
+				gle := Command{CommandName: "getLastError", Database: "test", Args: args}
+				So(WaitsForReplication(GetLastErrorWriteConcern(gle)), ShouldBeFalse)
+			}
+		})
+
+		Convey("when the backend fails", func() {
+			backend := ModuleResponse{}
+			backend.Error(100, "no replication has been enabled")
+			r := WriteConcernResponse(LastErrorResponse(&res), &backend)
+			So(r.Reply["err"], ShouldEqual, "no replication has been enabled")
+			So(r.Reply["code"], ShouldEqual, 100)
+			So(r.Reply["writeConcernError"].(bson.M)["code"], ShouldEqual, 100)
+		})
+
+		Convey("and keep the error of a write that failed", func() {
+			failed := ModuleResponse{}
+			failed.Error(13, "not authorized")
+			backend := ModuleResponse{}
+			backend.Error(100, "no replication has been enabled")
+			r := WriteConcernResponse(LastErrorResponse(&failed), &backend)
+			So(r.Reply["err"], ShouldEqual, "not authorized")
+			So(r.Reply["code"], ShouldEqual, 13)
+			So(r.Reply["writeConcernError"], ShouldNotBeNil)
+		})
+	})
+}
+
+func TestEncodeOpMsgResponse(t *testing.T) {
+	Convey("Encode a response to an OP_MSG request", t, func() {
+		reqHeader := MsgHeader{
+			RequestID: int32(5),
+			OpCode:    int32(2013),
+		}
+
+		r := InsertResponse{}
+		r.N = 5
+
+		res := ModuleResponse{}
+		res.Write(r)
+
+		actual, err := Encode(reqHeader, res)
+		So(err, ShouldBeNil)
+
+		header := MsgHeader{}
+		err = binary.Read(bytes.NewReader(actual), binary.LittleEndian, &header)
+		So(err, ShouldBeNil)
+		So(header.MessageLength, ShouldEqual, len(actual))
+		So(header.ResponseTo, ShouldEqual, 5)
+		So(header.OpCode, ShouldEqual, OP_MSG)
+
+		// flagBits and the section kind
+		So(actual[16:21], ShouldResemble, []byte{0, 0, 0, 0, 0})
+
+		reply := bson.M{}
+		err = bson.Unmarshal(actual[21:], &reply)
+		So(err, ShouldBeNil)
+		So(reply["n"], ShouldEqual, 5)
+		So(reply["ok"], ShouldEqual, 1)
+	})
+
+	Convey("Encode a command reply to an OP_MSG request", t, func() {
+		reqHeader := MsgHeader{RequestID: int32(5), OpCode: OP_MSG}
+		decode := func(r CommandResponse) bson.M {
+			actual, err := r.ToBytes(reqHeader)
+			So(err, ShouldBeNil)
+			reply := bson.M{}
+			So(bson.Unmarshal(actual[21:], &reply), ShouldBeNil)
+			return reply
+		}
+
+		Convey("without a reply", func() {
+			So(decode(CommandResponse{}), ShouldResemble, bson.M{"ok": 1})
+		})
+
+		Convey("and keep its ok field without changing it", func() {
+			r := CommandResponse{Reply: bson.M{"ok": 0, "errmsg": "failed"}}
+			So(decode(r)["ok"], ShouldEqual, 0)
+
+			r = CommandResponse{Reply: bson.M{"n": 1}}
+			So(decode(r)["ok"], ShouldEqual, 1)
+			So(r.Reply, ShouldResemble, bson.M{"n": 1})
+		})
+	})
+}
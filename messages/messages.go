@@ -3,26 +3,37 @@
 package messages
 
 import (
+	"github.com/mongodbinc-interns/mongoproxy/convert"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // constants representing the different opcodes for the wire protocol.
 const (
-	OP_UPDATE   int32 = 2001
-	OP_INSERT         = 2002
-	OP_QUERY          = 2004
-	OP_GET_MORE       = 2005
-	OP_DELETE         = 2006
+	OP_UPDATE       int32 = 2001
+	OP_INSERT             = 2002
+	OP_QUERY              = 2004
+	OP_GET_MORE           = 2005
+	OP_DELETE             = 2006
+	OP_KILL_CURSORS       = 2007
+	OP_COMPRESSED         = 2012
+	OP_MSG                = 2013
 )
 
 // constants representing the types of request structs supported by proxy core.
 const (
-	CommandType string = "command"
-	FindType           = "find"
-	InsertType         = "insert"
-	UpdateType         = "update"
-	DeleteType         = "delete"
-	GetMoreType        = "getMore"
+	CommandType         string = "command"
+	FindType                   = "find"
+	InsertType                 = "insert"
+	UpdateType                 = "update"
+	DeleteType                 = "delete"
+	GetMoreType                = "getMore"
+	KillCursorsType            = "killCursors"
+	AggregateType              = "aggregate"
+	FindAndModifyType          = "findAndModify"
+	CountType                  = "count"
+	DistinctType               = "distinct"
+	ListCollectionsType        = "listCollections"
+	ListIndexesType            = "listIndexes"
 )
 
 // a struct to represent a wire protocol message header.
@@ -33,6 +44,41 @@ type MsgHeader struct {
 	OpCode        int32
 }
 
+// A RequestHeader is the header of a decoded request, along with any information
+// from the rest of the message that is needed to reply to it.
+type RequestHeader struct {
+	MsgHeader
+
+	// the flagBits of an OP_MSG request. Always 0 for other opcodes.
+	FlagBits int32
+
+	// true if the request was sent as a command, either in an OP_MSG or as an
+	// OP_QUERY on $cmd, rather than with a legacy opcode. Commands are replied
+	// to in the command reply format.
+	Command bool
+
+	// the name of the compressor if the request was sent in an OP_COMPRESSED
+	// message, and empty otherwise. Replies should be compressed with the same compressor.
+	Compressor string
+}
+
+// ChecksumPresent returns true if the request was an OP_MSG with a CRC-32C checksum.
+func (h RequestHeader) ChecksumPresent() bool {
+	return h.OpCode == OP_MSG && convert.ReadBit32LE(h.FlagBits, 0)
+}
+
+// MoreToCome returns true if the request was an OP_MSG with the moreToCome flag
+// set, in which case the client does not expect a reply.
+func (h RequestHeader) MoreToCome() bool {
+	return h.OpCode == OP_MSG && convert.ReadBit32LE(h.FlagBits, 1)
+}
+
+// ExhaustAllowed returns true if the request was an OP_MSG with the exhaustAllowed
+// flag set, in which case the client accepts multiple replies to the request.
+func (h RequestHeader) ExhaustAllowed() bool {
+	return h.OpCode == OP_MSG && convert.ReadBit32LE(h.FlagBits, 16)
+}
+
 // struct for a generic command, the default Requester sent from proxy
 // core to modules
 type Command struct {
@@ -91,12 +137,119 @@ type Find struct {
 	NoCursorTimeout bool
 	AwaitData       bool
 	Partial         bool
+
+	// the index to use, as either an index name or an index specification document.
+	Hint interface{}
+
+	// the exclusive upper and inclusive lower bounds of the index to use.
+	Max bson.D
+	Min bson.D
+
+	MaxTimeMS      int64
+	Comment        string
+	ReadPreference bson.D
+
+	// true if the query plan should be returned instead of the results.
+	Explain      bool
+	Snapshot     bool
+	ShowRecordId bool
+	ReturnKey    bool
+
+	// the batchSize of the cursor. Negative if the batch size is not set.
+	BatchSize int32
+
+	// true if the cursor should be closed after the first batch.
+	SingleBatch bool
+
+	ReadConcern bson.D
+	Collation   bson.D
+
+	// true if the client wants all of the results streamed back without sending
+	// getMores, from the exhaust flag of a legacy query.
+	Exhaust bool
 }
 
 func (f Find) Type() string {
 	return FindType
 }
 
+// ToBSON returns the find as a find command. The read preference and explain
+// options aren't part of the command, and aren't included.
+func (f Find) ToBSON() bson.D {
+	args := bson.D{
+		{"find", f.Collection},
+	}
+
+	if f.Filter != nil {
+		args = append(args, bson.DocElem{"filter", f.Filter})
+	}
+	if f.Sort != nil {
+		args = append(args, bson.DocElem{"sort", f.Sort})
+	}
+	if f.Projection != nil {
+		args = append(args, bson.DocElem{"projection", f.Projection})
+	}
+	if f.Hint != nil {
+		args = append(args, bson.DocElem{"hint", f.Hint})
+	}
+	if f.Skip > 0 {
+		args = append(args, bson.DocElem{"skip", f.Skip})
+	}
+	if f.Limit > 0 {
+		args = append(args, bson.DocElem{"limit", f.Limit})
+	}
+	if f.BatchSize >= 0 {
+		args = append(args, bson.DocElem{"batchSize", f.BatchSize})
+	}
+	if f.SingleBatch {
+		args = append(args, bson.DocElem{"singleBatch", true})
+	}
+	if len(f.Comment) > 0 {
+		args = append(args, bson.DocElem{"comment", f.Comment})
+	}
+	if f.MaxTimeMS > 0 {
+		args = append(args, bson.DocElem{"maxTimeMS", f.MaxTimeMS})
+	}
+	if f.ReadConcern != nil {
+		args = append(args, bson.DocElem{"readConcern", f.ReadConcern})
+	}
+	if f.Max != nil {
+		args = append(args, bson.DocElem{"max", f.Max})
+	}
+	if f.Min != nil {
+		args = append(args, bson.DocElem{"min", f.Min})
+	}
+	if f.ReturnKey {
+		args = append(args, bson.DocElem{"returnKey", true})
+	}
+	if f.ShowRecordId {
+		args = append(args, bson.DocElem{"showRecordId", true})
+	}
+	if f.Snapshot {
+		args = append(args, bson.DocElem{"snapshot", true})
+	}
+	if f.Tailable {
+		args = append(args, bson.DocElem{"tailable", true})
+	}
+	if f.OplogReplay {
+		args = append(args, bson.DocElem{"oplogReplay", true})
+	}
+	if f.NoCursorTimeout {
+		args = append(args, bson.DocElem{"noCursorTimeout", true})
+	}
+	if f.AwaitData {
+		args = append(args, bson.DocElem{"awaitData", true})
+	}
+	if f.Partial {
+		args = append(args, bson.DocElem{"allowPartialResults", true})
+	}
+	if f.Collation != nil {
+		args = append(args, bson.DocElem{"collation", f.Collation})
+	}
+
+	return args
+}
+
 // the struct for the 'insert' command
 type Insert struct {
 	RequestID    int32
@@ -227,3 +380,299 @@ type GetMore struct {
 func (g GetMore) Type() string {
 	return GetMoreType
 }
+
+// struct for 'killCursors' command. Cursors killed with the legacy OP_KILL_CURSORS
+// opcode have no namespace, so the Database and Collection may be empty.
+type KillCursors struct {
+	RequestID  int32
+	Database   string
+	Collection string
+	CursorIDs  []int64
+}
+
+func (k KillCursors) Type() string {
+	return KillCursorsType
+}
+
+func (k KillCursors) ToBSON() bson.D {
+	return bson.D{
+		{"killCursors", k.Collection},
+		{"cursors", k.CursorIDs},
+	}
+}
+
+// struct for 'aggregate' command. An aggregation on a database rather than
+// a collection has an empty Collection.
+type Aggregate struct {
+	RequestID  int32
+	Database   string
+	Collection string
+	Pipeline   []bson.D
+
+	// the batchSize of the cursor. Negative if the batch size is not set.
+	BatchSize int32
+
+	AllowDiskUse bool
+	MaxTimeMS    int64
+	Collation    bson.D
+
+	// the index to use, as either an index name or an index specification document.
+	Hint interface{}
+}
+
+func (a Aggregate) Type() string {
+	return AggregateType
+}
+
+func (a Aggregate) ToBSON() bson.D {
+	var collection interface{} = a.Collection
+	if len(a.Collection) == 0 {
+		collection = 1
+	}
+
+	cursor := bson.D{}
+	if a.BatchSize >= 0 {
+		cursor = append(cursor, bson.DocElem{"batchSize", a.BatchSize})
+	}
+
+	pipeline := a.Pipeline
+	if pipeline == nil {
+		pipeline = make([]bson.D, 0)
+	}
+
+	args := bson.D{
+		{"aggregate", collection},
+		{"pipeline", pipeline},
+		{"cursor", cursor},
+	}
+
+	if a.AllowDiskUse {
+		args = append(args, bson.DocElem{"allowDiskUse", true})
+	}
+	if a.MaxTimeMS > 0 {
+		args = append(args, bson.DocElem{"maxTimeMS", a.MaxTimeMS})
+	}
+	if a.Collation != nil {
+		args = append(args, bson.DocElem{"collation", a.Collation})
+	}
+	if a.Hint != nil {
+		args = append(args, bson.DocElem{"hint", a.Hint})
+	}
+
+	return args
+}
+
+// struct for 'findAndModify' command. Exactly one of Remove and Update is used.
+type FindAndModify struct {
+	RequestID  int32
+	Database   string
+	Collection string
+	Query      bson.D
+	Sort       bson.D
+	Remove     bool
+
+	// the update to apply, as either an update document or, for an update
+	// with an aggregation pipeline, a []bson.D.
+	Update interface{}
+
+	// true if the modified document should be returned rather than the original.
+	New          bool
+	Fields       bson.D
+	Upsert       bool
+	ArrayFilters []bson.D
+	Collation    bson.D
+	MaxTimeMS    int64
+	WriteConcern *bson.M
+}
+
+func (f FindAndModify) Type() string {
+	return FindAndModifyType
+}
+
+func (f FindAndModify) ToBSON() bson.D {
+	args := bson.D{
+		{"findAndModify", f.Collection},
+	}
+
+	if f.Query != nil {
+		args = append(args, bson.DocElem{"query", f.Query})
+	}
+	if f.Sort != nil {
+		args = append(args, bson.DocElem{"sort", f.Sort})
+	}
+	if f.Remove {
+		args = append(args, bson.DocElem{"remove", true})
+	} else {
+		args = append(args, bson.DocElem{"update", f.Update})
+		args = append(args, bson.DocElem{"new", f.New})
+		args = append(args, bson.DocElem{"upsert", f.Upsert})
+	}
+	if f.Fields != nil {
+		args = append(args, bson.DocElem{"fields", f.Fields})
+	}
+	if f.ArrayFilters != nil {
+		args = append(args, bson.DocElem{"arrayFilters", f.ArrayFilters})
+	}
+	if f.Collation != nil {
+		args = append(args, bson.DocElem{"collation", f.Collation})
+	}
+	if f.MaxTimeMS > 0 {
+		args = append(args, bson.DocElem{"maxTimeMS", f.MaxTimeMS})
+	}
+	if f.WriteConcern != nil {
+		args = append(args, bson.DocElem{"writeConcern", *f.WriteConcern})
+	}
+
+	return args
+}
+
+// struct for 'count' command. A Limit or Skip of 0 means that the
+// option isn't set.
+type Count struct {
+	RequestID  int32
+	Database   string
+	Collection string
+	Query      bson.D
+	Limit      int64
+	Skip       int64
+
+	// the index to use, as either an index name or an index specification document.
+	Hint interface{}
+
+	MaxTimeMS int64
+	Collation bson.D
+}
+
+func (c Count) Type() string {
+	return CountType
+}
+
+func (c Count) ToBSON() bson.D {
+	args := bson.D{
+		{"count", c.Collection},
+	}
+
+	if c.Query != nil {
+		args = append(args, bson.DocElem{"query", c.Query})
+	}
+	if c.Limit != 0 {
+		args = append(args, bson.DocElem{"limit", c.Limit})
+	}
+	if c.Skip > 0 {
+		args = append(args, bson.DocElem{"skip", c.Skip})
+	}
+	if c.Hint != nil {
+		args = append(args, bson.DocElem{"hint", c.Hint})
+	}
+	if c.MaxTimeMS > 0 {
+		args = append(args, bson.DocElem{"maxTimeMS", c.MaxTimeMS})
+	}
+	if c.Collation != nil {
+		args = append(args, bson.DocElem{"collation", c.Collation})
+	}
+
+	return args
+}
+
+// struct for 'distinct' command.
+type Distinct struct {
+	RequestID  int32
+	Database   string
+	Collection string
+	Key        string
+	Query      bson.D
+	MaxTimeMS  int64
+	Collation  bson.D
+}
+
+func (d Distinct) Type() string {
+	return DistinctType
+}
+
+func (d Distinct) ToBSON() bson.D {
+	args := bson.D{
+		{"distinct", d.Collection},
+		{"key", d.Key},
+	}
+
+	if d.Query != nil {
+		args = append(args, bson.DocElem{"query", d.Query})
+	}
+	if d.MaxTimeMS > 0 {
+		args = append(args, bson.DocElem{"maxTimeMS", d.MaxTimeMS})
+	}
+	if d.Collation != nil {
+		args = append(args, bson.DocElem{"collation", d.Collation})
+	}
+
+	return args
+}
+
+// struct for 'listCollections' command.
+type ListCollections struct {
+	RequestID int32
+	Database  string
+	Filter    bson.D
+
+	// true if only the names and types of the collections should be returned.
+	NameOnly bool
+
+	AuthorizedCollections bool
+
+	// the batchSize of the cursor. Negative if the batch size is not set.
+	BatchSize int32
+}
+
+func (l ListCollections) Type() string {
+	return ListCollectionsType
+}
+
+func (l ListCollections) ToBSON() bson.D {
+	cursor := bson.D{}
+	if l.BatchSize >= 0 {
+		cursor = append(cursor, bson.DocElem{"batchSize", l.BatchSize})
+	}
+
+	args := bson.D{
+		{"listCollections", 1},
+		{"cursor", cursor},
+	}
+
+	if l.Filter != nil {
+		args = append(args, bson.DocElem{"filter", l.Filter})
+	}
+	if l.NameOnly {
+		args = append(args, bson.DocElem{"nameOnly", true})
+	}
+	if l.AuthorizedCollections {
+		args = append(args, bson.DocElem{"authorizedCollections", true})
+	}
+
+	return args
+}
+
+// struct for 'listIndexes' command.
+type ListIndexes struct {
+	RequestID  int32
+	Database   string
+	Collection string
+
+	// the batchSize of the cursor. Negative if the batch size is not set.
+	BatchSize int32
+}
+
+func (l ListIndexes) Type() string {
+	return ListIndexesType
+}
+
+func (l ListIndexes) ToBSON() bson.D {
+	cursor := bson.D{}
+	if l.BatchSize >= 0 {
+		cursor = append(cursor, bson.DocElem{"batchSize", l.BatchSize})
+	}
+
+	return bson.D{
+		{"listIndexes", l.Collection},
+		{"cursor", cursor},
+	}
+}
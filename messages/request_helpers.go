@@ -2,6 +2,11 @@ package messages
 
 import (
 	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
 )
 
 func ToFindRequest(r Requester) (Find, error) {
@@ -44,6 +49,62 @@ func ToDeleteRequest(r Requester) (Delete, error) {
 	return f, nil
 }
 
+func ToKillCursorsRequest(r Requester) (KillCursors, error) {
+	k, ok := r.(KillCursors)
+	if !ok {
+		return KillCursors{}, fmt.Errorf("Requester was not a killCursors object. Requester received instead: %#v", r)
+	}
+	return k, nil
+}
+
+func ToAggregateRequest(r Requester) (Aggregate, error) {
+	a, ok := r.(Aggregate)
+	if !ok {
+		return Aggregate{}, fmt.Errorf("Requester was not an aggregate object. Requester received instead: %#v", r)
+	}
+	return a, nil
+}
+
+func ToFindAndModifyRequest(r Requester) (FindAndModify, error) {
+	f, ok := r.(FindAndModify)
+	if !ok {
+		return FindAndModify{}, fmt.Errorf("Requester was not a findAndModify object. Requester received instead: %#v", r)
+	}
+	return f, nil
+}
+
+func ToCountRequest(r Requester) (Count, error) {
+	c, ok := r.(Count)
+	if !ok {
+		return Count{}, fmt.Errorf("Requester was not a count object. Requester received instead: %#v", r)
+	}
+	return c, nil
+}
+
+func ToDistinctRequest(r Requester) (Distinct, error) {
+	d, ok := r.(Distinct)
+	if !ok {
+		return Distinct{}, fmt.Errorf("Requester was not a distinct object. Requester received instead: %#v", r)
+	}
+	return d, nil
+}
+
+func ToListCollectionsRequest(r Requester) (ListCollections, error) {
+	l, ok := r.(ListCollections)
+	if !ok {
+		return ListCollections{}, fmt.Errorf("Requester was not a listCollections object. Requester received instead: %#v", r)
+	}
+	return l, nil
+}
+
+func ToListIndexesRequest(r Requester) (ListIndexes, error) {
+	l, ok := r.(ListIndexes)
+	if !ok {
+		return ListIndexes{}, fmt.Errorf("Requester was not a listIndexes object. Requester received instead: %#v", r)
+	}
+	return l, nil
+}
+
 func ToCommandRequest(r Requester) (Command, error) {
 	c, ok := r.(Command)
 	if !ok {
@@ -51,3 +112,230 @@ func ToCommandRequest(r Requester) (Command, error) {
 	}
 	return c, nil
 }
+
+// MaxTimeMS returns the time limit in milliseconds that the client set on a request
+// with maxTimeMS, or 0 if it has no limit. The maxTimeMS of a getMore isn't a limit,
+// since it is how long to wait for new documents on a tailable cursor.
+func MaxTimeMS(r Requester) int64 {
+	switch req := r.(type) {
+	case Find:
+		return req.MaxTimeMS
+	case Aggregate:
+		return req.MaxTimeMS
+	case FindAndModify:
+		return req.MaxTimeMS
+	case Count:
+		return req.MaxTimeMS
+	case Distinct:
+		return req.MaxTimeMS
+	case Command:
+		return convert.ToInt64(req.GetArg("maxTimeMS"), 0)
+	}
+	return 0
+}
+
+// Namespace returns the database and collection that a request operates on. The
+// collection is empty for requests on a whole database, and for commands whose first
+// argument isn't a collection name.
+func Namespace(r Requester) (string, string) {
+	switch req := r.(type) {
+	case Find:
+		return req.Database, req.Collection
+	case Insert:
+		return req.Database, req.Collection
+	case Update:
+		return req.Database, req.Collection
+	case Delete:
+		return req.Database, req.Collection
+	case GetMore:
+		return req.Database, req.Collection
+	case KillCursors:
+		return req.Database, req.Collection
+	case Aggregate:
+		return req.Database, req.Collection
+	case FindAndModify:
+		return req.Database, req.Collection
+	case Count:
+		return req.Database, req.Collection
+	case Distinct:
+		return req.Database, req.Collection
+	case ListCollections:
+		return req.Database, ""
+	case ListIndexes:
+		return req.Database, req.Collection
+	case Command:
+		collection, _ := req.GetArg(req.CommandName).(string)
+		return req.Database, collection
+	}
+	return "", ""
+}
+
+// CommandName returns the name of the command for a request. Requests that aren't
+// generic commands are named after their type, which is the name of the command
+// for the same operation.
+func CommandName(r Requester) string {
+	c, ok := r.(Command)
+	if ok {
+		return c.CommandName
+	}
+	return r.Type()
+}
+
+// LogFields returns the fields that describe a request in log lines: its type, the
+// name of the command, and its namespace.
+func LogFields(r Requester) Fields {
+	fields := Fields{"type": r.Type()}
+	if r.Type() == CommandType {
+		fields["command"] = CommandName(r)
+	}
+	database, collection := Namespace(r)
+	if len(database) > 0 {
+		fields["database"] = database
+	}
+	if len(collection) > 0 {
+		fields["collection"] = collection
+	}
+	return fields
+}
+
+// FilterShape returns the normalized shape of a request: its filter, pipeline or
+// command arguments with every value replaced by "?", so that operations that only
+// differ in their values have the same shape. Updates and deletes use the selector
+// of their first statement.
+func FilterShape(req Requester) string {
+	switch r := req.(type) {
+	case Find:
+		return bsonutil.Shape(r.Filter)
+	case Count:
+		return bsonutil.Shape(r.Query)
+	case Distinct:
+		return bsonutil.Shape(r.Query)
+	case FindAndModify:
+		return bsonutil.Shape(r.Query)
+	case Update:
+		if len(r.Updates) > 0 {
+			return bsonutil.Shape(r.Updates[0].Selector)
+		}
+	case Delete:
+		if len(r.Deletes) > 0 {
+			return bsonutil.Shape(r.Deletes[0].Selector)
+		}
+	case Aggregate:
+		return bsonutil.Shape(r.Pipeline)
+	case Command:
+		// the command name comes first, as it does on the wire
+		shape := bson.D{{r.CommandName, r.GetArg(r.CommandName)}}
+		keys := make([]string, 0, len(r.Args))
+		for k := range r.Args {
+			if k != r.CommandName {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for i := 0; i < len(keys); i++ {
+			shape = append(shape, bson.DocElem{keys[i], r.Args[keys[i]]})
+		}
+		return bsonutil.Shape(shape)
+	}
+	return ""
+}
+
+// GetLastErrorWriteConcern returns the write concern that a getLastError command
+// asks for with its w, j, wtimeout and fsync options, or an empty document if it
+// asks for none.
+func GetLastErrorWriteConcern(gle Command) bson.M {
+	writeConcern := bson.M{}
+	for _, option := range []string{"w", "j", "wtimeout"} {
+		value := gle.GetArg(option)
+		if value != nil {
+			writeConcern[option] = value
+		}
+	}
+	if convert.ToBool(gle.GetArg("fsync")) {
+		writeConcern["j"] = true
+	}
+	return writeConcern
+}
+
+// WalkPipeline calls f with the name and specification of every stage of an
+// aggregation pipeline, including the stages of the pipelines in $lookup, $unionWith
+// and $facet stages.
+func WalkPipeline(pipeline []bson.D, f func(stage string, spec interface{})) {
+	for i := 0; i < len(pipeline); i++ {
+		for j := 0; j < len(pipeline[i]); j++ {
+			stage, spec := pipeline[i][j].Name, pipeline[i][j].Value
+			f(stage, spec)
+
+			var subPipelines []interface{}
+			switch stage {
+			case "$lookup", "$unionWith":
+				subPipelines = append(subPipelines, convert.ToBSONMap(spec)["pipeline"])
+			case "$facet":
+				for _, facet := range convert.ToBSONMap(spec) {
+					subPipelines = append(subPipelines, facet)
+				}
+			}
+			for k := 0; k < len(subPipelines); k++ {
+				sub, err := convert.ConvertToBSONDocSlice(subPipelines[k])
+				if err == nil {
+					WalkPipeline(sub, f)
+				}
+			}
+		}
+	}
+}
+
+// A StageNamespace is a namespace that a stage of an aggregation pipeline reads
+// from or writes to.
+type StageNamespace struct {
+	Stage      string
+	Database   string
+	Collection string
+}
+
+// PipelineNamespaces returns the namespaces that the stages of an aggregation
+// pipeline on the database read with $lookup, $graphLookup and $unionWith, and write
+// to with $out and $merge, including the stages of nested pipelines.
+func PipelineNamespaces(database string, pipeline []bson.D) []StageNamespace {
+	namespaces := make([]StageNamespace, 0)
+	WalkPipeline(pipeline, func(stage string, spec interface{}) {
+		var target interface{}
+		switch stage {
+		case "$lookup", "$graphLookup":
+			target = convert.ToBSONMap(spec)["from"]
+		case "$unionWith":
+			target = spec
+			if m := convert.ToBSONMap(spec); m != nil {
+				target = m["coll"]
+			}
+		case "$merge":
+			target = spec
+			if m := convert.ToBSONMap(spec); m != nil {
+				target = m["into"]
+			}
+		case "$out":
+			// either a collection, or a document with the db and coll
+			target = spec
+		default:
+			return
+		}
+		// a $lookup of documents from a $documents stage doesn't read a collection
+		if target == nil {
+			return
+		}
+
+		ns := StageNamespace{Stage: stage, Database: database}
+		collection, ok := target.(string)
+		if ok {
+			ns.Collection = collection
+		} else {
+			m := convert.ToBSONMap(target)
+			ns.Collection = convert.ToString(m["coll"])
+			if db := convert.ToString(m["db"]); len(db) > 0 {
+				ns.Database = db
+			}
+		}
+		namespaces = append(namespaces, ns)
+	})
+	return namespaces
+}
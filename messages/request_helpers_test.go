@@ -0,0 +1,64 @@
+package messages
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestFilterShape(t *testing.T) {
+	Convey("Normalize the filter of", t, func() {
+		Convey("a find", func() {
+			So(FilterShape(Find{Filter: bson.D{{"x", "y"}}}), ShouldEqual, "{ x: ? }")
+		})
+
+		Convey("a delete", func() {
+			So(FilterShape(Delete{Deletes: []SingleDelete{{Selector: bson.D{{"_id", 3}}}}}),
+				ShouldEqual, "{ _id: ? }")
+		})
+
+		Convey("an aggregation", func() {
+			So(FilterShape(Aggregate{Pipeline: []bson.D{
+				{{"$match", bson.D{{"status", "A"}}}},
+				{{"$group", bson.D{{"_id", "$cust"}, {"total", bson.D{{"$sum", "$amount"}}}}}},
+			}}), ShouldEqual, "[ { $match: { status: ? } }, { $group: { _id: ?, total: { $sum: ? } } } ]")
+		})
+
+		Convey("a command", func() {
+			So(FilterShape(Command{CommandName: "collStats", Args: bson.M{"collStats": "foo", "scale": 1024}}),
+				ShouldEqual, "{ collStats: ?, scale: ? }")
+		})
+	})
+}
+
+func TestPipelineNamespaces(t *testing.T) {
+	Convey("Find the namespaces that an aggregation pipeline reads and writes", t, func() {
+		pipeline := []bson.D{
+			{{"$lookup", bson.D{{"from", "customers"}, {"localField", "cust"},
+				{"foreignField", "_id"}, {"as", "customer"}}}},
+			{{"$facet", bson.D{{"byRegion", []interface{}{
+				bson.D{{"$graphLookup", bson.D{{"from", "regions"}, {"startWith", "$region"}}}},
+			}}}}},
+			{{"$unionWith", bson.D{{"coll", "archive"}, {"pipeline", []interface{}{
+				bson.D{{"$lookup", bson.D{{"from", "payments"}, {"pipeline", []interface{}{
+					bson.D{{"$unionWith", "refunds"}},
+				}}}}},
+			}}}}},
+			{{"$match", bson.D{{"status", "A"}}}},
+			{{"$merge", bson.D{{"into", bson.D{{"db", "reports"}, {"coll", "totals"}}}}}},
+		}
+
+		So(PipelineNamespaces("sales", pipeline), ShouldResemble, []StageNamespace{
+			{"$lookup", "sales", "customers"},
+			{"$graphLookup", "sales", "regions"},
+			{"$unionWith", "sales", "archive"},
+			{"$lookup", "sales", "payments"},
+			{"$unionWith", "sales", "refunds"},
+			{"$merge", "reports", "totals"},
+		})
+
+		So(PipelineNamespaces("sales", []bson.D{{{"$out", "copy"}}}), ShouldResemble,
+			[]StageNamespace{{"$out", "sales", "copy"}})
+		So(PipelineNamespaces("sales", []bson.D{{{"$match", bson.D{}}}}), ShouldBeEmpty)
+	})
+}
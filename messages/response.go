@@ -1,5 +1,10 @@
 package messages
 
+import (
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"reflect"
+)
+
 // A ResponderError is used to represent an error in a module response.
 type ResponderError struct {
 	ErrorCode int32
@@ -30,6 +35,21 @@ func (r *ModuleResponse) Type() string {
 	return "response"
 }
 
+// LogFields returns the fields that describe a response in log lines: the error, or
+// the type of the reply.
+func (r *ModuleResponse) LogFields() Fields {
+	if r.CommandError != nil {
+		return Fields{
+			"errorCode": r.CommandError.ErrorCode,
+			"errmsg":    r.CommandError.Message,
+		}
+	}
+	if r.Writer == nil {
+		return Fields{}
+	}
+	return Fields{"reply": reflect.TypeOf(r.Writer).Name()}
+}
+
 func (r *ModuleResponse) Write(writer ResponseWriter) {
 	r.Writer = writer
 }
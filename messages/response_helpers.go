@@ -3,6 +3,7 @@ package messages
 import (
 	"bytes"
 	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
 	"github.com/mongodbinc-interns/mongoproxy/buffer"
 	"github.com/mongodbinc-interns/mongoproxy/convert"
 	"gopkg.in/mgo.v2/bson"
@@ -27,7 +28,24 @@ type CommandResponse struct {
 	Documents []bson.D
 }
 
+// replyWithOK returns a copy of a command reply that has an ok field, which is 1
+// unless the reply already has one. A nil reply is an empty document.
+func replyWithOK(reply bson.M) bson.M {
+	out := make(bson.M, len(reply)+1)
+	for k, v := range reply {
+		out[k] = v
+	}
+	if _, ok := out["ok"]; !ok {
+		out["ok"] = 1
+	}
+	return out
+}
+
 func (c CommandResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	if header.OpCode == OP_MSG {
+		return EncodeOpMsg(header, 0, replyWithOK(c.Reply))
+	}
+
 	resHeader := createResponseHeader(header)
 	startingFrom := int32(0)
 
@@ -41,9 +59,7 @@ func (c CommandResponse) ToBytes(header MsgHeader) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error writing prepared response: %v", err)
 	}
-	reply := c.Reply
-	reply["ok"] = 1
-	docBytes, err := marshalReplyDocs(reply, c.Documents)
+	docBytes, err := marshalReplyDocs(replyWithOK(c.Reply), c.Documents)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling documents: %v", err)
 	}
@@ -72,6 +88,10 @@ type FindResponse struct {
 }
 
 func (f FindResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	if header.OpCode == OP_MSG {
+		return EncodeOpMsg(header, 0, f.commandReply())
+	}
+
 	resHeader := createResponseHeader(header)
 	startingFrom := int32(0)
 
@@ -118,6 +138,20 @@ func (f FindResponse) ToBytes(header MsgHeader) ([]byte, error) {
 	return resp, nil
 }
 
+func (f FindResponse) commandReply() bson.M {
+	errMsg, ok := f.QueryFailure["$err"]
+	if ok {
+		return bson.M{
+			"ok":     0,
+			"errmsg": convert.ToString(errMsg),
+			"code":   convert.ToInt32(f.QueryFailure["code"]),
+		}
+	}
+	b := f.ToBSON()
+	b["ok"] = 1
+	return b
+}
+
 // ToBSON converts a FindResponse to a BSON format that is compatible with
 // the command response spec
 func (f FindResponse) ToBSON() bson.M {
@@ -140,6 +174,10 @@ type GetMoreResponse struct {
 }
 
 func (g GetMoreResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	if header.OpCode == OP_MSG {
+		return EncodeOpMsg(header, 0, g.commandReply())
+	}
+
 	resHeader := createResponseHeader(header)
 	startingFrom := int32(0)
 
@@ -182,6 +220,19 @@ func (g GetMoreResponse) ToBytes(header MsgHeader) ([]byte, error) {
 	return resp, nil
 }
 
+func (g GetMoreResponse) commandReply() bson.M {
+	if g.InvalidCursor {
+		return bson.M{
+			"ok":     0,
+			"errmsg": fmt.Sprintf("cursor id %v not found", g.CursorID),
+			"code":   43, // CursorNotFound
+		}
+	}
+	b := g.ToBSON()
+	b["ok"] = 1
+	return b
+}
+
 func (g GetMoreResponse) ToBSON() bson.M {
 
 	return bson.M{
@@ -193,6 +244,202 @@ func (g GetMoreResponse) ToBSON() bson.M {
 	}
 }
 
+// A struct that represents a response to an aggregate command.
+type AggregateResponse struct {
+	CursorID   int64
+	Database   string
+	Collection string
+	Documents  []bson.D
+}
+
+func (a AggregateResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := a.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+// ToBSON converts an AggregateResponse to the command reply for an aggregation,
+// with the first batch of the cursor.
+func (a AggregateResponse) ToBSON() bson.M {
+	docs := a.Documents
+	if docs == nil {
+		docs = make([]bson.D, 0)
+	}
+
+	return bson.M{
+		"cursor": bson.M{
+			"id":         a.CursorID,
+			"ns":         a.Database + "." + a.Collection,
+			"firstBatch": docs,
+		},
+	}
+}
+
+// A struct that represents a response to a findAndModify command.
+type FindAndModifyResponse struct {
+	// the original or modified document, or nil if no document matched the query.
+	Value bson.D
+
+	// the number of documents that were modified or removed.
+	N int32
+
+	// true if the command removed the document, in which case updatedExisting
+	// isn't reported.
+	Removed bool
+
+	// true if an existing document was updated
+	UpdatedExisting bool
+
+	// the _id of the upserted document, if there was one
+	Upserted interface{}
+
+	// an error waiting for the write concern to be satisfied, if there was one
+	WriteConcernError bson.M
+}
+
+func (f FindAndModifyResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := f.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (f FindAndModifyResponse) ToBSON() bson.M {
+	lastErrorObject := bson.M{
+		"n": f.N,
+	}
+	if !f.Removed {
+		lastErrorObject["updatedExisting"] = f.UpdatedExisting
+	}
+	if f.Upserted != nil {
+		lastErrorObject["upserted"] = f.Upserted
+	}
+
+	// value is null rather than an empty document when nothing matched
+	var value interface{}
+	if f.Value != nil {
+		value = f.Value
+	}
+
+	r := bson.M{
+		"lastErrorObject": lastErrorObject,
+		"value":           value,
+	}
+	if f.WriteConcernError != nil {
+		r["writeConcernError"] = f.WriteConcernError
+	}
+
+	return r
+}
+
+// A struct that represents a response to a count command.
+type CountResponse struct {
+	N int64
+}
+
+func (c CountResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := c.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (c CountResponse) ToBSON() bson.M {
+	return bson.M{
+		"n": c.N,
+	}
+}
+
+// A struct that represents a response to a distinct command.
+type DistinctResponse struct {
+	Values []interface{}
+}
+
+func (d DistinctResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := d.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (d DistinctResponse) ToBSON() bson.M {
+	values := d.Values
+	if values == nil {
+		values = make([]interface{}, 0)
+	}
+
+	return bson.M{
+		"values": values,
+	}
+}
+
+// A struct that represents a response to a listCollections command.
+type ListCollectionsResponse struct {
+	CursorID int64
+	Database string
+
+	// the collection of the cursor namespace. Defaults to $cmd.listCollections
+	// if empty.
+	Collection string
+
+	// the collection information documents, in the first batch of the cursor
+	Collections []bson.D
+}
+
+func (l ListCollectionsResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := l.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (l ListCollectionsResponse) ToBSON() bson.M {
+	collection := l.Collection
+	if len(collection) == 0 {
+		collection = "$cmd.listCollections"
+	}
+
+	collections := l.Collections
+	if collections == nil {
+		collections = make([]bson.D, 0)
+	}
+
+	return bson.M{
+		"cursor": bson.M{
+			"id":         l.CursorID,
+			"ns":         l.Database + "." + collection,
+			"firstBatch": collections,
+		},
+	}
+}
+
+// A struct that represents a response to a listIndexes command.
+type ListIndexesResponse struct {
+	CursorID   int64
+	Database   string
+	Collection string
+
+	// the index specification documents, in the first batch of the cursor
+	Indexes []bson.D
+}
+
+func (l ListIndexesResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := l.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (l ListIndexesResponse) ToBSON() bson.M {
+	indexes := l.Indexes
+	if indexes == nil {
+		indexes = make([]bson.D, 0)
+	}
+
+	return bson.M{
+		"cursor": bson.M{
+			"id":         l.CursorID,
+			"ns":         l.Database + "." + l.Collection,
+			"firstBatch": indexes,
+		},
+	}
+}
+
 // A struct that represents a response to an insert command.
 type InsertResponse struct {
 
@@ -203,6 +450,9 @@ type InsertResponse struct {
 	// a list of write errors
 	// TODO: create a WriteError struct
 	WriteErrors []bson.M
+
+	// an error waiting for the write concern to be satisfied, if there was one
+	WriteConcernError bson.M
 }
 
 func (i InsertResponse) ToBytes(header MsgHeader) ([]byte, error) {
@@ -222,6 +472,9 @@ func (i InsertResponse) ToBSON() bson.M {
 	if i.WriteErrors != nil && len(i.WriteErrors) > 0 {
 		r["writeErrors"] = i.WriteErrors
 	}
+	if i.WriteConcernError != nil {
+		r["writeConcernError"] = i.WriteConcernError
+	}
 
 	return r
 }
@@ -241,6 +494,9 @@ type UpdateResponse struct {
 
 	// a list of write errors that occurred while updating
 	WriteErrors []bson.M
+
+	// an error waiting for the write concern to be satisfied, if there was one
+	WriteConcernError bson.M
 }
 
 func (u UpdateResponse) ToBytes(header MsgHeader) ([]byte, error) {
@@ -263,6 +519,9 @@ func (u UpdateResponse) ToBSON() bson.M {
 	if u.WriteErrors != nil && len(u.WriteErrors) > 0 {
 		r["writeErrors"] = u.WriteErrors
 	}
+	if u.WriteConcernError != nil {
+		r["writeConcernError"] = u.WriteConcernError
+	}
 
 	return r
 }
@@ -274,6 +533,9 @@ type DeleteResponse struct {
 
 	// a list of write errors that occurred while deleting
 	WriteErrors []bson.M
+
+	// an error waiting for the write concern to be satisfied, if there was one
+	WriteConcernError bson.M
 }
 
 func (d DeleteResponse) ToBytes(header MsgHeader) ([]byte, error) {
@@ -290,6 +552,186 @@ func (d DeleteResponse) ToBSON() bson.M {
 	if d.WriteErrors != nil && len(d.WriteErrors) > 0 {
 		r["writeErrors"] = d.WriteErrors
 	}
+	if d.WriteConcernError != nil {
+		r["writeConcernError"] = d.WriteConcernError
+	}
+
+	return r
+}
+
+// A struct that represents a response to a killCursors command.
+type KillCursorsResponse struct {
+	// the cursors that were killed
+	CursorsKilled []int64
+
+	// the cursors that weren't found on the server
+	CursorsNotFound []int64
+
+	// the cursors that were found, but couldn't be killed
+	CursorsAlive []int64
+
+	// the cursors whose status couldn't be determined
+	CursorsUnknown []int64
+}
+
+func (k KillCursorsResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := k.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (k KillCursorsResponse) ToBSON() bson.M {
+	r := bson.M{
+		"cursorsKilled":   k.CursorsKilled,
+		"cursorsNotFound": k.CursorsNotFound,
+		"cursorsAlive":    k.CursorsAlive,
+		"cursorsUnknown":  k.CursorsUnknown,
+	}
+
+	// the fields are always arrays in command replies
+	for key, value := range r {
+		if value.([]int64) == nil {
+			r[key] = make([]int64, 0)
+		}
+	}
 
 	return r
 }
+
+// LastErrorResponse creates the reply to a getLastError command from the response
+// to the last legacy write on a connection. A nil response means that there was no write.
+func LastErrorResponse(res *ModuleResponse) CommandResponse {
+	reply := bson.M{
+		"n":   0,
+		"err": nil,
+	}
+	if res == nil {
+		return CommandResponse{Reply: reply}
+	}
+
+	if res.CommandError != nil {
+		reply["err"] = res.CommandError.Message
+		reply["code"] = res.CommandError.ErrorCode
+		return CommandResponse{Reply: reply}
+	}
+
+	var writeErrors []bson.M
+	var writeConcernError bson.M
+	switch r := res.Writer.(type) {
+	case InsertResponse:
+		// getLastError doesn't count inserted documents
+		writeErrors = r.WriteErrors
+		writeConcernError = r.WriteConcernError
+	case UpdateResponse:
+		if r.N >= 0 {
+			reply["n"] = r.N
+		}
+		if len(r.Upserted) > 0 {
+			reply["upserted"] = bsonutil.FindValueByKey("_id", r.Upserted[0])
+			reply["updatedExisting"] = false
+		} else {
+			reply["updatedExisting"] = r.N > 0
+		}
+		writeErrors = r.WriteErrors
+		writeConcernError = r.WriteConcernError
+	case DeleteResponse:
+		if r.N >= 0 {
+			reply["n"] = r.N
+		}
+		writeErrors = r.WriteErrors
+		writeConcernError = r.WriteConcernError
+	}
+
+	if len(writeErrors) > 0 {
+		reply["err"] = writeErrors[0]["errmsg"]
+		reply["code"] = writeErrors[0]["code"]
+	} else if writeConcernError != nil {
+		reply["err"] = writeConcernError["errmsg"]
+		reply["code"] = writeConcernError["code"]
+
+		// WriteConcernFailed, which is returned when wtimeout expires
+		if convert.ToInt32(writeConcernError["code"]) == 64 {
+			reply["wtimeout"] = true
+		}
+	}
+
+	return CommandResponse{Reply: reply}
+}
+
+// WaitsForReplication returns true if a write concern waits for more than the
+// primary's acknowledgement of a write, which is the default.
+func WaitsForReplication(writeConcern bson.M) bool {
+	w, hasW := writeConcern["w"]
+	return (hasW && convert.ToInt64(w, 2) > 1) || convert.ToBool(writeConcern["j"])
+}
+
+// the fields of a getLastError reply that report how its write concern was waited for.
+var writeConcernFields = []string{"wtimeout", "waited", "wtime", "writtenTo", "wnote",
+	"writeConcernError"}
+
+// WriteConcernResponse adds the result of waiting for a write concern to the reply to
+// a getLastError, from the response of the backend to the same getLastError. The error
+// of the write is kept if it had one, and otherwise an error waiting for the write
+// concern is the error of the reply.
+func WriteConcernResponse(r CommandResponse, backend *ModuleResponse) CommandResponse {
+	if backend.CommandError != nil {
+		errmsg := backend.CommandError.Message
+		code := backend.CommandError.ErrorCode
+		r.Reply["writeConcernError"] = bson.M{"code": code, "errmsg": errmsg}
+		if r.Reply["err"] == nil {
+			r.Reply["err"] = errmsg
+			r.Reply["code"] = code
+		}
+		return r
+	}
+	if backend.Writer == nil {
+		return r
+	}
+
+	reply := backend.Writer.ToBSON()
+	for i := 0; i < len(writeConcernFields); i++ {
+		value, ok := reply[writeConcernFields[i]]
+		if ok {
+			r.Reply[writeConcernFields[i]] = value
+		}
+	}
+	if r.Reply["err"] == nil && reply["err"] != nil {
+		r.Reply["err"] = reply["err"]
+		r.Reply["code"] = reply["code"]
+	}
+	return r
+}
+
+// DocumentCounts returns the number of documents that a response returned, or that
+// a write affected. Negative counts aren't sent to the client, so they aren't
+// reported either.
+func DocumentCounts(w ResponseWriter) (*int64, *int64) {
+	count := func(n int64) *int64 {
+		if n < 0 {
+			return nil
+		}
+		return &n
+	}
+
+	switch r := w.(type) {
+	case FindResponse:
+		return count(int64(len(r.Documents))), nil
+	case GetMoreResponse:
+		return count(int64(len(r.Documents))), nil
+	case AggregateResponse:
+		return count(int64(len(r.Documents))), nil
+	case CountResponse:
+		return count(r.N), nil
+	case DistinctResponse:
+		return count(int64(len(r.Values))), nil
+	case InsertResponse:
+		return nil, count(int64(r.N))
+	case UpdateResponse:
+		return nil, count(int64(r.N))
+	case DeleteResponse:
+		return nil, count(int64(r.N))
+	case FindAndModifyResponse:
+		return nil, count(int64(r.N))
+	}
+	return nil, nil
+}
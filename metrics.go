@@ -0,0 +1,133 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"net/http"
+)
+
+// the path that metrics are served on if the configuration doesn't set one.
+const defaultMetricsPath = "/metrics"
+
+var (
+	connectionsOpen = metrics.RegisterGauge("mongoproxy_connections_open",
+		"Client connections that are open.")
+	connectionsAccepted = metrics.RegisterCounter("mongoproxy_connections_accepted_total",
+		"Client connections that were accepted.")
+	requestsTotal = metrics.RegisterCounter("mongoproxy_requests_total",
+		"Requests received, by opcode and request type.", "opcode", "type")
+	requestDuration = metrics.RegisterHistogram("mongoproxy_request_duration_seconds",
+		"Time taken to handle a request and write its response, by request type.",
+		metrics.DefaultBuckets, "type")
+	decodeErrors = metrics.RegisterCounter("mongoproxy_decode_errors_total",
+		"Messages from clients that couldn't be decoded.")
+	encodeErrors = metrics.RegisterCounter("mongoproxy_encode_errors_total",
+		"Responses that couldn't be encoded.")
+	bytesReceived = metrics.RegisterCounter("mongoproxy_bytes_received_total",
+		"Bytes read from client connections.")
+	bytesSent = metrics.RegisterCounter("mongoproxy_bytes_sent_total",
+		"Bytes written to client connections.")
+)
+
+// opCodeName returns the name of an opcode, for use as the value of a label.
+func opCodeName(opCode int32) string {
+	switch opCode {
+	case messages.OP_UPDATE:
+		return "OP_UPDATE"
+	case messages.OP_INSERT:
+		return "OP_INSERT"
+	case messages.OP_QUERY:
+		return "OP_QUERY"
+	case messages.OP_GET_MORE:
+		return "OP_GET_MORE"
+	case messages.OP_DELETE:
+		return "OP_DELETE"
+	case messages.OP_KILL_CURSORS:
+		return "OP_KILL_CURSORS"
+	case messages.OP_COMPRESSED:
+		return "OP_COMPRESSED"
+	case messages.OP_MSG:
+		return "OP_MSG"
+	}
+	return "unknown"
+}
+
+// A countingReader counts the bytes read from a client connection.
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	bytesReceived.Add(float64(n))
+	return n, err
+}
+
+/*
+parseMetricsConfig reads the metrics field of the configuration, which has the
+following structure:
+
+	{
+		address: string,
+		path: string
+	}
+
+The address is the host and port that the metrics listener listens on, such as
+"localhost:9216". The path defaults to /metrics.
+*/
+func parseMetricsConfig(conf bson.M) (string, string) {
+	path := convert.ToString(conf["path"])
+	if len(path) == 0 {
+		path = defaultMetricsPath
+	}
+	return convert.ToString(conf["address"]), path
+}
+
+// listenMetrics starts the HTTP listener that serves the metrics in the default
+// registry, if the server has a metrics address.
+func (s *Server) listenMetrics() error {
+	if len(s.MetricsAddress) == 0 {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.MetricsAddress)
+	if err != nil {
+		return fmt.Errorf("Error listening for metrics on %v: %v", s.MetricsAddress, err)
+	}
+
+	path := s.MetricsPath
+	if len(path) == 0 {
+		path = defaultMetricsPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, metrics.DefaultRegistry)
+	metricsServer := &http.Server{Handler: mux}
+
+	s.mu.Lock()
+	s.metricsServer = metricsServer
+	s.mu.Unlock()
+
+	go func() {
+		err := metricsServer.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			Log(ERROR, "Error serving metrics: %v", err)
+		}
+	}()
+	Log(INFO, "Serving metrics on %v%v", ln.Addr(), path)
+	return nil
+}
+
+// closeMetrics closes the metrics listener, if it was started.
+func (s *Server) closeMetrics() {
+	s.mu.Lock()
+	metricsServer := s.metricsServer
+	s.mu.Unlock()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+}
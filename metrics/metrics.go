@@ -0,0 +1,360 @@
+// Package metrics contains counters, gauges and histograms that the proxy and its
+// modules use to report what they are doing, and writes them in the Prometheus
+// text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of a histogram
+// that measures latency.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// the types of metrics, as named in the text format.
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// A Registry holds metrics, and writes them out when they are scraped.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+// DefaultRegistry is the registry that the proxy serves, and that the Register
+// functions add metrics to.
+var DefaultRegistry = NewRegistry()
+
+// register adds a metric to the registry, or returns the metric that was already
+// registered with the same name. Modules are created again each time the
+// configuration is reloaded, so registering the same metric twice keeps counting
+// where the first one left off. A metric with the same name but a different type or
+// labels is left out of the registry, so that it can still be used but isn't served.
+func (r *Registry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.metrics[m.name]
+	if !ok {
+		r.metrics[m.name] = m
+		return m
+	}
+	if existing.typ != m.typ || !sameStrings(existing.labels, m.labels) ||
+		!sameFloats(existing.buckets, m.buckets) {
+		Log(WARNING, "Metric %v is already registered with a different definition", m.name)
+		return m
+	}
+	return existing
+}
+
+// RegisterCounter registers a counter with the name, help text and label names, and
+// returns it.
+func (r *Registry) RegisterCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(newMetric(name, help, counterType, nil, labels))}
+}
+
+// RegisterGauge registers a gauge with the name, help text and label names, and
+// returns it.
+func (r *Registry) RegisterGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(newMetric(name, help, gaugeType, nil, labels))}
+}
+
+// RegisterHistogram registers a histogram with the name, help text, bucket upper
+// bounds and label names, and returns it.
+func (r *Registry) RegisterHistogram(name, help string, buckets []float64,
+	labels ...string) *Histogram {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	return &Histogram{r.register(newMetric(name, help, histogramType, sorted, labels))}
+}
+
+// RegisterCounter registers a counter in the default registry.
+func RegisterCounter(name, help string, labels ...string) *Counter {
+	return DefaultRegistry.RegisterCounter(name, help, labels...)
+}
+
+// RegisterGauge registers a gauge in the default registry.
+func RegisterGauge(name, help string, labels ...string) *Gauge {
+	return DefaultRegistry.RegisterGauge(name, help, labels...)
+}
+
+// RegisterHistogram registers a histogram in the default registry.
+func RegisterHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return DefaultRegistry.RegisterHistogram(name, help, buckets, labels...)
+}
+
+// Write writes every metric in the registry to w in the Prometheus text format,
+// sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]*metric, len(names))
+	sort.Strings(names)
+	for i := 0; i < len(names); i++ {
+		metrics[i] = r.metrics[names[i]]
+	}
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for i := 0; i < len(metrics); i++ {
+		metrics[i].write(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP serves the metrics in the registry to Prometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := r.Write(w)
+	if err != nil {
+		Log(WARNING, "Error writing metrics: %v", err)
+	}
+}
+
+// A Counter is a value that only goes up, such as the number of requests, with a
+// separate value for each combination of its labels' values.
+type Counter struct {
+	m *metric
+}
+
+// Inc adds 1 to the counter for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which can't be negative, to the counter for the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.m.update(labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// A Gauge is a value that can go up and down, such as the number of open
+// connections, with a separate value for each combination of its labels' values.
+type Gauge struct {
+	m *metric
+}
+
+// Set sets the gauge for the label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.update(labelValues, func(s *series) {
+		s.value = v
+	})
+}
+
+// Add adds v to the gauge for the label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.update(labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// Inc adds 1 to the gauge for the label values.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts 1 from the gauge for the label values.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// A Histogram counts observations, such as the latency of requests, in buckets by
+// their value, with separate buckets for each combination of its labels' values.
+type Histogram struct {
+	m *metric
+}
+
+// Observe adds the observation v to the histogram for the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.update(labelValues, func(s *series) {
+		for i := 0; i < len(h.m.buckets); i++ {
+			if v <= h.m.buckets[i] {
+				s.buckets[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+// A metric holds the values of a counter, gauge or histogram.
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// The series of a metric holds its value for one combination of label values. The
+// value of a histogram is the sum of its observations.
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+func newMetric(name, help, typ string, buckets []float64, labels []string) *metric {
+	return &metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// update calls f with the series for the label values, creating it if needed.
+func (m *metric) update(labelValues []string, f func(s *series)) {
+	if len(labelValues) != len(m.labels) {
+		Log(WARNING, "Metric %v has %v labels, but was given %v values",
+			m.name, len(m.labels), len(labelValues))
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		values := make([]string, len(labelValues))
+		copy(values, labelValues)
+		s = &series{labelValues: values, buckets: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	f(s)
+}
+
+// write writes the metric in the text format, with its series sorted by their
+// label values.
+func (m *metric) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.typ)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.typ != histogramType {
+			writeSample(w, m.name, m.labels, s.labelValues, "", "", s.value)
+			continue
+		}
+		for i := 0; i < len(m.buckets); i++ {
+			writeSample(w, m.name+"_bucket", m.labels, s.labelValues,
+				"le", formatFloat(m.buckets[i]), float64(s.buckets[i]))
+		}
+		writeSample(w, m.name+"_bucket", m.labels, s.labelValues,
+			"le", "+Inf", float64(s.count))
+		writeSample(w, m.name+"_sum", m.labels, s.labelValues, "", "", s.value)
+		writeSample(w, m.name+"_count", m.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// writeSample writes a line with a value and its labels, along with an extra label,
+// such as the upper bound of a bucket, if it has a name.
+func writeSample(w *bufio.Writer, name string, labels []string, labelValues []string,
+	extraLabel string, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || len(extraLabel) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i++ {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", labels[i], escapeLabelValue(labelValues[i]))
+		}
+		if len(extraLabel) > 0 {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameFloats(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
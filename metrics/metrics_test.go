@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"testing"
+)
+
+func write(r *Registry) string {
+	var buf bytes.Buffer
+	r.Write(&buf)
+	return buf.String()
+}
+
+func TestMetrics(t *testing.T) {
+	SetLogLevel(DEBUG)
+
+	Convey("Write metrics in the text format", t, func() {
+		r := NewRegistry()
+
+		Convey("for a counter", func() {
+			c := r.RegisterCounter("requests_total", "The requests.", "type")
+			c.Inc("find")
+			c.Add(2, "insert")
+			c.Inc("find")
+			c.Add(-1, "find")
+
+			So(write(r), ShouldEqual, "# HELP requests_total The requests.\n"+
+				"# TYPE requests_total counter\n"+
+				"requests_total{type=\"find\"} 2\n"+
+				"requests_total{type=\"insert\"} 2\n")
+		})
+
+		Convey("for a gauge without labels", func() {
+			g := r.RegisterGauge("open", "Open\nconnections.")
+			g.Inc()
+			g.Inc()
+			g.Dec()
+
+			So(write(r), ShouldEqual, "# HELP open Open\\nconnections.\n"+
+				"# TYPE open gauge\n"+
+				"open 1\n")
+		})
+
+		Convey("for a histogram", func() {
+			h := r.RegisterHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "module")
+			h.Observe(0.05, "mongod")
+			h.Observe(0.5, "mongod")
+			h.Observe(5, "mongod")
+
+			So(write(r), ShouldEqual, "# HELP latency_seconds Latency.\n"+
+				"# TYPE latency_seconds histogram\n"+
+				"latency_seconds_bucket{module=\"mongod\",le=\"0.1\"} 1\n"+
+				"latency_seconds_bucket{module=\"mongod\",le=\"1\"} 2\n"+
+				"latency_seconds_bucket{module=\"mongod\",le=\"+Inf\"} 3\n"+
+				"latency_seconds_sum{module=\"mongod\"} 5.55\n"+
+				"latency_seconds_count{module=\"mongod\"} 3\n")
+		})
+
+		Convey("with escaped label values", func() {
+			c := r.RegisterCounter("errors_total", "Errors.", "message")
+			c.Inc("a \"quoted\"\\path")
+			So(write(r), ShouldContainSubstring, `errors_total{message="a \"quoted\"\\path"} 1`)
+		})
+
+		Convey("with the wrong number of label values", func() {
+			c := r.RegisterCounter("errors_total", "Errors.", "kind")
+			c.Inc()
+			c.Inc("a", "b")
+			So(write(r), ShouldEqual, "# HELP errors_total Errors.\n# TYPE errors_total counter\n")
+		})
+	})
+
+	Convey("Register a metric twice", t, func() {
+		r := NewRegistry()
+		first := r.RegisterCounter("upserts_total", "Upserts.", "result")
+		first.Inc("written")
+
+		Convey("with the same definition", func() {
+			second := r.RegisterCounter("upserts_total", "Upserts.", "result")
+			second.Inc("written")
+			So(write(r), ShouldContainSubstring, "upserts_total{result=\"written\"} 2\n")
+		})
+
+		Convey("with a different definition", func() {
+			second := r.RegisterGauge("upserts_total", "Upserts.")
+			second.Set(10)
+			So(write(r), ShouldContainSubstring, "upserts_total{result=\"written\"} 1\n")
+			So(write(r), ShouldNotContainSubstring, "upserts_total 10")
+		})
+	})
+
+	Convey("Serve metrics over HTTP", t, func() {
+		r := NewRegistry()
+		r.RegisterCounter("requests_total", "The requests.").Inc()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		So(w.Code, ShouldEqual, 200)
+		So(w.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+		So(w.Body.String(), ShouldContainSubstring, "requests_total 1\n")
+	})
+}
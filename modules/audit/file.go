@@ -0,0 +1,182 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// the logs that modules have open, by their absolute path. When the module chain is
+// reloaded, the modules of the old and the new chain share the log of a path, so
+// that their records stay in one chain.
+var (
+	logsMu sync.Mutex
+	logs   = make(map[string]*logFile)
+)
+
+// openLog returns the log of the path, and opens it if no module has it open. Every
+// log that is returned has to be released.
+func openLog(path string, format string, key []byte) (*logFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	l, ok := logs[abs]
+	if ok {
+		if l.format != format || !bytes.Equal(l.key, key) {
+			return nil, fmt.Errorf("The audit log %v is open with another format or key", path)
+		}
+		l.refs++
+		return l, nil
+	}
+
+	l = &logFile{path: path, format: format, key: key}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	l.abs = abs
+	l.refs = 1
+	logs[abs] = l
+	return l, nil
+}
+
+// logFile appends records to a file, and continues the chain of the records that
+// the file already has.
+type logFile struct {
+	path   string
+	format string
+	key    []byte
+
+	// the key of the log in logs, and the number of modules that use it, which are
+	// guarded by logsMu
+	abs  string
+	refs int
+
+	mu       sync.Mutex
+	file     *os.File
+	seq      int64
+	lastHash string
+	err      error
+}
+
+// open verifies the records that the file already has, and opens it for appending.
+// A file that doesn't verify isn't appended to, since the new records couldn't be
+// told apart from the ones that broke the chain. The exception is a last record that
+// was cut short by a crash, which is removed so that the chain continues from the
+// record before it.
+func (l *logFile) open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return nil
+	}
+
+	seq, lastHash, size, err := l.verify()
+	if os.IsNotExist(err) {
+		lastHash = ZeroHash
+	} else if isIncomplete(err) {
+		Log(WARNING, "Removing the incomplete last record of the audit log %v: %v", l.path, err)
+		err = os.Truncate(l.path, size)
+		if err != nil {
+			return fmt.Errorf("Error removing the incomplete record of the audit log %v: %v",
+				l.path, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("The audit log %v doesn't verify: %v", l.path, err)
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.seq = seq
+	l.lastHash = lastHash
+	l.err = nil
+	return nil
+}
+
+// verify verifies the records of the file, and returns the size of the ones that
+// verified.
+func (l *logFile) verify() (int64, string, int64, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	defer f.Close()
+	return verify(f, l.format, l.key, "")
+}
+
+// append numbers the record, chains it to the last one and writes it. The record
+// is only part of the chain if it was written.
+func (l *logFile) append(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("The audit log %v isn't open", l.path)
+	}
+
+	r.Seq = l.seq + 1
+	r.PrevHash = l.lastHash
+	encoded, err := encodeRecord(r, l.format)
+	if err != nil {
+		return err
+	}
+	h := hashRecord(encoded, l.key)
+	_, err = l.file.Write(appendHash(encoded, h, l.format))
+	if err != nil {
+		l.err = err
+		return err
+	}
+	l.seq = r.Seq
+	l.lastHash = h
+	l.err = nil
+	return nil
+}
+
+// release stops a module from using the log, and closes the log once no module
+// uses it.
+func (l *logFile) release() error {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	delete(logs, l.abs)
+	return l.close()
+}
+
+func (l *logFile) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *logFile) health() server.Health {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	details := bson.M{"path": l.path, "records": l.seq}
+	if l.file == nil {
+		details["error"] = "not open"
+		return server.Health{Status: server.HealthDown, Details: details}
+	}
+	if l.err != nil {
+		details["error"] = l.err.Error()
+		return server.Health{Status: server.HealthDown, Details: details}
+	}
+	return server.Health{Status: server.HealthOK, Details: details}
+}
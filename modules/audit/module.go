@@ -0,0 +1,174 @@
+// Package audit contains a module that writes a record of every request to an
+// append-only file. The records are hash chained, so that a log can be verified
+// to have no records missing or changed.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"time"
+)
+
+// An AuditModule calls the next module, and appends a record of the request and its
+// outcome to its log. Only requests on the Namespaces are recorded, if there are any.
+type AuditModule struct {
+	Namespaces server.Namespaces
+
+	path   string
+	format string
+	key    []byte
+	log    *logFile
+}
+
+func init() {
+	server.Publish(&AuditModule{})
+}
+
+// failures counts the records that couldn't be written.
+var failures = metrics.RegisterCounter("mongoproxy_audit_write_failures_total",
+	"Audit records that couldn't be written to the log.")
+
+func (a *AuditModule) New() server.Module {
+	return &AuditModule{}
+}
+
+func (a *AuditModule) Name() string {
+	return "audit"
+}
+
+/*
+Configuration structure:
+
+	{
+		path: string,
+		format: "json" or "bson",
+		namespaces: string or []string,
+		keyFile: string
+	}
+
+The namespaces are globs, such as "sales.*". If there's a key file, the records are
+hashed with an HMAC of its contents.
+*/
+func (a *AuditModule) Configure(conf bson.M) error {
+	filename := convert.ToString(conf["path"])
+	if len(filename) == 0 {
+		return fmt.Errorf("The audit log doesn't have a path")
+	}
+	format := convert.ToString(conf["format"], JSONLinesFormat)
+	if format != JSONLinesFormat && format != BSONFormat {
+		return fmt.Errorf("Unknown format: %v", format)
+	}
+
+	var err error
+	a.Namespaces, err = server.ParseNamespaces(conf["namespaces"])
+	if err != nil {
+		return fmt.Errorf("Error parsing namespaces: %v", err)
+	}
+
+	var key []byte
+	keyFile := convert.ToString(conf["keyFile"])
+	if len(keyFile) > 0 {
+		key, err = ReadKeyFile(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.path = filename
+	a.format = format
+	a.key = key
+	return nil
+}
+
+// ReadKeyFile reads the key that records are hashed with from a file, without the
+// whitespace around it.
+func ReadKeyFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the key file: %v", err)
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("The key file %v is empty", filename)
+	}
+	return key, nil
+}
+
+// Start verifies the existing log and opens it, so that the proxy doesn't start if
+// records can't be written, or if the log has been tampered with. A log that another
+// module already has open, such as the module of the chain that is being reloaded,
+// is shared with it.
+func (a *AuditModule) Start() error {
+	if a.log != nil {
+		return nil
+	}
+	l, err := openLog(a.path, a.format, a.key)
+	if err != nil {
+		return err
+	}
+	a.log = l
+	return nil
+}
+
+// Close closes the log, once no other module uses it.
+func (a *AuditModule) Close() error {
+	if a.log == nil {
+		return nil
+	}
+	err := a.log.release()
+	a.log = nil
+	return err
+}
+
+// Health reports whether the last record could be written. Requests still pass
+// through the module if it couldn't, but they aren't being audited, so the module
+// is down.
+func (a *AuditModule) Health() server.Health {
+	if a.log == nil {
+		return server.Health{Status: server.HealthDown,
+			Details: bson.M{"path": a.path, "error": "not open"}}
+	}
+	return a.log.health()
+}
+
+// audits returns true if requests on the namespace are recorded.
+func (a *AuditModule) audits(database string, collection string) bool {
+	return len(a.Namespaces) == 0 || a.Namespaces.Match(database, collection)
+}
+
+func (a *AuditModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	resNext := messages.ModuleResponse{}
+	start := time.Now()
+	next(ctx, req, &resNext)
+
+	if resNext.Writer != nil {
+		res.Write(resNext.Writer)
+	}
+	if resNext.CommandError != nil {
+		res.Error(resNext.CommandError.ErrorCode, resNext.CommandError.Message)
+	}
+
+	if !a.audits(messages.Namespace(req)) {
+		return
+	}
+	if a.log == nil {
+		failures.Inc()
+		LogContext(ctx, ERROR, "Error writing audit record: the audit log %v isn't open", a.path)
+		return
+	}
+	err := a.log.append(newRecord(ctx, req, &resNext, start))
+	if err != nil {
+		failures.Inc()
+		LogContext(ctx, ERROR, "Error writing audit record: %v", err)
+	}
+}
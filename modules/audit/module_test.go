@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// respond returns a module that writes the response or the error.
+func respond(w messages.ResponseWriter, err *messages.ResponderError) server.PipelineFunc {
+	return func(ctx context.Context, req messages.Requester, res messages.Responder) {
+		if w != nil {
+			res.Write(w)
+		}
+		if err != nil {
+			res.Error(err.ErrorCode, err.Message)
+		}
+	}
+}
+
+func TestAuditModule(t *testing.T) {
+	for _, format := range []string{JSONLinesFormat, BSONFormat} {
+		Convey("Write a hash chained "+format+" log", t, func() {
+			dir, err := ioutil.TempDir("", "mongoproxy-audit")
+			So(err, ShouldBeNil)
+			Reset(func() {
+				os.RemoveAll(dir)
+			})
+			path := filepath.Join(dir, "audit.log")
+			keyFile := filepath.Join(dir, "key")
+			So(ioutil.WriteFile(keyFile, []byte("secret\n"), 0600), ShouldBeNil)
+
+			conf := bson.M{"path": path, "format": format, "keyFile": keyFile,
+				"namespaces": []interface{}{"sales.*"}}
+			a := &AuditModule{}
+			So(a.Configure(conf), ShouldBeNil)
+			So(a.Start(), ShouldBeNil)
+
+			c := &server.Connection{ID: 7, RemoteAddr: "10.0.0.1:5000"}
+			c.SetPrincipal(&server.Principal{User: "ann", Database: "admin"})
+			ctx := server.WithConnection(context.Background(), c)
+
+			find := messages.Find{Database: "sales", Collection: "orders",
+				Filter: bson.D{{"customer", "bob"}}}
+			found := messages.FindResponse{Documents: []bson.D{{{"a", 1}}}}
+			res := messages.ModuleResponse{}
+			a.Process(ctx, find, &res, respond(found, nil))
+			So(res.Writer, ShouldResemble, found)
+
+			res = messages.ModuleResponse{}
+			a.Process(ctx, messages.Insert{Database: "sales", Collection: "orders"}, &res,
+				respond(nil, &messages.ResponderError{ErrorCode: 11000, Message: "duplicate key"}))
+			So(res.CommandError.ErrorCode, ShouldEqual, 11000)
+
+			a.Process(ctx, messages.Find{Database: "other", Collection: "foo"},
+				&messages.ModuleResponse{}, respond(found, nil))
+			So(a.Health().Status, ShouldEqual, server.HealthOK)
+			So(a.Close(), ShouldBeNil)
+
+			key := []byte("secret")
+			count, _, err := VerifyFile(path, format, key)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+
+			b, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			rr := newRecordReader(bytes.NewReader(b), format)
+			first, err := rr.next()
+			So(err, ShouldBeNil)
+			encoded, _, err := splitHash(first, format)
+			So(err, ShouldBeNil)
+			r, err := decodeRecord(encoded, format)
+			So(err, ShouldBeNil)
+			So(r.Seq, ShouldEqual, 1)
+			So(r.PrevHash, ShouldEqual, ZeroHash)
+			So(r.ConnectionID, ShouldEqual, 7)
+			So(r.Client, ShouldEqual, "10.0.0.1:5000")
+			So(r.User, ShouldEqual, "ann")
+			So(r.Type, ShouldEqual, messages.FindType)
+			So(r.Filter, ShouldEqual, "{ customer: ? }")
+			So(*r.NReturned, ShouldEqual, 1)
+			So(r.Outcome, ShouldEqual, OutcomeOK)
+			So(bytes.Contains(b, []byte("bob")), ShouldBeFalse)
+
+			Convey("and continue it after a restart", func() {
+				a := &AuditModule{}
+				So(a.Configure(conf), ShouldBeNil)
+				So(a.Start(), ShouldBeNil)
+				a.Process(ctx, find, &messages.ModuleResponse{}, respond(found, nil))
+				So(a.Close(), ShouldBeNil)
+				count, _, err := VerifyFile(path, format, key)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+			})
+
+			Convey("and share it with the module of a reloaded chain", func() {
+				old := &AuditModule{}
+				So(old.Configure(conf), ShouldBeNil)
+				So(old.Start(), ShouldBeNil)
+				reloaded := &AuditModule{}
+				So(reloaded.Configure(conf), ShouldBeNil)
+				So(reloaded.Start(), ShouldBeNil)
+
+				// requests that are in flight on the old chain finish while the new
+				// chain takes requests
+				old.Process(ctx, find, &messages.ModuleResponse{}, respond(found, nil))
+				reloaded.Process(ctx, find, &messages.ModuleResponse{}, respond(found, nil))
+				old.Process(ctx, find, &messages.ModuleResponse{}, respond(found, nil))
+				So(old.Close(), ShouldBeNil)
+				reloaded.Process(ctx, find, &messages.ModuleResponse{}, respond(found, nil))
+				So(reloaded.Health().Status, ShouldEqual, server.HealthOK)
+
+				other := &AuditModule{}
+				So(other.Configure(bson.M{"path": path, "format": format}), ShouldBeNil)
+				So(other.Start(), ShouldNotBeNil)
+
+				So(reloaded.Close(), ShouldBeNil)
+				count, _, err := VerifyFile(path, format, key)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 6)
+			})
+
+			Convey("and find changed records", func() {
+				changed := bytes.Replace(b, []byte("ann"), []byte("eve"), 1)
+				_, _, err := Verify(bytes.NewReader(changed), format, key)
+				So(err, ShouldResemble, &VerifyError{1, "the hash doesn't match the record"})
+
+				a := &AuditModule{}
+				So(ioutil.WriteFile(path, changed, 0600), ShouldBeNil)
+				So(a.Configure(conf), ShouldBeNil)
+				So(a.Start(), ShouldNotBeNil)
+			})
+
+			Convey("and find missing records", func() {
+				_, _, err := Verify(bytes.NewReader(b[len(first):]), format, key)
+				So(err, ShouldResemble, &VerifyError{1, "expected sequence number 1, but found 2"})
+			})
+
+			Convey("and find incomplete records", func() {
+				count, _, err := Verify(bytes.NewReader(b[:len(b)-3]), format, key)
+				So(count, ShouldEqual, 1)
+				So(err, ShouldResemble, &VerifyError{2, "the record is incomplete"})
+			})
+
+			Convey("and remove an incomplete last record after a crash", func() {
+				So(ioutil.WriteFile(path, b[:len(b)-3], 0600), ShouldBeNil)
+				a := &AuditModule{}
+				So(a.Configure(conf), ShouldBeNil)
+				So(a.Start(), ShouldBeNil)
+				a.Process(ctx, find, &messages.ModuleResponse{}, respond(found, nil))
+				So(a.Close(), ShouldBeNil)
+				count, _, err := VerifyFile(path, format, key)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+			})
+
+			Convey("but not a changed record before an incomplete one", func() {
+				changed := bytes.Replace(b[:len(b)-3], []byte("ann"), []byte("eve"), 1)
+				So(ioutil.WriteFile(path, changed, 0600), ShouldBeNil)
+				a := &AuditModule{}
+				So(a.Configure(conf), ShouldBeNil)
+				So(a.Start(), ShouldNotBeNil)
+			})
+
+			Convey("and find records removed from the end with the last hash", func() {
+				_, lastHash, err := VerifyFile(path, format, key)
+				So(err, ShouldBeNil)
+				_, firstHash, err := Verify(bytes.NewReader(first), format, key)
+				So(err, ShouldBeNil)
+
+				count, _, err := VerifyThrough(bytes.NewReader(b), format, key, lastHash)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+				_, _, err = VerifyThrough(bytes.NewReader(b), format, key, firstHash)
+				So(err, ShouldBeNil)
+
+				_, _, err = VerifyThrough(bytes.NewReader(first), format, key, lastHash)
+				So(err, ShouldNotBeNil)
+				So(err.(*VerifyError).Position, ShouldEqual, 2)
+			})
+
+			Convey("but not verify it with another key", func() {
+				_, _, err := Verify(bytes.NewReader(b), format, []byte("guess"))
+				So(err, ShouldNotBeNil)
+			})
+		})
+	}
+
+	Convey("Reject invalid configurations", t, func() {
+		a := &AuditModule{}
+		So(a.Configure(bson.M{}), ShouldNotBeNil)
+		So(a.Configure(bson.M{"path": "audit.log", "format": "xml"}), ShouldNotBeNil)
+		So(a.Configure(bson.M{"path": "audit.log", "namespaces": "sales.["}), ShouldNotBeNil)
+		So(a.Configure(bson.M{"path": "audit.log", "keyFile": "/nonexistent/key"}), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,208 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"hash"
+	"strings"
+	"time"
+)
+
+// the formats that records can be written in.
+const (
+	JSONLinesFormat = "json"
+	BSONFormat      = "bson"
+)
+
+// the outcomes of a request.
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// hashLength is the length of a hash in hex.
+const hashLength = 2 * sha256.Size
+
+// ZeroHash is the previous hash of the first record of a log.
+var ZeroHash = strings.Repeat("0", hashLength)
+
+// A Record describes a request and its outcome. Records are chained: each one has
+// the hash of the record before it, so records can't be removed, reordered or
+// changed without the chain breaking.
+type Record struct {
+	// the position of the record in the log, starting at 1
+	Seq int64 `bson:"seq" json:"seq"`
+
+	Time time.Time `bson:"time" json:"time"`
+
+	ConnectionID      int64  `bson:"connectionId,omitempty" json:"connectionId,omitempty"`
+	Client            string `bson:"client,omitempty" json:"client,omitempty"`
+	ClientCertSubject string `bson:"clientCertSubject,omitempty" json:"clientCertSubject,omitempty"`
+	User              string `bson:"user,omitempty" json:"user,omitempty"`
+	UserDatabase      string `bson:"userDatabase,omitempty" json:"userDatabase,omitempty"`
+
+	Database   string `bson:"database,omitempty" json:"database,omitempty"`
+	Collection string `bson:"collection,omitempty" json:"collection,omitempty"`
+	Type       string `bson:"type" json:"type"`
+	Command    string `bson:"command,omitempty" json:"command,omitempty"`
+
+	// the filter, pipeline or command with its values replaced by "?".
+	Filter string `bson:"filter,omitempty" json:"filter,omitempty"`
+
+	// the number of documents returned by a read, or affected by a write. Nil if
+	// the response doesn't say.
+	NReturned *int64 `bson:"nreturned,omitempty" json:"nreturned,omitempty"`
+	NAffected *int64 `bson:"naffected,omitempty" json:"naffected,omitempty"`
+
+	Outcome   string `bson:"outcome" json:"outcome"`
+	ErrorCode int32  `bson:"errorCode,omitempty" json:"errorCode,omitempty"`
+	Error     string `bson:"errmsg,omitempty" json:"errmsg,omitempty"`
+
+	// the hash of the previous record, or ZeroHash for the first one.
+	PrevHash string `bson:"prevHash" json:"prevHash"`
+}
+
+// newRecord creates the record for a request and the response that the rest of the
+// chain wrote for it. The sequence number and previous hash are set when it is
+// written.
+func newRecord(ctx context.Context, req messages.Requester, res *messages.ModuleResponse,
+	t time.Time) Record {
+	r := Record{
+		Time:    t.UTC(),
+		Type:    req.Type(),
+		Filter:  messages.FilterShape(req),
+		Outcome: OutcomeOK,
+	}
+	if req.Type() == messages.CommandType {
+		r.Command = messages.CommandName(req)
+	}
+	r.Database, r.Collection = messages.Namespace(req)
+
+	c := server.ConnectionFromContext(ctx)
+	if c != nil {
+		r.ConnectionID = c.ID
+		r.Client = c.RemoteAddr
+		r.ClientCertSubject = c.ClientCertSubject
+		principal := c.Principal()
+		if principal != nil {
+			r.User = principal.User
+			r.UserDatabase = principal.Database
+		}
+	}
+
+	if res.CommandError != nil {
+		r.Outcome = OutcomeError
+		r.ErrorCode = res.CommandError.ErrorCode
+		r.Error = res.CommandError.Message
+		return r
+	}
+	r.NReturned, r.NAffected = messages.DocumentCounts(res.Writer)
+	return r
+}
+
+// hashRecord returns the hash of an encoded record, in hex. With a key, the hash is
+// an HMAC, so that the chain can't be recomputed by someone who doesn't have the key.
+func hashRecord(encoded []byte, key []byte) string {
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(encoded)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encodeRecord encodes a record, without its hash, in the format.
+func encodeRecord(r Record, format string) ([]byte, error) {
+	if format == BSONFormat {
+		return bson.Marshal(r)
+	}
+	return json.Marshal(r)
+}
+
+// The hash of a record is stored as its last field, after the fields it covers.
+// In JSON, that's `,"hash":"<hex>"}` at the end of the line, and in BSON a string
+// element before the terminating byte of the document.
+var (
+	jsonHashPrefix = []byte(`,"hash":"`)
+	bsonHashPrefix = []byte{0x02, 'h', 'a', 's', 'h', 0x00, hashLength + 1, 0, 0, 0}
+)
+
+// appendHash adds the hash to an encoded record.
+func appendHash(encoded []byte, h string, format string) []byte {
+	if format == BSONFormat {
+		out := make([]byte, 4, len(encoded)+len(bsonHashPrefix)+hashLength+1)
+		out = append(out, encoded[4:len(encoded)-1]...)
+		out = append(out, bsonHashPrefix...)
+		out = append(out, h...)
+		out = append(out, 0, 0)
+		binary.LittleEndian.PutUint32(out, uint32(len(out)))
+		return out
+	}
+	out := make([]byte, 0, len(encoded)+len(jsonHashPrefix)+hashLength+3)
+	out = append(out, encoded[:len(encoded)-1]...)
+	out = append(out, jsonHashPrefix...)
+	out = append(out, h...)
+	out = append(out, '"', '}', '\n')
+	return out
+}
+
+// splitHash separates a record that was written with appendHash into the encoding
+// that the hash covers, and the hash.
+func splitHash(written []byte, format string) ([]byte, string, error) {
+	if format == BSONFormat {
+		suffix := len(bsonHashPrefix) + hashLength + 2
+		if len(written) < 5+suffix {
+			return nil, "", fmt.Errorf("the record is too short")
+		}
+		end := len(written) - suffix
+		if !bytes.Equal(written[end:end+len(bsonHashPrefix)], bsonHashPrefix) ||
+			written[len(written)-2] != 0 || written[len(written)-1] != 0 {
+			return nil, "", fmt.Errorf("the record doesn't end with a hash")
+		}
+		h := string(written[end+len(bsonHashPrefix) : len(written)-2])
+		encoded := make([]byte, 4, end+1)
+		encoded = append(encoded, written[4:end]...)
+		encoded = append(encoded, 0)
+		binary.LittleEndian.PutUint32(encoded, uint32(len(encoded)))
+		return encoded, h, nil
+	}
+
+	written = bytes.TrimSuffix(written, []byte{'\n'})
+	suffix := len(jsonHashPrefix) + hashLength + 2
+	if len(written) < 2+suffix {
+		return nil, "", fmt.Errorf("the record is too short")
+	}
+	end := len(written) - suffix
+	if !bytes.Equal(written[end:end+len(jsonHashPrefix)], jsonHashPrefix) ||
+		!bytes.HasSuffix(written, []byte(`"}`)) {
+		return nil, "", fmt.Errorf("the record doesn't end with a hash")
+	}
+	h := string(written[end+len(jsonHashPrefix) : len(written)-2])
+	encoded := make([]byte, 0, end+1)
+	encoded = append(encoded, written[:end]...)
+	encoded = append(encoded, '}')
+	return encoded, h, nil
+}
+
+// decodeRecord decodes a record that splitHash returned.
+func decodeRecord(encoded []byte, format string) (Record, error) {
+	r := Record{}
+	var err error
+	if format == BSONFormat {
+		err = bson.Unmarshal(encoded, &r)
+	} else {
+		err = json.Unmarshal(encoded, &r)
+	}
+	return r, err
+}
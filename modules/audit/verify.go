@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxRecordSize is the largest record that is read from a log. Filters are shapes
+// without their values, so records are much smaller than this.
+const maxRecordSize = 16 * 1024 * 1024
+
+// A recordReader reads the records of a log, in order.
+type recordReader struct {
+	r      *bufio.Reader
+	format string
+}
+
+func newRecordReader(r io.Reader, format string) *recordReader {
+	return &recordReader{r: bufio.NewReader(r), format: format}
+}
+
+// next returns the next record as it was written, or io.EOF at the end of the log.
+// A record that was cut short returns io.ErrUnexpectedEOF.
+func (rr *recordReader) next() ([]byte, error) {
+	if rr.format == BSONFormat {
+		header := make([]byte, 4)
+		n, err := io.ReadFull(rr.r, header)
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := binary.LittleEndian.Uint32(header)
+		if size < 5 || size > maxRecordSize {
+			return nil, fmt.Errorf("invalid record size %v", size)
+		}
+		doc := make([]byte, size)
+		copy(doc, header)
+		_, err = io.ReadFull(rr.r, doc[4:])
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return doc, nil
+	}
+
+	line, err := rr.r.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > maxRecordSize {
+		return nil, fmt.Errorf("invalid record size %v", len(line))
+	}
+	return line, nil
+}
+
+// A VerifyError describes the first record of a log that breaks the chain.
+type VerifyError struct {
+	// the position of the record in the file, starting at 1
+	Position int64
+	Message  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("record %v: %v", e.Position, e.Message)
+}
+
+// the message of the VerifyError for a record that was cut short at the end of a log.
+const incompleteRecord = "the record is incomplete"
+
+// Verify reads a log in the format, and checks that its records are numbered without
+// gaps, that each one has the hash of the one before it, and that each hash matches
+// the record. It returns the number of records and the hash of the last one, or a
+// VerifyError for the first record that doesn't check out. The key must be the one
+// that the log was written with, if any.
+func Verify(r io.Reader, format string, key []byte) (int64, string, error) {
+	count, lastHash, _, err := verify(r, format, key, "")
+	return count, lastHash, err
+}
+
+// VerifyThrough verifies a log like Verify, and also checks that one of its records
+// has the hash, such as the last hash that an earlier verification returned. Records
+// that were removed from the end of the log leave the chain intact, so only a hash that
+// was kept somewhere else shows that they are missing.
+func VerifyThrough(r io.Reader, format string, key []byte, lastHash string) (int64, string, error) {
+	count, h, _, err := verify(r, format, key, lastHash)
+	return count, h, err
+}
+
+// verify verifies a log, and also returns the size of the records that verified. If
+// want isn't empty, one of the records has to have it as its hash.
+func verify(r io.Reader, format string, key []byte, want string) (int64, string, int64, error) {
+	if format != JSONLinesFormat && format != BSONFormat {
+		return 0, "", 0, fmt.Errorf("Unknown format: %v", format)
+	}
+	rr := newRecordReader(r, format)
+	var count, size int64
+	prevHash := ZeroHash
+	found := len(want) == 0 || want == ZeroHash
+	for {
+		written, err := rr.next()
+		if err == io.EOF {
+			if !found {
+				return count, prevHash, size, &VerifyError{count + 1,
+					fmt.Sprintf("no record has the hash %v, so records are missing from the end", want)}
+			}
+			return count, prevHash, size, nil
+		}
+		position := count + 1
+		if err == io.ErrUnexpectedEOF {
+			return count, prevHash, size, &VerifyError{position, incompleteRecord}
+		}
+		if err != nil {
+			return count, prevHash, size, &VerifyError{position, err.Error()}
+		}
+
+		encoded, h, err := splitHash(written, format)
+		if err != nil {
+			return count, prevHash, size, &VerifyError{position, err.Error()}
+		}
+		record, err := decodeRecord(encoded, format)
+		if err != nil {
+			return count, prevHash, size, &VerifyError{position,
+				fmt.Sprintf("the record can't be decoded: %v", err)}
+		}
+		if record.Seq != position {
+			return count, prevHash, size, &VerifyError{position,
+				fmt.Sprintf("expected sequence number %v, but found %v", position, record.Seq)}
+		}
+		if record.PrevHash != prevHash {
+			return count, prevHash, size, &VerifyError{position,
+				"the previous hash doesn't match the record before it"}
+		}
+		if hashRecord(encoded, key) != h {
+			return count, prevHash, size, &VerifyError{position, "the hash doesn't match the record"}
+		}
+		count++
+		size += int64(len(written))
+		prevHash = h
+		if h == want {
+			found = true
+		}
+	}
+}
+
+// VerifyFile verifies the log at the path. See Verify.
+func VerifyFile(path string, format string, key []byte) (int64, string, error) {
+	return VerifyFileThrough(path, format, key, "")
+}
+
+// VerifyFileThrough verifies the log at the path, and checks that one of its records
+// has the hash, if it isn't empty. See VerifyThrough.
+func VerifyFileThrough(path string, format string, key []byte, lastHash string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	return VerifyThrough(f, format, key, lastHash)
+}
+
+// isIncomplete returns true if a verification failed only because the last record
+// of the log was cut short, as happens when the proxy crashes while writing it.
+func isIncomplete(err error) bool {
+	verifyErr, ok := err.(*VerifyError)
+	return ok && verifyErr.Message == incompleteRecord
+}
@@ -0,0 +1,393 @@
+// Package auth contains a module that authenticates clients with SCRAM-SHA-1 and
+// SCRAM-SHA-256 against its own users, rather than the backend's, and rejects the
+// requests of clients that haven't authenticated.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/connection"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the error codes of mongod that the module replies with.
+const (
+	Unauthorized         int32 = 13
+	ProtocolError              = 17
+	AuthenticationFailed       = 18
+	MechanismUnavailable       = 334
+)
+
+// the key of the SCRAM conversation that is stored on a connection.
+const conversationKey = "auth.conversation"
+
+// the ID of a connection's conversation. A connection only has one conversation at
+// a time, so it is always the same.
+const conversationID = 1
+
+// An AuthModule runs the SCRAM conversations of clients itself, with the users of its
+// store, and records the user that a client authenticated as on its connection.
+// Requests from connections that haven't authenticated are rejected, except for the
+// commands of the handshake, and don't reach the next module.
+type AuthModule struct {
+	Mechanisms []string
+	users      userStore
+}
+
+func init() {
+	server.Publish(&AuthModule{})
+}
+
+// attempts counts the authentication attempts, by mechanism and whether they
+// succeeded or failed.
+var attempts = metrics.RegisterCounter("mongoproxy_auth_attempts_total",
+	"Authentication attempts, by mechanism and whether they succeeded or failed.",
+	"mechanism", "result")
+
+// rejected counts the requests that were rejected because the client hadn't
+// authenticated.
+var rejected = metrics.RegisterCounter("mongoproxy_auth_rejected_total",
+	"Requests that were rejected because the client hadn't authenticated.")
+
+func (a *AuthModule) New() server.Module {
+	return &AuthModule{}
+}
+
+func (a *AuthModule) Name() string {
+	return "auth"
+}
+
+/*
+Configuration structure:
+
+	{
+		mechanisms: []string,
+		store: "file" or "collection",
+		file: {
+			path: string
+		},
+		collection: {
+			connection: {
+				addresses: []string,
+				direct: boolean,
+				timeout: integer,
+				auth: {
+					username: string,
+					password: string,
+					database: string
+				},
+				tls: {
+					caFile: string,
+					certFile: string,
+					keyFile: string,
+					serverName: string,
+					insecureSkipVerify: boolean
+				}
+			},
+			database: string,
+			collection: string
+		}
+	}
+*/
+func (a *AuthModule) Configure(conf bson.M) error {
+	a.Mechanisms = supportedMechanisms
+	if conf["mechanisms"] != nil {
+		mechanisms, err := convert.ConvertToStringSlice(conf["mechanisms"])
+		if err != nil {
+			return fmt.Errorf("Error parsing mechanisms: %v", err)
+		}
+		for i := 0; i < len(mechanisms); i++ {
+			if mechanismHash(mechanisms[i]) == nil {
+				return fmt.Errorf("Unsupported mechanism: %v", mechanisms[i])
+			}
+		}
+		a.Mechanisms = mechanisms
+	}
+
+	switch store := convert.ToString(conf["store"], FileStore); store {
+	case FileStore:
+		path := convert.ToString(convert.ToBSONMap(conf["file"])["path"])
+		if len(path) == 0 {
+			return fmt.Errorf("The users file doesn't have a path")
+		}
+		a.users = &fileStore{path: path}
+	case CollectionStore:
+		collection := convert.ToBSONMap(conf["collection"])
+		dialInfo, err := connection.ParseDialInfo(convert.ToBSONMap(collection["connection"]))
+		if err != nil {
+			return err
+		}
+		database := convert.ToString(collection["database"])
+		name := convert.ToString(collection["collection"])
+		if len(database) == 0 || len(name) == 0 {
+			return fmt.Errorf("The users collection needs a database and a collection")
+		}
+		a.users = &collectionStore{connection: dialInfo, database: database, collection: name}
+	default:
+		return fmt.Errorf("Unknown user store: %v", store)
+	}
+	return nil
+}
+
+// Start reads the users file, or connects to the backend with the users collection,
+// so that the proxy doesn't start if clients can't authenticate.
+func (a *AuthModule) Start() error {
+	return a.users.start()
+}
+
+// Close closes the session with the backend of the users collection.
+func (a *AuthModule) Close() error {
+	a.users.close()
+	return nil
+}
+
+// Health reports whether users can be looked up.
+func (a *AuthModule) Health() server.Health {
+	return a.users.health()
+}
+
+func (a *AuthModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	c := server.ConnectionFromContext(ctx)
+	command, isCommand := req.(messages.Command)
+	if isCommand {
+		switch command.CommandName {
+		case "saslStart":
+			reply, err := a.saslStart(ctx, c, command.Database, command.Args)
+			writeReply(res, reply, err)
+			return
+		case "saslContinue":
+			reply, err := a.saslContinue(ctx, c, command.Args)
+			writeReply(res, reply, err)
+			return
+		case "getnonce":
+			// older drivers ask for a nonce on every connection, whether or not
+			// they use it
+			nonce, err := generateNonce()
+			if err != nil {
+				res.Error(ProtocolError, err.Error())
+				return
+			}
+			res.Write(messages.CommandResponse{Reply: bson.M{"nonce": nonce}})
+			return
+		case "authenticate":
+			res.Error(MechanismUnavailable, "Only SCRAM-SHA-1 and SCRAM-SHA-256 authentication "+
+				"are supported by the proxy")
+			return
+		case "logout":
+			if c != nil {
+				c.SetPrincipal(nil)
+				c.Delete(conversationKey)
+			}
+			res.Write(messages.CommandResponse{Reply: bson.M{}})
+			return
+		case "hello", "isMaster", "ismaster":
+			a.handshake(ctx, c, command, res, next)
+			return
+		}
+	}
+
+	if (c == nil || c.Principal() == nil) && !(isCommand && server.HandshakeCommands[command.CommandName]) {
+		rejected.Inc()
+		LogContext(ctx, INFO, "Rejected %v from a client that hasn't authenticated",
+			messages.CommandName(req))
+		res.Error(Unauthorized, fmt.Sprintf("command %v requires authentication",
+			messages.CommandName(req)))
+		return
+	}
+	next(ctx, req, res)
+}
+
+// writeReply writes the reply to a SASL command, or its error.
+func writeReply(res messages.Responder, reply bson.M, err *messages.ResponderError) {
+	if err != nil {
+		res.Error(err.ErrorCode, err.Message)
+		return
+	}
+	res.Write(messages.CommandResponse{Reply: reply})
+}
+
+// authenticationFailed logs why an authentication failed, and returns the error that
+// is sent to the client, which doesn't say why so that clients can't probe for users.
+func authenticationFailed(ctx context.Context, mechanism string, user string,
+	reason error) *messages.ResponderError {
+	attempts.Inc(mechanism, "failure")
+	LoggerFromContext(ctx).With(Fields{"mechanism": mechanism, "user": user}).
+		Log(WARNING, "Authentication failed: %v", reason)
+	return &messages.ResponderError{ErrorCode: AuthenticationFailed, Message: "Authentication failed."}
+}
+
+// payload returns the SASL payload of a command, which drivers send as binary data.
+func payload(args bson.M) []byte {
+	switch p := args["payload"].(type) {
+	case []byte:
+		return p
+	case bson.Binary:
+		return p.Data
+	case string:
+		return []byte(p)
+	}
+	return nil
+}
+
+// enabled returns true if clients can authenticate with the mechanism.
+func (a *AuthModule) enabled(mechanism string) bool {
+	for i := 0; i < len(a.Mechanisms); i++ {
+		if a.Mechanisms[i] == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// saslStart starts a conversation with the client's first message, and replies with
+// the server's first message.
+func (a *AuthModule) saslStart(ctx context.Context, c *server.Connection, database string,
+	args bson.M) (bson.M, *messages.ResponderError) {
+	mechanism := convert.ToString(args["mechanism"])
+	if !a.enabled(mechanism) {
+		return nil, &messages.ResponderError{ErrorCode: MechanismUnavailable,
+			Message: fmt.Sprintf("Received authentication for mechanism %v which is not enabled",
+				mechanism)}
+	}
+	if c == nil {
+		return nil, authenticationFailed(ctx, mechanism, "", fmt.Errorf("no client connection"))
+	}
+	c.Delete(conversationKey)
+
+	conv := &conversation{mechanism: mechanism}
+	name, clientNonce, err := conv.parseClientFirst(payload(args))
+	if err != nil {
+		return nil, authenticationFailed(ctx, mechanism, "", err)
+	}
+	user, err := a.users.lookup(database, name)
+	if err != nil {
+		return nil, authenticationFailed(ctx, mechanism, name, err)
+	}
+	if user == nil {
+		return nil, authenticationFailed(ctx, mechanism, name,
+			fmt.Errorf("Could not find user %v@%v", name, database))
+	}
+	if _, ok := user.Credentials[mechanism]; !ok {
+		attempts.Inc(mechanism, "failure")
+		return nil, &messages.ResponderError{ErrorCode: MechanismUnavailable,
+			Message: fmt.Sprintf("Unable to use %v based authentication for user without any "+
+				"%v credentials registered", mechanism, mechanism)}
+	}
+	conv.user = user
+	conv.skipEmptyExchange = convert.ToBool(convert.ToBSONMap(args["options"])["skipEmptyExchange"])
+
+	serverFirst, err := conv.serverFirstMessage(clientNonce)
+	if err != nil {
+		return nil, authenticationFailed(ctx, mechanism, name, err)
+	}
+	c.Set(conversationKey, conv)
+	return bson.M{"conversationId": conversationID, "done": false, "payload": serverFirst}, nil
+}
+
+// saslContinue checks the client's final message and replies with the server's final
+// message. Unless the client asked to skip it, the conversation ends with an empty
+// exchange after that. The client is authenticated once the conversation is done.
+func (a *AuthModule) saslContinue(ctx context.Context, c *server.Connection,
+	args bson.M) (bson.M, *messages.ResponderError) {
+	var conv *conversation
+	if c != nil {
+		value, _ := c.Get(conversationKey)
+		conv, _ = value.(*conversation)
+	}
+	if conv == nil || convert.ToInt(args["conversationId"]) != conversationID {
+		return nil, &messages.ResponderError{ErrorCode: ProtocolError,
+			Message: "No SASL session state found"}
+	}
+
+	if !conv.verified {
+		serverFinal, err := conv.verifyClientFinal(payload(args))
+		if err != nil {
+			c.Delete(conversationKey)
+			return nil, authenticationFailed(ctx, conv.mechanism, conv.user.Name, err)
+		}
+		if !conv.skipEmptyExchange {
+			return bson.M{"conversationId": conversationID, "done": false, "payload": serverFinal}, nil
+		}
+		a.authenticated(ctx, c, conv)
+		return bson.M{"conversationId": conversationID, "done": true, "payload": serverFinal}, nil
+	}
+
+	a.authenticated(ctx, c, conv)
+	return bson.M{"conversationId": conversationID, "done": true, "payload": []byte{}}, nil
+}
+
+// authenticated records the user of a finished conversation on the connection.
+func (a *AuthModule) authenticated(ctx context.Context, c *server.Connection, conv *conversation) {
+	c.Delete(conversationKey)
+	c.SetPrincipal(&server.Principal{
+		User:     conv.user.Name,
+		Database: conv.user.Database,
+		Roles:    conv.user.Roles,
+	})
+	attempts.Inc(conv.mechanism, "success")
+	LoggerFromContext(ctx).With(Fields{"mechanism": conv.mechanism, "user": conv.user.Name,
+		"userDatabase": conv.user.Database}).Log(NOTICE, "Authenticated")
+}
+
+// handshake passes a hello or isMaster command on without the fields for
+// authentication, which would otherwise be answered by the backend for its own users.
+// The module answers them in the reply instead: saslSupportedMechs lists the
+// mechanisms of a user, and speculativeAuthenticate starts a conversation.
+func (a *AuthModule) handshake(ctx context.Context, c *server.Connection, command messages.Command,
+	res messages.Responder, next server.PipelineFunc) {
+	args := make(bson.M, len(command.Args))
+	for k, v := range command.Args {
+		if k != "saslSupportedMechs" && k != "speculativeAuthenticate" {
+			args[k] = v
+		}
+	}
+	forwarded := command
+	forwarded.Args = args
+
+	resNext := messages.ModuleResponse{}
+	next(ctx, forwarded, &resNext)
+	if resNext.CommandError != nil {
+		res.Error(resNext.CommandError.ErrorCode, resNext.CommandError.Message)
+		return
+	}
+	res.Write(resNext.Writer)
+
+	reply, ok := resNext.Writer.(messages.CommandResponse)
+	if !ok || reply.Reply == nil {
+		return
+	}
+
+	supported, ok := command.Args["saslSupportedMechs"].(string)
+	if ok {
+		database, name, err := messages.ParseNamespace(supported)
+		if err == nil {
+			user, err := a.users.lookup(database, name)
+			if err == nil && user != nil {
+				mechanisms := make([]string, 0)
+				userMechanisms := user.Mechanisms()
+				for i := 0; i < len(userMechanisms); i++ {
+					if a.enabled(userMechanisms[i]) {
+						mechanisms = append(mechanisms, userMechanisms[i])
+					}
+				}
+				reply.Reply["saslSupportedMechs"] = mechanisms
+			}
+		}
+	}
+
+	speculative := convert.ToBSONMap(command.Args["speculativeAuthenticate"])
+	if speculative != nil {
+		database := convert.ToString(speculative["db"], command.Database)
+		speculativeReply, err := a.saslStart(ctx, c, database, speculative)
+		if err == nil {
+			reply.Reply["speculativeAuthenticate"] = speculativeReply
+		}
+	}
+}
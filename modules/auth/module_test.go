@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useNonce makes the server use the nonce until the test is done.
+func useNonce(nonce string) {
+	original := generateNonce
+	generateNonce = func() (string, error) {
+		return nonce, nil
+	}
+	Reset(func() {
+		generateNonce = original
+	})
+}
+
+func TestScramConversation(t *testing.T) {
+	Convey("Verify the SCRAM-SHA-256 conversation of RFC 7677", t, func() {
+		useNonce("%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0")
+		salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+		credential, err := NewCredential(ScramSHA256, "user", "pencil", salt, 4096)
+		So(err, ShouldBeNil)
+
+		conv := &conversation{mechanism: ScramSHA256, user: &User{Name: "user",
+			Credentials: map[string]Credential{ScramSHA256: credential}}}
+		name, clientNonce, err := conv.parseClientFirst([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "user")
+
+		serverFirst, err := conv.serverFirstMessage(clientNonce)
+		So(err, ShouldBeNil)
+		So(string(serverFirst), ShouldEqual,
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+
+		Convey("with the right proof", func() {
+			serverFinal, err := conv.verifyClientFinal([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO" +
+				"%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+			So(err, ShouldBeNil)
+			So(string(serverFinal), ShouldEqual, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+			So(conv.verified, ShouldBeTrue)
+		})
+
+		Convey("with the wrong proof", func() {
+			_, err := conv.verifyClientFinal([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO" +
+				"%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=AHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+			So(err, ShouldNotBeNil)
+			So(conv.verified, ShouldBeFalse)
+		})
+
+		Convey("with another nonce", func() {
+			_, err := conv.verifyClientFinal([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO," +
+				"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// a scramClient is the client side of a SCRAM conversation, as a driver runs it.
+type scramClient struct {
+	mechanism   string
+	user        string
+	password    string
+	clientFirst string
+	authMessage string
+	serverKey   []byte
+}
+
+func (s *scramClient) first() []byte {
+	s.clientFirst = "n=" + s.user + ",r=clientnonce"
+	return []byte("n,," + s.clientFirst)
+}
+
+func (s *scramClient) final(serverFirst []byte) []byte {
+	attributes, _ := parseAttributes(string(serverFirst))
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	var iterations int
+	fmt.Sscan(attributes["i"], &iterations)
+
+	h := mechanismHash(s.mechanism)
+	password := s.password
+	if s.mechanism == ScramSHA1 {
+		password = passwordDigest(s.user, s.password)
+	}
+	saltedPassword := saltPassword(h, []byte(password), salt, iterations)
+	clientKey := computeHMAC(h, saltedPassword, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	s.serverKey = computeHMAC(h, saltedPassword, []byte("Server Key"))
+
+	withoutProof := "c=biws,r=" + attributes["r"]
+	s.authMessage = s.clientFirst + "," + string(serverFirst) + "," + withoutProof
+	signature := computeHMAC(h, storedKey.Sum(nil), []byte(s.authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := 0; i < len(proof); i++ {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+func (s *scramClient) verifyServer(serverFinal []byte) bool {
+	signature := computeHMAC(mechanismHash(s.mechanism), s.serverKey, []byte(s.authMessage))
+	expected := "v=" + base64.StdEncoding.EncodeToString(signature)
+	return hmac.Equal([]byte(expected), serverFinal)
+}
+
+// run sends a command through the module, and returns the response.
+func run(ctx context.Context, a *AuthModule, name string, database string,
+	args bson.M) messages.ModuleResponse {
+	if args == nil {
+		args = bson.M{}
+	}
+	args[name] = 1
+	res := messages.ModuleResponse{}
+	a.Process(ctx, messages.Command{CommandName: name, Database: database, Args: args}, &res,
+		backend)
+	return res
+}
+
+// backend replies to every request with a document that says it reached the backend.
+func backend(ctx context.Context, req messages.Requester, res messages.Responder) {
+	res.Write(messages.CommandResponse{Reply: bson.M{"backend": true}})
+}
+
+func reply(res messages.ModuleResponse) bson.M {
+	So(res.CommandError, ShouldBeNil)
+	return res.Writer.(messages.CommandResponse).Reply
+}
+
+func TestAuthModule(t *testing.T) {
+	Convey("Authenticate clients", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-auth")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		path := filepath.Join(dir, "users.json")
+		salt := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+		sha1Credential, _ := NewCredential(ScramSHA1, "legacy", "secret", []byte("0123456789abcdef"), 1000)
+		users := `[
+			{"user": "alice", "db": "admin", "password": "wonderland", "roles": ["readWrite", {"role": "read", "db": "crm"}]},
+			{"user": "legacy", "db": "test", "credentials": {"SCRAM-SHA-1": {"iterationCount": 1000,
+				"salt": "` + salt + `", "storedKey": "` + base64.StdEncoding.EncodeToString(sha1Credential.StoredKey) + `",
+				"serverKey": "` + base64.StdEncoding.EncodeToString(sha1Credential.ServerKey) + `"}}}
+		]`
+		So(ioutil.WriteFile(path, []byte(users), 0600), ShouldBeNil)
+
+		a := &AuthModule{}
+		So(a.Configure(bson.M{"file": bson.M{"path": path}}), ShouldBeNil)
+		So(a.Start(), ShouldBeNil)
+		So(a.Health().Status, ShouldEqual, server.HealthOK)
+
+		c := &server.Connection{ID: 1}
+		ctx := server.WithConnection(context.Background(), c)
+
+		authenticate := func(mechanism string, user string, database string, password string,
+			options bson.M) messages.ModuleResponse {
+			client := &scramClient{mechanism: mechanism, user: user, password: password}
+			res := run(ctx, a, "saslStart", database, bson.M{"mechanism": mechanism,
+				"payload": client.first(), "options": options})
+			if res.CommandError != nil {
+				return res
+			}
+			start := reply(res)
+			So(start["done"], ShouldBeFalse)
+			res = run(ctx, a, "saslContinue", database, bson.M{"conversationId": start["conversationId"],
+				"payload": client.final(start["payload"].([]byte))})
+			if res.CommandError != nil {
+				return res
+			}
+			cont := reply(res)
+			So(client.verifyServer(cont["payload"].([]byte)), ShouldBeTrue)
+			if cont["done"] == true {
+				return res
+			}
+			return run(ctx, a, "saslContinue", database, bson.M{"conversationId": 1, "payload": []byte{}})
+		}
+
+		Convey("and reject requests until they do", func() {
+			res := messages.ModuleResponse{}
+			a.Process(ctx, messages.Find{Database: "test", Collection: "foo"}, &res, backend)
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: Unauthorized,
+				Message: "command find requires authentication"})
+			So(res.Writer, ShouldBeNil)
+
+			So(reply(run(ctx, a, "ping", "admin", nil))["backend"], ShouldBeTrue)
+			So(run(ctx, a, "listDatabases", "admin", nil).CommandError.ErrorCode, ShouldEqual, Unauthorized)
+		})
+
+		Convey("with SCRAM-SHA-256", func() {
+			res := authenticate(ScramSHA256, "alice", "admin", "wonderland", nil)
+			So(reply(res)["done"], ShouldBeTrue)
+			So(c.Principal(), ShouldResemble, &server.Principal{User: "alice", Database: "admin",
+				Roles: []string{"readWrite@admin", "read@crm"}})
+
+			res = messages.ModuleResponse{}
+			a.Process(ctx, messages.Find{Database: "test", Collection: "foo"}, &res, backend)
+			So(reply(res)["backend"], ShouldBeTrue)
+
+			Convey("and log out", func() {
+				run(ctx, a, "logout", "admin", nil)
+				So(c.Principal(), ShouldBeNil)
+			})
+		})
+
+		Convey("with SCRAM-SHA-1 and stored credentials, skipping the empty exchange", func() {
+			res := authenticate(ScramSHA1, "legacy", "test", "secret", bson.M{"skipEmptyExchange": true})
+			So(reply(res)["done"], ShouldBeTrue)
+			So(c.Principal().User, ShouldEqual, "legacy")
+		})
+
+		Convey("but not with the wrong password", func() {
+			res := authenticate(ScramSHA256, "alice", "admin", "looking-glass", nil)
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: AuthenticationFailed,
+				Message: "Authentication failed."})
+			So(c.Principal(), ShouldBeNil)
+		})
+
+		Convey("but not as an unknown user, or in another database", func() {
+			res := authenticate(ScramSHA256, "bob", "admin", "wonderland", nil)
+			So(res.CommandError.ErrorCode, ShouldEqual, AuthenticationFailed)
+			res = authenticate(ScramSHA256, "alice", "test", "wonderland", nil)
+			So(res.CommandError.ErrorCode, ShouldEqual, AuthenticationFailed)
+		})
+
+		Convey("but not with a mechanism the user has no credentials for", func() {
+			res := authenticate(ScramSHA256, "legacy", "test", "secret", nil)
+			So(res.CommandError.ErrorCode, ShouldEqual, MechanismUnavailable)
+		})
+
+		Convey("in the hello handshake", func() {
+			client := &scramClient{mechanism: ScramSHA256, user: "alice", password: "wonderland"}
+			res := run(ctx, a, "hello", "admin", bson.M{
+				"saslSupportedMechs": "admin.alice",
+				"speculativeAuthenticate": bson.M{"saslStart": 1, "mechanism": ScramSHA256,
+					"payload": client.first(), "db": "admin"},
+			})
+			hello := reply(res)
+			So(hello["backend"], ShouldBeTrue)
+			So(hello["saslSupportedMechs"], ShouldResemble, []string{ScramSHA256, ScramSHA1})
+			speculative := hello["speculativeAuthenticate"].(bson.M)
+			So(strings.HasPrefix(string(speculative["payload"].([]byte)), "r=clientnonce"), ShouldBeTrue)
+
+			res = run(ctx, a, "saslContinue", "admin", bson.M{"conversationId": 1,
+				"payload": client.final(speculative["payload"].([]byte))})
+			So(client.verifyServer(reply(res)["payload"].([]byte)), ShouldBeTrue)
+			run(ctx, a, "saslContinue", "admin", bson.M{"conversationId": 1, "payload": []byte{}})
+			So(c.Principal().User, ShouldEqual, "alice")
+		})
+	})
+}
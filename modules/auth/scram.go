@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// the SCRAM mechanisms that clients can authenticate with.
+const (
+	ScramSHA1   = "SCRAM-SHA-1"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+// the mechanisms that the module supports, from most to least preferred.
+var supportedMechanisms = []string{ScramSHA256, ScramSHA1}
+
+// the iteration counts of credentials that are derived from a password, which are
+// the defaults of mongod.
+var defaultIterations = map[string]int{
+	ScramSHA1:   10000,
+	ScramSHA256: 15000,
+}
+
+// mechanismHash returns the hash function of a SCRAM mechanism, or nil if the
+// mechanism isn't supported.
+func mechanismHash(mechanism string) func() hash.Hash {
+	switch mechanism {
+	case ScramSHA1:
+		return sha1.New
+	case ScramSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+// A Credential has the keys that a SCRAM mechanism checks a client's proof with,
+// which can't be used to recover the password.
+type Credential struct {
+	IterationCount int
+	Salt           []byte
+	StoredKey      []byte
+	ServerKey      []byte
+}
+
+// NewCredential derives the credential of a user for the mechanism from their
+// password. SCRAM-SHA-1 uses a digest of the user name and password, as mongod does,
+// and SCRAM-SHA-256 uses the password itself, without SASLprep normalization.
+func NewCredential(mechanism string, user string, password string, salt []byte,
+	iterations int) (Credential, error) {
+	h := mechanismHash(mechanism)
+	if h == nil {
+		return Credential{}, fmt.Errorf("Unsupported mechanism: %v", mechanism)
+	}
+	if mechanism == ScramSHA1 {
+		password = passwordDigest(user, password)
+	}
+
+	saltedPassword := saltPassword(h, []byte(password), salt, iterations)
+	clientKey := computeHMAC(h, saltedPassword, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return Credential{
+		IterationCount: iterations,
+		Salt:           salt,
+		StoredKey:      storedKey.Sum(nil),
+		ServerKey:      computeHMAC(h, saltedPassword, []byte("Server Key")),
+	}, nil
+}
+
+// passwordDigest returns the digest of a user's password that SCRAM-SHA-1 uses in
+// place of the password.
+func passwordDigest(user string, password string) string {
+	digest := md5.Sum([]byte(user + ":mongo:" + password))
+	return hex.EncodeToString(digest[:])
+}
+
+// saltPassword is the Hi function of RFC 5802, which is PBKDF2 with a key that is as
+// long as the output of the hash.
+func saltPassword(h func() hash.Hash, password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := 0; j < len(result); j++ {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func computeHMAC(h func() hash.Hash, key []byte, message []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// generateNonce returns the random part of the server's nonce. It is a variable so
+// that tests can use the nonces of known conversations.
+var generateNonce = func() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// newSalt returns a random salt for a credential of the mechanism, with the size
+// that mongod uses.
+func newSalt(mechanism string) ([]byte, error) {
+	size := 16
+	if mechanism == ScramSHA256 {
+		size = 28
+	}
+	salt := make([]byte, size)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// A conversation is the server side of a SCRAM conversation with a client, from
+// RFC 5802. The client sends its first message with saslStart, and its final message
+// with saslContinue.
+type conversation struct {
+	mechanism string
+	user      *User
+
+	// true if the client asked to finish the conversation with the server's final
+	// message, rather than with an empty exchange after it.
+	skipEmptyExchange bool
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	serverSignature []byte
+	verified        bool
+}
+
+// parseAttributes parses the comma separated attributes of a SCRAM message, such as
+// "n=user,r=nonce".
+func parseAttributes(message string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	parts := strings.Split(message, ",")
+	for i := 0; i < len(parts); i++ {
+		if len(parts[i]) < 2 || parts[i][1] != '=' {
+			return nil, fmt.Errorf("Invalid SCRAM attribute: %q", parts[i])
+		}
+		attributes[parts[i][:1]] = parts[i][2:]
+	}
+	return attributes, nil
+}
+
+// parseClientFirst returns the user name and nonce of the client's first message, and
+// splits it into the GS2 header and the bare message.
+func (c *conversation) parseClientFirst(payload []byte) (string, string, error) {
+	message := string(payload)
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("Invalid SCRAM client-first message")
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return "", "", fmt.Errorf("SCRAM channel binding is not supported")
+	}
+	c.gs2Header = parts[0] + "," + parts[1] + ","
+	c.clientFirstBare = parts[2]
+
+	attributes, err := parseAttributes(c.clientFirstBare)
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := attributes["m"]; ok {
+		return "", "", fmt.Errorf("SCRAM extensions are not supported")
+	}
+	user, ok := attributes["n"]
+	if !ok || len(user) == 0 {
+		return "", "", fmt.Errorf("The SCRAM client-first message has no user name")
+	}
+	clientNonce, ok := attributes["r"]
+	if !ok || len(clientNonce) == 0 {
+		return "", "", fmt.Errorf("The SCRAM client-first message has no nonce")
+	}
+	user = strings.Replace(strings.Replace(user, "=2C", ",", -1), "=3D", "=", -1)
+	return user, clientNonce, nil
+}
+
+// serverFirstMessage creates the server's reply to the client's first message, with
+// the combined nonce and the user's salt and iteration count.
+func (c *conversation) serverFirstMessage(clientNonce string) ([]byte, error) {
+	credential, ok := c.user.Credentials[c.mechanism]
+	if !ok {
+		return nil, fmt.Errorf("User %v@%v has no %v credentials", c.user.Name, c.user.Database,
+			c.mechanism)
+	}
+	serverNonce, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+	c.nonce = clientNonce + serverNonce
+	c.serverFirst = fmt.Sprintf("r=%v,s=%v,i=%v", c.nonce,
+		base64.StdEncoding.EncodeToString(credential.Salt), credential.IterationCount)
+	return []byte(c.serverFirst), nil
+}
+
+// verifyClientFinal checks the proof in the client's final message, and returns the
+// server's final message with the server's signature.
+func (c *conversation) verifyClientFinal(payload []byte) ([]byte, error) {
+	message := string(payload)
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, fmt.Errorf("The SCRAM client-final message has no proof")
+	}
+	withoutProof := message[:i]
+	proof, err := base64.StdEncoding.DecodeString(message[i+len(",p="):])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SCRAM proof: %v", err)
+	}
+
+	attributes, err := parseAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) {
+		return nil, fmt.Errorf("The SCRAM channel binding doesn't match")
+	}
+	if attributes["r"] != c.nonce {
+		return nil, fmt.Errorf("The SCRAM nonce doesn't match")
+	}
+
+	h := mechanismHash(c.mechanism)
+	credential := c.user.Credentials[c.mechanism]
+	authMessage := []byte(c.clientFirstBare + "," + c.serverFirst + "," + withoutProof)
+	clientSignature := computeHMAC(h, credential.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, fmt.Errorf("Invalid SCRAM proof")
+	}
+	clientKey := make([]byte, len(proof))
+	for j := 0; j < len(proof); j++ {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), credential.StoredKey) {
+		return nil, fmt.Errorf("Invalid SCRAM proof")
+	}
+
+	c.verified = true
+	c.serverSignature = computeHMAC(h, credential.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(c.serverSignature)), nil
+}
@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/connection"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"sync"
+)
+
+// A User is a user that clients can authenticate as, with the credentials of each
+// mechanism that they can use.
+type User struct {
+	Name        string
+	Database    string
+	Roles       []string
+	Credentials map[string]Credential
+}
+
+/*
+ParseUser parses a user document, which has the same structure as the documents
+of mongod's system.users collection:
+
+	{
+		user: string,
+		db: string,
+		roles: [ string or { role: string, db: string } ],
+		credentials: {
+			"SCRAM-SHA-1": {
+				iterationCount: integer,
+				salt: base64 string,
+				storedKey: base64 string,
+				serverKey: base64 string
+			},
+			"SCRAM-SHA-256": { ... }
+		},
+		password: string
+	}
+
+Roles are named role@db, such as readWrite@crm. A role that is a string is a role
+on the user's database, as it is in mongod. A user with a password
+instead of credentials gets credentials for every mechanism, with a random salt.
+*/
+func ParseUser(doc bson.M) (*User, error) {
+	u := &User{
+		Name:        convert.ToString(doc["user"]),
+		Database:    convert.ToString(doc["db"]),
+		Roles:       make([]string, 0),
+		Credentials: make(map[string]Credential),
+	}
+	if len(u.Name) == 0 || len(u.Database) == 0 {
+		return nil, fmt.Errorf("A user needs a user name and a database")
+	}
+
+	roles, _ := doc["roles"].([]interface{})
+	for i := 0; i < len(roles); i++ {
+		role, ok := roles[i].(string)
+		database := u.Database
+		if !ok {
+			doc := convert.ToBSONMap(roles[i])
+			role = convert.ToString(doc["role"])
+			database = convert.ToString(doc["db"])
+		}
+		if len(role) == 0 || len(database) == 0 {
+			return nil, fmt.Errorf("Invalid role for user %v@%v: %v", u.Name, u.Database, roles[i])
+		}
+		u.Roles = append(u.Roles, role+"@"+database)
+	}
+
+	credentials := convert.ToBSONMap(doc["credentials"])
+	for i := 0; i < len(supportedMechanisms); i++ {
+		mechanism := supportedMechanisms[i]
+		c := convert.ToBSONMap(credentials[mechanism])
+		if c == nil {
+			continue
+		}
+		credential, err := parseCredential(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v credentials for user %v@%v: %v", mechanism,
+				u.Name, u.Database, err)
+		}
+		u.Credentials[mechanism] = credential
+	}
+
+	password, ok := doc["password"].(string)
+	if ok && len(u.Credentials) == 0 {
+		for i := 0; i < len(supportedMechanisms); i++ {
+			mechanism := supportedMechanisms[i]
+			salt, err := newSalt(mechanism)
+			if err != nil {
+				return nil, err
+			}
+			credential, err := NewCredential(mechanism, u.Name, password, salt,
+				defaultIterations[mechanism])
+			if err != nil {
+				return nil, err
+			}
+			u.Credentials[mechanism] = credential
+		}
+	}
+
+	if len(u.Credentials) == 0 {
+		return nil, fmt.Errorf("User %v@%v has no credentials", u.Name, u.Database)
+	}
+	return u, nil
+}
+
+// parseCredential parses the salt and keys of a credential, which are base64 strings.
+func parseCredential(c bson.M) (Credential, error) {
+	credential := Credential{IterationCount: convert.ToInt(c["iterationCount"])}
+	if credential.IterationCount <= 0 {
+		return Credential{}, fmt.Errorf("iterationCount must be positive")
+	}
+	fields := []struct {
+		name  string
+		value *[]byte
+	}{
+		{"salt", &credential.Salt},
+		{"storedKey", &credential.StoredKey},
+		{"serverKey", &credential.ServerKey},
+	}
+	for i := 0; i < len(fields); i++ {
+		b, err := base64.StdEncoding.DecodeString(convert.ToString(c[fields[i].name]))
+		if err != nil || len(b) == 0 {
+			return Credential{}, fmt.Errorf("Invalid %v", fields[i].name)
+		}
+		*fields[i].value = b
+	}
+	return credential, nil
+}
+
+// Mechanisms returns the mechanisms that the user has credentials for, from most to
+// least preferred.
+func (u *User) Mechanisms() []string {
+	mechanisms := make([]string, 0, len(u.Credentials))
+	for i := 0; i < len(supportedMechanisms); i++ {
+		_, ok := u.Credentials[supportedMechanisms[i]]
+		if ok {
+			mechanisms = append(mechanisms, supportedMechanisms[i])
+		}
+	}
+	return mechanisms
+}
+
+// the stores that users can be looked up in.
+const (
+	FileStore       = "file"
+	CollectionStore = "collection"
+)
+
+// A userStore looks up the users that clients authenticate as.
+type userStore interface {
+	// lookup returns the user with the name in the database, or nil if there isn't one.
+	lookup(database string, name string) (*User, error)
+	start() error
+	close()
+	health() server.Health
+}
+
+// the name and database that identify a user.
+type userKey struct {
+	database string
+	name     string
+}
+
+// fileStore has the users of a JSON file, which is an array of user documents. The
+// file is read when the module starts.
+type fileStore struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[userKey]*User
+}
+
+func (s *fileStore) start() error {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("Error reading users file: %v", err)
+	}
+	var docs []bson.M
+	err = json.Unmarshal(b, &docs)
+	if err != nil {
+		return fmt.Errorf("Invalid users file: %v", err)
+	}
+
+	users := make(map[userKey]*User)
+	for i := 0; i < len(docs); i++ {
+		u, err := ParseUser(docs[i])
+		if err != nil {
+			return err
+		}
+		users[userKey{u.Database, u.Name}] = u
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	return nil
+}
+
+func (s *fileStore) lookup(database string, name string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.users == nil {
+		return nil, fmt.Errorf("The users file hasn't been read")
+	}
+	return s.users[userKey{database, name}], nil
+}
+
+func (s *fileStore) close() {}
+
+func (s *fileStore) health() server.Health {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	details := bson.M{"path": s.path, "users": len(s.users)}
+	if s.users == nil {
+		details["error"] = "not read"
+		return server.Health{Status: server.HealthDown, Details: details}
+	}
+	return server.Health{Status: server.HealthOK, Details: details}
+}
+
+// collectionStore looks up users in a collection on a backend each time a client
+// authenticates, so that changes to users apply to the next authentication.
+type collectionStore struct {
+	connection mgo.DialInfo
+	database   string
+	collection string
+
+	mu           sync.Mutex
+	mongoSession *mgo.Session
+}
+
+func (s *collectionStore) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mongoSession != nil {
+		return nil
+	}
+	session, err := mgo.DialWithInfo(&s.connection)
+	if err != nil {
+		return fmt.Errorf("Error connecting to MongoDB: %v", err)
+	}
+	s.mongoSession = session
+	return nil
+}
+
+func (s *collectionStore) lookup(database string, name string) (*User, error) {
+	s.mu.Lock()
+	if s.mongoSession == nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("Not connected to the users collection")
+	}
+	session := s.mongoSession.Copy()
+	s.mu.Unlock()
+	defer session.Close()
+
+	doc := bson.M{}
+	err := session.DB(s.database).C(s.collection).Find(bson.M{"user": name, "db": database}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error looking up user: %v", err)
+	}
+	return ParseUser(doc)
+}
+
+func (s *collectionStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mongoSession != nil {
+		s.mongoSession.Close()
+		s.mongoSession = nil
+	}
+}
+
+// health pings the backend. Clients can't authenticate if it can't be reached, so
+// the module is down.
+func (s *collectionStore) health() server.Health {
+	s.mu.Lock()
+	session := s.mongoSession
+	s.mu.Unlock()
+	return connection.Health(session, s.connection)
+}
@@ -0,0 +1,313 @@
+// Package authz contains a module that authorizes requests with the roles of the user
+// that a client authenticated as, and rejects the requests that no role allows.
+package authz
+
+import (
+	"context"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Unauthorized is the error code of mongod for requests that the user isn't allowed
+// to run.
+const Unauthorized int32 = 13
+
+// AnyAction is the action of a privilege that allows every request on its namespaces.
+const AnyAction = "*"
+
+// stageActions are the actions that the stages of an aggregation pipeline perform on
+// the namespaces that they read from or write to, which have to be allowed as well as
+// the aggregate.
+var stageActions = map[string][]string{
+	"$lookup":      {"find"},
+	"$graphLookup": {"find"},
+	"$unionWith":   {"find"},
+	"$out":         {"insert", "delete"},
+	"$merge":       {"insert", "update"},
+}
+
+// A Privilege allows actions on namespaces.
+type Privilege struct {
+	// globs for the namespaces, such as "sales.*"
+	Namespaces server.Namespaces
+
+	// the actions, which are the names of commands, such as "find" or "collStats".
+	// Requests that aren't generic commands are named after their type.
+	Actions []string
+}
+
+// Allows returns true if the privilege allows the action on the namespace.
+func (p Privilege) Allows(action string, database string, collection string) bool {
+	return matchesAction(p.Actions, action) && p.Namespaces.Match(database, collection)
+}
+
+func matchesAction(actions []string, action string) bool {
+	for i := 0; i < len(actions); i++ {
+		if actions[i] == action || actions[i] == AnyAction {
+			return true
+		}
+	}
+	return false
+}
+
+// A Role has privileges of its own, and the privileges of the roles that it inherits.
+type Role struct {
+	Name       string
+	Privileges []Privilege
+	Roles      []string
+}
+
+// An AuthzModule allows a request if one of the roles of the connection's principal
+// has a privilege for it, and rejects it with an Unauthorized error otherwise.
+// Connections that haven't authenticated have the UnauthenticatedRoles. Every
+// decision is logged.
+type AuthzModule struct {
+	Roles                map[string]Role
+	UnauthenticatedRoles []string
+
+	// the privileges of each role, including the ones it inherits
+	privileges map[string][]Privilege
+}
+
+func init() {
+	server.Publish(&AuthzModule{})
+}
+
+// decisions counts the requests that were allowed or denied.
+var decisions = metrics.RegisterCounter("mongoproxy_authz_decisions_total",
+	"Authorization decisions, by whether the request was allowed or denied.", "decision")
+
+func (a *AuthzModule) New() server.Module {
+	return &AuthzModule{}
+}
+
+func (a *AuthzModule) Name() string {
+	return "authz"
+}
+
+/*
+Configuration structure:
+
+	{
+		roles: [
+			{
+				name: string,
+				privileges: [
+					{
+						namespace: string or []string,
+						actions: []string
+					}
+				],
+				roles: []string
+			}
+		],
+		unauthenticatedRoles: []string
+	}
+
+The names of roles are matched against the roles of the principal, which are named
+role@db, such as "reader@admin". The namespaces of a privilege are globs, such as
+"sales.*", and the action "*" allows every request. The roles of a role are
+inherited by it.
+*/
+func (a *AuthzModule) Configure(conf bson.M) error {
+	a.Roles = make(map[string]Role)
+	roles, err := convert.ConvertToBSONMapSlice(conf["roles"])
+	if err != nil {
+		return fmt.Errorf("Error parsing roles: %v", err)
+	}
+	for i := 0; i < len(roles); i++ {
+		role, err := parseRole(roles[i])
+		if err != nil {
+			return err
+		}
+		if _, ok := a.Roles[role.Name]; ok {
+			return fmt.Errorf("Role %v is defined more than once", role.Name)
+		}
+		a.Roles[role.Name] = role
+	}
+
+	a.UnauthenticatedRoles = make([]string, 0)
+	if conf["unauthenticatedRoles"] != nil {
+		a.UnauthenticatedRoles, err = convert.ConvertToStringSlice(conf["unauthenticatedRoles"])
+		if err != nil {
+			return fmt.Errorf("Error parsing unauthenticatedRoles: %v", err)
+		}
+	}
+	for i := 0; i < len(a.UnauthenticatedRoles); i++ {
+		if _, ok := a.Roles[a.UnauthenticatedRoles[i]]; !ok {
+			return fmt.Errorf("Unknown role: %v", a.UnauthenticatedRoles[i])
+		}
+	}
+
+	a.privileges = make(map[string][]Privilege)
+	for name := range a.Roles {
+		privileges, err := a.resolve(name, make(map[string]bool))
+		if err != nil {
+			return err
+		}
+		a.privileges[name] = privileges
+	}
+	return nil
+}
+
+// parseRole parses a role from the configuration.
+func parseRole(doc bson.M) (Role, error) {
+	role := Role{
+		Name:       convert.ToString(doc["name"]),
+		Privileges: make([]Privilege, 0),
+		Roles:      make([]string, 0),
+	}
+	if len(role.Name) == 0 {
+		return Role{}, fmt.Errorf("A role doesn't have a name")
+	}
+
+	privileges, err := convert.ConvertToBSONMapSlice(doc["privileges"])
+	if doc["privileges"] != nil && err != nil {
+		return Role{}, fmt.Errorf("Error parsing the privileges of role %v: %v", role.Name, err)
+	}
+	for i := 0; i < len(privileges); i++ {
+		namespaces, err := server.ParseNamespaces(privileges[i]["namespace"])
+		if err != nil {
+			return Role{}, fmt.Errorf("Invalid namespace for role %v: %v", role.Name, err)
+		}
+		if len(namespaces) == 0 {
+			return Role{}, fmt.Errorf("A privilege of role %v doesn't have a namespace", role.Name)
+		}
+		actions, err := convert.ConvertToStringSlice(privileges[i]["actions"])
+		if err != nil || len(actions) == 0 {
+			return Role{}, fmt.Errorf("Invalid actions for a privilege of role %v", role.Name)
+		}
+		role.Privileges = append(role.Privileges, Privilege{Namespaces: namespaces, Actions: actions})
+	}
+
+	if doc["roles"] != nil {
+		role.Roles, err = convert.ConvertToStringSlice(doc["roles"])
+		if err != nil {
+			return Role{}, fmt.Errorf("Error parsing the roles of role %v: %v", role.Name, err)
+		}
+	}
+	return role, nil
+}
+
+// resolve returns the privileges of a role and of the roles it inherits. The roles
+// that are being resolved are kept in visiting, to find cycles.
+func (a *AuthzModule) resolve(name string, visiting map[string]bool) ([]Privilege, error) {
+	role, ok := a.Roles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown role: %v", name)
+	}
+	if visiting[name] {
+		return nil, fmt.Errorf("Role %v inherits itself", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	privileges := append([]Privilege{}, role.Privileges...)
+	for i := 0; i < len(role.Roles); i++ {
+		inherited, err := a.resolve(role.Roles[i], visiting)
+		if err != nil {
+			return nil, err
+		}
+		privileges = append(privileges, inherited...)
+	}
+	return privileges, nil
+}
+
+// Authorize returns the first of the roles that allows the action on the namespace,
+// and false if none of them do. Roles that the module doesn't have are ignored.
+func (a *AuthzModule) Authorize(roles []string, action string, database string,
+	collection string) (string, bool) {
+	for i := 0; i < len(roles); i++ {
+		privileges := a.privileges[roles[i]]
+		for j := 0; j < len(privileges); j++ {
+			if privileges[j].Allows(action, database, collection) {
+				return roles[i], true
+			}
+		}
+	}
+	return "", false
+}
+
+// authorizePipeline returns the first of the roles that allows the actions of every
+// stage of an aggregation pipeline on the namespaces it reads from and writes to. If
+// none of them do, it returns the stage and action that isn't allowed, and false.
+func (a *AuthzModule) authorizePipeline(roles []string, database string,
+	pipeline []bson.D) (messages.StageNamespace, string, bool) {
+
+	namespaces := messages.PipelineNamespaces(database, pipeline)
+	for i := 0; i < len(namespaces); i++ {
+		actions := stageActions[namespaces[i].Stage]
+		for j := 0; j < len(actions); j++ {
+			_, allowed := a.Authorize(roles, actions[j], namespaces[i].Database,
+				namespaces[i].Collection)
+			if !allowed {
+				return namespaces[i], actions[j], false
+			}
+		}
+	}
+	return messages.StageNamespace{}, "", true
+}
+
+func (a *AuthzModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	action := messages.CommandName(req)
+	if req.Type() == messages.CommandType && server.HandshakeCommands[action] {
+		next(ctx, req, res)
+		return
+	}
+
+	database, collection := messages.Namespace(req)
+	fields := Fields{"action": action, "database": database}
+	if len(collection) > 0 {
+		fields["collection"] = collection
+	}
+
+	roles := a.UnauthenticatedRoles
+	var principal *server.Principal
+	c := server.ConnectionFromContext(ctx)
+	if c != nil {
+		principal = c.Principal()
+	}
+	if principal != nil {
+		roles = principal.Roles
+		fields["user"] = principal.User
+		fields["userDatabase"] = principal.Database
+	}
+	fields["roles"] = roles
+
+	role, allowed := a.Authorize(roles, action, database, collection)
+	deniedAction, deniedDatabase := action, database
+	aggregate, ok := req.(messages.Aggregate)
+	if allowed && ok {
+		// the stages of the pipeline also need the actions they perform on the
+		// namespaces that they read from and write to
+		var stage messages.StageNamespace
+		stage, deniedAction, allowed = a.authorizePipeline(roles, database, aggregate.Pipeline)
+		if !allowed {
+			deniedDatabase = stage.Database
+			fields["stage"] = stage.Stage
+			fields["stageNamespace"] = stage.Database + "." + stage.Collection
+		}
+	}
+	if !allowed {
+		decisions.Inc("denied")
+		fields["decision"] = "denied"
+		LoggerFromContext(ctx).With(fields).Log(NOTICE, "Denied %v on %v", deniedAction,
+			deniedDatabase)
+		res.Error(Unauthorized, fmt.Sprintf("not authorized on %v to execute command %v",
+			deniedDatabase, deniedAction))
+		return
+	}
+
+	decisions.Inc("allowed")
+	fields["decision"] = "allowed"
+	fields["role"] = role
+	LoggerFromContext(ctx).With(fields).Log(NOTICE, "Allowed %v on %v", action, database)
+	next(ctx, req, res)
+}
@@ -0,0 +1,155 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"testing"
+)
+
+// reached records that a request reached the next module.
+func reached(ctx context.Context, req messages.Requester, res messages.Responder) {
+	res.Write(messages.CommandResponse{Reply: bson.M{"reached": true}})
+}
+
+func TestAuthzModule(t *testing.T) {
+	Convey("Authorize requests", t, func() {
+		a := &AuthzModule{}
+		err := a.Configure(bson.M{
+			"roles": []interface{}{
+				bson.M{"name": "reader@admin", "privileges": []interface{}{
+					bson.M{"namespace": []interface{}{"sales.*", "reports.daily"},
+						"actions": []interface{}{"find", "getMore", "count", "aggregate", "listCollections"}},
+				}},
+				bson.M{"name": "writer@admin", "roles": []interface{}{"reader@admin"}, "privileges": []interface{}{
+					bson.M{"namespace": "sales.orders", "actions": []interface{}{"insert", "update"}},
+				}},
+				bson.M{"name": "root@admin", "privileges": []interface{}{
+					bson.M{"namespace": "*", "actions": []interface{}{"*"}},
+				}},
+				bson.M{"name": "monitor", "privileges": []interface{}{
+					bson.M{"namespace": "admin.*", "actions": []interface{}{"serverStatus"}},
+				}},
+			},
+			"unauthenticatedRoles": []interface{}{"monitor"},
+		})
+		So(err, ShouldBeNil)
+
+		var buf bytes.Buffer
+		SetLogOutput(&buf)
+		SetLogFormat(JSONFormat)
+		Reset(func() {
+			SetLogOutput(os.Stderr)
+			SetLogFormat(TextFormat)
+		})
+
+		c := &server.Connection{ID: 1}
+		ctx := server.WithConnection(context.Background(), c)
+		process := func(req messages.Requester) messages.ModuleResponse {
+			res := messages.ModuleResponse{}
+			a.Process(ctx, req, &res, reached)
+			return res
+		}
+		find := messages.Find{Database: "sales", Collection: "orders"}
+		insert := messages.Insert{Database: "sales", Collection: "orders"}
+
+		Convey("with the roles of the principal", func() {
+			c.SetPrincipal(&server.Principal{User: "ann", Database: "admin", Roles: []string{"reader@admin"}})
+			So(process(find).CommandError, ShouldBeNil)
+			So(process(messages.Find{Database: "reports", Collection: "daily"}).CommandError, ShouldBeNil)
+			So(process(messages.ListCollections{Database: "sales"}).CommandError, ShouldBeNil)
+
+			res := process(insert)
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: Unauthorized,
+				Message: "not authorized on sales to execute command insert"})
+			So(res.Writer, ShouldBeNil)
+			So(process(messages.Find{Database: "reports", Collection: "monthly"}).CommandError,
+				ShouldNotBeNil)
+
+			So(buf.String(), ShouldContainSubstring, `"decision":"allowed"`)
+			So(buf.String(), ShouldContainSubstring, `"decision":"denied"`)
+			So(buf.String(), ShouldContainSubstring, `"user":"ann"`)
+		})
+
+		Convey("with inherited roles", func() {
+			c.SetPrincipal(&server.Principal{User: "bob", Database: "admin", Roles: []string{"writer@admin"}})
+			So(process(find).CommandError, ShouldBeNil)
+			So(process(insert).CommandError, ShouldBeNil)
+			So(process(messages.Delete{Database: "sales", Collection: "orders"}).CommandError, ShouldNotBeNil)
+		})
+
+		Convey("only with the roles of the same database", func() {
+			c.SetPrincipal(&server.Principal{User: "cat", Database: "sales", Roles: []string{"reader@sales"}})
+			So(process(find).CommandError, ShouldNotBeNil)
+		})
+
+		Convey("with the namespaces of aggregation stages", func() {
+			c.SetPrincipal(&server.Principal{User: "ann", Database: "admin", Roles: []string{"reader@admin"}})
+			aggregate := func(database string, collection string, pipeline ...bson.D) messages.ModuleResponse {
+				return process(messages.Aggregate{Database: database, Collection: collection,
+					Pipeline: pipeline})
+			}
+
+			So(aggregate("sales", "orders", bson.D{{"$lookup", bson.D{{"from", "customers"}}}}).CommandError,
+				ShouldBeNil)
+			So(aggregate("reports", "daily", bson.D{{"$unionWith", "monthly"}}).CommandError,
+				ShouldResemble, &messages.ResponderError{ErrorCode: Unauthorized,
+					Message: "not authorized on reports to execute command find"})
+			So(aggregate("reports", "daily", bson.D{{"$facet", bson.D{{"a", []interface{}{
+				bson.D{{"$lookup", bson.D{{"from", "daily"}, {"pipeline", []interface{}{
+					bson.D{{"$graphLookup", bson.D{{"from", "secret"}}}},
+				}}}}},
+			}}}}}).CommandError, ShouldNotBeNil)
+
+			res := aggregate("sales", "orders", bson.D{{"$out", "copy"}})
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: Unauthorized,
+				Message: "not authorized on sales to execute command insert"})
+			So(res.Writer, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, `"stage":"$out"`)
+
+			c.SetPrincipal(&server.Principal{User: "bob", Database: "admin", Roles: []string{"writer@admin"}})
+			So(aggregate("sales", "orders", bson.D{{"$merge", bson.D{{"into", "orders"}}}}).CommandError,
+				ShouldBeNil)
+			So(aggregate("sales", "orders", bson.D{{"$out", "orders"}}).CommandError, ShouldResemble,
+				&messages.ResponderError{ErrorCode: Unauthorized,
+					Message: "not authorized on sales to execute command delete"})
+			So(aggregate("sales", "orders", bson.D{{"$merge", bson.D{
+				{"into", bson.D{{"db", "reports"}, {"coll", "daily"}}}}}}).CommandError, ShouldNotBeNil)
+		})
+
+		Convey("with commands", func() {
+			c.SetPrincipal(&server.Principal{User: "root", Database: "admin", Roles: []string{"root@admin"}})
+			So(process(messages.Command{CommandName: "dropDatabase", Database: "sales",
+				Args: bson.M{"dropDatabase": 1}}).CommandError, ShouldBeNil)
+		})
+
+		Convey("without a principal", func() {
+			So(process(find).CommandError, ShouldNotBeNil)
+			So(process(messages.Command{CommandName: "serverStatus", Database: "admin",
+				Args: bson.M{"serverStatus": 1}}).CommandError, ShouldBeNil)
+			So(process(messages.Command{CommandName: "hello", Database: "admin",
+				Args: bson.M{"hello": 1}}).CommandError, ShouldBeNil)
+		})
+	})
+
+	Convey("Reject invalid roles", t, func() {
+		a := &AuthzModule{}
+		So(a.Configure(bson.M{"roles": []interface{}{
+			bson.M{"name": "a", "roles": []interface{}{"b"}},
+			bson.M{"name": "b", "roles": []interface{}{"a"}},
+		}}), ShouldNotBeNil)
+		So(a.Configure(bson.M{"roles": []interface{}{
+			bson.M{"name": "a", "roles": []interface{}{"missing"}},
+		}}), ShouldNotBeNil)
+		So(a.Configure(bson.M{"roles": []interface{}{
+			bson.M{"name": "a", "privileges": []interface{}{bson.M{"namespace": "x.*"}}},
+		}}), ShouldNotBeNil)
+		So(a.Configure(bson.M{"roles": []interface{}{}, "unauthenticatedRoles": []interface{}{"a"}}),
+			ShouldNotBeNil)
+	})
+}
@@ -363,10 +363,13 @@ func Setup(r *gin.Engine, config bson.M, baseDir string) error {
 	biConfig = config
 
 	if config != nil {
-		biModule.Configure(config)
+		err := biModule.Configure(config)
+		if err != nil {
+			Log(ERROR, "Invalid BI module configuration: %v", err)
+			return err
+		}
 
 		// set up mongod connection
-		var err error
 		mongoSession, err = mgo.DialWithInfo(&biModule.Connection)
 		if err != nil {
 			Log(ERROR, "Error connecting to MongoDB: %v", err)
@@ -3,11 +3,14 @@
 package bi
 
 import (
+	"context"
 	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/connection"
 	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
 	"github.com/mongodbinc-interns/mongoproxy/server"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -27,6 +30,10 @@ func init() {
 	server.Publish(&BIModule{})
 }
 
+// upserts counts the upserts of metric documents, by whether they were written.
+var upserts = metrics.RegisterCounter("mongoproxy_bi_upserts_total",
+	"Upserts of metric documents, by whether they were written or failed.", "result")
+
 func (b *BIModule) New() server.Module {
 	return &BIModule{}
 }
@@ -46,6 +53,13 @@ Configuration structure:
 			username: string,
 			password: string,
 			database: string
+		},
+		tls: {
+			caFile: string,
+			certFile: string,
+			keyFile: string,
+			serverName: string,
+			insecureSkipVerify: boolean
 		}
 	}
 	rules: [
@@ -61,42 +75,10 @@ Configuration structure:
 */
 func (b *BIModule) Configure(conf bson.M) error {
 
-	conn := convert.ToBSONMap(conf["connection"])
-	if conn == nil {
-		return fmt.Errorf("No connection data")
-	}
-	addrs, err := convert.ConvertToStringSlice(conn["addresses"])
+	dialInfo, err := connection.ParseDialInfo(convert.ToBSONMap(conf["connection"]))
 	if err != nil {
-		return fmt.Errorf("Invalid addresses: %v", err)
+		return err
 	}
-
-	timeout := time.Duration(convert.ToInt64(conn["timeout"], -1))
-	if timeout == -1 {
-		timeout = time.Second * 10
-	}
-
-	dialInfo := mgo.DialInfo{
-		Addrs:   addrs,
-		Direct:  convert.ToBool(conn["direct"]),
-		Timeout: timeout,
-	}
-
-	auth := convert.ToBSONMap(conn["auth"])
-	if auth != nil {
-		username, ok := auth["username"].(string)
-		if ok {
-			dialInfo.Username = username
-		}
-		password, ok := auth["password"].(string)
-		if ok {
-			dialInfo.Password = password
-		}
-		database, ok := auth["database"].(string)
-		if ok {
-			dialInfo.Database = database
-		}
-	}
-
 	b.Connection = dialInfo
 
 	// Rules
@@ -147,11 +129,50 @@ func (b *BIModule) Configure(conf bson.M) error {
 	return nil
 }
 
-func (b *BIModule) Process(req messages.Requester, res messages.Responder,
+// Start connects to the mongod that metrics are written to, so that the proxy doesn't
+// start if it can't be reached.
+func (b *BIModule) Start() error {
+	return b.dial()
+}
+
+// dial creates the module's session with mongod if it doesn't have one yet.
+func (b *BIModule) dial() error {
+	if b.mongoSession != nil {
+		return nil
+	}
+	session, err := mgo.DialWithInfo(&b.Connection)
+	if err != nil {
+		return fmt.Errorf("Error connecting to MongoDB: %v", err)
+	}
+	session.SetPrefetch(0)
+	b.mongoSession = session
+	return nil
+}
+
+// Health pings the mongod that metrics are written to. Requests still pass through
+// the module if it can't be reached, so the module is only degraded.
+func (b *BIModule) Health() server.Health {
+	health := connection.Health(b.mongoSession, b.Connection)
+	if health.Status == server.HealthDown {
+		health.Status = server.HealthDegraded
+	}
+	return health
+}
+
+// Close closes the module's session with mongod, if it has one.
+func (b *BIModule) Close() error {
+	if b.mongoSession != nil {
+		b.mongoSession.Close()
+		b.mongoSession = nil
+	}
+	return nil
+}
+
+func (b *BIModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
 	next server.PipelineFunc) {
 
 	resNext := messages.ModuleResponse{}
-	next(req, &resNext)
+	next(ctx, req, &resNext)
 
 	res.Write(resNext.Writer)
 
@@ -161,14 +182,10 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 	}
 
 	// spin up the session if it doesn't exist
-	if b.mongoSession == nil {
-		var err error
-		b.mongoSession, err = mgo.DialWithInfo(&b.Connection)
-		if err != nil {
-			Log(ERROR, "Error connecting to MongoDB: %v", err)
-			return
-		}
-		b.mongoSession.SetPrefetch(0)
+	err := b.dial()
+	if err != nil {
+		LogContext(ctx, ERROR, "%v", err)
+		return
 	}
 
 	session := b.mongoSession.Copy()
@@ -189,7 +206,7 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 			// and pass it on to mongod
 			if opi.Collection != rule.OriginCollection ||
 				opi.Database != rule.OriginDatabase {
-				Log(DEBUG, "Didn't match database %v.%v. Was %v.%v", rule.OriginDatabase,
+				LogContext(ctx, DEBUG, "Didn't match database %v.%v. Was %v.%v", rule.OriginDatabase,
 					rule.OriginCollection, opi.Database, opi.Collection)
 				continue
 			}
@@ -199,7 +216,7 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 				granularity := rule.TimeGranularities[j]
 				suffix, err := GetSuffix(granularity)
 				if err != nil {
-					Log(INFO, "%v is not a time granularity", granularity)
+					LogContext(ctx, INFO, "%v is not a time granularity", granularity)
 					continue
 				}
 
@@ -268,9 +285,16 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 			reply := bson.D{}
 			err := session.DB(u.Database).Run(b, &reply)
 			if err != nil {
-				Log(ERROR, "Error updating database: %v", err)
+				LoggerFromContext(ctx).With(Fields{"database": u.Database, "collection": u.Collection}).
+					Log(ERROR, "Error updating database: %v", err)
+				upserts.Add(float64(len(u.Updates)), "failed")
 			} else {
-				Log(INFO, "Successfully updated database!")
+				LoggerFromContext(ctx).With(Fields{"database": u.Database, "collection": u.Collection}).
+					Log(INFO, "Successfully updated database!")
+				writeErrors, _ := convert.ConvertToBSONMapSlice(
+					bsonutil.FindValueByKey("writeErrors", reply))
+				upserts.Add(float64(len(u.Updates)-len(writeErrors)), "written")
+				upserts.Add(float64(len(writeErrors)), "failed")
 			}
 		}
 
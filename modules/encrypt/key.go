@@ -0,0 +1,146 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"unicode"
+)
+
+// the algorithms that fields can be encrypted with.
+const (
+	// Deterministic encryption gives the same ciphertext for the same value of a
+	// field, so fields can be queried by equality.
+	Deterministic = "deterministic"
+
+	// Random encryption gives a different ciphertext every time, so it doesn't
+	// show which documents have the same value.
+	Random = "random"
+)
+
+// the first byte of a ciphertext, which records the algorithm.
+const (
+	deterministicByte byte = 1
+	randomByte        byte = 2
+)
+
+// EncryptedKind is the BSON binary subtype of encrypted values.
+const EncryptedKind byte = 0x06
+
+// KeySize is the size of a key file's key: a 32-byte AES-256 key, followed by a
+// 32-byte HMAC-SHA-256 key that the nonces of deterministic encryption are derived
+// with.
+const KeySize = 64
+
+const nonceSize = 12
+
+// A Key encrypts and decrypts the values of fields.
+type Key struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// NewKey creates a key from KeySize bytes.
+func NewKey(b []byte) (*Key, error) {
+	if len(b) != KeySize {
+		return nil, fmt.Errorf("The key must be %v bytes, not %v", KeySize, len(b))
+	}
+	block, err := aes.NewCipher(b[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead, macKey: append([]byte{}, b[32:]...)}, nil
+}
+
+// ReadKeyFile reads a key from a file with the key in base64. Whitespace in the
+// file is ignored.
+func ReadKeyFile(filename string) (*Key, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the key file: %v", err)
+	}
+	encoded := bytes.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, b)
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(key, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding the key file: %v", err)
+	}
+	return NewKey(key[:n])
+}
+
+// Encrypt encrypts the value of the field at path. The path is authenticated with
+// the value, so a ciphertext can't be moved to another field.
+func (k *Key) Encrypt(path string, value interface{}, algorithm string) (bson.Binary, error) {
+	plaintext, err := bson.Marshal(bson.D{{Name: "v", Value: value}})
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	first := randomByte
+	nonce := make([]byte, nonceSize)
+	if algorithm == Deterministic {
+		first = deterministicByte
+		mac := hmac.New(sha256.New, k.macKey)
+		mac.Write([]byte(path))
+		mac.Write([]byte{0})
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else {
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return bson.Binary{}, err
+		}
+	}
+
+	data := make([]byte, 0, 1+nonceSize+len(plaintext)+k.aead.Overhead())
+	data = append(data, first)
+	data = append(data, nonce...)
+	data = k.aead.Seal(data, nonce, plaintext, additionalData(first, path))
+	return bson.Binary{Kind: EncryptedKind, Data: data}, nil
+}
+
+// Decrypt decrypts the value of the field at path.
+func (k *Key) Decrypt(path string, b bson.Binary) (interface{}, error) {
+	if b.Kind != EncryptedKind || len(b.Data) < 1+nonceSize+k.aead.Overhead() {
+		return nil, fmt.Errorf("The value of %v isn't encrypted", path)
+	}
+	first := b.Data[0]
+	nonce := b.Data[1 : 1+nonceSize]
+	plaintext, err := k.aead.Open(nil, nonce, b.Data[1+nonceSize:], additionalData(first, path))
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting %v: %v", path, err)
+	}
+	// decoding into a bson.D keeps the order of the fields of embedded documents
+	doc := bson.D{}
+	err = bson.Unmarshal(plaintext, &doc)
+	if err != nil || len(doc) != 1 {
+		return nil, fmt.Errorf("Error decoding %v: %v", path, err)
+	}
+	return doc[0].Value, nil
+}
+
+func additionalData(first byte, path string) []byte {
+	return append([]byte{first}, path...)
+}
+
+// IsEncrypted returns true if a value was encrypted by a key.
+func IsEncrypted(value interface{}) bool {
+	b, ok := value.(bson.Binary)
+	return ok && b.Kind == EncryptedKind
+}
@@ -0,0 +1,648 @@
+// Package encrypt contains a module that encrypts fields of the documents that
+// clients write, and decrypts them in the documents that clients read, so that the
+// backend only stores ciphertexts.
+package encrypt
+
+import (
+	"context"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+)
+
+// BadValue is the error code of mongod for requests with invalid arguments. It is
+// returned for requests that use encrypted fields in ways that can't be encrypted.
+const BadValue int32 = 2
+
+// the update operators that set the values of fields, which are encrypted. Other
+// operators, apart from $unset, can't be applied to ciphertexts.
+var setOperators = map[string]bool{
+	"$set":         true,
+	"$setOnInsert": true,
+}
+
+// An EncryptedField is a field that is encrypted with an algorithm.
+type EncryptedField struct {
+	// the dot-notation path of the field. Arrays along the path are descended into.
+	Path      string
+	Algorithm string
+}
+
+// A Collection has the fields that are encrypted in the namespaces.
+type Collection struct {
+	// globs for the namespaces, such as "crm.*".
+	Namespaces server.Namespaces
+	Fields     []EncryptedField
+}
+
+// An EncryptModule encrypts the fields of inserted documents and of the values set
+// by updates, and encrypts the values that filters compare deterministic fields to.
+// It decrypts the fields in the documents of responses.
+type EncryptModule struct {
+	Collections []Collection
+	key         *Key
+}
+
+func init() {
+	server.Publish(&EncryptModule{})
+}
+
+func (e *EncryptModule) New() server.Module {
+	return &EncryptModule{}
+}
+
+func (e *EncryptModule) Name() string {
+	return "encrypt"
+}
+
+/*
+Configuration structure:
+
+	{
+		keyFile: string,
+		collections: [
+			{
+				namespace: string or []string,
+				fields: [
+					{
+						path: string,
+						algorithm: "deterministic" or "random"
+					}
+				]
+			}
+		]
+	}
+
+The key file has a 64-byte key in base64. The namespaces of a collection are globs,
+such as "crm.*".
+*/
+func (e *EncryptModule) Configure(conf bson.M) error {
+	keyFile := convert.ToString(conf["keyFile"])
+	if len(keyFile) == 0 {
+		return fmt.Errorf("The encrypt module needs a keyFile")
+	}
+	key, err := ReadKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+	e.key = key
+
+	collections, err := convert.ConvertToBSONMapSlice(conf["collections"])
+	if err != nil {
+		return fmt.Errorf("Error parsing collections: %v", err)
+	}
+	e.Collections = make([]Collection, 0, len(collections))
+	for i := 0; i < len(collections); i++ {
+		c, err := parseCollection(collections[i])
+		if err != nil {
+			return err
+		}
+		e.Collections = append(e.Collections, c)
+	}
+	return nil
+}
+
+// parseCollection parses a collection from the configuration.
+func parseCollection(doc bson.M) (Collection, error) {
+	c := Collection{}
+	var err error
+	c.Namespaces, err = server.ParseNamespaces(doc["namespace"])
+	if err != nil {
+		return Collection{}, fmt.Errorf("Invalid namespace: %v", err)
+	}
+	if len(c.Namespaces) == 0 {
+		return Collection{}, fmt.Errorf("A collection doesn't have a namespace")
+	}
+
+	fields, err := convert.ConvertToBSONMapSlice(doc["fields"])
+	if err != nil || len(fields) == 0 {
+		return Collection{}, fmt.Errorf("The collection %v needs fields", c.Namespaces[0])
+	}
+	c.Fields = make([]EncryptedField, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		f := EncryptedField{
+			Path:      convert.ToString(fields[i]["path"]),
+			Algorithm: convert.ToString(fields[i]["algorithm"], Random),
+		}
+		if len(f.Path) == 0 {
+			return Collection{}, fmt.Errorf("A field of %v doesn't have a path", c.Namespaces[0])
+		}
+		if f.Algorithm != Deterministic && f.Algorithm != Random {
+			return Collection{}, fmt.Errorf("Unknown algorithm for field %v: %v", f.Path, f.Algorithm)
+		}
+		c.Fields = append(c.Fields, f)
+	}
+	return c, nil
+}
+
+// fields returns the encrypted fields of the namespace.
+func (e *EncryptModule) fields(database string, collection string) []EncryptedField {
+	fields := make([]EncryptedField, 0)
+	for i := 0; i < len(e.Collections); i++ {
+		if e.Collections[i].Namespaces.Match(database, collection) {
+			fields = append(fields, e.Collections[i].Fields...)
+		}
+	}
+	return fields
+}
+
+// encryptFunc returns a function that encrypts the values of a field. Values that
+// are null or already encrypted are left alone. The first error is kept in err.
+func (e *EncryptModule) encryptFunc(f EncryptedField, err *error) bsonutil.RewriteFunc {
+	return func(v interface{}) (interface{}, bool) {
+		if v == nil || IsEncrypted(v) || *err != nil {
+			return v, true
+		}
+		b, encryptErr := e.key.Encrypt(f.Path, v, f.Algorithm)
+		if encryptErr != nil {
+			*err = encryptErr
+			return v, true
+		}
+		return b, true
+	}
+}
+
+// encryptDocument encrypts the fields of a document.
+func (e *EncryptModule) encryptDocument(doc bson.D, fields []EncryptedField) (bson.D, error) {
+	var err error
+	for i := 0; i < len(fields); i++ {
+		doc = bsonutil.RewriteDeepValue(fields[i].Path, doc, e.encryptFunc(fields[i], &err)).(bson.D)
+	}
+	return doc, err
+}
+
+// toDoc returns the fields of an embedded document as a bson.D, or nil if the value
+// isn't a document.
+func toDoc(v interface{}) bson.D {
+	d, ok := v.(bson.D)
+	if ok {
+		return d
+	}
+	m := convert.ToBSONMap(v)
+	if m == nil {
+		return nil
+	}
+	d = make(bson.D, 0, len(m))
+	for k, value := range m {
+		d = append(d, bson.DocElem{Name: k, Value: value})
+	}
+	return d
+}
+
+// fieldPath removes the array positions from the path of an update, such as
+// "cards.$.number" or "cards.0.number", so that it can be compared to the paths of
+// the encrypted fields.
+func fieldPath(updatePath string) string {
+	keys := strings.Split(updatePath, ".")
+	out := make([]string, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		if _, err := strconv.Atoi(keys[i]); err == nil || strings.HasPrefix(keys[i], "$") {
+			continue
+		}
+		out = append(out, keys[i])
+	}
+	return strings.Join(out, ".")
+}
+
+// encryptUpdate encrypts the values that an update sets. Replacement documents are
+// encrypted like inserted documents.
+func (e *EncryptModule) encryptUpdate(update bson.D, fields []EncryptedField) (bson.D, error) {
+	if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+		return e.encryptDocument(update, fields)
+	}
+
+	out := make(bson.D, 0, len(update))
+	for i := 0; i < len(update); i++ {
+		operator := update[i].Name
+		args := toDoc(update[i].Value)
+		rewritten := make(bson.D, 0, len(args))
+		for j := 0; j < len(args); j++ {
+			arg := args[j]
+			// a renamed field would keep its plaintext value at the encrypted path
+			if operator == "$rename" {
+				f, ok := onPath(convert.ToString(arg.Value), fields)
+				if ok {
+					return nil, fmt.Errorf("Cannot rename %v to %v, since %v is encrypted", arg.Name,
+						arg.Value, f.Path)
+				}
+			}
+			updatePath := fieldPath(arg.Name)
+			for k := 0; k < len(fields); k++ {
+				f := fields[k]
+				within := strings.HasPrefix(f.Path, updatePath+".")
+				if updatePath != f.Path && !within && !strings.HasPrefix(updatePath, f.Path+".") {
+					continue
+				}
+				if operator == "$unset" {
+					continue
+				}
+				if !setOperators[operator] || (!within && updatePath != f.Path) {
+					return nil, fmt.Errorf("Cannot apply %v to %v, since %v is encrypted", operator,
+						arg.Name, f.Path)
+				}
+				var err error
+				if within {
+					arg.Value = bsonutil.RewriteDeepValue(strings.TrimPrefix(f.Path, updatePath+"."),
+						arg.Value, e.encryptFunc(f, &err))
+				} else {
+					arg.Value, _ = e.encryptFunc(f, &err)(arg.Value)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			rewritten = append(rewritten, arg)
+		}
+		out = append(out, bson.DocElem{Name: operator, Value: rewritten})
+	}
+	return out, nil
+}
+
+// encryptFilter encrypts the values that a filter compares deterministic fields to
+// by equality. Other queries on encrypted fields can't be answered from the
+// ciphertexts, and return an error.
+func (e *EncryptModule) encryptFilter(filter bson.D, fields []EncryptedField) (bson.D, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	out := make(bson.D, 0, len(filter))
+	for i := 0; i < len(filter); i++ {
+		elem := filter[i]
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			clauses, ok := elem.Value.([]interface{})
+			if !ok {
+				break
+			}
+			encrypted := make([]interface{}, len(clauses))
+			for j := 0; j < len(clauses); j++ {
+				clause, err := e.encryptFilter(toDoc(clauses[j]), fields)
+				if err != nil {
+					return nil, err
+				}
+				encrypted[j] = clause
+			}
+			elem.Value = encrypted
+		case "$expr":
+			// expressions would compare the ciphertexts to plaintext values
+			f, ok := references(elem.Value, fields, false)
+			if ok {
+				return nil, fmt.Errorf("Cannot use $expr on %v, since it is encrypted", f.Path)
+			}
+		case "$where":
+			// functions could read any of the fields
+			if len(fields) > 0 {
+				return nil, fmt.Errorf("Cannot use $where on a collection with encrypted fields")
+			}
+		default:
+			var err error
+			elem.Value, err = e.encryptCondition(elem.Name, elem.Value, fields)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, elem)
+	}
+	return out, nil
+}
+
+// encryptCondition encrypts the condition of a filter on a field.
+func (e *EncryptModule) encryptCondition(fieldName string, condition interface{},
+	fields []EncryptedField) (interface{}, error) {
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		within := strings.HasPrefix(f.Path, fieldName+".")
+		if fieldName != f.Path && !within && !strings.HasPrefix(fieldName, f.Path+".") {
+			continue
+		}
+		unsupported := fmt.Errorf("Cannot query on %v, since %v is encrypted", fieldName, f.Path)
+		if f.Algorithm != Deterministic || (!within && fieldName != f.Path) {
+			return nil, unsupported
+		}
+
+		operators := toDoc(condition)
+		if len(operators) > 0 && strings.HasPrefix(operators[0].Name, "$") {
+			if within {
+				return nil, unsupported
+			}
+			encrypted := make(bson.D, 0, len(operators))
+			for j := 0; j < len(operators); j++ {
+				op := operators[j]
+				var err error
+				switch op.Name {
+				case "$eq", "$ne":
+					op.Value, _ = e.encryptFunc(f, &err)(op.Value)
+				case "$in", "$nin":
+					values, ok := op.Value.([]interface{})
+					if !ok {
+						return nil, unsupported
+					}
+					encryptedValues := make([]interface{}, len(values))
+					for k := 0; k < len(values); k++ {
+						encryptedValues[k], _ = e.encryptFunc(f, &err)(values[k])
+					}
+					op.Value = encryptedValues
+				case "$exists":
+				default:
+					return nil, unsupported
+				}
+				if err != nil {
+					return nil, err
+				}
+				encrypted = append(encrypted, op)
+			}
+			condition = encrypted
+			continue
+		}
+
+		if _, ok := condition.(bson.RegEx); ok {
+			return nil, unsupported
+		}
+		var err error
+		if within {
+			condition = bsonutil.RewriteDeepValue(strings.TrimPrefix(f.Path, fieldName+"."),
+				condition, e.encryptFunc(f, &err))
+		} else {
+			condition, _ = e.encryptFunc(f, &err)(condition)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return condition, nil
+}
+
+// onPath returns the encrypted field that a path is on, and true if it is on one. A
+// path is on a field if it is the field, a field inside it, or a document that has
+// it.
+func onPath(p string, fields []EncryptedField) (EncryptedField, bool) {
+	p = fieldPath(p)
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if p == f.Path || strings.HasPrefix(f.Path, p+".") || strings.HasPrefix(p, f.Path+".") {
+			return f, true
+		}
+	}
+	return EncryptedField{}, false
+}
+
+// references returns the encrypted field that an aggregation expression refers to
+// with a field path, such as "$ssn", and true if it refers to one. With keys, the
+// names of the fields of documents are paths too, as they are in filters and sorts.
+func references(expr interface{}, fields []EncryptedField, keys bool) (EncryptedField, bool) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") && !strings.HasPrefix(e, "$$") {
+			return onPath(e[1:], fields)
+		}
+	case bson.D, bson.M:
+		doc := toDoc(e)
+		for i := 0; i < len(doc); i++ {
+			if doc[i].Name == "$literal" {
+				continue
+			}
+			if keys && !strings.HasPrefix(doc[i].Name, "$") {
+				if f, ok := onPath(doc[i].Name, fields); ok {
+					return f, true
+				}
+			}
+			if f, ok := references(doc[i].Value, fields, keys); ok {
+				return f, true
+			}
+		}
+	case []interface{}:
+		for i := 0; i < len(e); i++ {
+			if f, ok := references(e[i], fields, keys); ok {
+				return f, true
+			}
+		}
+	case []bson.D:
+		for i := 0; i < len(e); i++ {
+			if f, ok := references(e[i], fields, keys); ok {
+				return f, true
+			}
+		}
+	}
+	return EncryptedField{}, false
+}
+
+// checkSort returns an error if a sort is on an encrypted field, since the order of
+// the ciphertexts isn't the order of the values.
+func checkSort(sort bson.D, fields []EncryptedField) error {
+	f, ok := references(sort, fields, true)
+	if ok {
+		return fmt.Errorf("Cannot sort on %v, since it is encrypted", f.Path)
+	}
+	return nil
+}
+
+// encryptPipeline encrypts the filters of the $match stages at the start of an
+// aggregation pipeline, like the filters of finds. The stages after them see the
+// ciphertexts, so they can't refer to encrypted fields.
+func (e *EncryptModule) encryptPipeline(pipeline []bson.D,
+	fields []EncryptedField) ([]bson.D, error) {
+	out := make([]bson.D, len(pipeline))
+	copy(out, pipeline)
+
+	i := 0
+	for ; i < len(out) && len(out[i]) == 1 && out[i][0].Name == "$match"; i++ {
+		filter, err := e.encryptFilter(toDoc(out[i][0].Value), fields)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = bson.D{{Name: "$match", Value: filter}}
+	}
+
+	var err error
+	messages.WalkPipeline(out[i:], func(stage string, spec interface{}) {
+		if err != nil || stage == "$facet" {
+			return
+		}
+		// the stages of nested pipelines are walked on their own
+		if stage == "$lookup" || stage == "$unionWith" {
+			doc := toDoc(spec)
+			rest := make(bson.D, 0, len(doc))
+			for j := 0; j < len(doc); j++ {
+				if doc[j].Name != "pipeline" {
+					rest = append(rest, doc[j])
+				}
+			}
+			spec = rest
+		}
+		f, ok := references(spec, fields, stage == "$match" || stage == "$sort")
+		if ok {
+			err = fmt.Errorf("Cannot use %v in %v, since it is encrypted", f.Path, stage)
+		}
+	})
+	return out, err
+}
+
+// EncryptRequest returns the request with the fields that it writes encrypted, and
+// with the values its filters compare deterministic fields to encrypted.
+func (e *EncryptModule) EncryptRequest(r messages.Requester,
+	fields []EncryptedField) (messages.Requester, error) {
+	var err error
+	switch req := r.(type) {
+	case messages.Insert:
+		documents := make([]bson.D, len(req.Documents))
+		for i := 0; i < len(req.Documents) && err == nil; i++ {
+			documents[i], err = e.encryptDocument(req.Documents[i], fields)
+		}
+		req.Documents = documents
+		return req, err
+	case messages.Update:
+		updates := make([]messages.SingleUpdate, len(req.Updates))
+		for i := 0; i < len(req.Updates) && err == nil; i++ {
+			updates[i] = req.Updates[i]
+			updates[i].Selector, err = e.encryptFilter(req.Updates[i].Selector, fields)
+			if err == nil {
+				updates[i].Update, err = e.encryptUpdate(req.Updates[i].Update, fields)
+			}
+		}
+		req.Updates = updates
+		return req, err
+	case messages.Delete:
+		deletes := make([]messages.SingleDelete, len(req.Deletes))
+		for i := 0; i < len(req.Deletes) && err == nil; i++ {
+			deletes[i] = req.Deletes[i]
+			deletes[i].Selector, err = e.encryptFilter(req.Deletes[i].Selector, fields)
+		}
+		req.Deletes = deletes
+		return req, err
+	case messages.Find:
+		req.Filter, err = e.encryptFilter(req.Filter, fields)
+		if err == nil {
+			err = checkSort(req.Sort, fields)
+		}
+		return req, err
+	case messages.FindAndModify:
+		// an upsert inserts the fields of the query and the update, so both are
+		// encrypted like those of updates
+		req.Query, err = e.encryptFilter(req.Query, fields)
+		if err == nil {
+			err = checkSort(req.Sort, fields)
+		}
+		switch update := req.Update.(type) {
+		case bson.D:
+			if err == nil {
+				req.Update, err = e.encryptUpdate(update, fields)
+			}
+		case []bson.D:
+			f, ok := references(update, fields, true)
+			if err == nil && ok {
+				err = fmt.Errorf("Cannot use %v in an update pipeline, since it is encrypted", f.Path)
+			}
+		}
+		return req, err
+	case messages.Count:
+		req.Query, err = e.encryptFilter(req.Query, fields)
+		return req, err
+	case messages.Distinct:
+		f, ok := onPath(req.Key, fields)
+		if ok {
+			return nil, fmt.Errorf("Cannot get the distinct values of %v, since %v is encrypted",
+				req.Key, f.Path)
+		}
+		req.Query, err = e.encryptFilter(req.Query, fields)
+		return req, err
+	case messages.Aggregate:
+		req.Pipeline, err = e.encryptPipeline(req.Pipeline, fields)
+		return req, err
+	}
+	return r, nil
+}
+
+// decryptDocument decrypts the fields of a document. Values that can't be decrypted
+// are left alone, and the first error is returned.
+func (e *EncryptModule) decryptDocument(doc bson.D, fields []EncryptedField) (bson.D, error) {
+	var err error
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		doc = bsonutil.RewriteDeepValue(f.Path, doc, func(v interface{}) (interface{}, bool) {
+			b, ok := v.(bson.Binary)
+			if !ok || b.Kind != EncryptedKind {
+				return v, true
+			}
+			value, decryptErr := e.key.Decrypt(f.Path, b)
+			if decryptErr != nil {
+				if err == nil {
+					err = decryptErr
+				}
+				return v, true
+			}
+			return value, true
+		}).(bson.D)
+	}
+	return doc, err
+}
+
+// decryptDocuments decrypts the fields of documents, and returns the new documents.
+func (e *EncryptModule) decryptDocuments(ctx context.Context, docs []bson.D,
+	fields []EncryptedField) []bson.D {
+	if docs == nil {
+		return nil
+	}
+	out := make([]bson.D, len(docs))
+	for i := 0; i < len(docs); i++ {
+		var err error
+		out[i], err = e.decryptDocument(docs[i], fields)
+		if err != nil {
+			LogContext(ctx, ERROR, "%v", err)
+		}
+	}
+	return out
+}
+
+// DecryptResponse returns the response with the fields of its documents decrypted.
+func (e *EncryptModule) DecryptResponse(ctx context.Context, w messages.ResponseWriter,
+	fields []EncryptedField) messages.ResponseWriter {
+	switch res := w.(type) {
+	case messages.FindResponse:
+		res.Documents = e.decryptDocuments(ctx, res.Documents, fields)
+		return res
+	case messages.GetMoreResponse:
+		res.Documents = e.decryptDocuments(ctx, res.Documents, fields)
+		return res
+	case messages.AggregateResponse:
+		res.Documents = e.decryptDocuments(ctx, res.Documents, fields)
+		return res
+	case messages.FindAndModifyResponse:
+		if res.Value != nil {
+			res.Value = e.decryptDocuments(ctx, []bson.D{res.Value}, fields)[0]
+		}
+		return res
+	}
+	return w
+}
+
+func (e *EncryptModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	fields := e.fields(messages.Namespace(req))
+	if len(fields) == 0 {
+		next(ctx, req, res)
+		return
+	}
+
+	req, err := e.EncryptRequest(req, fields)
+	if err != nil {
+		res.Error(BadValue, err.Error())
+		return
+	}
+
+	resNext := messages.ModuleResponse{}
+	next(ctx, req, &resNext)
+
+	if resNext.Writer != nil {
+		res.Write(e.DecryptResponse(ctx, resNext.Writer, fields))
+	}
+	if resNext.CommandError != nil {
+		res.Error(resNext.CommandError.ErrorCode, resNext.CommandError.Message)
+	}
+}
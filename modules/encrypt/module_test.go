@@ -0,0 +1,313 @@
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeyFile writes a key file with a fixed key to dir.
+func writeKeyFile(dir string, b byte) string {
+	filename := filepath.Join(dir, "key")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, KeySize))
+	So(ioutil.WriteFile(filename, []byte(key[:40]+"\n"+key[40:]+"\n"), 0600), ShouldBeNil)
+	return filename
+}
+
+func TestKey(t *testing.T) {
+	Convey("Encrypt and decrypt values", t, func() {
+		key, err := NewKey(bytes.Repeat([]byte{1}, KeySize))
+		So(err, ShouldBeNil)
+
+		Convey("deterministically", func() {
+			a, err := key.Encrypt("ssn", "123-45-6789", Deterministic)
+			So(err, ShouldBeNil)
+			b, _ := key.Encrypt("ssn", "123-45-6789", Deterministic)
+			So(a, ShouldResemble, b)
+			So(IsEncrypted(a), ShouldBeTrue)
+			other, _ := key.Encrypt("taxId", "123-45-6789", Deterministic)
+			So(other, ShouldNotResemble, a)
+
+			v, err := key.Decrypt("ssn", a)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, "123-45-6789")
+			_, err = key.Decrypt("taxId", a)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("randomly", func() {
+			value := bson.D{{"street", "1 Main St"}, {"zip", 10001}}
+			a, err := key.Encrypt("address", value, Random)
+			So(err, ShouldBeNil)
+			b, _ := key.Encrypt("address", value, Random)
+			So(a, ShouldNotResemble, b)
+
+			v, err := key.Decrypt("address", b)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, value)
+		})
+
+		Convey("but not with another key", func() {
+			a, _ := key.Encrypt("ssn", "123-45-6789", Random)
+			other, _ := NewKey(bytes.Repeat([]byte{2}, KeySize))
+			_, err := other.Decrypt("ssn", a)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Reject keys of the wrong size", t, func() {
+		_, err := NewKey(make([]byte, 32))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEncryptModule(t *testing.T) {
+	Convey("Encrypt fields in the proxy", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-encrypt")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		e := &EncryptModule{}
+		err = e.Configure(bson.M{
+			"keyFile": writeKeyFile(dir, 7),
+			"collections": []interface{}{
+				bson.M{"namespace": "crm.customers", "fields": []interface{}{
+					bson.M{"path": "ssn", "algorithm": "deterministic"},
+					bson.M{"path": "cards.number", "algorithm": "random"},
+				}},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		// backend keeps the last request that reached it, and answers finds with the
+		// documents it was given.
+		var received messages.Requester
+		var stored []bson.D
+		backend := func(ctx context.Context, req messages.Requester, res messages.Responder) {
+			received = req
+			res.Write(messages.FindResponse{Documents: stored})
+		}
+		process := func(req messages.Requester) messages.ModuleResponse {
+			res := messages.ModuleResponse{}
+			e.Process(context.Background(), req, &res, backend)
+			return res
+		}
+
+		customer := bson.D{
+			{"name", "ann"},
+			{"ssn", "123-45-6789"},
+			{"cards", []interface{}{bson.D{{"number", "4111111111111111"}}}},
+		}
+
+		Convey("in inserted documents, and decrypt them in responses", func() {
+			res := process(messages.Insert{Database: "crm", Collection: "customers",
+				Documents: []bson.D{customer}})
+			So(res.CommandError, ShouldBeNil)
+			doc := received.(messages.Insert).Documents[0]
+			So(bsonutil.FindValueByKey("name", doc), ShouldEqual, "ann")
+			So(IsEncrypted(bsonutil.FindValueByKey("ssn", doc)), ShouldBeTrue)
+			cards := bsonutil.FindValueByKey("cards", doc).([]interface{})
+			So(IsEncrypted(bsonutil.FindValueByKey("number", cards[0].(bson.D))), ShouldBeTrue)
+
+			stored = []bson.D{doc}
+			res = process(messages.Find{Database: "crm", Collection: "customers"})
+			So(res.Writer.(messages.FindResponse).Documents, ShouldResemble, []bson.D{customer})
+		})
+
+		Convey("in equality filters on deterministic fields", func() {
+			process(messages.Insert{Database: "crm", Collection: "customers",
+				Documents: []bson.D{customer}})
+			encrypted := bsonutil.FindValueByKey("ssn", received.(messages.Insert).Documents[0])
+
+			res := process(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"ssn", "123-45-6789"}, {"name", "ann"}}})
+			So(res.CommandError, ShouldBeNil)
+			So(received.(messages.Find).Filter, ShouldResemble,
+				bson.D{{"ssn", encrypted}, {"name", "ann"}})
+
+			process(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"$or", []interface{}{
+					bson.D{{"ssn", bson.D{{"$in", []interface{}{"123-45-6789"}}}}},
+					bson.D{{"name", "bob"}},
+				}}}})
+			So(received.(messages.Find).Filter, ShouldResemble, bson.D{{"$or", []interface{}{
+				bson.D{{"ssn", bson.D{{"$in", []interface{}{encrypted}}}}},
+				bson.D{{"name", "bob"}},
+			}}})
+		})
+
+		Convey("in the values set by updates", func() {
+			res := process(messages.Update{Database: "crm", Collection: "customers",
+				Updates: []messages.SingleUpdate{{
+					Selector: bson.D{{"ssn", "123-45-6789"}},
+					Update: bson.D{{"$set", bson.D{{"cards.0.number", "5500"}, {"name", "anne"}}},
+						{"$unset", bson.D{{"ssn", ""}}}},
+				}}})
+			So(res.CommandError, ShouldBeNil)
+			update := received.(messages.Update).Updates[0]
+			So(IsEncrypted(bsonutil.FindValueByKey("ssn", update.Selector)), ShouldBeTrue)
+			set := bsonutil.FindValueByKey("$set", update.Update).(bson.D)
+			So(IsEncrypted(bsonutil.FindValueByKey("cards.0.number", set)), ShouldBeTrue)
+			So(bsonutil.FindValueByKey("name", set), ShouldEqual, "anne")
+			So(bsonutil.FindValueByKey("$unset", update.Update), ShouldResemble, bson.D{{"ssn", ""}})
+		})
+
+		Convey("in the queries and updates of findAndModify, including upserts", func() {
+			process(messages.Insert{Database: "crm", Collection: "customers",
+				Documents: []bson.D{customer}})
+			encrypted := bsonutil.FindValueByKey("ssn", received.(messages.Insert).Documents[0])
+
+			res := process(messages.FindAndModify{Database: "crm", Collection: "customers",
+				Query:  bson.D{{"ssn", "123-45-6789"}},
+				Update: bson.D{{"$setOnInsert", bson.D{{"cards", []interface{}{bson.D{{"number", "5500"}}}}}}},
+				Upsert: true, New: true})
+			So(res.CommandError, ShouldBeNil)
+			findAndModify := received.(messages.FindAndModify)
+			So(findAndModify.Query, ShouldResemble, bson.D{{"ssn", encrypted}})
+			setOnInsert := bsonutil.FindValueByKey("$setOnInsert", findAndModify.Update.(bson.D)).(bson.D)
+			cards := bsonutil.FindValueByKey("cards", setOnInsert).([]interface{})
+			So(IsEncrypted(bsonutil.FindValueByKey("number", cards[0].(bson.D))), ShouldBeTrue)
+
+			res = process(messages.FindAndModify{Database: "crm", Collection: "customers",
+				Update: bson.D{{"ssn", "987-65-4321"}}})
+			So(res.CommandError, ShouldBeNil)
+			So(IsEncrypted(bsonutil.FindValueByKey("ssn", received.(messages.FindAndModify).Update.(bson.D))),
+				ShouldBeTrue)
+		})
+
+		Convey("in the filters of counts, distincts and the first stages of aggregations", func() {
+			process(messages.Insert{Database: "crm", Collection: "customers",
+				Documents: []bson.D{customer}})
+			encrypted := bsonutil.FindValueByKey("ssn", received.(messages.Insert).Documents[0])
+
+			So(process(messages.Count{Database: "crm", Collection: "customers",
+				Query: bson.D{{"ssn", "123-45-6789"}}}).CommandError, ShouldBeNil)
+			So(received.(messages.Count).Query, ShouldResemble, bson.D{{"ssn", encrypted}})
+
+			So(process(messages.Distinct{Database: "crm", Collection: "customers", Key: "name",
+				Query: bson.D{{"ssn", "123-45-6789"}}}).CommandError, ShouldBeNil)
+			So(received.(messages.Distinct).Query, ShouldResemble, bson.D{{"ssn", encrypted}})
+
+			So(process(messages.Aggregate{Database: "crm", Collection: "customers", Pipeline: []bson.D{
+				{{"$match", bson.D{{"ssn", "123-45-6789"}}}},
+				{{"$group", bson.D{{"_id", "$name"}, {"n", bson.D{{"$sum", 1}}}}}},
+			}}).CommandError, ShouldBeNil)
+			So(received.(messages.Aggregate).Pipeline[0], ShouldResemble,
+				bson.D{{"$match", bson.D{{"ssn", encrypted}}}})
+		})
+
+		Convey("and reject counts, distincts and aggregations that use encrypted fields", func() {
+			received = nil
+			res := process(messages.Count{Database: "crm", Collection: "customers",
+				Query: bson.D{{"ssn", bson.D{{"$gt", "1"}}}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			res = process(messages.Distinct{Database: "crm", Collection: "customers", Key: "cards.number"})
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: BadValue,
+				Message: "Cannot get the distinct values of cards.number, since cards.number is encrypted"})
+			res = process(messages.Distinct{Database: "crm", Collection: "customers", Key: "cards"})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+
+			aggregate := func(pipeline ...bson.D) messages.ModuleResponse {
+				return process(messages.Aggregate{Database: "crm", Collection: "customers",
+					Pipeline: pipeline})
+			}
+			res = aggregate(bson.D{{"$group", bson.D{{"_id", "$ssn"}}}})
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: BadValue,
+				Message: "Cannot use ssn in $group, since it is encrypted"})
+			So(aggregate(bson.D{{"$sort", bson.D{{"ssn", 1}}}}).CommandError.ErrorCode,
+				ShouldEqual, BadValue)
+			So(aggregate(bson.D{{"$limit", 5}}, bson.D{{"$match", bson.D{{"ssn", "123-45-6789"}}}}).
+				CommandError.ErrorCode, ShouldEqual, BadValue)
+			So(aggregate(bson.D{{"$facet", bson.D{{"numbers", []interface{}{
+				bson.D{{"$project", bson.D{{"n", bson.D{{"$concat", []interface{}{"$cards.number"}}}}}}},
+			}}}}}).CommandError.ErrorCode, ShouldEqual, BadValue)
+
+			res = process(messages.FindAndModify{Database: "crm", Collection: "customers",
+				Update: []bson.D{{{"$set", bson.D{{"ssn", "1"}}}}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			res = process(messages.Find{Database: "crm", Collection: "customers",
+				Sort: bson.D{{"ssn", 1}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			So(received, ShouldBeNil)
+		})
+
+		Convey("and reject queries that can't be encrypted", func() {
+			received = nil
+			res := process(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"ssn", bson.D{{"$gt", "1"}}}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			res = process(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"cards.number", "4111111111111111"}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			res = process(messages.Update{Database: "crm", Collection: "customers",
+				Updates: []messages.SingleUpdate{{Update: bson.D{{"$inc", bson.D{{"ssn", 1}}}}}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			So(received, ShouldBeNil)
+		})
+
+		Convey("and reject expressions and functions that use encrypted fields", func() {
+			received = nil
+			res := process(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"$expr", bson.D{{"$eq", []interface{}{"$ssn", "123-45-6789"}}}}}})
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: BadValue,
+				Message: "Cannot use $expr on ssn, since it is encrypted"})
+			res = process(messages.Count{Database: "crm", Collection: "customers",
+				Query: bson.D{{"$or", []interface{}{bson.D{{"$where", "this.ssn == '123-45-6789'"}}}}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			So(received, ShouldBeNil)
+
+			res = process(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"$expr", bson.D{{"$eq", []interface{}{"$name", "ann"}}}}}})
+			So(res.CommandError, ShouldBeNil)
+		})
+
+		Convey("and reject renaming fields to encrypted paths", func() {
+			received = nil
+			res := process(messages.Update{Database: "crm", Collection: "customers",
+				Updates: []messages.SingleUpdate{{Update: bson.D{{"$rename", bson.D{{"plain", "ssn"}}}}}}})
+			So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: BadValue,
+				Message: "Cannot rename plain to ssn, since ssn is encrypted"})
+			res = process(messages.FindAndModify{Database: "crm", Collection: "customers",
+				Update: bson.D{{"$rename", bson.D{{"numbers", "cards"}}}}})
+			So(res.CommandError.ErrorCode, ShouldEqual, BadValue)
+			So(received, ShouldBeNil)
+
+			res = process(messages.Update{Database: "crm", Collection: "customers",
+				Updates: []messages.SingleUpdate{{Update: bson.D{{"$rename", bson.D{{"name", "fullName"}}}}}}})
+			So(res.CommandError, ShouldBeNil)
+		})
+
+		Convey("but not in other namespaces", func() {
+			process(messages.Insert{Database: "crm", Collection: "leads", Documents: []bson.D{customer}})
+			So(received.(messages.Insert).Documents[0], ShouldResemble, customer)
+		})
+	})
+
+	Convey("Reject invalid configurations", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-encrypt")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		keyFile := writeKeyFile(dir, 7)
+
+		e := &EncryptModule{}
+		So(e.Configure(bson.M{}), ShouldNotBeNil)
+		So(e.Configure(bson.M{"keyFile": filepath.Join(dir, "missing")}), ShouldNotBeNil)
+		So(e.Configure(bson.M{"keyFile": keyFile, "collections": []interface{}{
+			bson.M{"namespace": "a.b", "fields": []interface{}{
+				bson.M{"path": "x", "algorithm": "rot13"}}}}}), ShouldNotBeNil)
+		So(e.Configure(bson.M{"keyFile": keyFile, "collections": []interface{}{
+			bson.M{"namespace": "a.b"}}}), ShouldNotBeNil)
+	})
+}
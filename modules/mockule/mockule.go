@@ -3,15 +3,19 @@
 package mockule
 
 import (
+	"context"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
 	"github.com/mongodbinc-interns/mongoproxy/server"
 	"gopkg.in/mgo.v2/bson"
 	"math/rand"
+	"reflect"
 	"strconv"
 )
 
-var maxWireVersion = 3
+// 6 is the first wire version with OP_MSG, which modern drivers require.
+var maxWireVersion = 6
 
 // a 'database' in memory. The string keys are the collections, which
 // have an array of bson documents.
@@ -39,16 +43,21 @@ func (m Mockule) Configure(bson.M) error {
 	return nil
 }
 
-func (m Mockule) Process(req messages.Requester, res messages.Responder,
+func (m Mockule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
 	next server.PipelineFunc) {
 
+	if server.Interrupted(ctx, res) {
+		next(ctx, req, res)
+		return
+	}
+
 	switch req.Type() {
 	case messages.FindType:
 		opq, err := messages.ToFindRequest(req)
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opq)
+		LoggerFromContext(ctx).With(messages.LogFields(opq)).Log(INFO, "Request")
 
 		// TODO: actually do something with the query
 
@@ -63,27 +72,148 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		r.Database = opq.Database
 		r.Collection = opq.Collection
 		res.Write(r)
+	case messages.AggregateType:
+		opa, err := messages.ToAggregateRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opa)).Log(INFO, "Request")
+
+		// like finds, the pipeline is ignored and all of the documents are returned
+		r := messages.AggregateResponse{}
+		docs, ok := database[opa.Collection]
+		r.Documents = docs
+		if !ok {
+			r.Documents = make([]bson.D, 0)
+		}
+		r.Database = opa.Database
+		r.Collection = opa.Collection
+		res.Write(r)
+	case messages.FindAndModifyType:
+		opf, err := messages.ToFindAndModifyRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opf)).Log(INFO, "Request")
+
+		if !opf.Remove {
+			res.Error(0, "not supported")
+			break
+		}
+
+		// like finds, the query is ignored and the first document is removed
+		r := messages.FindAndModifyResponse{}
+		r.Removed = true
+		docs := database[opf.Collection]
+		if len(docs) > 0 {
+			r.Value = docs[0]
+			r.N = 1
+			database[opf.Collection] = docs[1:]
+		}
+		res.Write(r)
+	case messages.CountType:
+		opc, err := messages.ToCountRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opc)).Log(INFO, "Request")
+
+		r := messages.CountResponse{}
+		r.N = int64(len(database[opc.Collection]))
+		res.Write(r)
+	case messages.DistinctType:
+		opd, err := messages.ToDistinctRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opd)).Log(INFO, "Request")
+
+		// collect the unique values of the key from every document
+		r := messages.DistinctResponse{}
+		r.Values = make([]interface{}, 0)
+		docs := database[opd.Collection]
+		for i := 0; i < len(docs); i++ {
+			value := bsonutil.FindValueByKey(opd.Key, docs[i])
+			if value == nil {
+				continue
+			}
+			found := false
+			for j := 0; j < len(r.Values); j++ {
+				if reflect.DeepEqual(r.Values[j], value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				r.Values = append(r.Values, value)
+			}
+		}
+		res.Write(r)
+	case messages.ListCollectionsType:
+		opl, err := messages.ToListCollectionsRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opl)).Log(INFO, "Request")
+
+		// the 'database' holds every collection, regardless of the request's database
+		r := messages.ListCollectionsResponse{}
+		r.Database = opl.Database
+		r.Collections = make([]bson.D, 0)
+		for name := range database {
+			r.Collections = append(r.Collections, bson.D{
+				{"name", name},
+				{"type", "collection"},
+			})
+		}
+		res.Write(r)
+	case messages.ListIndexesType:
+		opl, err := messages.ToListIndexesRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opl)).Log(INFO, "Request")
+
+		// the only index is the default _id index
+		r := messages.ListIndexesResponse{}
+		r.Database = opl.Database
+		r.Collection = opl.Collection
+		r.Indexes = []bson.D{
+			{{"v", 2}, {"key", bson.D{{"_id", 1}}}, {"name", "_id_"}},
+		}
+		res.Write(r)
 	case messages.GetMoreType:
 		opg, err := messages.ToGetMoreRequest(req)
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opg)
+		LoggerFromContext(ctx).With(messages.LogFields(opg)).Log(INFO, "Request")
 		r := messages.GetMoreResponse{}
 		if opg.CursorID == int64(100) {
-			Log(NOTICE, "Retrieved valid getMore\n")
+			LogContext(ctx, NOTICE, "Retrieved valid getMore")
 		}
 		r.Database = opg.Database
 		r.Collection = opg.Collection
 		r.CursorID = opg.CursorID
 		r.Documents = make([]bson.D, 0)
 		res.Write(r)
+	case messages.KillCursorsType:
+		opk, err := messages.ToKillCursorsRequest(req)
+		if err != nil {
+			break
+		}
+		LoggerFromContext(ctx).With(messages.LogFields(opk)).Log(INFO, "Request")
+
+		// there aren't any real cursors, so pretend that they were all killed
+		r := messages.KillCursorsResponse{}
+		r.CursorsKilled = opk.CursorIDs
+		res.Write(r)
 	case messages.InsertType:
 		opi, err := messages.ToInsertRequest(req)
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opi)
+		LoggerFromContext(ctx).With(messages.LogFields(opi)).Log(INFO, "Request")
 
 		// insert documents into the 'database'
 		for doc := range opi.Documents {
@@ -104,7 +234,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 			break
 		}
 		r := messages.UpdateResponse{}
-		Log(INFO, "%#v", opu)
+		LoggerFromContext(ctx).With(messages.LogFields(opu)).Log(INFO, "Request")
 		r.N = 5
 		r.NModified = 4
 
@@ -114,7 +244,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opd)
+		LoggerFromContext(ctx).With(messages.LogFields(opd)).Log(INFO, "Request")
 		r := messages.DeleteResponse{}
 		r.N = 1
 
@@ -124,14 +254,17 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", command)
+		LoggerFromContext(ctx).With(messages.LogFields(command)).Log(INFO, "Request")
 
 		switch command.CommandName {
+		case "hello":
+			fallthrough
 		case "ismaster":
 			fallthrough
 		case "isMaster":
 			r := bson.M{}
 			r["ismaster"] = true
+			r["isWritablePrimary"] = true
 			r["secondary"] = false
 			r["localTime"] = bson.Now()
 			r["maxWireVersion"] = maxWireVersion
@@ -209,5 +342,5 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		reply.Reply = bson.M{"ok": 1}
 		res.Write(reply)
 	}
-	next(req, res)
+	next(ctx, req, res)
 }
@@ -4,17 +4,22 @@
 package mongod
 
 import (
+	"context"
 	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/connection"
 	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
 	"github.com/mongodbinc-interns/mongoproxy/server"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"time"
 )
 
+// the number of documents returned by a getMore that doesn't specify a batch size.
+const defaultBatchSize = 101
+
 // A MongodModule takes the request, sends it to a mongod instance, and then
 // writes the response from mongod into the ResponseWriter before calling
 // the next module. It passes on requests unchanged.
@@ -27,6 +32,27 @@ func init() {
 	server.Publish(&MongodModule{})
 }
 
+// backendErrors counts the errors from mongod, by whether it couldn't be reached
+// ("connection"), the request or its reply was lost on the way ("network"), a cursor
+// couldn't be read ("query"), or it replied with an error ("command").
+var backendErrors = metrics.RegisterCounter("mongoproxy_mongod_backend_errors_total",
+	"Errors connecting to or returned by mongod, by kind.", "kind")
+
+// countBackendError counts an error that mgo returned for a request. mgo returns the
+// error replies of mongod, including the command replies with ok: 0, as QueryErrors.
+func countBackendError(err error) {
+	if _, ok := err.(*mgo.QueryError); ok {
+		backendErrors.Inc("command")
+		return
+	}
+	switch err {
+	case mgo.ErrCursor, mgo.ErrNotFound:
+		backendErrors.Inc("query")
+	default:
+		backendErrors.Inc("network")
+	}
+}
+
 func (m *MongodModule) New() server.Module {
 	return &MongodModule{}
 }
@@ -45,83 +71,87 @@ Configuration structure:
 		username: string,
 		password: string,
 		database: string
+	},
+	tls: {
+		caFile: string,
+		certFile: string,
+		keyFile: string,
+		serverName: string,
+		insecureSkipVerify: boolean
 	}
 }
 */
 func (m *MongodModule) Configure(conf bson.M) error {
-	addrs, ok := conf["addresses"].([]string)
-	if !ok {
-		// check if it's a slice of interfaces
-		addrsRaw, ok := conf["addresses"].([]interface{})
-		if !ok {
-			return fmt.Errorf("Invalid addresses: not a slice")
-		}
-		addrs = make([]string, len(addrsRaw))
-		for i := 0; i < len(addrsRaw); i++ {
-			a, ok := addrsRaw[i].(string)
-			if !ok {
-				return fmt.Errorf("Invalid addresses: address is not a string")
-			}
-			addrs[i] = a
-		}
+	dialInfo, err := connection.ParseDialInfo(conf)
+	if err != nil {
+		return err
 	}
 
-	timeout := time.Duration(convert.ToInt64(conf["timeout"], -1))
-	if timeout == -1 {
-		timeout = time.Second * 10
-	}
+	m.Connection = dialInfo
+	return nil
+}
 
-	dialInfo := mgo.DialInfo{
-		Addrs:   addrs,
-		Direct:  convert.ToBool(conf["direct"]),
-		Timeout: timeout,
+// Start connects to mongod, so that the proxy doesn't start if mongod can't be reached.
+func (m *MongodModule) Start() error {
+	return m.dial()
+}
+
+// dial creates the module's session with mongod if it doesn't have one yet.
+func (m *MongodModule) dial() error {
+	if m.mongoSession != nil {
+		return nil
+	}
+	session, err := mgo.DialWithInfo(&m.Connection)
+	if err != nil {
+		return fmt.Errorf("Error connecting to MongoDB: %v", err)
 	}
+	session.SetPrefetch(0)
+	m.mongoSession = session
+	return nil
+}
 
-	auth := convert.ToBSONMap(conf["auth"])
-	if auth != nil {
-		username, ok := auth["username"].(string)
-		if ok {
-			dialInfo.Username = username
-		}
-		password, ok := auth["password"].(string)
-		if ok {
-			dialInfo.Password = password
-		}
-		database, ok := auth["database"].(string)
-		if ok {
-			dialInfo.Database = database
-		}
+// Health pings mongod, and reports the module as down if it can't be reached.
+func (m *MongodModule) Health() server.Health {
+	return connection.Health(m.mongoSession, m.Connection)
+}
 
+// Close closes the module's session with mongod, if it has one.
+func (m *MongodModule) Close() error {
+	if m.mongoSession != nil {
+		m.mongoSession.Close()
+		m.mongoSession = nil
 	}
-
-	m.Connection = dialInfo
 	return nil
 }
 
-func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
+func (m *MongodModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
 	next server.PipelineFunc) {
 
 	// spin up the session if it doesn't exist
-	if m.mongoSession == nil {
-		var err error
-		m.mongoSession, err = mgo.DialWithInfo(&m.Connection)
-		if err != nil {
-			Log(ERROR, "Error connecting to MongoDB: %#v", err)
-			next(req, res)
-			return
-		}
-		m.mongoSession.SetPrefetch(0)
+	err := m.dial()
+	if err != nil {
+		LogContext(ctx, ERROR, "%v", err)
+		backendErrors.Inc("connection")
+		next(ctx, req, res)
+		return
 	}
 
 	session := m.mongoSession.Copy()
 	defer session.Close()
 
+	// the client may have disconnected or run out of time while the request was
+	// in the pipeline.
+	if server.Interrupted(ctx, res) {
+		next(ctx, req, res)
+		return
+	}
+
 	switch req.Type() {
 	case messages.CommandType:
 		command, err := messages.ToCommandRequest(req)
 		if err != nil {
-			Log(WARNING, "Error converting to command: %#v", err)
-			next(req, res)
+			LogContext(ctx, WARNING, "Error converting to command: %v", err)
+			next(ctx, req, res)
 			return
 		}
 
@@ -129,16 +159,21 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 
 		reply := bson.M{}
 		err = session.DB(command.Database).Run(b, reply)
+		if server.Interrupted(ctx, res) {
+			next(ctx, req, res)
+			return
+		}
 		if err != nil {
+			countBackendError(err)
 			// log an error if we can
 			qErr, ok := err.(*mgo.QueryError)
-			Log(WARNING, "Error running command %v: %v", command.CommandName, err)
+			LogContext(ctx, WARNING, "Error running command %v: %v", command.CommandName, err)
 			if ok {
 				res.Error(int32(qErr.Code), qErr.Message)
 			} else {
 				res.Error(-1, "Unknown error")
 			}
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -148,8 +183,9 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 
 		if convert.ToInt(reply["ok"]) == 0 {
 			// we have a command error.
+			backendErrors.Inc("command")
 			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -158,80 +194,60 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 	case messages.FindType:
 		f, err := messages.ToFindRequest(req)
 		if err != nil {
-			Log(WARNING, "Error converting to a Find command: %#v", err)
-			next(req, res)
+			LogContext(ctx, WARNING, "Error converting to a Find command: %v", err)
+			next(ctx, req, res)
 			return
 		}
 
-		c := session.DB(f.Database).C(f.Collection)
-		query := c.Find(f.Filter).Batch(int(f.Limit)).Skip(int(f.Skip)).Prefetch(0)
+		// the read preference isn't applied: mgo could read from a secondary in the
+		// eventual consistency mode, but the getMores and killCursors of the cursor
+		// would then go to the primary, which doesn't have it. Reads always go to the
+		// primary until the module keeps track of the member that has each cursor.
 
-		if f.Projection != nil {
-			query = query.Select(f.Projection)
+		// the backend is given the time that is left, so it stops the operation
+		// when the request runs out of time.
+		if ms := server.RemainingMaxTimeMS(ctx); ms > 0 {
+			f.MaxTimeMS = ms
 		}
 
-		var iter = query.Iter()
-		var results []bson.D
-
-		cursorID := int64(0)
-
-		if f.Limit > 0 {
-			// only store the amount specified by the limit
-			for i := 0; i < int(f.Limit); i++ {
-				var result bson.D
-				ok := iter.Next(&result)
-				if !ok {
-					err = iter.Err()
-					if err != nil {
-						Log(WARNING, "Error on Find Command: %#v", err)
-
-						// log an error if we can
-						qErr, ok := err.(*mgo.QueryError)
-						if ok {
-							res.Error(int32(qErr.Code), qErr.Message)
-						}
-						iter.Close()
-						next(req, res)
-						return
-					}
-					// we ran out of documents, but didn't have an error
-					break
-				}
-				if cursorID == 0 {
-					cursorID = iter.CursorID()
-				}
-				results = append(results, result)
-			}
-		} else {
-			// dump all of them
-			err = iter.All(&results)
-			if err != nil {
-				Log(WARNING, "Error on Find Command: %#v", err)
-
-				// log an error if we can
-				qErr, ok := err.(*mgo.QueryError)
-				if ok {
-					res.Error(int32(qErr.Code), qErr.Message)
-				}
-				next(req, res)
+		// finds are run as find commands, which support all of the options that the
+		// legacy opcode does. The cursor can still be iterated with getMores.
+		if f.Explain {
+			reply, ok := runCommand(ctx, session, f.Database, bson.D{{"explain", f.ToBSON()}}, res)
+			if !ok {
+				next(ctx, req, res)
 				return
 			}
+
+			response := messages.FindResponse{
+				Database:   f.Database,
+				Collection: f.Collection,
+				Documents:  []bson.D{reply},
+			}
+			res.Write(response)
+			break
+		}
+
+		reply, ok := runCommand(ctx, session, f.Database, f.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
 		}
 
 		response := messages.FindResponse{
 			Database:   f.Database,
 			Collection: f.Collection,
-			Documents:  results,
-			CursorID:   cursorID,
 		}
+		parseCursorReply(reply, &response.CursorID, &response.Database,
+			&response.Collection, &response.Documents)
 
 		res.Write(response)
 
 	case messages.InsertType:
 		insert, err := messages.ToInsertRequest(req)
 		if err != nil {
-			Log(WARNING, "Error converting to Insert command: %#v", err)
-			next(req, res)
+			LogContext(ctx, WARNING, "Error converting to Insert command: %v", err)
+			next(ctx, req, res)
 			return
 		}
 
@@ -240,12 +256,13 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 		reply := bson.M{}
 		err = session.DB(insert.Database).Run(b, reply)
 		if err != nil {
+			countBackendError(err)
 			// log an error if we can
 			qErr, ok := err.(*mgo.QueryError)
 			if ok {
 				res.Error(int32(qErr.Code), qErr.Message)
 			}
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -258,11 +275,13 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			// we have write errors
 			response.WriteErrors = writeErrors
 		}
+		response.WriteConcernError = convert.ToBSONMap(reply["writeConcernError"])
 
 		if convert.ToInt(reply["ok"]) == 0 {
 			// we have a command error.
+			backendErrors.Inc("command")
 			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -271,8 +290,8 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 	case messages.UpdateType:
 		u, err := messages.ToUpdateRequest(req)
 		if err != nil {
-			Log(WARNING, "Error converting to Update command: %v", err)
-			next(req, res)
+			LogContext(ctx, WARNING, "Error converting to Update command: %v", err)
+			next(ctx, req, res)
 			return
 		}
 
@@ -281,12 +300,13 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 		reply := bson.D{}
 		err = session.DB(u.Database).Run(b, &reply)
 		if err != nil {
+			countBackendError(err)
 			// log an error if we can
 			qErr, ok := err.(*mgo.QueryError)
 			if ok {
 				res.Error(int32(qErr.Code), qErr.Message)
 			}
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -301,6 +321,8 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			// we have write errors
 			response.WriteErrors = writeErrors
 		}
+		response.WriteConcernError = convert.ToBSONMap(
+			bsonutil.FindValueByKey("writeConcernError", reply))
 
 		rawUpserted := bsonutil.FindValueByKey("upserted", reply)
 		upserted, err := convert.ConvertToBSONDocSlice(rawUpserted)
@@ -311,9 +333,10 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 
 		if convert.ToInt(bsonutil.FindValueByKey("ok", reply)) == 0 {
 			// we have a command error.
+			backendErrors.Inc("command")
 			res.Error(convert.ToInt32(bsonutil.FindValueByKey("code", reply)),
 				convert.ToString(bsonutil.FindValueByKey("errmsg", reply)))
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -322,8 +345,8 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 	case messages.DeleteType:
 		d, err := messages.ToDeleteRequest(req)
 		if err != nil {
-			Log(WARNING, "Error converting to Delete command: %v", err)
-			next(req, res)
+			LogContext(ctx, WARNING, "Error converting to Delete command: %v", err)
+			next(ctx, req, res)
 			return
 		}
 
@@ -332,12 +355,13 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 		reply := bson.M{}
 		err = session.DB(d.Database).Run(b, reply)
 		if err != nil {
+			countBackendError(err)
 			// log an error if we can
 			qErr, ok := err.(*mgo.QueryError)
 			if ok {
 				res.Error(int32(qErr.Code), qErr.Message)
 			}
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
@@ -349,43 +373,58 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			// we have write errors
 			response.WriteErrors = writeErrors
 		}
+		response.WriteConcernError = convert.ToBSONMap(reply["writeConcernError"])
 
 		if convert.ToInt(reply["ok"]) == 0 {
 			// we have a command error.
+			backendErrors.Inc("command")
 			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
-		Log(INFO, "Reply: %#v", reply)
+		LoggerFromContext(ctx).With(Fields{"n": response.N}).Log(DEBUG, "Deleted documents")
 
 		res.Write(response)
 
 	case messages.GetMoreType:
 		g, err := messages.ToGetMoreRequest(req)
 		if err != nil {
-			Log(WARNING, "Error converting to GetMore command: %#v", err)
-			next(req, res)
+			LogContext(ctx, WARNING, "Error converting to GetMore command: %v", err)
+			next(ctx, req, res)
 			return
 		}
-		Log(DEBUG, "%#v", g)
+		LoggerFromContext(ctx).With(Fields{"cursorId": g.CursorID, "batchSize": g.BatchSize}).
+			Log(DEBUG, "Getting more results")
 
 		// make an iterable to get more
 		c := session.DB(g.Database).C(g.Collection)
 		batch := make([]bson.Raw, 0)
 		iter := c.NewIter(session, batch, g.CursorID, nil)
-		iter.SetBatch(int(g.BatchSize))
+
+		// a getMore without a batch size returns a default-sized batch.
+		batchSize := int(g.BatchSize)
+		if batchSize <= 0 {
+			batchSize = defaultBatchSize
+		}
+		iter.SetBatch(batchSize)
 
 		var results []bson.D
 		cursorID := int64(0)
 
-		for i := 0; i < int(g.BatchSize); i++ {
+		for i := 0; i < batchSize; i++ {
+			if server.Interrupted(ctx, res) {
+				iter.Close()
+				next(ctx, req, res)
+				return
+			}
+
 			var result bson.D
 			ok := iter.Next(&result)
 			if !ok {
 				err = iter.Err()
 				if err != nil {
-					Log(WARNING, "Error on GetMore Command: %#v", err)
+					LogContext(ctx, WARNING, "Error on GetMore Command: %v", err)
 
 					if err == mgo.ErrCursor {
 						// we return an empty getMore with an errored out
@@ -397,17 +436,19 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 							InvalidCursor: true,
 						}
 						res.Write(response)
-						next(req, res)
+						next(ctx, req, res)
 						return
 					}
 
+					countBackendError(err)
+
 					// log an error if we can
 					qErr, ok := err.(*mgo.QueryError)
 					if ok {
 						res.Error(int32(qErr.Code), qErr.Message)
 					}
 					iter.Close()
-					next(req, res)
+					next(ctx, req, res)
 					return
 				}
 				break
@@ -425,11 +466,289 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			Documents:  results,
 		}
 
+		res.Write(response)
+
+	case messages.AggregateType:
+		a, err := messages.ToAggregateRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to Aggregate command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		if ms := server.RemainingMaxTimeMS(ctx); ms > 0 {
+			a.MaxTimeMS = ms
+		}
+
+		reply, ok := runCommand(ctx, session, a.Database, a.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
+		}
+
+		response := messages.AggregateResponse{
+			Database:   a.Database,
+			Collection: a.Collection,
+		}
+		parseCursorReply(reply, &response.CursorID, &response.Database,
+			&response.Collection, &response.Documents)
+
+		res.Write(response)
+
+	case messages.FindAndModifyType:
+		f, err := messages.ToFindAndModifyRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to FindAndModify command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		if ms := server.RemainingMaxTimeMS(ctx); ms > 0 {
+			f.MaxTimeMS = ms
+		}
+
+		reply, ok := runCommand(ctx, session, f.Database, f.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
+		}
+
+		lastErrorObject := convert.ToBSONDoc(bsonutil.FindValueByKey("lastErrorObject", reply))
+		response := messages.FindAndModifyResponse{
+			Value:   convert.ToBSONDoc(bsonutil.FindValueByKey("value", reply)),
+			N:       convert.ToInt32(bsonutil.FindValueByKey("n", lastErrorObject)),
+			Removed: f.Remove,
+			UpdatedExisting: convert.ToBool(
+				bsonutil.FindValueByKey("updatedExisting", lastErrorObject)),
+			Upserted: bsonutil.FindValueByKey("upserted", lastErrorObject),
+			WriteConcernError: convert.ToBSONMap(
+				bsonutil.FindValueByKey("writeConcernError", reply)),
+		}
+
+		res.Write(response)
+
+	case messages.CountType:
+		c, err := messages.ToCountRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to Count command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		if ms := server.RemainingMaxTimeMS(ctx); ms > 0 {
+			c.MaxTimeMS = ms
+		}
+
+		reply, ok := runCommand(ctx, session, c.Database, c.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
+		}
+
+		response := messages.CountResponse{
+			N: convert.ToInt64(bsonutil.FindValueByKey("n", reply)),
+		}
+
+		res.Write(response)
+
+	case messages.DistinctType:
+		d, err := messages.ToDistinctRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to Distinct command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		if ms := server.RemainingMaxTimeMS(ctx); ms > 0 {
+			d.MaxTimeMS = ms
+		}
+
+		reply, ok := runCommand(ctx, session, d.Database, d.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
+		}
+
+		response := messages.DistinctResponse{}
+		values, ok := bsonutil.FindValueByKey("values", reply).([]interface{})
+		if ok {
+			response.Values = values
+		}
+
+		res.Write(response)
+
+	case messages.ListCollectionsType:
+		l, err := messages.ToListCollectionsRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to ListCollections command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		reply, ok := runCommand(ctx, session, l.Database, l.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
+		}
+
+		response := messages.ListCollectionsResponse{
+			Database: l.Database,
+		}
+		parseCursorReply(reply, &response.CursorID, &response.Database,
+			&response.Collection, &response.Collections)
+
+		res.Write(response)
+
+	case messages.ListIndexesType:
+		l, err := messages.ToListIndexesRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to ListIndexes command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		reply, ok := runCommand(ctx, session, l.Database, l.ToBSON(), res)
+		if !ok {
+			next(ctx, req, res)
+			return
+		}
+
+		response := messages.ListIndexesResponse{
+			Database:   l.Database,
+			Collection: l.Collection,
+		}
+		parseCursorReply(reply, &response.CursorID, &response.Database,
+			&response.Collection, &response.Indexes)
+
+		res.Write(response)
+
+	case messages.KillCursorsType:
+		k, err := messages.ToKillCursorsRequest(req)
+		if err != nil {
+			LogContext(ctx, WARNING, "Error converting to KillCursors command: %v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		if len(k.Collection) == 0 {
+			// the legacy opcode doesn't have a namespace, so we can't run the command.
+			// Instead, each cursor is killed through the driver, which doesn't report
+			// whether the cursor existed.
+			response := messages.KillCursorsResponse{}
+
+			// NewIter needs a socket to be reserved for the session
+			session.Ping()
+			c := session.DB("admin").C("$cmd")
+			for i := 0; i < len(k.CursorIDs); i++ {
+				iter := c.NewIter(session, nil, k.CursorIDs[i], nil)
+				err = iter.Close()
+				if err != nil {
+					LogContext(ctx, WARNING, "Error killing cursor %v: %v", k.CursorIDs[i], err)
+					response.CursorsUnknown = append(response.CursorsUnknown, k.CursorIDs[i])
+				} else {
+					response.CursorsKilled = append(response.CursorsKilled, k.CursorIDs[i])
+				}
+			}
+
+			res.Write(response)
+			break
+		}
+
+		b := k.ToBSON()
+
+		reply := bson.M{}
+		err = session.DB(k.Database).Run(b, reply)
+		if err != nil {
+			countBackendError(err)
+			// log an error if we can
+			qErr, ok := err.(*mgo.QueryError)
+			if ok {
+				res.Error(int32(qErr.Code), qErr.Message)
+			}
+			next(ctx, req, res)
+			return
+		}
+
+		if convert.ToInt(reply["ok"]) == 0 {
+			// we have a command error.
+			backendErrors.Inc("command")
+			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
+			next(ctx, req, res)
+			return
+		}
+
+		response := messages.KillCursorsResponse{}
+		response.CursorsKilled, _ = convert.ConvertToInt64Slice(reply["cursorsKilled"])
+		response.CursorsNotFound, _ = convert.ConvertToInt64Slice(reply["cursorsNotFound"])
+		response.CursorsAlive, _ = convert.ConvertToInt64Slice(reply["cursorsAlive"])
+		response.CursorsUnknown, _ = convert.ConvertToInt64Slice(reply["cursorsUnknown"])
+
 		res.Write(response)
 	default:
-		Log(WARNING, "Unsupported operation: %v", req.Type())
+		LogContext(ctx, WARNING, "Unsupported operation: %v", req.Type())
+	}
+
+	next(ctx, req, res)
+
+}
+
+// runCommand runs a command against mongod and returns the reply. If the command
+// fails or the context is done, the error is written to the response and false
+// is returned.
+func runCommand(ctx context.Context, session *mgo.Session, database string,
+	command bson.D, res messages.Responder) (bson.D, bool) {
+
+	reply := bson.D{}
+	err := session.DB(database).Run(command, &reply)
+
+	// the reply is thrown away if the request's context finished first
+	if server.Interrupted(ctx, res) {
+		return nil, false
+	}
+	if err != nil {
+		countBackendError(err)
+		// log an error if we can
+		qErr, ok := err.(*mgo.QueryError)
+		LogContext(ctx, WARNING, "Error running command %v: %v", command[0].Name, err)
+		if ok {
+			res.Error(int32(qErr.Code), qErr.Message)
+		} else {
+			res.Error(-1, "Unknown error")
+		}
+		return nil, false
 	}
 
-	next(req, res)
+	if convert.ToInt(bsonutil.FindValueByKey("ok", reply)) == 0 {
+		// we have a command error.
+		backendErrors.Inc("command")
+		res.Error(convert.ToInt32(bsonutil.FindValueByKey("code", reply)),
+			convert.ToString(bsonutil.FindValueByKey("errmsg", reply)))
+		return nil, false
+	}
+
+	return reply, true
+}
 
+// parseCursorReply reads the cursor from the reply to a command that returns one.
+// The database and collection are only overwritten if the reply has a valid
+// namespace, since the namespace is needed for getMores and isn't always the
+// collection that the command was run on.
+func parseCursorReply(reply bson.D, cursorID *int64, database *string,
+	collection *string, firstBatch *[]bson.D) {
+
+	cursor := convert.ToBSONDoc(bsonutil.FindValueByKey("cursor", reply))
+	*cursorID = convert.ToInt64(bsonutil.FindValueByKey("id", cursor))
+
+	db, c, err := messages.ParseNamespace(
+		convert.ToString(bsonutil.FindValueByKey("ns", cursor)))
+	if err == nil {
+		*database = db
+		*collection = c
+	}
+
+	batch, err := convert.ConvertToBSONDocSlice(
+		bsonutil.FindValueByKey("firstBatch", cursor))
+	if err == nil {
+		*firstBatch = batch
+	}
 }
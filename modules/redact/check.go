@@ -0,0 +1,274 @@
+package redact
+
+import (
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+)
+
+// Unauthorized is the error code of the requests that are rejected because their
+// response could have the values of redacted fields where the rules don't apply.
+const Unauthorized int32 = 13
+
+// the stages of an aggregation pipeline that don't move the values of fields, so
+// they can refer to redacted fields. $match and $sort stages are checked on their own,
+// since they can tell values apart.
+var filterStages = map[string]bool{
+	"$unwind": true,
+	"$limit":  true,
+	"$skip":   true,
+	"$count":  true,
+	"$sample": true,
+}
+
+// check returns an error if the response to a request could have the values of the
+// fields somewhere the rules don't apply to them: a distinct of a field, a projection
+// or aggregation stage that computes a field from one of them, or an aggregation that
+// copies the documents to another collection. Aggregations also can't read the
+// documents of other namespaces whose fields the principal can't see. Filters and
+// sorts can't use the fields either, since the documents that they return would tell
+// their values apart one query at a time.
+func (r *RedactModule) check(req messages.Requester, fields []Field,
+	principal *server.Principal) error {
+
+	switch q := req.(type) {
+	case messages.Distinct:
+		field, ok := onPaths(q.Key, fields)
+		if ok {
+			return fmt.Errorf("distinct of the redacted field %v isn't allowed", field)
+		}
+		return checkFilter(q.Query, fields)
+	case messages.Count:
+		return checkFilter(q.Query, fields)
+	case messages.Find:
+		field, ok := references(q.Projection, fields)
+		if ok {
+			return fmt.Errorf("the projection can't use the redacted field %v", field)
+		}
+		for _, keys := range []bson.D{q.Sort, q.Min, q.Max} {
+			err := checkSort(keys, fields)
+			if err != nil {
+				return err
+			}
+		}
+		return checkFilter(q.Filter, fields)
+	case messages.FindAndModify:
+		field, ok := references(q.Fields, fields)
+		if ok {
+			return fmt.Errorf("the projection can't use the redacted field %v", field)
+		}
+		err := checkSort(q.Sort, fields)
+		if err != nil {
+			return err
+		}
+		return checkFilter(q.Query, fields)
+	case messages.Aggregate:
+		return r.checkPipeline(q.Database, q.Pipeline, fields, principal)
+	}
+	return nil
+}
+
+// checkPipeline returns an error if an aggregation pipeline could move the values of
+// the fields, or read documents whose fields the principal can't see.
+func (r *RedactModule) checkPipeline(database string, pipeline []bson.D, fields []Field,
+	principal *server.Principal) error {
+
+	namespaces := messages.PipelineNamespaces(database, pipeline)
+	for i := 0; i < len(namespaces); i++ {
+		ns := namespaces[i]
+		switch ns.Stage {
+		case "$out", "$merge":
+			if len(fields) > 0 {
+				return fmt.Errorf("%v isn't allowed on a namespace with redacted fields", ns.Stage)
+			}
+		default:
+			if len(r.fields(ns.Database, ns.Collection, principal)) > 0 {
+				return fmt.Errorf("%v from %v.%v, which has redacted fields, isn't allowed",
+					ns.Stage, ns.Database, ns.Collection)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var err error
+	messages.WalkPipeline(pipeline, func(stage string, spec interface{}) {
+		if err != nil || filterStages[stage] || stage == "$facet" {
+			return
+		}
+		switch stage {
+		case "$match":
+			err = checkFilter(spec, fields)
+			return
+		case "$sort":
+			err = checkSort(toDoc(spec), fields)
+			return
+		}
+		// the stages of nested pipelines are walked on their own
+		if m, ok := spec.(bson.D); ok && (stage == "$lookup" || stage == "$unionWith") {
+			spec = withoutField(m, "pipeline")
+		}
+		field, ok := references(spec, fields)
+		if ok {
+			err = fmt.Errorf("%v can't use the redacted field %v", stage, field)
+		}
+	})
+	return err
+}
+
+// checkFilter returns an error if a query filter tests one of the fields, or a
+// document that has one. Expressions in $expr can't use the fields either, and $where
+// functions could use any of them.
+func checkFilter(filter interface{}, fields []Field) error {
+	field, ok := filterReferences(filter, fields)
+	if ok {
+		return fmt.Errorf("the filter can't use the redacted field %v", field)
+	}
+	return nil
+}
+
+// filterReferences returns the first of the fields that a query filter tests, and
+// true if it tests one.
+func filterReferences(filter interface{}, fields []Field) (string, bool) {
+	if len(fields) == 0 {
+		return "", false
+	}
+	doc := toDoc(filter)
+	for i := 0; i < len(doc); i++ {
+		switch doc[i].Name {
+		case "$and", "$or", "$nor":
+			clauses, _ := doc[i].Value.([]interface{})
+			for j := 0; j < len(clauses); j++ {
+				field, ok := filterReferences(clauses[j], fields)
+				if ok {
+					return field, true
+				}
+			}
+		case "$expr":
+			field, ok := references(doc[i].Value, fields)
+			if ok {
+				return field, true
+			}
+		case "$where":
+			return fields[0].Path, true
+		case "$comment", "$text":
+		default:
+			field, ok := onPaths(doc[i].Name, fields)
+			if ok {
+				return field, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkSort returns an error if the keys of a sort, or of an index bound, are on one
+// of the fields.
+func checkSort(keys bson.D, fields []Field) error {
+	for i := 0; i < len(keys); i++ {
+		field, ok := onPaths(keys[i].Name, fields)
+		if ok {
+			return fmt.Errorf("the sort can't use the redacted field %v", field)
+		}
+	}
+	return nil
+}
+
+// references returns the first of the fields that an expression refers to, and
+// true if it refers to one. Expressions that refer to the whole document, or to
+// fields by name with $getField, could refer to any of them.
+func references(expr interface{}, fields []Field) (string, bool) {
+	if len(fields) == 0 {
+		return "", false
+	}
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$$ROOT") || strings.HasPrefix(e, "$$CURRENT") {
+			return fields[0].Path, true
+		}
+		if strings.HasPrefix(e, "$") && !strings.HasPrefix(e, "$$") {
+			return onPaths(e[1:], fields)
+		}
+	case bson.D:
+		for i := 0; i < len(e); i++ {
+			switch e[i].Name {
+			case "$literal":
+				continue
+			case "$getField":
+				return fields[0].Path, true
+			}
+			field, ok := references(e[i].Value, fields)
+			if ok {
+				return field, true
+			}
+		}
+	case bson.M:
+		return references(toDoc(e), fields)
+	case []interface{}:
+		for i := 0; i < len(e); i++ {
+			field, ok := references(e[i], fields)
+			if ok {
+				return field, true
+			}
+		}
+	}
+	return "", false
+}
+
+// onPaths returns the first of the fields that a path is on, and true if it is on
+// one. A path is on a field if it is the field, a field inside it, or a document
+// that has it. Array indexes aren't compared, since a path without them refers to
+// every element.
+func onPaths(p string, fields []Field) (string, bool) {
+	p = withoutIndexes(p)
+	for i := 0; i < len(fields); i++ {
+		f := withoutIndexes(fields[i].Path)
+		if p == f || strings.HasPrefix(f, p+".") || strings.HasPrefix(p, f+".") {
+			return fields[i].Path, true
+		}
+	}
+	return "", false
+}
+
+// withoutIndexes removes the array indexes from a dot-notation path.
+func withoutIndexes(p string) string {
+	parts := strings.Split(p, ".")
+	kept := make([]string, 0, len(parts))
+	for i := 0; i < len(parts); i++ {
+		_, err := strconv.Atoi(parts[i])
+		if err != nil {
+			kept = append(kept, parts[i])
+		}
+	}
+	return strings.Join(kept, ".")
+}
+
+// toDoc returns a document as a bson.D, or nil if it isn't a document.
+func toDoc(v interface{}) bson.D {
+	switch d := v.(type) {
+	case bson.D:
+		return d
+	case bson.M:
+		doc := make(bson.D, 0, len(d))
+		for k, v := range d {
+			doc = append(doc, bson.DocElem{Name: k, Value: v})
+		}
+		return doc
+	}
+	return nil
+}
+
+// withoutField returns a copy of a document without the field.
+func withoutField(doc bson.D, name string) bson.D {
+	out := make(bson.D, 0, len(doc))
+	for i := 0; i < len(doc); i++ {
+		if doc[i].Name != name {
+			out = append(out, doc[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,413 @@
+// Package redact contains a module that removes or masks fields of the documents
+// in responses, so that clients don't see the values of sensitive fields.
+package redact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// the actions that can be applied to a field.
+const (
+	RemoveAction  = "remove"
+	ReplaceAction = "replace"
+	HashAction    = "hash"
+	MaskAction    = "mask"
+)
+
+// maskCharacter replaces the characters that a mask hides.
+const maskCharacter = "*"
+
+// A Field is a field of the documents that an action is applied to.
+type Field struct {
+	// the dot-notation path of the field. Arrays along the path are descended into.
+	Path   string
+	Action string
+
+	// the value of the field, for the replace action.
+	Value interface{}
+
+	// the number of characters at the end of the value that are kept, for the mask
+	// action.
+	Keep int
+}
+
+// A Rule applies actions to fields of the documents from namespaces. Rules with Users
+// or Roles only apply to clients that authenticated as one of the users, or with one
+// of the roles, and other rules apply to every client.
+type Rule struct {
+	// globs for the namespaces, such as "sales.*".
+	Namespaces server.Namespaces
+	Users      []string
+	Roles      []string
+	Fields     []Field
+}
+
+// matches returns true if the rule applies to the namespace and the principal, which
+// is nil for clients that haven't authenticated.
+func (r Rule) matches(database string, collection string, principal *server.Principal) bool {
+	if !r.Namespaces.Match(database, collection) {
+		return false
+	}
+	if len(r.Users) == 0 && len(r.Roles) == 0 {
+		return true
+	}
+	if principal == nil {
+		return false
+	}
+	for i := 0; i < len(r.Users); i++ {
+		if r.Users[i] == principal.User {
+			return true
+		}
+	}
+	for i := 0; i < len(r.Roles); i++ {
+		for j := 0; j < len(principal.Roles); j++ {
+			if r.Roles[i] == principal.Roles[j] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A RedactModule calls the next module, and applies the rules that match the
+// namespace and the client to the documents of the response.
+type RedactModule struct {
+	Rules []Rule
+
+	// the key of the HMAC that values are hashed with, so that a hash can't be
+	// matched to a value by hashing guesses without it.
+	HashKey []byte
+}
+
+func init() {
+	server.Publish(&RedactModule{})
+}
+
+// redacted counts the documents that rules were applied to.
+var redacted = metrics.RegisterCounter("mongoproxy_redact_documents_total",
+	"Documents in responses that redaction rules were applied to.")
+
+// rejected counts the requests that were rejected because they could return the
+// values of redacted fields.
+var rejected = metrics.RegisterCounter("mongoproxy_redact_rejected_total",
+	"Requests that were rejected because they could return the values of redacted fields.")
+
+func (r *RedactModule) New() server.Module {
+	return &RedactModule{}
+}
+
+func (r *RedactModule) Name() string {
+	return "redact"
+}
+
+/*
+Configuration structure:
+
+	{
+		hashKey: string,
+		rules: [
+			{
+				namespace: string or []string,
+				users: []string,
+				roles: []string,
+				fields: [
+					{
+						path: string,
+						action: "remove", "replace", "hash" or "mask",
+						value: any,
+						keep: integer
+					}
+				]
+			}
+		]
+	}
+
+The namespaces of a rule are globs, such as "sales.*". The value is what the replace
+action sets a field to, and keep is the number of characters at the end of a value
+that the mask action leaves.
+*/
+func (r *RedactModule) Configure(conf bson.M) error {
+	r.HashKey = []byte(convert.ToString(conf["hashKey"]))
+
+	rules, err := convert.ConvertToBSONMapSlice(conf["rules"])
+	if err != nil {
+		return fmt.Errorf("Error parsing rules: %v", err)
+	}
+	r.Rules = make([]Rule, 0, len(rules))
+	for i := 0; i < len(rules); i++ {
+		rule, err := parseRule(rules[i])
+		if err != nil {
+			return fmt.Errorf("Error parsing rule %v: %v", i, err)
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	return nil
+}
+
+// parseRule parses a rule from the configuration.
+func parseRule(doc bson.M) (Rule, error) {
+	rule := Rule{Users: make([]string, 0), Roles: make([]string, 0)}
+	var err error
+	rule.Namespaces, err = server.ParseNamespaces(doc["namespace"])
+	if err != nil {
+		return Rule{}, fmt.Errorf("Invalid namespace: %v", err)
+	}
+	if len(rule.Namespaces) == 0 {
+		return Rule{}, fmt.Errorf("A rule doesn't have a namespace")
+	}
+	if doc["users"] != nil {
+		rule.Users, err = convert.ConvertToStringSlice(doc["users"])
+		if err != nil {
+			return Rule{}, fmt.Errorf("Error parsing users: %v", err)
+		}
+	}
+	if doc["roles"] != nil {
+		rule.Roles, err = convert.ConvertToStringSlice(doc["roles"])
+		if err != nil {
+			return Rule{}, fmt.Errorf("Error parsing roles: %v", err)
+		}
+	}
+
+	fields, err := convert.ConvertToBSONMapSlice(doc["fields"])
+	if err != nil || len(fields) == 0 {
+		return Rule{}, fmt.Errorf("A rule needs fields")
+	}
+	rule.Fields = make([]Field, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		f := Field{
+			Path:   convert.ToString(fields[i]["path"]),
+			Action: convert.ToString(fields[i]["action"]),
+			Value:  fields[i]["value"],
+			Keep:   convert.ToInt(fields[i]["keep"], 0),
+		}
+		if len(f.Path) == 0 {
+			return Rule{}, fmt.Errorf("A field doesn't have a path")
+		}
+		switch f.Action {
+		case RemoveAction, ReplaceAction, HashAction:
+		case MaskAction:
+			if f.Keep < 0 {
+				return Rule{}, fmt.Errorf("keep must not be negative for field %v", f.Path)
+			}
+		default:
+			return Rule{}, fmt.Errorf("Unknown action for field %v: %v", f.Path, f.Action)
+		}
+		rule.Fields = append(rule.Fields, f)
+	}
+	return rule, nil
+}
+
+// fields returns the fields of the rules that apply to a request on the namespace
+// from the principal, in the order of the rules.
+func (r *RedactModule) fields(database string, collection string,
+	principal *server.Principal) []Field {
+	fields := make([]Field, 0)
+	for i := 0; i < len(r.Rules); i++ {
+		if r.Rules[i].matches(database, collection, principal) {
+			fields = append(fields, r.Rules[i].Fields...)
+		}
+	}
+	return fields
+}
+
+// rewriteFunc returns the function that applies the action of a field to its value.
+func (r *RedactModule) rewriteFunc(f Field) bsonutil.RewriteFunc {
+	switch f.Action {
+	case RemoveAction:
+		return func(v interface{}) (interface{}, bool) {
+			return nil, false
+		}
+	case ReplaceAction:
+		return func(v interface{}) (interface{}, bool) {
+			return f.Value, true
+		}
+	case HashAction:
+		return func(v interface{}) (interface{}, bool) {
+			return eachValue(v, r.hash), true
+		}
+	}
+	return func(v interface{}) (interface{}, bool) {
+		return eachValue(v, func(v interface{}) interface{} {
+			return mask(v, f.Keep)
+		}), true
+	}
+}
+
+// eachValue applies f to a value, or to each of its elements if it is an array.
+func eachValue(v interface{}, f func(interface{}) interface{}) interface{} {
+	values, ok := v.([]interface{})
+	if !ok {
+		return f(v)
+	}
+	out := make([]interface{}, len(values))
+	for i := 0; i < len(values); i++ {
+		out[i] = eachValue(values[i], f)
+	}
+	return out
+}
+
+// hash returns the hex SHA-256 HMAC of a value, or nil for a null value.
+func (r *RedactModule) hash(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	h := hmac.New(sha256.New, r.HashKey)
+	h.Write([]byte(fmt.Sprint(v)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// mask replaces all but the last keep characters of a value with asterisks. Values
+// that aren't longer than keep are masked completely, so that they aren't shown.
+func mask(v interface{}, keep int) interface{} {
+	if v == nil {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	runes := []rune(s)
+	if len(runes) <= keep {
+		return strings.Repeat(maskCharacter, len(runes))
+	}
+	hidden := len(runes) - keep
+	return strings.Repeat(maskCharacter, hidden) + string(runes[hidden:])
+}
+
+// redactDocument applies the fields to a document.
+func (r *RedactModule) redactDocument(doc interface{}, fields []Field) interface{} {
+	for i := 0; i < len(fields); i++ {
+		doc = bsonutil.RewriteDeepValue(fields[i].Path, doc, r.rewriteFunc(fields[i]))
+	}
+	return doc
+}
+
+// redactDocuments applies the fields to documents, and returns the new documents.
+func (r *RedactModule) redactDocuments(docs []bson.D, fields []Field) []bson.D {
+	if docs == nil {
+		return nil
+	}
+	out := make([]bson.D, len(docs))
+	for i := 0; i < len(docs); i++ {
+		out[i] = r.redactDocument(docs[i], fields).(bson.D)
+	}
+	redacted.Add(float64(len(docs)))
+	return out
+}
+
+// redactBatch applies the fields to the documents of an array in a command reply.
+func (r *RedactModule) redactBatch(batch interface{}, fields []Field) interface{} {
+	docs, ok := batch.([]interface{})
+	if !ok {
+		return batch
+	}
+	out := make([]interface{}, len(docs))
+	for i := 0; i < len(docs); i++ {
+		out[i] = r.redactDocument(docs[i], fields)
+	}
+	redacted.Add(float64(len(docs)))
+	return out
+}
+
+// redactReply applies the fields to the documents of a command reply: the batches of
+// a cursor, and the value of a findAndModify.
+func (r *RedactModule) redactReply(reply bson.M, fields []Field) bson.M {
+	if reply == nil {
+		return nil
+	}
+	out := make(bson.M, len(reply))
+	for k, v := range reply {
+		out[k] = v
+	}
+	cursor := convert.ToBSONMap(reply["cursor"])
+	if cursor != nil {
+		redactedCursor := make(bson.M, len(cursor))
+		for k, v := range cursor {
+			redactedCursor[k] = v
+		}
+		for _, batch := range []string{"firstBatch", "nextBatch"} {
+			if cursor[batch] != nil {
+				redactedCursor[batch] = r.redactBatch(cursor[batch], fields)
+			}
+		}
+		out["cursor"] = redactedCursor
+	}
+	if reply["value"] != nil {
+		out["value"] = r.redactDocument(reply["value"], fields)
+		redacted.Inc()
+	}
+	return out
+}
+
+// Redact applies the fields to the documents of a response, and returns the new
+// response. Responses without documents are returned as they are.
+func (r *RedactModule) Redact(w messages.ResponseWriter, fields []Field) messages.ResponseWriter {
+	switch res := w.(type) {
+	case messages.FindResponse:
+		res.Documents = r.redactDocuments(res.Documents, fields)
+		return res
+	case messages.GetMoreResponse:
+		res.Documents = r.redactDocuments(res.Documents, fields)
+		return res
+	case messages.AggregateResponse:
+		res.Documents = r.redactDocuments(res.Documents, fields)
+		return res
+	case messages.FindAndModifyResponse:
+		if res.Value != nil {
+			res.Value = r.redactDocuments([]bson.D{res.Value}, fields)[0]
+		}
+		return res
+	case messages.CommandResponse:
+		res.Documents = r.redactDocuments(res.Documents, fields)
+		res.Reply = r.redactReply(res.Reply, fields)
+		return res
+	}
+	return w
+}
+
+func (r *RedactModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	var principal *server.Principal
+	c := server.ConnectionFromContext(ctx)
+	if c != nil {
+		principal = c.Principal()
+	}
+	database, collection := messages.Namespace(req)
+	fields := r.fields(database, collection, principal)
+
+	// the fields are only redacted where the rules expect them, so requests that
+	// could return their values elsewhere don't reach the backend
+	err := r.check(req, fields, principal)
+	if err != nil {
+		rejected.Inc()
+		LogContext(ctx, INFO, "Rejected %v: %v", messages.CommandName(req), err)
+		res.Error(Unauthorized, err.Error())
+		return
+	}
+
+	resNext := messages.ModuleResponse{}
+	next(ctx, req, &resNext)
+
+	if resNext.Writer != nil {
+		if len(fields) > 0 {
+			resNext.Writer = r.Redact(resNext.Writer, fields)
+		}
+		res.Write(resNext.Writer)
+	}
+	if resNext.CommandError != nil {
+		res.Error(resNext.CommandError.ErrorCode, resNext.CommandError.Message)
+	}
+}
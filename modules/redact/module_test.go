@@ -0,0 +1,199 @@
+package redact
+
+import (
+	"context"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// respond returns a module that writes the response.
+func respond(w messages.ResponseWriter) server.PipelineFunc {
+	return func(ctx context.Context, req messages.Requester, res messages.Responder) {
+		res.Write(w)
+	}
+}
+
+func TestRedactModule(t *testing.T) {
+	Convey("Redact the documents of responses", t, func() {
+		r := &RedactModule{}
+		err := r.Configure(bson.M{
+			"hashKey": "secret",
+			"rules": []interface{}{
+				bson.M{"namespace": "crm.*", "fields": []interface{}{
+					bson.M{"path": "ssn", "action": "remove"},
+					bson.M{"path": "cards.number", "action": "mask", "keep": 4},
+					bson.M{"path": "email", "action": "hash"},
+				}},
+				bson.M{"namespace": "crm.customers", "roles": []interface{}{"support@admin"},
+					"fields": []interface{}{
+						bson.M{"path": "address.street", "action": "replace", "value": "REDACTED"},
+					}},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		c := &server.Connection{ID: 1}
+		ctx := server.WithConnection(context.Background(), c)
+		customer := bson.D{
+			{"name", "ann"},
+			{"ssn", "123-45-6789"},
+			{"email", "ann@example.com"},
+			{"address", bson.D{{"street", "1 Main St"}, {"city", "Springfield"}}},
+			{"cards", []interface{}{bson.D{{"number", "4111111111111111"}}, bson.D{{"number", 42}}}},
+		}
+		find := messages.Find{Database: "crm", Collection: "customers"}
+		process := func(req messages.Requester, w messages.ResponseWriter) messages.ResponseWriter {
+			res := messages.ModuleResponse{}
+			r.Process(ctx, req, &res, respond(w))
+			return res.Writer
+		}
+
+		Convey("in find responses", func() {
+			w := process(find, messages.FindResponse{Documents: []bson.D{customer}})
+			doc := w.(messages.FindResponse).Documents[0]
+			So(bsonutil.FindValueByKey("ssn", doc), ShouldBeNil)
+			So(bsonutil.FindValueByKey("name", doc), ShouldEqual, "ann")
+			So(bsonutil.FindValueByKey("cards", doc), ShouldResemble, []interface{}{
+				bson.D{{"number", "************1111"}}, bson.D{{"number", "**"}}})
+			So(bsonutil.FindValueByKey("email", doc), ShouldEqual, r.hash("ann@example.com"))
+			So(bsonutil.FindValueByKey("email", doc), ShouldNotEqual, "ann@example.com")
+			So(bsonutil.FindValueByKey("address", doc), ShouldResemble, customer[3].Value)
+			So(bsonutil.FindValueByKey("ssn", customer), ShouldEqual, "123-45-6789")
+		})
+
+		Convey("with the rules of the client's role", func() {
+			c.SetPrincipal(&server.Principal{User: "sam", Database: "admin", Roles: []string{"support@admin"}})
+			w := process(messages.GetMore{Database: "crm", Collection: "customers"},
+				messages.GetMoreResponse{Documents: []bson.D{customer}})
+			doc := w.(messages.GetMoreResponse).Documents[0]
+			So(bsonutil.FindValueByKey("address", doc), ShouldResemble,
+				bson.D{{"street", "REDACTED"}, {"city", "Springfield"}})
+			So(bsonutil.FindValueByKey("ssn", doc), ShouldBeNil)
+		})
+
+		Convey("but not with the role of another database", func() {
+			c.SetPrincipal(&server.Principal{User: "sam", Database: "crm", Roles: []string{"support@crm"}})
+			w := process(find, messages.FindResponse{Documents: []bson.D{customer}})
+			So(bsonutil.FindValueByKey("address", w.(messages.FindResponse).Documents[0]),
+				ShouldResemble, customer[3].Value)
+		})
+
+		Convey("in command replies", func() {
+			w := process(messages.Command{CommandName: "aggregate", Database: "crm",
+				Args: bson.M{"aggregate": "customers"}},
+				messages.CommandResponse{Reply: bson.M{"ok": 1, "cursor": bson.M{
+					"id": int64(0), "firstBatch": []interface{}{bson.M{"ssn": "123-45-6789", "n": 1}}}}})
+			reply := w.(messages.CommandResponse).Reply
+			So(reply["cursor"].(bson.M)["firstBatch"], ShouldResemble, []interface{}{bson.M{"n": 1}})
+			So(reply["ok"], ShouldEqual, 1)
+
+			w = process(messages.FindAndModify{Database: "crm", Collection: "customers"},
+				messages.FindAndModifyResponse{Value: customer})
+			So(bsonutil.FindValueByKey("ssn", w.(messages.FindAndModifyResponse).Value), ShouldBeNil)
+		})
+
+		Convey("and reject requests that could return redacted values elsewhere", func() {
+			reached := false
+			check := func(req messages.Requester) *messages.ResponderError {
+				reached = false
+				res := messages.ModuleResponse{}
+				r.Process(ctx, req, &res, func(ctx context.Context, req messages.Requester,
+					res messages.Responder) {
+					reached = true
+					res.Write(messages.FindResponse{})
+				})
+				return res.CommandError
+			}
+			aggregate := func(collection string, pipeline ...bson.D) messages.Requester {
+				return messages.Aggregate{Database: "crm", Collection: collection, Pipeline: pipeline}
+			}
+
+			err := check(messages.Distinct{Database: "crm", Collection: "customers", Key: "ssn"})
+			So(err, ShouldResemble, &messages.ResponderError{ErrorCode: Unauthorized,
+				Message: "distinct of the redacted field ssn isn't allowed"})
+			So(reached, ShouldBeFalse)
+			So(check(messages.Distinct{Database: "crm", Collection: "customers", Key: "cards"}),
+				ShouldNotBeNil)
+			So(check(messages.Distinct{Database: "crm", Collection: "customers", Key: "name"}),
+				ShouldBeNil)
+			So(reached, ShouldBeTrue)
+
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Projection: bson.D{{"id", "$ssn"}}}), ShouldNotBeNil)
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Projection: bson.D{{"ssn", 1}, {"name", 1}}}), ShouldBeNil)
+
+			So(check(aggregate("customers", bson.D{{"$project", bson.D{{"id", "$ssn"}}}})),
+				ShouldResemble, &messages.ResponderError{ErrorCode: Unauthorized,
+					Message: "$project can't use the redacted field ssn"})
+			So(check(aggregate("customers", bson.D{{"$group", bson.D{{"_id", nil},
+				{"numbers", bson.D{{"$push", "$cards.0.number"}}}}}})), ShouldNotBeNil)
+			So(check(aggregate("customers", bson.D{{"$facet", bson.D{{"all", []interface{}{
+				bson.D{{"$replaceRoot", bson.D{{"newRoot", bson.D{{"doc", "$$ROOT"}}}}}},
+			}}}}})), ShouldNotBeNil)
+			So(check(aggregate("customers", bson.D{{"$out", "copy"}})), ShouldNotBeNil)
+			So(check(aggregate("customers",
+				bson.D{{"$match", bson.D{{"name", bson.D{{"$exists", true}}}}}},
+				bson.D{{"$sort", bson.D{{"name", 1}}}},
+				bson.D{{"$group", bson.D{{"_id", "$name"}, {"n", bson.D{{"$sum", 1}}}}}},
+			)), ShouldBeNil)
+
+			// filters and sorts could find the values one prefix at a time
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"ssn", bson.RegEx{Pattern: "^123"}}}}), ShouldResemble,
+				&messages.ResponderError{ErrorCode: Unauthorized,
+					Message: "the filter can't use the redacted field ssn"})
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"$or", []interface{}{bson.D{{"name", "ann"}},
+					bson.D{{"cards.number", bson.D{{"$gt", "4"}}}}}}}}), ShouldNotBeNil)
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"$where", "this.name == 'ann'"}}}), ShouldNotBeNil)
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Sort: bson.D{{"ssn", 1}}}), ShouldNotBeNil)
+			So(check(messages.Find{Database: "crm", Collection: "customers",
+				Filter: bson.D{{"name", "ann"}}, Sort: bson.D{{"name", 1}}}), ShouldBeNil)
+			So(check(messages.Count{Database: "crm", Collection: "customers",
+				Query: bson.D{{"ssn", "123-45-6789"}}}), ShouldNotBeNil)
+			So(check(messages.Distinct{Database: "crm", Collection: "customers", Key: "name",
+				Query: bson.D{{"ssn", "123-45-6789"}}}), ShouldNotBeNil)
+			So(check(messages.FindAndModify{Database: "crm", Collection: "customers",
+				Query: bson.D{{"name", "ann"}}, Sort: bson.D{{"email", -1}}}), ShouldNotBeNil)
+			So(check(aggregate("customers", bson.D{{"$match", bson.D{{"$expr",
+				bson.D{{"$eq", []interface{}{bson.D{{"$substr", []interface{}{"$ssn", 0, 3}}}, "123"}}}}}}})),
+				ShouldNotBeNil)
+			So(check(aggregate("customers", bson.D{{"$sort", bson.D{{"cards.number", 1}}}})),
+				ShouldNotBeNil)
+
+			// the documents of other namespaces aren't redacted by the rules of the
+			// aggregation's namespace
+			c.SetPrincipal(nil)
+			r.Rules = append(r.Rules, Rule{Namespaces: server.Namespaces{"hr.staff"},
+				Fields: []Field{{Path: "salary", Action: RemoveAction}}})
+			So(check(messages.Aggregate{Database: "hr", Collection: "teams", Pipeline: []bson.D{
+				{{"$lookup", bson.D{{"from", "staff"}, {"localField", "members"},
+					{"foreignField", "_id"}, {"as", "members"}}}},
+			}}), ShouldNotBeNil)
+		})
+
+		Convey("but not from other namespaces", func() {
+			w := process(messages.Find{Database: "test", Collection: "customers"},
+				messages.FindResponse{Documents: []bson.D{customer}})
+			So(w.(messages.FindResponse).Documents[0], ShouldResemble, customer)
+		})
+	})
+
+	Convey("Reject invalid rules", t, func() {
+		r := &RedactModule{}
+		So(r.Configure(bson.M{"rules": []interface{}{bson.M{"fields": []interface{}{
+			bson.M{"path": "a", "action": "remove"}}}}}), ShouldNotBeNil)
+		So(r.Configure(bson.M{"rules": []interface{}{bson.M{"namespace": "a.*"}}}), ShouldNotBeNil)
+		So(r.Configure(bson.M{"rules": []interface{}{bson.M{"namespace": "a.*", "fields": []interface{}{
+			bson.M{"path": "a", "action": "scramble"}}}}}), ShouldNotBeNil)
+		So(r.Configure(bson.M{"rules": []interface{}{bson.M{"namespace": "a.*", "fields": []interface{}{
+			bson.M{"action": "remove"}}}}}), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,92 @@
+package slowlog
+
+import (
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"time"
+)
+
+// An Entry describes an operation that was logged, either because it was slow or
+// because it was sampled.
+type Entry struct {
+	Time           time.Time `bson:"time" json:"time"`
+	DurationMillis float64   `bson:"durationMillis" json:"durationMillis"`
+
+	// true if the operation took longer than the threshold, and false if it was
+	// sampled.
+	Slow bool `bson:"slow" json:"slow"`
+
+	ConnectionID int64  `bson:"connectionId,omitempty" json:"connectionId,omitempty"`
+	Type         string `bson:"type" json:"type"`
+	Command      string `bson:"command,omitempty" json:"command,omitempty"`
+	Database     string `bson:"database,omitempty" json:"database,omitempty"`
+	Collection   string `bson:"collection,omitempty" json:"collection,omitempty"`
+
+	// the filter, pipeline or command with its values replaced by "?".
+	Shape string `bson:"shape,omitempty" json:"shape,omitempty"`
+
+	// the number of documents returned by a read, or affected by a write. Nil if
+	// the response doesn't say.
+	NReturned *int64 `bson:"nreturned,omitempty" json:"nreturned,omitempty"`
+	NAffected *int64 `bson:"naffected,omitempty" json:"naffected,omitempty"`
+
+	ErrorCode int32  `bson:"errorCode,omitempty" json:"errorCode,omitempty"`
+	Error     string `bson:"errmsg,omitempty" json:"errmsg,omitempty"`
+}
+
+// newEntry creates the entry for a request and the response that the rest of the
+// chain wrote for it.
+func newEntry(req messages.Requester, res *messages.ModuleResponse, start time.Time,
+	duration time.Duration) Entry {
+	e := Entry{
+		Time:           start,
+		DurationMillis: float64(duration) / float64(time.Millisecond),
+		Type:           req.Type(),
+		Shape:          messages.FilterShape(req),
+	}
+	if req.Type() == messages.CommandType {
+		e.Command = messages.CommandName(req)
+	}
+	e.Database, e.Collection = messages.Namespace(req)
+
+	if res.CommandError != nil {
+		e.ErrorCode = res.CommandError.ErrorCode
+		e.Error = res.CommandError.Message
+		return e
+	}
+	e.NReturned, e.NAffected = messages.DocumentCounts(res.Writer)
+	return e
+}
+
+// Fields returns the entry as fields of a log line. The time is left out, since
+// every log line has one.
+func (e Entry) Fields() Fields {
+	fields := Fields{
+		"durationMillis": e.DurationMillis,
+		"slow":           e.Slow,
+		"type":           e.Type,
+	}
+	if len(e.Command) > 0 {
+		fields["command"] = e.Command
+	}
+	if len(e.Database) > 0 {
+		fields["database"] = e.Database
+	}
+	if len(e.Collection) > 0 {
+		fields["collection"] = e.Collection
+	}
+	if len(e.Shape) > 0 {
+		fields["shape"] = e.Shape
+	}
+	if e.NReturned != nil {
+		fields["nreturned"] = *e.NReturned
+	}
+	if e.NAffected != nil {
+		fields["naffected"] = *e.NAffected
+	}
+	if len(e.Error) > 0 {
+		fields["errorCode"] = e.ErrorCode
+		fields["errmsg"] = e.Error
+	}
+	return fields
+}
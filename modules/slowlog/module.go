@@ -0,0 +1,179 @@
+// Package slowlog contains a module that times the rest of the module chain, and logs
+// the operations that are slower than a threshold.
+package slowlog
+
+import (
+	"context"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/connection"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"math/rand"
+	"time"
+)
+
+// the defaults for the configuration.
+const (
+	defaultSlowMS         = 100
+	defaultFileMaxSizeMB  = 100
+	defaultFileMaxBackups = 5
+	defaultCollectionSize = 16 * 1024 * 1024
+)
+
+// A SlowLogModule calls the next module, and writes an entry for the operation to
+// its sink if it took at least SlowMS milliseconds. Faster operations are sampled
+// at the SampleRate.
+type SlowLogModule struct {
+	SlowMS     int64
+	SampleRate float64
+	sink       sink
+}
+
+func init() {
+	server.Publish(&SlowLogModule{})
+}
+
+func (s *SlowLogModule) New() server.Module {
+	return &SlowLogModule{}
+}
+
+func (s *SlowLogModule) Name() string {
+	return "slowlog"
+}
+
+/*
+Configuration structure:
+
+	{
+		slowMS: integer,
+		sampleRate: float,
+		sink: "log", "file" or "collection",
+		file: {
+			path: string,
+			maxSizeMB: integer,
+			maxBackups: integer
+		},
+		collection: {
+			connection: {
+				addresses: []string,
+				direct: boolean,
+				timeout: integer,
+				auth: {
+					username: string,
+					password: string,
+					database: string
+				},
+				tls: {
+					caFile: string,
+					certFile: string,
+					keyFile: string,
+					serverName: string,
+					insecureSkipVerify: boolean
+				}
+			},
+			database: string,
+			collection: string,
+			sizeBytes: integer
+		}
+	}
+*/
+func (s *SlowLogModule) Configure(conf bson.M) error {
+	s.SlowMS = convert.ToInt64(conf["slowMS"], defaultSlowMS)
+	if s.SlowMS < 0 {
+		return fmt.Errorf("slowMS must not be negative")
+	}
+	s.SampleRate = convert.ToFloat64(conf["sampleRate"], 0)
+	if s.SampleRate < 0 || s.SampleRate > 1 {
+		return fmt.Errorf("sampleRate must be between 0 and 1")
+	}
+
+	switch sinkName := convert.ToString(conf["sink"], LogSink); sinkName {
+	case LogSink:
+		s.sink = logSink{}
+	case FileSink:
+		file := convert.ToBSONMap(conf["file"])
+		path := convert.ToString(file["path"])
+		if len(path) == 0 {
+			return fmt.Errorf("The file sink doesn't have a path")
+		}
+		s.sink = &fileSink{
+			path:       path,
+			maxSize:    convert.ToInt64(file["maxSizeMB"], defaultFileMaxSizeMB) * 1024 * 1024,
+			maxBackups: convert.ToInt(file["maxBackups"], defaultFileMaxBackups),
+		}
+	case CollectionSink:
+		collection := convert.ToBSONMap(conf["collection"])
+		dialInfo, err := connection.ParseDialInfo(convert.ToBSONMap(collection["connection"]))
+		if err != nil {
+			return err
+		}
+		database := convert.ToString(collection["database"])
+		name := convert.ToString(collection["collection"])
+		if len(database) == 0 || len(name) == 0 {
+			return fmt.Errorf("The collection sink needs a database and a collection")
+		}
+		s.sink = &collectionSink{
+			connection: dialInfo,
+			database:   database,
+			collection: name,
+			sizeBytes:  convert.ToInt(collection["sizeBytes"], defaultCollectionSize),
+		}
+	default:
+		return fmt.Errorf("Unknown sink: %v", sinkName)
+	}
+	return nil
+}
+
+// Start opens the file or connects to the backend of the sink, so that the proxy
+// doesn't start if entries can't be written.
+func (s *SlowLogModule) Start() error {
+	return s.sink.start()
+}
+
+// Stop waits for the entries that are being written in the background.
+func (s *SlowLogModule) Stop() error {
+	s.sink.stop()
+	return nil
+}
+
+// Close closes the file or the session with the backend of the sink.
+func (s *SlowLogModule) Close() error {
+	return s.sink.close()
+}
+
+// Health reports whether the sink can be written to. Requests still pass through
+// the module if it can't, so the module is at worst degraded.
+func (s *SlowLogModule) Health() server.Health {
+	return s.sink.health()
+}
+
+func (s *SlowLogModule) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	resNext := messages.ModuleResponse{}
+	start := time.Now()
+	next(ctx, req, &resNext)
+	duration := time.Since(start)
+
+	if resNext.Writer != nil {
+		res.Write(resNext.Writer)
+	}
+	if resNext.CommandError != nil {
+		res.Error(resNext.CommandError.ErrorCode, resNext.CommandError.Message)
+	}
+
+	slow := duration >= time.Duration(s.SlowMS)*time.Millisecond
+	if !slow && (s.SampleRate <= 0 || rand.Float64() >= s.SampleRate) {
+		return
+	}
+
+	e := newEntry(req, &resNext, start, duration)
+	e.Slow = slow
+	c := server.ConnectionFromContext(ctx)
+	if c != nil {
+		e.ConnectionID = c.ID
+	}
+	s.sink.write(ctx, e)
+}
@@ -0,0 +1,165 @@
+package slowlog
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sleepModule sleeps for its duration before writing its response.
+func sleepModule(d time.Duration, w messages.ResponseWriter, err *messages.ResponderError) server.PipelineFunc {
+	return func(ctx context.Context, req messages.Requester, res messages.Responder) {
+		time.Sleep(d)
+		if w != nil {
+			res.Write(w)
+		}
+		if err != nil {
+			res.Error(err.ErrorCode, err.Message)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	Convey("Log slow operations to a file", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-slowlog")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		path := filepath.Join(dir, "slow.log")
+
+		s := &SlowLogModule{}
+		err = s.Configure(bson.M{"slowMS": 20, "sink": "file", "file": bson.M{"path": path}})
+		So(err, ShouldBeNil)
+		So(s.Start(), ShouldBeNil)
+
+		ctx := server.WithConnection(context.Background(), &server.Connection{ID: 4})
+		find := messages.Find{Database: "db", Collection: "foo", Filter: bson.D{{"a", 1}}}
+		found := messages.FindResponse{Documents: []bson.D{{{"a", 1}}, {{"a", 1}}}}
+
+		res := messages.ModuleResponse{}
+		s.Process(ctx, find, &res, sleepModule(0, found, nil))
+		So(res.Writer, ShouldResemble, found)
+
+		res = messages.ModuleResponse{}
+		s.Process(ctx, find, &res, sleepModule(30*time.Millisecond, found, nil))
+		So(res.Writer, ShouldResemble, found)
+
+		update := messages.Update{Database: "db", Collection: "bar",
+			Updates: []messages.SingleUpdate{{Selector: bson.D{{"b", 2}}}}}
+		res = messages.ModuleResponse{}
+		s.Process(ctx, update, &res, sleepModule(30*time.Millisecond, nil,
+			&messages.ResponderError{ErrorCode: 50, Message: "operation exceeded time limit"}))
+		So(res.CommandError, ShouldResemble, &messages.ResponderError{ErrorCode: 50,
+			Message: "operation exceeded time limit"})
+
+		So(s.Stop(), ShouldBeNil)
+		So(s.Close(), ShouldBeNil)
+
+		b, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		So(len(lines), ShouldEqual, 2)
+
+		e := Entry{}
+		So(json.Unmarshal([]byte(lines[0]), &e), ShouldBeNil)
+		So(e.Slow, ShouldBeTrue)
+		So(e.DurationMillis, ShouldBeGreaterThanOrEqualTo, 20)
+		So(e.ConnectionID, ShouldEqual, 4)
+		So(e.Type, ShouldEqual, messages.FindType)
+		So(e.Database, ShouldEqual, "db")
+		So(e.Collection, ShouldEqual, "foo")
+		So(e.Shape, ShouldEqual, "{ a: ? }")
+		So(*e.NReturned, ShouldEqual, 2)
+		So(e.NAffected, ShouldBeNil)
+
+		e = Entry{}
+		So(json.Unmarshal([]byte(lines[1]), &e), ShouldBeNil)
+		So(e.Type, ShouldEqual, messages.UpdateType)
+		So(e.Shape, ShouldEqual, "{ b: ? }")
+		So(e.ErrorCode, ShouldEqual, 50)
+		So(e.Error, ShouldEqual, "operation exceeded time limit")
+		So(e.NAffected, ShouldBeNil)
+	})
+
+	Convey("Share the file of a path between modules", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-slowlog")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		conf := bson.M{"slowMS": 0, "sink": "file", "file": bson.M{"path": filepath.Join(dir, "slow.log")}}
+
+		old := &SlowLogModule{}
+		So(old.Configure(conf), ShouldBeNil)
+		So(old.Start(), ShouldBeNil)
+		reloaded := &SlowLogModule{}
+		So(reloaded.Configure(conf), ShouldBeNil)
+		So(reloaded.Start(), ShouldBeNil)
+
+		other := &SlowLogModule{}
+		So(other.Configure(bson.M{"sink": "file", "file": bson.M{
+			"path": filepath.Join(dir, "slow.log"), "maxBackups": 1}}), ShouldBeNil)
+		So(other.Start(), ShouldNotBeNil)
+
+		find := messages.Find{Database: "db", Collection: "foo"}
+		old.Process(context.Background(), find, &messages.ModuleResponse{}, sleepModule(0, nil, nil))
+		So(old.Stop(), ShouldBeNil)
+		So(old.Close(), ShouldBeNil)
+		reloaded.Process(context.Background(), find, &messages.ModuleResponse{}, sleepModule(0, nil, nil))
+		So(reloaded.Stop(), ShouldBeNil)
+		So(reloaded.Close(), ShouldBeNil)
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "slow.log"))
+		So(err, ShouldBeNil)
+		So(len(strings.Split(strings.TrimSpace(string(b)), "\n")), ShouldEqual, 2)
+		So(len(files), ShouldEqual, 0)
+	})
+
+	Convey("Sample fast operations", t, func() {
+		s := &SlowLogModule{}
+		So(s.Configure(bson.M{"slowMS": 1000, "sampleRate": 1}), ShouldBeNil)
+		entries := &recordSink{}
+		s.sink = entries
+
+		insert := messages.Insert{Database: "db", Collection: "foo"}
+		s.Process(context.Background(), insert, &messages.ModuleResponse{},
+			sleepModule(0, messages.InsertResponse{N: 3}, nil))
+		So(len(entries.entries), ShouldEqual, 1)
+		So(entries.entries[0].Slow, ShouldBeFalse)
+		So(*entries.entries[0].NAffected, ShouldEqual, 3)
+
+		s.SampleRate = 0
+		s.Process(context.Background(), insert, &messages.ModuleResponse{},
+			sleepModule(0, messages.InsertResponse{N: 3}, nil))
+		So(len(entries.entries), ShouldEqual, 1)
+	})
+
+	Convey("Reject invalid configurations", t, func() {
+		s := &SlowLogModule{}
+		So(s.Configure(bson.M{"sampleRate": 2}), ShouldNotBeNil)
+		So(s.Configure(bson.M{"sink": "syslog"}), ShouldNotBeNil)
+		So(s.Configure(bson.M{"sink": "file"}), ShouldNotBeNil)
+		So(s.Configure(bson.M{"sink": "collection", "collection": bson.M{
+			"connection": bson.M{"addresses": []interface{}{"localhost"}}}}), ShouldNotBeNil)
+	})
+}
+
+// recordSink keeps the entries that are written to it.
+type recordSink struct {
+	logSink
+	entries []Entry
+}
+
+func (r *recordSink) write(ctx context.Context, e Entry) {
+	r.entries = append(r.entries, e)
+}
@@ -0,0 +1,308 @@
+package slowlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/connection"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"path/filepath"
+	"sync"
+)
+
+// the sinks that entries can be written to.
+const (
+	LogSink        = "log"
+	FileSink       = "file"
+	CollectionSink = "collection"
+)
+
+// the number of entries waiting to be inserted into a collection before new entries
+// are dropped.
+const collectionQueueSize = 1000
+
+// A sink is where the module writes its entries to.
+type sink interface {
+	write(ctx context.Context, e Entry)
+	start() error
+	stop()
+	close() error
+	health() server.Health
+}
+
+// logSink writes entries to the proxy log, with the fields of the request.
+type logSink struct{}
+
+func (s logSink) write(ctx context.Context, e Entry) {
+	l := LoggerFromContext(ctx).With(e.Fields())
+	if e.Slow {
+		l.Log(NOTICE, "Slow operation")
+	} else {
+		l.Log(INFO, "Sampled operation")
+	}
+}
+
+func (s logSink) start() error {
+	return nil
+}
+
+func (s logSink) stop() {}
+
+func (s logSink) close() error {
+	return nil
+}
+
+func (s logSink) health() server.Health {
+	return server.Health{Status: server.HealthOK}
+}
+
+// the files that file sinks have open, by their absolute path. When the module chain
+// is reloaded, the sinks of the old and the new chain share the file of a path, so
+// that they don't rotate it out from under each other.
+var (
+	filesMu sync.Mutex
+	files   = make(map[string]*sharedFile)
+)
+
+// A sharedFile is a rotating file and the number of sinks that use it.
+type sharedFile struct {
+	*RotatingFile
+	abs        string
+	maxSize    int64
+	maxBackups int
+	refs       int
+}
+
+// openFile returns the file of the path, and opens it if no sink has it open. Every
+// file that is returned has to be released.
+func openFile(path string, maxSize int64, maxBackups int) (*sharedFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	f, ok := files[abs]
+	if ok {
+		if f.maxSize != maxSize || f.maxBackups != maxBackups {
+			return nil, fmt.Errorf("The slow operation log %v is open with another size or number of backups", path)
+		}
+		f.refs++
+		return f, nil
+	}
+
+	rotating, err := NewRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	f = &sharedFile{
+		RotatingFile: rotating,
+		abs:          abs,
+		maxSize:      maxSize,
+		maxBackups:   maxBackups,
+		refs:         1,
+	}
+	files[abs] = f
+	return f, nil
+}
+
+// release stops a sink from using the file, and closes the file once no sink uses it.
+func (f *sharedFile) release() error {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	delete(files, f.abs)
+	return f.Close()
+}
+
+// fileSink writes entries to a rotating file, with one JSON document per line.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *sharedFile
+}
+
+func (s *fileSink) write(ctx context.Context, e Entry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		LogContext(ctx, ERROR, "Error encoding slow operation: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		LogContext(ctx, ERROR, "Error writing slow operation: %v", err)
+	}
+}
+
+// start opens the file, so that the proxy doesn't start if it can't be written to.
+func (s *fileSink) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		return nil
+	}
+	f, err := openFile(s.path, s.maxSize, s.maxBackups)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+func (s *fileSink) stop() {}
+
+func (s *fileSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.release()
+	s.file = nil
+	return err
+}
+
+func (s *fileSink) health() server.Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return server.Health{
+			Status:  server.HealthDegraded,
+			Details: bson.M{"path": s.path, "error": "not open"},
+		}
+	}
+	return server.Health{Status: server.HealthOK, Details: bson.M{"path": s.path}}
+}
+
+// collectionSink inserts entries into a capped collection. Entries are inserted in
+// the background, so that requests don't wait on the backend, and are dropped if
+// too many are waiting.
+type collectionSink struct {
+	connection mgo.DialInfo
+	database   string
+	collection string
+	sizeBytes  int
+
+	mu           sync.Mutex
+	mongoSession *mgo.Session
+	queue        chan Entry
+	done         chan struct{}
+}
+
+func (s *collectionSink) write(ctx context.Context, e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		LogContext(ctx, WARNING, "Dropped slow operation, too many are waiting to be inserted")
+	}
+}
+
+// start connects to the backend, creates the capped collection if it doesn't exist,
+// and starts inserting entries.
+func (s *collectionSink) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue != nil {
+		return nil
+	}
+
+	if s.mongoSession == nil {
+		session, err := mgo.DialWithInfo(&s.connection)
+		if err != nil {
+			return fmt.Errorf("Error connecting to MongoDB: %v", err)
+		}
+		s.mongoSession = session
+	}
+
+	err := s.mongoSession.DB(s.database).C(s.collection).Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: s.sizeBytes,
+	})
+	if err != nil && !isNamespaceExists(err) {
+		return fmt.Errorf("Error creating capped collection %v.%v: %v", s.database, s.collection, err)
+	}
+
+	s.queue = make(chan Entry, collectionQueueSize)
+	s.done = make(chan struct{})
+	go s.insert(s.mongoSession.Copy(), s.queue, s.done)
+	return nil
+}
+
+// isNamespaceExists returns true if the error is because the collection already exists.
+func isNamespaceExists(err error) bool {
+	queryErr, ok := err.(*mgo.QueryError)
+	return ok && queryErr.Code == 48
+}
+
+// insert inserts the entries from the queue until it is closed.
+func (s *collectionSink) insert(session *mgo.Session, queue chan Entry, done chan struct{}) {
+	defer close(done)
+	defer session.Close()
+	c := session.DB(s.database).C(s.collection)
+	for e := range queue {
+		err := c.Insert(e)
+		if err != nil {
+			NewLogger("slowlog").Log(ERROR, "Error inserting slow operation: %v", err)
+		}
+	}
+}
+
+// stop waits for the entries that are queued to be inserted.
+func (s *collectionSink) stop() {
+	s.mu.Lock()
+	queue, done := s.queue, s.done
+	s.queue = nil
+	s.done = nil
+	s.mu.Unlock()
+
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+}
+
+func (s *collectionSink) close() error {
+	s.stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mongoSession != nil {
+		s.mongoSession.Close()
+		s.mongoSession = nil
+	}
+	return nil
+}
+
+// health pings the backend. Requests still pass through the module if it can't be
+// reached, so the module is only degraded.
+func (s *collectionSink) health() server.Health {
+	s.mu.Lock()
+	session := s.mongoSession
+	s.mu.Unlock()
+
+	health := connection.Health(session, s.connection)
+	if health.Status == server.HealthDown {
+		health.Status = server.HealthDegraded
+	}
+	return health
+}
@@ -1,7 +1,11 @@
 package mongoproxy
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
@@ -13,6 +17,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ParseConfigFromFile takes a filename for a JSON file, and returns a configuration
@@ -40,10 +51,10 @@ func ParseConfigFromDB(mongoURI string, configNamespace string) (bson.M, error)
 	var result bson.M
 
 	mongoSession, err := mgo.Dial(mongoURI)
-	defer mongoSession.Close()
 	if err != nil {
 		return nil, fmt.Errorf("Error connecting to MongoDB instance: %v", err)
 	}
+	defer mongoSession.Close()
 
 	database, collection, err := messages.ParseNamespace(configNamespace)
 	if err != nil {
@@ -58,110 +69,798 @@ func ParseConfigFromDB(mongoURI string, configNamespace string) (bson.M, error)
 	return result, nil
 }
 
-// Start starts the server at the provided port and with the given module chain.
-func Start(port int, chain *server.ModuleChain) {
+// the time that in-flight requests have to finish when the server shuts down, if the
+// configuration doesn't set one.
+const defaultGracePeriod = time.Second * 30
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
-	if err != nil {
-		Log(ERROR, "Error listening on port %v: %v", port, err)
-		return
+// the error code of requests from clients that haven't authenticated.
+const unauthorized = 13
+
+// ErrServerClosed is returned by ListenAndServe once the server has shut down.
+var ErrServerClosed = errors.New("mongoproxy: server closed")
+
+// A Server accepts client connections and passes their requests through a module
+// chain. The chain can be reloaded while the server runs, and the server can be shut
+// down gracefully, which lets in-flight requests finish. Servers have to be created
+// with NewServer or NewServerWithConfig.
+type Server struct {
+	Port int
+
+	// the compressors that are advertised to clients
+	Compressors []string
+
+	// the TLS configuration for the listener. If set, only TLS connections are accepted.
+	TLSConfig *tls.Config
+
+	// the time limit for requests that don't set their own maxTimeMS, or 0 for no limit
+	DefaultMaxTime time.Duration
+
+	// how long Shutdown waits for in-flight requests to finish before it closes
+	// their connections
+	GracePeriod time.Duration
+
+	// the address that Prometheus metrics are served on, or empty to not serve them,
+	// and the path they are served at, which defaults to /metrics
+	MetricsAddress string
+	MetricsPath    string
+
+	mu       sync.Mutex
+	listener net.Listener
+	running  bool
+	closing  bool
+
+	// the listener for metrics, if it was started
+	metricsServer *http.Server
+
+	// the module chain that new requests pass through
+	current *generation
+
+	// counts the replaced module chains that haven't been stopped yet
+	retiring sync.WaitGroup
+
+	// the open client connections, and whether each of them is waiting for a request
+	conns map[net.Conn]bool
+
+	// counts the open client connections
+	active sync.WaitGroup
+
+	// closed once the server has shut down
+	done chan struct{}
+}
+
+// NewServer creates a server for the provided port and module chain. All supported
+// compressors are advertised to clients.
+func NewServer(port int, chain *server.ModuleChain) *Server {
+	return &Server{
+		Port:        port,
+		current:     newGeneration(chain),
+		Compressors: messages.SupportedCompressors,
+		GracePeriod: defaultGracePeriod,
+		conns:       make(map[net.Conn]bool),
+		done:        make(chan struct{}),
+	}
+}
+
+/*
+NewServerWithConfig creates a server for the provided port, with a module chain created
+from the given configuration. The configuration has the following optional fields:
+
+	{
+		modules: []{ name: string, config: object },
+		compression: []string,
+		tls: object,
+		maxTimeMS: integer,
+		shutdownGracePeriodMS: integer,
+		metrics: { address: string, path: string },
+		logging: object
 	}
 
-	pipeline := server.BuildPipeline(chain)
-	Log(INFO, "Server running on port %v", port)
-	for {
-		conn, err := ln.Accept()
+The compression field lists the compressors advertised to clients, and defaults to all
+supported compressors. The tls field has the TLSOptions for the listener. maxTimeMS is
+the time limit for requests that don't set their own, and shutdownGracePeriodMS is how
+long in-flight requests have to finish when the server shuts down. If metrics has an
+address, Prometheus metrics are served over HTTP on it. The logging field is described
+in ConfigureLogging.
+*/
+func NewServerWithConfig(port int, config bson.M) (*Server, error) {
+	loggingConf := convert.ToBSONMap(config["logging"])
+	if loggingConf != nil {
+		err := ConfigureLogging(loggingConf)
 		if err != nil {
-			Log(ERROR, "error accepting connection: %v", err)
-			continue
+			return nil, fmt.Errorf("Invalid logging configuration: %v", err)
 		}
+	}
+
+	var tlsConfig *tls.Config
+	tlsRaw, ok := config["tls"]
+	if ok {
+		options, err := ParseTLSOptions(convert.ToBSONMap(tlsRaw))
+		if err == nil && options.Enabled() {
+			tlsConfig, err = options.Config()
+		}
+		if err != nil {
+			// don't fall back to accepting unencrypted connections
+			return nil, fmt.Errorf("Invalid TLS configuration: %v", err)
+		}
+	}
 
-		Log(NOTICE, "accepted connection from: %v", conn.RemoteAddr())
-		go handleConnection(conn, pipeline)
+	compressors := messages.SupportedCompressors
+	compressionRaw, ok := config["compression"]
+	if ok {
+		c, err := convert.ConvertToStringSlice(compressionRaw)
+		if err != nil {
+			Log(WARNING, "Invalid compression configuration: %v. No compressors will be advertised.", err)
+		}
+		compressors = make([]string, 0)
+		for i := 0; i < len(c); i++ {
+			if !messages.IsSupportedCompressor(c[i]) {
+				Log(WARNING, "Unsupported compressor: %v", c[i])
+				continue
+			}
+			compressors = append(compressors, c[i])
+		}
 	}
 
+	s := NewServer(port, CreateChainFromConfig(config))
+	s.Compressors = compressors
+	s.TLSConfig = tlsConfig
+	s.DefaultMaxTime = time.Duration(convert.ToInt64(config["maxTimeMS"], 0)) * time.Millisecond
+	gracePeriod := convert.ToInt64(config["shutdownGracePeriodMS"], -1)
+	if gracePeriod >= 0 {
+		s.GracePeriod = time.Duration(gracePeriod) * time.Millisecond
+	}
+	metricsConf := convert.ToBSONMap(config["metrics"])
+	if metricsConf != nil {
+		s.MetricsAddress, s.MetricsPath = parseMetricsConfig(metricsConf)
+	}
+	return s, nil
 }
 
-// StartWithConfig starts the server at the provided port, creating a module chaine
-// with the given configuration.
-func StartWithConfig(port int, config bson.M) {
-	chain := server.CreateChain()
+// CreateChainFromConfig creates a module chain from the modules field of a configuration,
+// as described in server.CreateChainFromConfig.
+func CreateChainFromConfig(config bson.M) *server.ModuleChain {
 	var modules []bson.M
 	var err error
 	modulesRaw, ok := config["modules"]
 	if ok {
 		modules, err = convert.ConvertToBSONMapSlice(modulesRaw)
 		if err != nil {
-			Log(WARNING, "Invalid module configuration: %v. Proxy will start with no modules.", err)
+			Log(WARNING, "Invalid module configuration: %v. The chain will have no modules.", err)
 		}
 	} else {
-		Log(WARNING, "No modules provided. Proxy will start without modules.")
+		Log(WARNING, "No modules provided. The chain will have no modules.")
 	}
+	return server.CreateChainFromConfig(modules)
+}
 
-	for i := 0; i < len(modules); i++ {
-		moduleNameRaw, ok := modules[i]["name"]
-		if !ok {
-			Log(WARNING, "Module in configuration does not have a name")
+// ListenAndServe starts the modules in the chain, then listens on the server's port
+// and handles client connections until the server is shut down. It returns
+// ErrServerClosed once Shutdown has finished, or an error if a module fails to start
+// or the server can't listen on the port.
+func (s *Server) ListenAndServe() error {
+	chain := s.currentChain()
+	err := chain.Start()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", s.Port))
+	if err != nil {
+		stopChain(chain)
+		return fmt.Errorf("Error listening on port %v: %v", s.Port, err)
+	}
+	err = s.listenMetrics()
+	if err != nil {
+		ln.Close()
+		stopChain(chain)
+		return err
+	}
+	if s.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.TLSConfig)
+		Log(INFO, "TLS is enabled")
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		ln.Close()
+		s.closeMetrics()
+		<-s.done
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.running = true
+	s.mu.Unlock()
+
+	Log(INFO, "Server running on port %v", s.Port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosing() {
+				<-s.done
+				return ErrServerClosed
+			}
+			Log(ERROR, "error accepting connection: %v", err)
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
 			continue
 		}
-		moduleName := convert.ToString(moduleNameRaw)
-		moduleType, ok := server.Registry[moduleName]
-		if !ok {
-			Log(WARNING, "Module doesn't exist in the registry: %v", moduleName)
-			continue // module doesn't exist
+		connectionsAccepted.Inc()
+		go s.handleConnection(conn)
+	}
+}
+
+// Shutdown stops the server from accepting connections and closes the idle ones. The
+// other connections are closed once their requests finish, or when the grace period
+// runs out, which cancels the requests that are left. Once every connection is closed,
+// the modules in the chain, and in chains that were replaced by a reload, are stopped
+// and closed.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(s.GracePeriod):
+		Log(WARNING, "Requests didn't finish in the shutdown grace period. Closing their connections.")
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
 		}
-		module := moduleType.New()
+		s.mu.Unlock()
+		<-drained
+	}
+
+	s.retiring.Wait()
+	err := stopChain(s.currentChain())
+	s.closeMetrics()
+	close(s.done)
+	return err
+}
+
+// Health returns the status of the proxy and the health of every module that reports
+// it. The status is the worst status of the modules, and the proxy is down while it
+// shuts down.
+func (s *Server) Health() (string, []server.ModuleHealth) {
+	modules := s.currentChain().Health()
+	status := server.HealthOK
+	if s.isClosing() {
+		status = server.HealthDown
+	}
+	for i := 0; i < len(modules); i++ {
+		status = server.WorseStatus(status, modules[i].Status)
+	}
+	return status, modules
+}
+
+// healthResponse answers the proxyHealth command with the health of the proxy.
+func (s *Server) healthResponse() messages.CommandResponse {
+	status, modules := s.Health()
+	return messages.CommandResponse{
+		Reply: bson.M{
+			"status":  status,
+			"modules": server.HealthToBSON(modules),
+			"ok":      1,
+		},
+	}
+}
 
-		// TODO: allow links to other collections
-		moduleConfig := convert.ToBSONMap(modules[i]["config"])
-		err := module.Configure(moduleConfig)
+// ShutdownOnSignal shuts the server down when the process receives one of the signals.
+// A second signal stops the process right away.
+func (s *Server) ShutdownOnSignal(signals ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	go func() {
+		sig := <-c
+		signal.Stop(c)
+		Log(NOTICE, "Received %v, shutting down", sig)
+		err := s.Shutdown()
 		if err != nil {
-			Log(WARNING, "Invalid configuration for module %v: %v", moduleName, err)
-			continue
+			Log(ERROR, "%v", err)
+		}
+	}()
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// track adds a client connection to the open connections, and returns false if the
+// server is shutting down and the connection should be closed instead.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	s.active.Add(1)
+	connectionsOpen.Inc()
+	return true
+}
+
+// untrack removes a client connection that was closed from the open connections.
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	connectionsOpen.Dec()
+	s.active.Done()
+}
+
+// setIdle marks whether a client connection is waiting for a request. It returns
+// false if the server is shutting down and the idle connection should be closed instead.
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idle && s.closing {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+// Start starts a server at the provided port and with the given module chain, which is
+// shut down gracefully on SIGINT or SIGTERM. All supported compressors are advertised
+// to clients.
+func Start(port int, chain *server.ModuleChain) {
+	run(NewServer(port, chain))
+}
+
+// StartTLS starts the server like Start, but only accepts TLS connections, using
+// the given TLS configuration.
+func StartTLS(port int, chain *server.ModuleChain, tlsConfig *tls.Config) {
+	s := NewServer(port, chain)
+	s.TLSConfig = tlsConfig
+	run(s)
+}
+
+// StartWithConfig starts a server like Start, creating the server and its module chain
+// with the given configuration, as described in NewServerWithConfig.
+func StartWithConfig(port int, config bson.M) {
+	s, err := NewServerWithConfig(port, config)
+	if err != nil {
+		Log(ERROR, "%v", err)
+		return
+	}
+	run(s)
+}
+
+// run handles client connections on the server until it is shut down by a signal.
+func run(s *Server) {
+	s.ShutdownOnSignal(os.Interrupt, syscall.SIGTERM)
+	err := s.ListenAndServe()
+	if err != ErrServerClosed {
+		Log(ERROR, "%v", err)
+	}
+}
+
+// handshakeCommand returns the command if the request is a hello or isMaster handshake.
+func handshakeCommand(req messages.Requester) (messages.Command, bool) {
+	command, err := messages.ToCommandRequest(req)
+	if err != nil {
+		return messages.Command{}, false
+	}
+	switch command.CommandName {
+	case "hello", "isMaster", "ismaster":
+		return command, true
+	}
+	return messages.Command{}, false
+}
+
+// recordClientMetadata stores the client document of the first handshake on the
+// connection, so modules can see which driver and application the client is.
+func recordClientMetadata(c *server.Connection, req messages.Requester) {
+	command, ok := handshakeCommand(req)
+	if !ok || c.ClientMetadata() != nil {
+		return
+	}
+	metadata := convert.ToBSONMap(command.GetArg("client"))
+	if metadata != nil {
+		c.SetClientMetadata(metadata)
+	}
+}
+
+// negotiateCompression replaces the compressors in the reply to a hello or isMaster
+// handshake with the ones that both the client and the proxy support, since the
+// connection to the client is compressed by the proxy rather than by the backend.
+// The negotiated compressors are recorded on the connection.
+func negotiateCompression(c *server.Connection, req messages.Requester,
+	res *messages.ModuleResponse, compressors []string) {
+	command, ok := handshakeCommand(req)
+	if !ok {
+		return
+	}
+	reply, ok := res.Writer.(messages.CommandResponse)
+	if !ok || reply.Reply == nil {
+		return
+	}
+
+	requested, err := convert.ConvertToStringSlice(command.GetArg("compression"))
+	if err != nil {
+		requested = make([]string, 0)
+	}
+	negotiated := messages.NegotiateCompressors(requested, compressors)
+	if len(negotiated) > 0 {
+		reply.Reply["compression"] = negotiated
+	} else {
+		delete(reply.Reply, "compression")
+	}
+	c.SetCompressors(negotiated)
+}
+
+// isLegacyWrite returns true if the opcode is one of the legacy write opcodes, which
+// are unacknowledged and have no reply.
+func isLegacyWrite(opCode int32) bool {
+	return opCode == messages.OP_UPDATE || opCode == messages.OP_INSERT ||
+		opCode == messages.OP_DELETE
+}
+
+// toGetLastError returns the request as a getLastError command, and false if it
+// isn't one.
+func toGetLastError(req messages.Requester) (messages.Command, bool) {
+	command, err := messages.ToCommandRequest(req)
+	if err != nil {
+		return messages.Command{}, false
+	}
+	switch command.CommandName {
+	case "getLastError", "getlasterror":
+		return command, true
+	}
+	return messages.Command{}, false
+}
+
+// isHealthCommand returns true if the request is the proxyHealth command, which the
+// proxy answers itself.
+func isHealthCommand(req messages.Requester) bool {
+	command, err := messages.ToCommandRequest(req)
+	return err == nil && command.CommandName == "proxyHealth"
+}
+
+// encodeResponse encodes the response to the request with header msgHeader, in the
+// command reply format if the request was a command.
+func encodeResponse(msgHeader messages.RequestHeader, res *messages.ModuleResponse) ([]byte, error) {
+	var bytes []byte
+	var err error
+	if msgHeader.Command {
+		bytes, err = messages.EncodeCommandReply(msgHeader.MsgHeader, *res)
+	} else {
+		bytes, err = messages.Encode(msgHeader.MsgHeader, *res)
+	}
+	if err != nil {
+		encodeErrors.Inc()
+	}
+	return bytes, err
+}
+
+// writeMessage writes an encoded reply to the connection, compressing it if the
+// request with header msgHeader was compressed.
+func writeMessage(conn net.Conn, msgHeader messages.RequestHeader, bytes []byte) error {
+	var err error
+
+	// replies are compressed with the same compressor as the request
+	if len(msgHeader.Compressor) > 0 {
+		bytes, err = messages.Compress(bytes, msgHeader.Compressor)
+		if err != nil {
+			return fmt.Errorf("Compression error: %v", err)
+		}
+	}
+
+	n, err := conn.Write(bytes)
+	bytesSent.Add(float64(n))
+	if err != nil {
+		return fmt.Errorf("Error writing to connection: %v", err)
+	}
+	return nil
+}
+
+// writeResponse encodes the response to the request with header msgHeader and writes it
+// to the connection.
+func writeResponse(conn net.Conn, msgHeader messages.RequestHeader,
+	res *messages.ModuleResponse) error {
+	bytes, err := encodeResponse(msgHeader, res)
+	if err != nil {
+		return fmt.Errorf("Encoding error: %v", err)
+	}
+	return writeMessage(conn, msgHeader, bytes)
+}
+
+// the last requestID used for a reply that is part of an exhaust stream. Other replies
+// don't need a requestID, since nothing responds to them.
+var lastReplyID int32
+
+// the last ID given to a client connection.
+var lastConnectionID int64
+
+// exhaustGetMore returns the getMore that continues the cursor of the request if the
+// client asked for the results to be streamed back, and false otherwise.
+func exhaustGetMore(req messages.Requester, msgHeader messages.RequestHeader) (messages.GetMore, bool) {
+	switch r := req.(type) {
+	case messages.Find:
+		if r.Exhaust {
+			batchSize := r.BatchSize
+			if batchSize < 0 {
+				batchSize = 0
+			}
+			return messages.GetMore{RequestID: r.RequestID, BatchSize: batchSize}, true
+		}
+	case messages.GetMore:
+		if msgHeader.ExhaustAllowed() {
+			return r, true
 		}
-		chain.AddModule(module)
 	}
-	Start(port, chain)
+	return messages.GetMore{}, false
 }
 
-func handleConnection(conn net.Conn, pipeline server.PipelineFunc) {
+// openCursor returns the ID and namespace of the cursor in a response to a find or
+// getMore, and 0 if the cursor was closed or the response was an error.
+func openCursor(res *messages.ModuleResponse) (int64, string, string) {
+	if res.CommandError != nil {
+		return 0, "", ""
+	}
+	switch r := res.Writer.(type) {
+	case messages.FindResponse:
+		if r.QueryFailure == nil {
+			return r.CursorID, r.Database, r.Collection
+		}
+	case messages.GetMoreResponse:
+		if !r.InvalidCursor {
+			return r.CursorID, r.Database, r.Collection
+		}
+	}
+	return 0, "", ""
+}
+
+// streamResponses writes the response to an exhaust request, followed by the responses
+// to getMores on its cursor until the cursor is exhausted. Each reply responds to
+// the one before it, and all but the last OP_MSG reply have moreToCome set.
+func streamResponses(ctx context.Context, conn net.Conn, msgHeader messages.RequestHeader,
+	res *messages.ModuleResponse, getMore messages.GetMore, pipeline server.PipelineFunc,
+	defaultMaxTime time.Duration) error {
 	for {
+		cursorID, database, collection := openCursor(res)
+
+		bytes, err := encodeResponse(msgHeader, res)
+		if err != nil {
+			return fmt.Errorf("Encoding error: %v", err)
+		}
+		replyID := atomic.AddInt32(&lastReplyID, 1)
+		bytes = messages.SetRequestID(bytes, replyID)
+		if cursorID != 0 {
+			bytes = messages.SetMoreToCome(bytes)
+		}
+
+		err = writeMessage(conn, msgHeader, bytes)
+		if err != nil || cursorID == 0 {
+			return err
+		}
+
+		// the next reply responds to this one, rather than to the original request
+		msgHeader.RequestID = replyID
+
+		getMore.CursorID = cursorID
+		getMore.Database = database
+		getMore.Collection = collection
+		res = &messages.ModuleResponse{}
+		reqCtx, cancelRequest := server.RequestContext(ctx, getMore, defaultMaxTime)
+		pipeline(reqCtx, getMore, res)
+		cancelRequest()
+	}
+}
+
+// newConnection performs the TLS handshake on a connection if it uses TLS, and returns
+// the information about the connection that is passed to modules.
+func newConnection(conn net.Conn) (*server.Connection, error) {
+	c := &server.Connection{
+		ID:         atomic.AddInt64(&lastConnectionID, 1),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return c, nil
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake error: %v", err)
+	}
+
+	// the client certificate is always verified if it is presented
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		c.ClientCertSubject = state.VerifiedChains[0][0].Subject.String()
+	}
+	return c, nil
+}
+
+// watchClose cancels the connection's context if the client closes the connection
+// while a request is being handled. The returned function stops watching, and has
+// to be called before reading from the connection again.
+func watchClose(conn net.Conn, reader *bufio.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// nothing else reads from the connection while a request is handled, so
+		// this only returns once the client sends another message or disconnects.
+		_, err := reader.Peek(1)
+		if err != nil && !isTimeout(err) {
+			cancel()
+		}
+	}()
 
-		message, msgHeader, err := messages.Decode(conn)
+	return func() {
+		// a deadline in the past interrupts the peek
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// isTimeout returns true if the error is from a read that ran past its deadline.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer s.untrack(conn)
+
+	c, err := newConnection(conn)
+	if err != nil {
+		NewLogger(CoreModule).With(Fields{"remoteAddr": conn.RemoteAddr().String()}).
+			Log(ERROR, "%v", err)
+		conn.Close()
+		return
+	}
+
+	// every log line about the connection has its ID, and the log lines about a
+	// request also have the request's ID.
+	logger := NewLogger(CoreModule).With(Fields{"connectionId": c.ID})
+	logger.Log(NOTICE, "accepted connection from: %v", c.RemoteAddr)
+
+	// the context of the connection is cancelled when the client disconnects,
+	// which interrupts the requests that are still being handled.
+	ctx, cancel := context.WithCancel(
+		server.WithConnection(WithLogger(context.Background(), logger), c))
+	defer cancel()
 
+	reader := bufio.NewReader(countingReader{conn})
+
+	// the response to the last legacy write, which is used to answer getLastError.
+	var lastWrite *messages.ModuleResponse
+
+	for {
+		// a connection is idle while it waits for a request, and is closed
+		// instead if the server is shutting down.
+		if reader.Buffered() == 0 && !s.setIdle(conn, true) {
+			conn.Close()
+			return
+		}
+		message, msgHeader, err := messages.Decode(reader)
+		s.setIdle(conn, false)
 		if err != nil {
-			if err != io.EOF {
-				Log(ERROR, "Decoding error: %v", err)
+			if err == io.EOF {
+				logger.Log(INFO, "connection closed")
+			} else if !s.isClosing() {
+				logger.Log(ERROR, "Decoding error: %v", err)
+				decodeErrors.Inc()
 			}
 			conn.Close()
 			return
 		}
 
-		Log(DEBUG, "Request: %#v", message)
+		start := time.Now()
+		requestsTotal.Inc(opCodeName(msgHeader.OpCode), message.Type())
+
+		// the context of the request has a logger with the request's ID
+		reqLogger := logger.With(Fields{"requestId": msgHeader.RequestID})
+		reqLogger.With(messages.LogFields(message)).Log(DEBUG, "Request")
+		msgCtx := WithLogger(ctx, reqLogger)
+
+		// legacy writes have no reply, so their results are kept to answer a
+		// getLastError later on. They are acknowledged by the primary, and the
+		// getLastError waits for the rest of its write concern.
+		if isLegacyWrite(msgHeader.OpCode) {
+			g, release := s.acquire()
+			reqCtx, cancelRequest := server.RequestContext(msgCtx, message, s.DefaultMaxTime)
+			stopWatching := watchClose(conn, reader, cancel)
+			res := &messages.ModuleResponse{}
+			g.pipeline(reqCtx, message, res)
+			stopWatching()
+			cancelRequest()
+			release()
+			lastWrite = res
+			requestDuration.Observe(time.Since(start).Seconds(), message.Type())
+			continue
+		}
 
+		// the request, including the getMores of an exhaust cursor, uses the module
+		// chain that is current when it starts, even if the chain is reloaded.
+		g, release := s.acquire()
+		pipeline := g.pipeline
+		stopWatching := watchClose(conn, reader, cancel)
 		res := &messages.ModuleResponse{}
-		pipeline(message, res)
+		_, isLastError := toGetLastError(message)
+		if (isLastError || isHealthCommand(message)) && c.Principal() == nil && g.requiresAuth {
+			// the proxy answers these commands itself, so it checks that the client
+			// authenticated when the auth module would have checked it.
+			res.Error(unauthorized, fmt.Sprintf("command %v requires authentication",
+				messages.CommandName(message)))
+		} else if gle, ok := toGetLastError(message); ok {
+			reply := messages.LastErrorResponse(lastWrite)
 
-		bytes, err := messages.Encode(msgHeader, *res)
+			// the backend runs a getLastError that waits for replication or the
+			// journal, so that it waits for the write concern.
+			if lastWrite != nil &&
+				messages.WaitsForReplication(messages.GetLastErrorWriteConcern(gle)) {
+				backend := &messages.ModuleResponse{}
+				reqCtx, cancelRequest := server.RequestContext(msgCtx, gle, s.DefaultMaxTime)
+				pipeline(reqCtx, gle, backend)
+				cancelRequest()
+				reply = messages.WriteConcernResponse(reply, backend)
+			}
+			res.Write(reply)
+		} else if isHealthCommand(message) {
+			res.Write(s.healthResponse())
+		} else {
+			lastWrite = nil
+			recordClientMetadata(c, message)
+			reqCtx, cancelRequest := server.RequestContext(msgCtx, message, s.DefaultMaxTime)
+			pipeline(reqCtx, message, res)
+			cancelRequest()
+			negotiateCompression(c, message, res, s.Compressors)
+		}
 
-		// update, delete, and insert messages do not have a response, so we continue and write the
-		// response on the getLastError that will be called immediately after. Kind of a hack.
-		if msgHeader.OpCode == messages.OP_UPDATE || msgHeader.OpCode == messages.OP_INSERT ||
-			msgHeader.OpCode == messages.OP_DELETE {
-			Log(INFO, "Continuing on OpCode: %v", msgHeader.OpCode)
+		// OP_KILL_CURSORS has no reply, and the client doesn't expect a reply to an
+		// OP_MSG with moreToCome set, so there is no need to encode one.
+		if msgHeader.OpCode == messages.OP_KILL_CURSORS || msgHeader.MoreToCome() {
+			stopWatching()
+			release()
+			requestDuration.Observe(time.Since(start).Seconds(), message.Type())
 			continue
 		}
-		if err != nil {
-			Log(ERROR, "Encoding error: %v", err)
-			conn.Close()
-			return
+
+		// the getMores of an exhaust cursor are part of the same request, but each
+		// one gets its own time limit.
+		reqLogger.With(res.LogFields()).Log(DEBUG, "Response")
+		getMore, ok := exhaustGetMore(message, msgHeader)
+		if ok {
+			err = streamResponses(msgCtx, conn, msgHeader, res, getMore, pipeline, s.DefaultMaxTime)
+		} else {
+			err = writeResponse(conn, msgHeader, res)
 		}
-		_, err = conn.Write(bytes)
+		stopWatching()
+		release()
+		requestDuration.Observe(time.Since(start).Seconds(), message.Type())
 		if err != nil {
-			Log(ERROR, "Error writing to connection: %v", err)
+			reqLogger.Log(ERROR, "%v", err)
 			conn.Close()
 			return
 		}
-
 	}
 }
@@ -0,0 +1,170 @@
+package mongoproxy
+
+import (
+	"fmt"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"time"
+)
+
+// A generation is a module chain and the pipeline built from it. When the chain is
+// reloaded, the server starts using a new generation, and the modules of the old one
+// are stopped once the requests that use it finish.
+type generation struct {
+	chain    *server.ModuleChain
+	pipeline server.PipelineFunc
+
+	// whether the chain has an auth module anywhere, so that the commands the proxy
+	// answers itself require authentication too
+	requiresAuth bool
+
+	// the number of requests that use the generation, and whether it was replaced.
+	// Both are guarded by the server's mutex.
+	active  int
+	retired bool
+
+	// closed once the generation is replaced and no requests use it
+	drained chan struct{}
+}
+
+func newGeneration(chain *server.ModuleChain) *generation {
+	return &generation{
+		chain:        chain,
+		pipeline:     server.BuildPipeline(chain),
+		requiresAuth: chain.Contains("auth"),
+		drained:      make(chan struct{}),
+	}
+}
+
+// acquire returns the generation of the current module chain for a request, and a
+// function to call once the request doesn't use it anymore.
+func (s *Server) acquire() (*generation, func()) {
+	s.mu.Lock()
+	g := s.current
+	g.active++
+	s.mu.Unlock()
+
+	return g, func() {
+		s.mu.Lock()
+		g.active--
+		if g.retired && g.active == 0 {
+			close(g.drained)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) currentChain() *server.ModuleChain {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current.chain
+}
+
+// stopChain stops and closes the modules of a chain, and returns the first error.
+func stopChain(chain *server.ModuleChain) error {
+	err := chain.Stop()
+	closeErr := chain.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reload replaces the server's module chain with one created from the modules field
+// of the configuration. The new modules are started first, and the server keeps its
+// current chain if one of them fails to start. Requests that are in flight finish on
+// the old chain, whose modules are then stopped and closed.
+func (s *Server) Reload(config bson.M) error {
+	chain := CreateChainFromConfig(config)
+	err := chain.Start()
+	if err != nil {
+		chain.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	if !s.running || s.closing {
+		s.mu.Unlock()
+		stopChain(chain)
+		return fmt.Errorf("The server isn't running")
+	}
+	old := s.current
+	s.current = newGeneration(chain)
+	old.retired = true
+	if old.active == 0 {
+		close(old.drained)
+	}
+	s.retiring.Add(1)
+	s.mu.Unlock()
+
+	Log(NOTICE, "Reloaded the module chain")
+	go func() {
+		defer s.retiring.Done()
+		<-old.drained
+		err := stopChain(old.chain)
+		if err != nil {
+			Log(ERROR, "%v", err)
+		}
+	}()
+	return nil
+}
+
+// A ConfigLoader loads the proxy's configuration from its source.
+type ConfigLoader func() (bson.M, error)
+
+// FileConfigLoader returns a ConfigLoader that reads the configuration from a JSON file.
+func FileConfigLoader(configFilename string) ConfigLoader {
+	return func() (bson.M, error) {
+		return ParseConfigFromFile(configFilename)
+	}
+}
+
+// DBConfigLoader returns a ConfigLoader that queries the configuration from a collection.
+func DBConfigLoader(mongoURI string, configNamespace string) ConfigLoader {
+	return func() (bson.M, error) {
+		return ParseConfigFromDB(mongoURI, configNamespace)
+	}
+}
+
+// WatchConfig loads the configuration every interval while the server runs, and
+// reloads the module chain when the modules field changes from the one in the
+// initial configuration, or the last one that was loaded. Other fields, such as the
+// TLS options, are only read when the server is created.
+func (s *Server) WatchConfig(load ConfigLoader, interval time.Duration, initial bson.M) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		modules := initial["modules"]
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			if s.isClosing() {
+				return
+			}
+
+			config, err := load()
+			if err != nil {
+				Log(WARNING, "Error loading configuration: %v", err)
+				continue
+			}
+			if reflect.DeepEqual(config["modules"], modules) {
+				continue
+			}
+
+			Log(NOTICE, "The module configuration changed")
+			err = s.Reload(config)
+			if err != nil {
+				// the reload is tried again on the next poll
+				Log(ERROR, "Error reloading the module chain: %v", err)
+				continue
+			}
+			modules = config["modules"]
+		}
+	}()
+}
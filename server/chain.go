@@ -1,12 +1,24 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"time"
 )
 
+// moduleDuration measures how long each module takes to process a request, which
+// includes the time spent in the modules after it.
+var moduleDuration = metrics.RegisterHistogram("mongoproxy_module_duration_seconds",
+	"Time taken by a module to process a request, including the modules after it.",
+	metrics.DefaultBuckets, "module")
+
 // PipelineFunc is the function type for the built pipeline, and is called
-// to begin the pipeline.
-type PipelineFunc func(messages.Requester, messages.Responder)
+// to begin the pipeline. The context carries information about the client
+// connection that the request came from.
+type PipelineFunc func(context.Context, messages.Requester, messages.Responder)
 
 // A ChainFunc is a closure that wraps a module so that they can accept
 // other modules as inputs and outputs for module chaining.
@@ -24,20 +36,46 @@ func (m *ModuleChain) AddModule(mod Module) *ModuleChain {
 	return m
 }
 
+// Contains returns true if the chain, or a branch of one of its routers, has a
+// module with the name.
+func (m *ModuleChain) Contains(name string) bool {
+	for i := 0; i < len(m.chain); i++ {
+		if m.chain[i].Name() == name {
+			return true
+		}
+		router, ok := m.chain[i].(*Router)
+		if !ok {
+			continue
+		}
+		for j := 0; j < len(router.Branches); j++ {
+			if router.Branches[j].Chain.Contains(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // wrapModule returns a closure ChainFunc that wraps over the module m, which
 // can input and output PipelineFuncs to help with chaining.
 func wrapModule(m Module) ChainFunc {
 
 	return ChainFunc(func(next PipelineFunc) PipelineFunc {
-		return PipelineFunc(func(r messages.Requester, w messages.Responder) {
+		return PipelineFunc(func(ctx context.Context, r messages.Requester, w messages.Responder) {
 
 			// if there is no next module in the pipeline, the pipeline terminates
 			if next == nil {
-				next = PipelineFunc(func(r messages.Requester, w messages.Responder) {
+				next = PipelineFunc(func(ctx context.Context, r messages.Requester, w messages.Responder) {
 					return
 				})
 			}
-			m.Process(r, w, next)
+			// log lines from the module are written for the module, with the fields
+			// of the request
+			ctx = WithLogger(ctx, LoggerFromContext(ctx).ForModule(m.Name()))
+
+			start := time.Now()
+			m.Process(ctx, r, w, next)
+			moduleDuration.Observe(time.Since(start).Seconds(), m.Name())
 		})
 	})
 }
@@ -54,16 +92,99 @@ func CreateChain() *ModuleChain {
 // module to the next module in the pipeline. The HandleFunc of the last module
 // in the pipeline is set to nil to terminate the pipeline.
 func BuildPipeline(m *ModuleChain) PipelineFunc {
+	return buildPipeline(m.chain, nil)
+}
+
+// buildPipeline creates a pipeline from the modules, which calls next after the
+// last module. A nil next terminates the pipeline.
+func buildPipeline(modules []Module, next PipelineFunc) PipelineFunc {
 
-	if len(m.chain) == 0 {
-		return PipelineFunc(func(r messages.Requester, w messages.Responder) {
+	if len(modules) == 0 {
+		if next != nil {
+			return next
+		}
+		return PipelineFunc(func(ctx context.Context, r messages.Requester, w messages.Responder) {
 			return
 		})
 	}
-	pipeline := wrapModule(m.chain[len(m.chain)-1])(nil)
-	for i := len(m.chain) - 2; i >= 0; i-- {
-		pipeline = wrapModule(m.chain[i])(pipeline)
+	pipeline := wrapModule(modules[len(modules)-1])(next)
+	for i := len(modules) - 2; i >= 0; i-- {
+		pipeline = wrapModule(modules[i])(pipeline)
 	}
 
 	return pipeline
 }
+
+// Start calls Start on every module in the chain that implements Starter, in the
+// order of the chain. If a module fails to start, the modules that already started
+// are stopped and the error is returned.
+func (m *ModuleChain) Start() error {
+	for i := 0; i < len(m.chain); i++ {
+		starter, ok := m.chain[i].(Starter)
+		if !ok {
+			continue
+		}
+		err := starter.Start()
+		if err != nil {
+			stopModules(m.chain[:i])
+			return fmt.Errorf("Error starting module %v: %v", m.chain[i].Name(), err)
+		}
+	}
+	return nil
+}
+
+// Stop calls Stop on every module in the chain that implements Stopper, in the
+// reverse order of the chain. All of the modules are stopped even if some of them
+// fail, and the first error is returned.
+func (m *ModuleChain) Stop() error {
+	return stopModules(m.chain)
+}
+
+func stopModules(modules []Module) error {
+	var err error
+	for i := len(modules) - 1; i >= 0; i-- {
+		stopper, ok := modules[i].(Stopper)
+		if !ok {
+			continue
+		}
+		stopErr := stopper.Stop()
+		if stopErr != nil && err == nil {
+			err = fmt.Errorf("Error stopping module %v: %v", modules[i].Name(), stopErr)
+		}
+	}
+	return err
+}
+
+// Health returns the health of every module in the chain that implements
+// HealthChecker, in the order of the chain.
+func (m *ModuleChain) Health() []ModuleHealth {
+	health := make([]ModuleHealth, 0)
+	for i := 0; i < len(m.chain); i++ {
+		checker, ok := m.chain[i].(HealthChecker)
+		if !ok {
+			continue
+		}
+		health = append(health, ModuleHealth{
+			Name:   m.chain[i].Name(),
+			Health: checker.Health(),
+		})
+	}
+	return health
+}
+
+// Close calls Close on every module in the chain that implements Closer. All of
+// the modules are closed even if some of them fail, and the first error is returned.
+func (m *ModuleChain) Close() error {
+	var err error
+	for i := 0; i < len(m.chain); i++ {
+		closer, ok := m.chain[i].(Closer)
+		if !ok {
+			continue
+		}
+		closeErr := closer.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("Error closing module %v: %v", m.chain[i].Name(), closeErr)
+		}
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
 	. "github.com/smartystreets/goconvey/convey"
@@ -52,11 +53,11 @@ func (m ModuleOne) Configure(bson.M) error {
 	return nil
 }
 
-func (m ModuleOne) Process(req messages.Requester, res messages.Responder, next PipelineFunc) {
+func (m ModuleOne) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
 	r := messages.CommandResponse{}
 	r.Reply = msgOne
 	res.Write(r)
-	next(req, res)
+	next(ctx, req, res)
 }
 
 func (m ModuleTwo) New() Module {
@@ -74,8 +75,8 @@ func (m ModuleTwo) Configure(bson.M) error {
 	return nil
 }
 
-func (m ModuleTwo) Process(req messages.Requester, res messages.Responder, next PipelineFunc) {
-	next(req, res)
+func (m ModuleTwo) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
+	next(ctx, req, res)
 	r := messages.CommandResponse{}
 	r.Reply = msgTwo
 	res.Write(r)
@@ -92,7 +93,7 @@ func TestModuleChaining(t *testing.T) {
 				Data: make([]bson.M, 0),
 			}
 			pipeline := BuildPipeline(chain)
-			pipeline(r, w)
+			pipeline(context.Background(), r, w)
 
 			So(len(w.Data), ShouldEqual, 0)
 
@@ -107,7 +108,7 @@ func TestModuleChaining(t *testing.T) {
 				Data: make([]bson.M, 0),
 			}
 			pipeline := BuildPipeline(chain)
-			pipeline(r, w)
+			pipeline(context.Background(), r, w)
 
 			So(w.Data[0], ShouldEqual, msgOne)
 
@@ -124,12 +125,271 @@ func TestModuleChaining(t *testing.T) {
 					Data: make([]bson.M, 0),
 				}
 				pipeline := BuildPipeline(chain)
-				pipeline(r, w)
+				pipeline(context.Background(), r, w)
 
 				So(w.Data[0], ShouldEqual, msgOne)
 				So(w.Data[1], ShouldEqual, msgTwo)
+				So(chain.Contains(m1.Name()), ShouldBeTrue)
+				So(chain.Contains("auth"), ShouldBeFalse)
+
+				branch := CreateChain()
+				branch.AddModule(TagModule{Tag: "branch"})
+				chain.AddModule(&Router{Branches: []Branch{{Chain: branch}}})
+				So(chain.Contains("tag"), ShouldBeTrue)
 			})
 		})
 
 	})
 }
+
+// A ConnectionModule writes the address of the client connection in the context.
+type ConnectionModule struct {
+}
+
+func (m ConnectionModule) New() Module {
+	return m
+}
+
+func (m ConnectionModule) Name() string {
+	return "connection"
+}
+
+func (m ConnectionModule) Configure(bson.M) error {
+	return nil
+}
+
+func (m ConnectionModule) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
+	r := messages.CommandResponse{}
+	r.Reply = bson.M{"connection": ConnectionFromContext(ctx)}
+	res.Write(r)
+	next(ctx, req, res)
+}
+
+func TestConnectionContext(t *testing.T) {
+	Convey("Pass a context through a chain", t, func() {
+		chain := CreateChain()
+		chain.AddModule(ConnectionModule{})
+		chain.AddModule(ConnectionModule{})
+		pipeline := BuildPipeline(chain)
+
+		Convey("with a connection", func() {
+			c := &Connection{RemoteAddr: "127.0.0.1:5000", ClientCertSubject: "CN=client"}
+			w := &MockRes{
+				Data: make([]bson.M, 0),
+			}
+			pipeline(WithConnection(context.Background(), c), MockReq{}, w)
+
+			So(len(w.Data), ShouldEqual, 2)
+			So(w.Data[0]["connection"], ShouldEqual, c)
+			So(w.Data[1]["connection"], ShouldEqual, c)
+		})
+
+		Convey("without a connection", func() {
+			w := &MockRes{
+				Data: make([]bson.M, 0),
+			}
+			pipeline(context.Background(), MockReq{}, w)
+
+			So(w.Data[0]["connection"], ShouldBeNil)
+		})
+	})
+}
+
+// A CounterModule counts the requests on a client connection, using the connection's
+// key/value storage.
+type CounterModule struct {
+}
+
+func (m CounterModule) New() Module {
+	return m
+}
+
+func (m CounterModule) Name() string {
+	return "counter"
+}
+
+func (m CounterModule) Configure(bson.M) error {
+	return nil
+}
+
+func (m CounterModule) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
+	c := ConnectionFromContext(ctx)
+	count, _ := c.Get("counter.requests")
+	n, _ := count.(int)
+	c.Set("counter.requests", n+1)
+
+	r := messages.CommandResponse{}
+	r.Reply = bson.M{"requests": n + 1}
+	res.Write(r)
+	next(ctx, req, res)
+}
+
+func TestConnectionState(t *testing.T) {
+	Convey("Keep state on a connection", t, func() {
+		Convey("across requests", func() {
+			chain := CreateChain()
+			chain.AddModule(CounterModule{})
+			pipeline := BuildPipeline(chain)
+
+			c := &Connection{ID: 1, RemoteAddr: "127.0.0.1:5000"}
+			other := &Connection{ID: 2, RemoteAddr: "127.0.0.1:5001"}
+			w := &MockRes{
+				Data: make([]bson.M, 0),
+			}
+			pipeline(WithConnection(context.Background(), c), MockReq{}, w)
+			pipeline(WithConnection(context.Background(), c), MockReq{}, w)
+			pipeline(WithConnection(context.Background(), other), MockReq{}, w)
+
+			So(len(w.Data), ShouldEqual, 3)
+			So(w.Data[0]["requests"], ShouldEqual, 1)
+			So(w.Data[1]["requests"], ShouldEqual, 2)
+			So(w.Data[2]["requests"], ShouldEqual, 1)
+		})
+
+		Convey("with the connection's accessors", func() {
+			c := &Connection{}
+			So(c.Principal(), ShouldBeNil)
+			So(c.ClientMetadata(), ShouldBeNil)
+
+			p := &Principal{User: "alice", Database: "admin", Roles: []string{"read"}}
+			c.SetPrincipal(p)
+			So(c.Principal(), ShouldEqual, p)
+
+			c.SetClientMetadata(bson.M{"application": bson.M{"name": "app"}})
+			So(c.ClientMetadata()["application"], ShouldResemble, bson.M{"name": "app"})
+
+			c.SetCompressors([]string{"snappy"})
+			So(c.Compressors(), ShouldResemble, []string{"snappy"})
+
+			c.Set("key", "value")
+			v, ok := c.Get("key")
+			So(ok, ShouldBeTrue)
+			So(v, ShouldEqual, "value")
+			c.Delete("key")
+			_, ok = c.Get("key")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+// A ClosingModule records when it is closed, and fails to close if it has an error.
+type ClosingModule struct {
+	Closed *bool
+	Err    error
+}
+
+func (m ClosingModule) New() Module {
+	return m
+}
+
+func (m ClosingModule) Name() string {
+	return "closing"
+}
+
+func (m ClosingModule) Configure(bson.M) error {
+	return nil
+}
+
+func (m ClosingModule) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
+	next(ctx, req, res)
+}
+
+func (m ClosingModule) Close() error {
+	*m.Closed = true
+	return m.Err
+}
+
+func TestCloseChain(t *testing.T) {
+	Convey("Close the modules of a chain", t, func() {
+		var first, second bool
+		chain := CreateChain()
+		chain.AddModule(ModuleOne{})
+		chain.AddModule(ClosingModule{Closed: &first, Err: fmt.Errorf("closing failed")})
+		chain.AddModule(ClosingModule{Closed: &second})
+
+		err := chain.Close()
+		So(err, ShouldNotBeNil)
+		So(first, ShouldBeTrue)
+		So(second, ShouldBeTrue)
+	})
+}
+
+// A LifecycleModule records the order that modules are started and stopped in,
+// and reports its health.
+type LifecycleModule struct {
+	ID       string
+	Events   *[]string
+	StartErr error
+	Status   string
+}
+
+func (m LifecycleModule) New() Module {
+	return m
+}
+
+func (m LifecycleModule) Name() string {
+	return m.ID
+}
+
+func (m LifecycleModule) Configure(bson.M) error {
+	return nil
+}
+
+func (m LifecycleModule) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
+	next(ctx, req, res)
+}
+
+func (m LifecycleModule) Start() error {
+	*m.Events = append(*m.Events, "start "+m.ID)
+	return m.StartErr
+}
+
+func (m LifecycleModule) Stop() error {
+	*m.Events = append(*m.Events, "stop "+m.ID)
+	return nil
+}
+
+func (m LifecycleModule) Health() Health {
+	return Health{Status: m.Status}
+}
+
+func TestChainLifecycle(t *testing.T) {
+	Convey("Start and stop the modules of a chain", t, func() {
+		events := make([]string, 0)
+
+		Convey("in order", func() {
+			chain := CreateChain()
+			chain.AddModule(LifecycleModule{ID: "a", Events: &events})
+			chain.AddModule(ModuleOne{})
+			chain.AddModule(LifecycleModule{ID: "b", Events: &events})
+
+			So(chain.Start(), ShouldBeNil)
+			So(chain.Stop(), ShouldBeNil)
+			So(events, ShouldResemble, []string{"start a", "start b", "stop b", "stop a"})
+		})
+
+		Convey("when a module fails to start", func() {
+			chain := CreateChain()
+			chain.AddModule(LifecycleModule{ID: "a", Events: &events})
+			chain.AddModule(LifecycleModule{ID: "b", Events: &events, StartErr: fmt.Errorf("no backend")})
+			chain.AddModule(LifecycleModule{ID: "c", Events: &events})
+
+			So(chain.Start(), ShouldNotBeNil)
+			So(events, ShouldResemble, []string{"start a", "start b", "stop a"})
+		})
+
+		Convey("and report their health", func() {
+			chain := CreateChain()
+			chain.AddModule(LifecycleModule{ID: "a", Events: &events, Status: HealthOK})
+			chain.AddModule(ModuleOne{})
+			chain.AddModule(LifecycleModule{ID: "b", Events: &events, Status: HealthDown})
+
+			health := chain.Health()
+			So(len(health), ShouldEqual, 2)
+			So(health[0].Name, ShouldEqual, "a")
+			So(health[0].Status, ShouldEqual, HealthOK)
+			So(health[1].Name, ShouldEqual, "b")
+			So(health[1].Status, ShouldEqual, HealthDown)
+		})
+	})
+}
@@ -1,5 +1,11 @@
 package config
 
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/audit"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/auth"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/authz"
 import _ "github.com/mongodbinc-interns/mongoproxy/modules/bi"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/encrypt"
 import _ "github.com/mongodbinc-interns/mongoproxy/modules/mockule"
 import _ "github.com/mongodbinc-interns/mongoproxy/modules/mongod"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/redact"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/slowlog"
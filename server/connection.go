@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+)
+
+// A Principal is a user that a client connection authenticated as. Its roles are
+// named role@db, such as readWrite@crm.
+type Principal struct {
+	User     string
+	Database string
+	Roles    []string
+}
+
+// HandshakeCommands are the commands that drivers use to connect and authenticate,
+// which clients can run before they authenticate.
+var HandshakeCommands = map[string]bool{
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"buildInfo":    true,
+	"buildinfo":    true,
+	"ping":         true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"getnonce":     true,
+	"authenticate": true,
+	"logout":       true,
+}
+
+// A Connection holds information about the client connection that a request
+// was received on. It is created when the client connects, and is shared by every
+// request on the connection, so modules can use it to keep state between requests.
+type Connection struct {
+	// a unique ID for the connection, assigned in the order that clients connect
+	ID int64
+
+	// the address of the client
+	RemoteAddr string
+
+	// the subject of the client's verified TLS certificate, as an RFC 2253
+	// distinguished name. Empty if the client didn't present a certificate.
+	ClientCertSubject string
+
+	mu             sync.RWMutex
+	principal      *Principal
+	clientMetadata bson.M
+	compressors    []string
+	values         map[string]interface{}
+}
+
+// Principal returns the user that the connection authenticated as, or nil if
+// it hasn't authenticated.
+func (c *Connection) Principal() *Principal {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.principal
+}
+
+// SetPrincipal sets the user that the connection authenticated as. A nil principal
+// marks the connection as unauthenticated.
+func (c *Connection) SetPrincipal(p *Principal) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.principal = p
+}
+
+// ClientMetadata returns the client document that the driver sent in its
+// hello handshake, or nil if it didn't send one.
+func (c *Connection) ClientMetadata() bson.M {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientMetadata
+}
+
+// SetClientMetadata sets the client document from the hello handshake.
+func (c *Connection) SetClientMetadata(metadata bson.M) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clientMetadata = metadata
+}
+
+// Compressors returns the compressors negotiated with the client in the
+// hello handshake.
+func (c *Connection) Compressors() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.compressors
+}
+
+// SetCompressors sets the compressors negotiated with the client.
+func (c *Connection) SetCompressors(compressors []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compressors = compressors
+}
+
+// Get returns the value that a module stored on the connection under the key.
+// Modules should prefix their keys with their name to avoid collisions.
+func (c *Connection) Get(key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Set stores a value on the connection under the key, which is kept for the
+// lifetime of the connection.
+func (c *Connection) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+}
+
+// Delete removes the value stored on the connection under the key.
+func (c *Connection) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+}
+
+// the key for the Connection stored in a context.
+type connectionKey struct{}
+
+// WithConnection returns a copy of the context that holds the connection.
+func WithConnection(ctx context.Context, c *Connection) context.Context {
+	return context.WithValue(ctx, connectionKey{}, c)
+}
+
+// ConnectionFromContext returns the client connection that a request was received
+// on, or nil if the context doesn't have one.
+func ConnectionFromContext(ctx context.Context) *Connection {
+	c, _ := ctx.Value(connectionKey{}).(*Connection)
+	return c
+}
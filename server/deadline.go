@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"time"
+)
+
+// the error codes that the server uses for requests that are stopped before they finish.
+const (
+	MaxTimeMSExpiredCode int32 = 50
+	InterruptedCode      int32 = 11601
+)
+
+// RequestContext returns a copy of the connection context for a request, with a
+// deadline from the request's maxTimeMS. If the request doesn't have a maxTimeMS,
+// the default time limit is used, and a default of 0 means no time limit.
+func RequestContext(ctx context.Context, req messages.Requester,
+	defaultMaxTime time.Duration) (context.Context, context.CancelFunc) {
+
+	maxTime := time.Duration(messages.MaxTimeMS(req)) * time.Millisecond
+	if maxTime <= 0 {
+		maxTime = defaultMaxTime
+	}
+	if maxTime <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, maxTime)
+}
+
+// Interrupted writes an error to the response and returns true if the request's
+// context is done. Requests that ran out of time get the server's MaxTimeMSExpired
+// error, and requests that were cancelled, such as when the client disconnects,
+// get the Interrupted error.
+func Interrupted(ctx context.Context, res messages.Responder) bool {
+	switch ctx.Err() {
+	case nil:
+		return false
+	case context.DeadlineExceeded:
+		res.Error(MaxTimeMSExpiredCode, "operation exceeded time limit")
+	default:
+		res.Error(InterruptedCode, "operation was interrupted")
+	}
+	return true
+}
+
+// RemainingMaxTimeMS returns the time left until the context's deadline in
+// milliseconds, which backend modules can send as the maxTimeMS of a request so
+// that the backend stops the operation as well. It returns 0 if the context has
+// no deadline.
+func RemainingMaxTimeMS(ctx context.Context) int64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	ms := int64(time.Until(deadline) / time.Millisecond)
+	if ms < 1 {
+		// a maxTimeMS of 0 means no limit, so the request is left to expire right away
+		ms = 1
+	}
+	return ms
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	Convey("Create the context for a request", t, func() {
+		Convey("with the request's maxTimeMS", func() {
+			ctx, cancel := RequestContext(context.Background(),
+				messages.Find{MaxTimeMS: 5000}, time.Second)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			So(ok, ShouldBeTrue)
+			So(deadline, ShouldHappenWithin, 10*time.Millisecond, time.Now().Add(5*time.Second))
+			So(RemainingMaxTimeMS(ctx), ShouldBeBetweenOrEqual, 4990, 5000)
+		})
+
+		Convey("with the maxTimeMS of a command", func() {
+			ctx, cancel := RequestContext(context.Background(),
+				messages.Command{CommandName: "dbStats", Args: bson.M{"maxTimeMS": 2000}}, 0)
+			defer cancel()
+
+			So(RemainingMaxTimeMS(ctx), ShouldBeBetweenOrEqual, 1990, 2000)
+		})
+
+		Convey("with the default time limit", func() {
+			ctx, cancel := RequestContext(context.Background(), messages.Find{}, time.Second)
+			defer cancel()
+
+			So(RemainingMaxTimeMS(ctx), ShouldBeBetweenOrEqual, 990, 1000)
+		})
+
+		Convey("without a time limit", func() {
+			ctx, cancel := RequestContext(context.Background(), messages.GetMore{}, 0)
+			defer cancel()
+
+			_, ok := ctx.Deadline()
+			So(ok, ShouldBeFalse)
+			So(RemainingMaxTimeMS(ctx), ShouldEqual, 0)
+		})
+
+		Convey("that is cancelled with the connection", func() {
+			connCtx, cancelConn := context.WithCancel(context.Background())
+			ctx, cancel := RequestContext(connCtx, messages.Find{}, time.Second)
+			defer cancel()
+
+			cancelConn()
+			So(ctx.Err(), ShouldEqual, context.Canceled)
+		})
+	})
+}
+
+func TestInterrupted(t *testing.T) {
+	Convey("Write the error for an interrupted request", t, func() {
+		Convey("that is still running", func() {
+			res := &messages.ModuleResponse{}
+			So(Interrupted(context.Background(), res), ShouldBeFalse)
+			So(res.CommandError, ShouldBeNil)
+		})
+
+		Convey("that ran out of time", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+			defer cancel()
+			<-ctx.Done()
+
+			res := &messages.ModuleResponse{}
+			So(Interrupted(ctx, res), ShouldBeTrue)
+			So(res.CommandError.ErrorCode, ShouldEqual, MaxTimeMSExpiredCode)
+		})
+
+		Convey("that was cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			res := &messages.ModuleResponse{}
+			So(Interrupted(ctx, res), ShouldBeTrue)
+			So(res.CommandError.ErrorCode, ShouldEqual, InterruptedCode)
+		})
+	})
+}
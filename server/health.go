@@ -0,0 +1,64 @@
+package server
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the statuses that a module or the proxy can report, from best to worst.
+const (
+	HealthOK       string = "ok"
+	HealthDegraded        = "degraded"
+	HealthDown            = "down"
+)
+
+// the rank of each status, which is higher for worse statuses.
+var healthRanks = map[string]int{
+	HealthOK:       0,
+	HealthDegraded: 1,
+	HealthDown:     2,
+}
+
+// A Health is the status of a module, with details that explain it, such as
+// the error from a backend.
+type Health struct {
+	Status  string
+	Details bson.M
+}
+
+// A ModuleHealth is the health that a module in a chain reported.
+type ModuleHealth struct {
+	Name string
+	Health
+}
+
+// WorseStatus returns the worse of two statuses. Unknown statuses are treated as down.
+func WorseStatus(a string, b string) string {
+	rankA, ok := healthRanks[a]
+	if !ok {
+		return HealthDown
+	}
+	rankB, ok := healthRanks[b]
+	if !ok {
+		return HealthDown
+	}
+	if rankB > rankA {
+		return b
+	}
+	return a
+}
+
+// HealthToBSON returns the health of modules as an array of documents, which is the
+// format used to report it to clients.
+func HealthToBSON(modules []ModuleHealth) []bson.M {
+	docs := make([]bson.M, len(modules))
+	for i := 0; i < len(modules); i++ {
+		docs[i] = bson.M{
+			"name":   modules[i].Name,
+			"status": modules[i].Status,
+		}
+		if modules[i].Details != nil {
+			docs[i]["details"] = modules[i].Details
+		}
+	}
+	return docs
+}
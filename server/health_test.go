@@ -0,0 +1,27 @@
+package server
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	Convey("Combine health statuses", t, func() {
+		So(WorseStatus(HealthOK, HealthOK), ShouldEqual, HealthOK)
+		So(WorseStatus(HealthOK, HealthDegraded), ShouldEqual, HealthDegraded)
+		So(WorseStatus(HealthDown, HealthDegraded), ShouldEqual, HealthDown)
+		So(WorseStatus(HealthOK, "unknown"), ShouldEqual, HealthDown)
+	})
+
+	Convey("Convert the health of modules to BSON", t, func() {
+		docs := HealthToBSON([]ModuleHealth{
+			{Name: "mongod", Health: Health{Status: HealthOK}},
+			{Name: "bi", Health: Health{Status: HealthDegraded, Details: bson.M{"error": "no reachable servers"}}},
+		})
+		So(docs, ShouldResemble, []bson.M{
+			{"name": "mongod", "status": HealthOK},
+			{"name": "bi", "status": HealthDegraded, "details": bson.M{"error": "no reachable servers"}},
+		})
+	})
+}
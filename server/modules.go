@@ -3,6 +3,7 @@
 package server
 
 import (
+	"context"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -17,11 +18,48 @@ type Module interface {
 	Configure(bson.M) error
 
 	// Process is the function executed when a message is called in the pipeline.
-	// It takes in a Requester from an upstream module (or proxy core), a
-	// Responder that it writes a response to, and a PipelineFunc that should
-	// be called to execute the next module in the pipeline.
-	Process(messages.Requester, messages.Responder, PipelineFunc)
+	// It takes in the context of the request, which holds the client Connection,
+	// a Requester from an upstream module (or proxy core), a Responder that it
+	// writes a response to, and a PipelineFunc that should be called to execute
+	// the next module in the pipeline.
+	Process(context.Context, messages.Requester, messages.Responder, PipelineFunc)
 
 	// New creates a new instance of this module.
 	New() Module
 }
+
+// A Starter is a module that has work to do once the whole chain is configured and
+// before requests are accepted, such as connecting to a backend. Modules don't have
+// to implement it.
+type Starter interface {
+
+	// Start starts the module. If it returns an error, the server doesn't start.
+	Start() error
+}
+
+// A Stopper is a module that stops work that it started when the server shuts down.
+// Modules don't have to implement it.
+type Stopper interface {
+
+	// Stop stops the module. It is called once no more requests will pass through
+	// the module, and before the module is closed.
+	Stop() error
+}
+
+// A HealthChecker is a module that can report whether it is working, such as whether
+// it can reach its backend. Modules don't have to implement it.
+type HealthChecker interface {
+
+	// Health returns the status of the module. It can be called at any time while
+	// the server is running, concurrently with requests.
+	Health() Health
+}
+
+// A Closer is a module that holds resources, such as sessions with a backend, that
+// have to be released when the server shuts down. Modules don't have to implement it.
+type Closer interface {
+
+	// Close releases the module's resources. It is called once no more requests
+	// will pass through the module.
+	Close() error
+}
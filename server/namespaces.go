@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"path"
+)
+
+// Namespaces are globs for the namespaces of requests, such as "sales.*". Requests
+// on a whole database have an empty collection, so they match "sales.*" too.
+type Namespaces []string
+
+// ParseNamespaces parses a glob or an array of globs from a configuration. A nil
+// value has no globs.
+func ParseNamespaces(in interface{}) (Namespaces, error) {
+	globs, err := ToStringList(in)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(globs); i++ {
+		_, err := path.Match(globs[i], "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace glob %v: %v", globs[i], err)
+		}
+	}
+	return Namespaces(globs), nil
+}
+
+// Match returns true if one of the globs matches the namespace.
+func (n Namespaces) Match(database string, collection string) bool {
+	for i := 0; i < len(n); i++ {
+		ok, _ := path.Match(n[i], database+"."+collection)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ToStringList converts a string or a slice of strings to a slice. A nil value is
+// an empty slice.
+func ToStringList(in interface{}) ([]string, error) {
+	if in == nil {
+		return nil, nil
+	}
+	s, ok := in.(string)
+	if ok {
+		return []string{s}, nil
+	}
+	return convert.ConvertToStringSlice(in)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	Convey("Parse namespace globs", t, func() {
+		n, err := ParseNamespaces("sales.*")
+		So(err, ShouldBeNil)
+		So(n, ShouldResemble, Namespaces{"sales.*"})
+
+		n, err = ParseNamespaces([]interface{}{"sales.*", "reports.daily"})
+		So(err, ShouldBeNil)
+		So(n, ShouldResemble, Namespaces{"sales.*", "reports.daily"})
+
+		n, err = ParseNamespaces(nil)
+		So(err, ShouldBeNil)
+		So(len(n), ShouldEqual, 0)
+
+		_, err = ParseNamespaces("sales.[")
+		So(err, ShouldNotBeNil)
+		_, err = ParseNamespaces(5)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Match namespaces", t, func() {
+		n := Namespaces{"sales.*", "reports.daily"}
+		So(n.Match("sales", "orders"), ShouldBeTrue)
+		So(n.Match("sales", ""), ShouldBeTrue)
+		So(n.Match("reports", "daily"), ShouldBeTrue)
+		So(n.Match("reports", "monthly"), ShouldBeFalse)
+		So(Namespaces{}.Match("sales", "orders"), ShouldBeFalse)
+	})
+}
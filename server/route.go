@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+)
+
+func init() {
+	Publish(&Router{})
+}
+
+// A Match has the criteria that a request has to meet to go down a branch of a
+// Router. Every criterion that is set has to match, and a criterion with several
+// values matches if any of them does. A Match without criteria matches every request.
+type Match struct {
+	// globs for the namespace of the request, such as "analytics.*"
+	Namespaces Namespaces
+
+	// the types of the request, as returned by its Type()
+	Types []string
+
+	// the names of the command, which for requests that aren't generic commands is
+	// the same as their type
+	Commands []string
+
+	// the networks that the client's address has to be in
+	Clients []*net.IPNet
+}
+
+// Matches returns true if the request meets the criteria.
+func (m Match) Matches(ctx context.Context, req messages.Requester) bool {
+	if len(m.Namespaces) > 0 {
+		database, collection := messages.Namespace(req)
+		if !m.Namespaces.Match(database, collection) {
+			return false
+		}
+	}
+	if len(m.Types) > 0 && !contains(m.Types, req.Type()) {
+		return false
+	}
+	if len(m.Commands) > 0 && !contains(m.Commands, messages.CommandName(req)) {
+		return false
+	}
+	if len(m.Clients) > 0 && !inNetworks(m.Clients, ConnectionFromContext(ctx)) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, s string) bool {
+	for i := 0; i < len(values); i++ {
+		if values[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// inNetworks returns true if the address of the client connection is in one of the
+// networks. Requests without a client connection aren't in any network.
+func inNetworks(networks []*net.IPNet, c *Connection) bool {
+	if c == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr)
+	if err != nil {
+		host = c.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for i := 0; i < len(networks); i++ {
+		if networks[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Branch is a module chain that a Router sends the requests that meet its
+// match criteria down.
+type Branch struct {
+	Match Match
+	Chain *ModuleChain
+
+	// if true, requests go on to the rest of the chain that the router is in after
+	// the modules of the branch. Otherwise the branch is the end of the pipeline.
+	Continue bool
+}
+
+// A Router is a module that sends each request down the first of its branches whose
+// criteria the request matches. The pipeline of a request ends with the modules of its
+// branch, unless the branch continues to the rest of the chain that the router is in.
+// Requests that don't match any branch go straight to the rest of the chain. Branches
+// can have routers of their own.
+type Router struct {
+	Branches []Branch
+}
+
+func (r *Router) New() Module {
+	return &Router{}
+}
+
+func (r *Router) Name() string {
+	return "route"
+}
+
+/*
+Configuration structure:
+
+	{
+		branches: [
+			{
+				match: {
+					namespace: string or []string,
+					type: string or []string,
+					command: string or []string,
+					client: string or []string
+				},
+				modules: [],
+				continue: bool
+			}
+		]
+	}
+
+The namespaces are globs, such as "analytics.*", and the clients are IP addresses or
+networks in CIDR notation, such as "10.0.0.0/8". A branch without a match gets every
+request that reaches it, so it can be the last branch to act as a default. The modules
+of a branch have the same format as the modules of the proxy's configuration. A
+request that goes down a branch only goes on to the modules after the router if the
+branch continues, which it doesn't by default.
+*/
+func (r *Router) Configure(conf bson.M) error {
+	branches, err := convert.ConvertToBSONMapSlice(conf["branches"])
+	if err != nil {
+		return fmt.Errorf("Invalid branches: %v", err)
+	}
+
+	r.Branches = make([]Branch, len(branches))
+	for i := 0; i < len(branches); i++ {
+		match, err := parseMatch(convert.ToBSONMap(branches[i]["match"]))
+		if err != nil {
+			return fmt.Errorf("Invalid match for branch %v: %v", i, err)
+		}
+		var modules []bson.M
+		modulesRaw, ok := branches[i]["modules"]
+		if ok {
+			modules, err = convert.ConvertToBSONMapSlice(modulesRaw)
+			if err != nil {
+				return fmt.Errorf("Invalid modules for branch %v: %v", i, err)
+			}
+		}
+		cont, ok := branches[i]["continue"].(bool)
+		if !ok && branches[i]["continue"] != nil {
+			return fmt.Errorf("Invalid continue for branch %v: not a boolean", i)
+		}
+		r.Branches[i] = Branch{
+			Match:    match,
+			Chain:    CreateChainFromConfig(modules),
+			Continue: cont,
+		}
+	}
+	return nil
+}
+
+// parseMatch parses the match criteria of a branch.
+func parseMatch(conf bson.M) (Match, error) {
+	m := Match{}
+	var err error
+
+	m.Namespaces, err = ParseNamespaces(conf["namespace"])
+	if err != nil {
+		return Match{}, fmt.Errorf("Invalid namespace: %v", err)
+	}
+
+	m.Types, err = ToStringList(conf["type"])
+	if err != nil {
+		return Match{}, fmt.Errorf("Invalid type: %v", err)
+	}
+	m.Commands, err = ToStringList(conf["command"])
+	if err != nil {
+		return Match{}, fmt.Errorf("Invalid command: %v", err)
+	}
+
+	clients, err := ToStringList(conf["client"])
+	if err != nil {
+		return Match{}, fmt.Errorf("Invalid client: %v", err)
+	}
+	for i := 0; i < len(clients); i++ {
+		network, err := parseNetwork(clients[i])
+		if err != nil {
+			return Match{}, err
+		}
+		m.Clients = append(m.Clients, network)
+	}
+	return m, nil
+}
+
+// parseNetwork parses a network in CIDR notation, or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(s)
+	if err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid client address: %v", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (r *Router) Process(ctx context.Context, req messages.Requester, res messages.Responder,
+	next PipelineFunc) {
+
+	for i := 0; i < len(r.Branches); i++ {
+		branch := r.Branches[i]
+		if branch.Match.Matches(ctx, req) {
+			if branch.Continue {
+				buildPipeline(branch.Chain.chain, next)(ctx, req, res)
+			} else {
+				buildPipeline(branch.Chain.chain, nil)(ctx, req, res)
+			}
+			return
+		}
+	}
+	next(ctx, req, res)
+}
+
+// Start starts the modules of every branch. If a branch fails to start, the
+// branches that already started are stopped.
+func (r *Router) Start() error {
+	for i := 0; i < len(r.Branches); i++ {
+		err := r.Branches[i].Chain.Start()
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				r.Branches[j].Chain.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops the modules of every branch, and returns the first error.
+func (r *Router) Stop() error {
+	var err error
+	for i := len(r.Branches) - 1; i >= 0; i-- {
+		stopErr := r.Branches[i].Chain.Stop()
+		if stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+	return err
+}
+
+// Close closes the modules of every branch, and returns the first error.
+func (r *Router) Close() error {
+	var err error
+	for i := 0; i < len(r.Branches); i++ {
+		closeErr := r.Branches[i].Chain.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Health reports the worst status of the modules in the branches, with the health
+// of each of them in the details.
+func (r *Router) Health() Health {
+	status := HealthOK
+	modules := make([]ModuleHealth, 0)
+	for i := 0; i < len(r.Branches); i++ {
+		health := r.Branches[i].Chain.Health()
+		for j := 0; j < len(health); j++ {
+			status = WorseStatus(status, health[j].Status)
+		}
+		modules = append(modules, health...)
+	}
+	return Health{
+		Status:  status,
+		Details: bson.M{"modules": HealthToBSON(modules)},
+	}
+}
+
+// CreateChainFromConfig creates a module chain from the module entries of a
+// configuration, which are objects with the name of a module and its configuration.
+// Modules that don't exist or have an invalid configuration are left out of the chain.
+func CreateChainFromConfig(modules []bson.M) *ModuleChain {
+	chain := CreateChain()
+	for i := 0; i < len(modules); i++ {
+		moduleNameRaw, ok := modules[i]["name"]
+		if !ok {
+			Log(WARNING, "Module in configuration does not have a name")
+			continue
+		}
+		moduleName := convert.ToString(moduleNameRaw)
+		moduleType, ok := Registry[moduleName]
+		if !ok {
+			Log(WARNING, "Module doesn't exist in the registry: %v", moduleName)
+			continue // module doesn't exist
+		}
+		module := moduleType.New()
+
+		// TODO: allow links to other collections
+		moduleConfig := convert.ToBSONMap(modules[i]["config"])
+		err := module.Configure(moduleConfig)
+		if err != nil {
+			Log(WARNING, "Invalid configuration for module %v: %v", moduleName, err)
+			continue
+		}
+		chain.AddModule(module)
+	}
+	return chain
+}
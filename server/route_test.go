@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// A TagModule writes its tag, to show which modules a request went through.
+type TagModule struct {
+	Tag string
+}
+
+func (m TagModule) New() Module {
+	return m
+}
+
+func (m TagModule) Name() string {
+	return "tag"
+}
+
+func (m TagModule) Configure(conf bson.M) error {
+	return nil
+}
+
+func (m TagModule) Process(ctx context.Context, req messages.Requester, res messages.Responder, next PipelineFunc) {
+	r := messages.CommandResponse{}
+	r.Reply = bson.M{"tag": m.Tag}
+	res.Write(r)
+	next(ctx, req, res)
+}
+
+func tags(res *MockRes) []string {
+	tags := make([]string, len(res.Data))
+	for i := 0; i < len(res.Data); i++ {
+		tags[i], _ = res.Data[i]["tag"].(string)
+	}
+	return tags
+}
+
+func TestMatch(t *testing.T) {
+	Convey("Match a request", t, func() {
+		find := messages.Find{Database: "analytics", Collection: "events"}
+		insert := messages.Insert{Database: "reports", Collection: "daily"}
+		dbStats := messages.Command{CommandName: "dbStats", Database: "analytics", Args: bson.M{"dbStats": 1}}
+
+		Convey("without criteria", func() {
+			So(Match{}.Matches(context.Background(), find), ShouldBeTrue)
+		})
+
+		Convey("by namespace", func() {
+			m, err := parseMatch(bson.M{"namespace": "analytics.*"})
+			So(err, ShouldBeNil)
+			So(m.Matches(context.Background(), find), ShouldBeTrue)
+			So(m.Matches(context.Background(), dbStats), ShouldBeTrue)
+			So(m.Matches(context.Background(), insert), ShouldBeFalse)
+		})
+
+		Convey("by type and command name", func() {
+			m, err := parseMatch(bson.M{"type": []interface{}{messages.FindType, messages.CommandType}})
+			So(err, ShouldBeNil)
+			So(m.Matches(context.Background(), find), ShouldBeTrue)
+			So(m.Matches(context.Background(), insert), ShouldBeFalse)
+
+			m, err = parseMatch(bson.M{"command": "dbStats"})
+			So(err, ShouldBeNil)
+			So(m.Matches(context.Background(), dbStats), ShouldBeTrue)
+			So(m.Matches(context.Background(), find), ShouldBeFalse)
+		})
+
+		Convey("by client address", func() {
+			m, err := parseMatch(bson.M{"client": []interface{}{"10.0.0.0/8", "192.168.1.5"}})
+			So(err, ShouldBeNil)
+
+			inside := WithConnection(context.Background(), &Connection{RemoteAddr: "10.1.2.3:50000"})
+			host := WithConnection(context.Background(), &Connection{RemoteAddr: "192.168.1.5:50000"})
+			outside := WithConnection(context.Background(), &Connection{RemoteAddr: "192.168.1.6:50000"})
+			So(m.Matches(inside, find), ShouldBeTrue)
+			So(m.Matches(host, find), ShouldBeTrue)
+			So(m.Matches(outside, find), ShouldBeFalse)
+			So(m.Matches(context.Background(), find), ShouldBeFalse)
+		})
+
+		Convey("with every criterion", func() {
+			m, err := parseMatch(bson.M{"namespace": "analytics.*", "type": messages.InsertType})
+			So(err, ShouldBeNil)
+			So(m.Matches(context.Background(), find), ShouldBeFalse)
+		})
+
+		Convey("with invalid criteria", func() {
+			_, err := parseMatch(bson.M{"namespace": "analytics.["})
+			So(err, ShouldNotBeNil)
+			_, err = parseMatch(bson.M{"client": "not an address"})
+			So(err, ShouldNotBeNil)
+			_, err = parseMatch(bson.M{"type": 5})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRouter(t *testing.T) {
+	Convey("Route requests", t, func() {
+		analytics := CreateChain()
+		analytics.AddModule(TagModule{Tag: "analytics"})
+		reports := CreateChain()
+		reports.AddModule(TagModule{Tag: "reports"})
+		reports.AddModule(TagModule{Tag: "reports 2"})
+
+		router := &Router{Branches: []Branch{
+			{Match: Match{Namespaces: []string{"analytics.*"}}, Chain: analytics, Continue: true},
+			{Match: Match{Namespaces: []string{"reports.*"}}, Chain: reports},
+		}}
+		chain := CreateChain()
+		chain.AddModule(TagModule{Tag: "before"})
+		chain.AddModule(router)
+		chain.AddModule(TagModule{Tag: "after"})
+		pipeline := BuildPipeline(chain)
+
+		Convey("down the first matching branch", func() {
+			res := &MockRes{}
+			pipeline(context.Background(), messages.Find{Database: "analytics", Collection: "events"}, res)
+			So(tags(res), ShouldResemble, []string{"before", "analytics", "after"})
+
+			res = &MockRes{}
+			pipeline(context.Background(), messages.Find{Database: "reports", Collection: "daily"}, res)
+			So(tags(res), ShouldResemble, []string{"before", "reports", "reports 2"})
+		})
+
+		Convey("that only continue to the rest of the chain if the branch does", func() {
+			res := &MockRes{}
+			pipeline(context.Background(), messages.Find{Database: "analytics", Collection: "events"}, res)
+			So(tags(res), ShouldResemble, []string{"before", "analytics", "after"})
+		})
+
+		Convey("that don't match any branch", func() {
+			res := &MockRes{}
+			pipeline(context.Background(), messages.Find{Database: "test", Collection: "foo"}, res)
+			So(tags(res), ShouldResemble, []string{"before", "after"})
+		})
+	})
+
+	Convey("Send requests to the backend of their branch", t, func() {
+		reports := CreateChain()
+		reports.AddModule(TagModule{Tag: "reports backend"})
+		router := &Router{Branches: []Branch{
+			{Match: Match{Namespaces: []string{"reports.*"}}, Chain: reports},
+		}}
+		chain := CreateChain()
+		chain.AddModule(router)
+		chain.AddModule(TagModule{Tag: "local backend"})
+		pipeline := BuildPipeline(chain)
+
+		res := &MockRes{}
+		pipeline(context.Background(), messages.Find{Database: "reports", Collection: "daily"}, res)
+		So(tags(res), ShouldResemble, []string{"reports backend"})
+
+		res = &MockRes{}
+		pipeline(context.Background(), messages.Find{Database: "test", Collection: "foo"}, res)
+		So(tags(res), ShouldResemble, []string{"local backend"})
+	})
+
+	Convey("Configure a router", t, func() {
+		Convey("with branches", func() {
+			router := &Router{}
+			err := router.Configure(bson.M{"branches": []interface{}{
+				bson.M{
+					"match":    bson.M{"namespace": "analytics.*"},
+					"modules":  []interface{}{bson.M{"name": "route", "config": bson.M{"branches": []interface{}{}}}},
+					"continue": true,
+				},
+				bson.M{},
+			}})
+			So(err, ShouldBeNil)
+			So(len(router.Branches), ShouldEqual, 2)
+			So(router.Branches[0].Continue, ShouldBeTrue)
+			So(router.Branches[1].Continue, ShouldBeFalse)
+			So(router.Branches[0].Match.Namespaces, ShouldResemble, Namespaces{"analytics.*"})
+			So(len(router.Branches[0].Chain.chain), ShouldEqual, 1)
+			So(len(router.Branches[1].Chain.chain), ShouldEqual, 0)
+		})
+
+		Convey("with an invalid match", func() {
+			router := &Router{}
+			err := router.Configure(bson.M{"branches": []interface{}{
+				bson.M{"match": bson.M{"client": "10.0.0.0/99"}},
+			}})
+			So(err, ShouldNotBeNil)
+
+			err = router.Configure(bson.M{"branches": []interface{}{
+				bson.M{"continue": "yes"},
+			}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Start and stop the modules of the branches", t, func() {
+		events := make([]string, 0)
+		first := CreateChain()
+		first.AddModule(LifecycleModule{ID: "a", Events: &events, Status: HealthOK})
+		second := CreateChain()
+		second.AddModule(LifecycleModule{ID: "b", Events: &events, Status: HealthDegraded})
+		router := &Router{Branches: []Branch{{Chain: first}, {Chain: second}}}
+
+		So(router.Start(), ShouldBeNil)
+		So(router.Stop(), ShouldBeNil)
+		So(events, ShouldResemble, []string{"start a", "start b", "stop b", "stop a"})
+		So(router.Health().Status, ShouldEqual, HealthDegraded)
+	})
+}
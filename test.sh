@@ -4,7 +4,7 @@
 chmod 755 ./set_gopath.sh
 . ./set_gopath.sh
 
-packages=(bsonutil buffer convert messages server modules/bi)
+packages=(bsonutil buffer connection convert messages metrics server modules/audit modules/auth modules/authz modules/bi modules/encrypt modules/redact modules/slowlog)
 for i in ${packages[@]}; do
 	go test github.com/mongodbinc-interns/mongoproxy/${i} -coverprofile=coverage.out $1
 done
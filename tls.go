@@ -0,0 +1,163 @@
+package mongoproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+)
+
+// constants for the client certificate verification modes.
+const (
+	ClientCertificatesNone     string = "none"
+	ClientCertificatesOptional        = "optional"
+	ClientCertificatesRequired        = "required"
+)
+
+// the TLS versions that can be used as a minimum version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions are the options for accepting TLS connections from clients. TLS is
+// only enabled if a certificate file is set.
+type TLSOptions struct {
+	// the PEM files with the proxy's certificate and private key
+	CertFile string
+	KeyFile  string
+
+	// a PEM file with the certificate authorities used to verify client certificates
+	CAFile string
+
+	// the minimum TLS version, from 1.0 to 1.3. Defaults to 1.2.
+	MinVersion string
+
+	// the names of the allowed cipher suites for TLS 1.2 and below, such as
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Go's defaults are used if empty.
+	CipherSuites []string
+
+	// whether clients have to present a certificate: none, optional or required.
+	// Certificates that are presented are always verified. Defaults to none.
+	ClientCertificates string
+}
+
+/*
+ParseTLSOptions parses the tls field of a configuration, which has the following structure:
+
+	{
+		certFile: string,
+		keyFile: string,
+		caFile: string,
+		minVersion: string,
+		cipherSuites: []string,
+		clientCertificates: string
+	}
+*/
+func ParseTLSOptions(conf bson.M) (TLSOptions, error) {
+	o := TLSOptions{
+		CertFile:           convert.ToString(conf["certFile"]),
+		KeyFile:            convert.ToString(conf["keyFile"]),
+		CAFile:             convert.ToString(conf["caFile"]),
+		MinVersion:         convert.ToString(conf["minVersion"]),
+		ClientCertificates: convert.ToString(conf["clientCertificates"]),
+	}
+
+	cipherSuites, ok := conf["cipherSuites"]
+	if ok {
+		c, err := convert.ConvertToStringSlice(cipherSuites)
+		if err != nil {
+			return TLSOptions{}, fmt.Errorf("Invalid cipher suites: %v", err)
+		}
+		o.CipherSuites = c
+	}
+
+	return o, nil
+}
+
+// Enabled returns true if the options have a certificate to accept TLS connections with.
+func (o TLSOptions) Enabled() bool {
+	return len(o.CertFile) > 0
+}
+
+// Config creates the TLS configuration for the proxy listener from the options.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	keyFile := o.KeyFile
+	if len(keyFile) == 0 {
+		// the key can be in the same file as the certificate
+		keyFile = o.CertFile
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(o.MinVersion) > 0 {
+		version, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid minimum TLS version: %v", o.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(o.CipherSuites) > 0 {
+		config.CipherSuites, err = cipherSuiteIDs(o.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %v", o.CAFile)
+		}
+	}
+
+	switch o.ClientCertificates {
+	case "", ClientCertificatesNone:
+		config.ClientAuth = tls.NoClientCert
+	case ClientCertificatesOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertificatesRequired:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Invalid client certificate mode: %v", o.ClientCertificates)
+	}
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, fmt.Errorf("A CA file is needed to verify client certificates")
+	}
+
+	return config, nil
+}
+
+// cipherSuiteIDs converts the names of cipher suites to their IDs.
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, len(names))
+	for i := 0; i < len(names); i++ {
+		id, ok := suites[names[i]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown cipher suite: %v", names[i])
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}